@@ -0,0 +1,264 @@
+package main
+
+/**
+ * This file implements the JSON endpoints used by browser encryption (see
+ * `static/client.js`). They only ever pass ciphertext and wrapped keys; byte
+ * slices are base64-encoded by encoding/json.
+ *
+ *     GET  /api/keys       the user's salt, KDF parameters and wrapped main-key
+ *     GET  /api/pages      every browser-encrypted page, without bodies
+ *     GET  /api/page/<id>  a browser-encrypted page and the user's page key
+ *     POST /api/page/0     create a page with a browser-made page key
+ *     POST /api/page/<id>  store a browser-encrypted title and body
+ */
+
+import (
+    "log"
+    "strconv"
+    "net/http"
+    "encoding/json"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+    "github.com/setonotes/pkg/permission"
+)
+
+type apiKeys struct {
+    UserID      int            `json:"user_id"`
+    Salt        []byte         `json:"salt"`
+    KDF         user.KDFParams `json:"kdf"`
+    MainKey     []byte         `json:"main_key"`
+    PageVersion int            `json:"page_version"`
+}
+
+type apiPage struct {
+    ID       int    `json:"id"`
+    IsOwner  bool   `json:"is_owner"`
+    CanEdit  bool   `json:"can_edit"`
+    Version  int    `json:"version"`
+    Revision int    `json:"revision"`
+    Title    []byte `json:"title"`
+    Body     []byte `json:"body,omitempty"`
+    Key      []byte `json:"key"`
+}
+
+type apiSaveRequest struct {
+    Key      []byte `json:"key"`      // only for new pages
+    Version  int    `json:"version"`
+    Revision int    `json:"revision"` // the revision the edit started from
+    Title    []byte `json:"title"`
+    Body     []byte `json:"body"`
+}
+
+const apiMaxRequestSize = 10 << 20
+
+/**
+ * Write a JSON response
+ */
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(status)
+    err := json.NewEncoder(w).Encode(v)
+    if err != nil {
+        log.Printf("failed to write JSON response: %v", err)
+    }
+}
+
+/**
+ * Write a JSON error
+ */
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+    writeJSON(w, status, map[string]string{"error": message})
+}
+
+/**
+ * Get the signed-in user for an API request -- the user must have turned on
+ * browser encryption. If false is returned, an error has been written.
+ */
+func (s *server) getAPIUser(w http.ResponseWriter,
+    r *http.Request) (*user.User, bool) {
+
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        writeJSONError(w, http.StatusUnauthorized, "not signed in")
+        return nil, false
+    }
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        writeJSONError(w, http.StatusUnauthorized, "not signed in")
+        return nil, false
+    }
+
+    if !u.ClientEncryption {
+        writeJSONError(w, http.StatusForbidden, "turn on browser encryption "+
+            "in your settings to read browser-encrypted pages")
+        return nil, false
+    }
+
+    // a cross-site form cannot send JSON without a CORS preflight
+    if r.Method == "POST" &&
+        r.Header.Get("Content-Type") != "application/json" {
+        writeJSONError(w, http.StatusUnsupportedMediaType, "expected JSON")
+        return nil, false
+    }
+
+    return u, true
+}
+
+/**
+ * Write the error of a permission service call
+ */
+func writePermissionError(w http.ResponseWriter, err error) {
+    switch err {
+    case permission.ErrPermissionConflict:
+        writeJSONError(w, http.StatusForbidden, err.Error())
+    case page.ErrEditConflict:
+        writeJSONError(w, http.StatusConflict, err.Error())
+    case permission.ErrNotClientEncrypted, permission.ErrInvalidCiphertext,
+        permission.ErrClientDisabled:
+        writeJSONError(w, http.StatusBadRequest, err.Error())
+    default:
+        writeJSONError(w, http.StatusInternalServerError, "internal error")
+    }
+}
+
+/**
+ * Handle `/api/keys`
+ */
+func (s *server) apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+    u, ok := s.getAPIUser(w, r)
+    if !ok {
+        return
+    }
+
+    writeJSON(w, http.StatusOK, &apiKeys{
+        UserID:      u.ID,
+        Salt:        u.Salt,
+        KDF:         u.KDF,
+        MainKey:     u.MainKeyEncrypted,
+        PageVersion: page.CurrentVersion,
+    })
+}
+
+/**
+ * Handle `/api/pages`
+ */
+func (s *server) apiPagesHandler(w http.ResponseWriter, r *http.Request) {
+    u, ok := s.getAPIUser(w, r)
+    if !ok {
+        return
+    }
+
+    pages, err := s.permissionService.GetClientPages(u)
+    if err != nil {
+        log.Printf("failed to get browser-encrypted pages for user-%v: %v",
+            u.ID, err)
+        writePermissionError(w, err)
+        return
+    }
+
+    result := []*apiPage{}
+    for _, p := range pages {
+        result = append(result, &apiPage{
+            ID:      p.Page.ID,
+            IsOwner: p.Page.OwnerID == u.ID,
+            Version: p.Page.Version,
+            Title:   p.Page.Title,
+            Key:     p.UserEncryptedPageKey,
+        })
+    }
+
+    writeJSON(w, http.StatusOK, result)
+}
+
+/**
+ * Handle `/api/page/<id>`
+ */
+func (s *server) apiPageHandler(w http.ResponseWriter, r *http.Request) {
+    m := s.apiPagePath.FindStringSubmatch(r.URL.Path)
+    if m == nil {
+        writeJSONError(w, http.StatusNotFound, "not found")
+        return
+    }
+    pageID, _ := strconv.Atoi(m[1])
+
+    u, ok := s.getAPIUser(w, r)
+    if !ok {
+        return
+    }
+
+    switch r.Method {
+    case "GET":
+        p, err := s.permissionService.GetClientPage(pageID, u)
+        if err != nil {
+            log.Printf("failed to get browser-encrypted page-%v: %v", pageID,
+                err)
+            writePermissionError(w, err)
+            return
+        }
+        writeJSON(w, http.StatusOK, &apiPage{
+            ID:       p.Page.ID,
+            IsOwner:  p.Page.OwnerID == u.ID,
+            CanEdit:  p.CanEdit,
+            Version:  p.Page.Version,
+            Revision: p.Page.Revision,
+            Title:    p.Page.Title,
+            Body:     p.Page.Body,
+            Key:      p.UserEncryptedPageKey,
+        })
+
+    case "POST":
+        var req apiSaveRequest
+        r.Body = http.MaxBytesReader(w, r.Body, apiMaxRequestSize)
+        err := json.NewDecoder(r.Body).Decode(&req)
+        if err != nil {
+            writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+            return
+        }
+
+        if pageID == 0 {
+            pageID, err = s.permissionService.CreateClientPage(u, req.Key)
+        } else {
+            err = s.permissionService.SaveClientPage(&page.Page{
+                ID:              pageID,
+                Title:           req.Title,
+                Body:            req.Body,
+                Version:         req.Version,
+                Revision:        req.Revision,
+                ClientEncrypted: true,
+            }, u)
+        }
+        if err != nil {
+            log.Printf("failed to save browser-encrypted page-%v: %v", pageID,
+                err)
+            writePermissionError(w, err)
+            return
+        }
+        writeJSON(w, http.StatusOK, map[string]int{"id": pageID})
+
+    default:
+        writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+    }
+}
+
+/**
+ * Render the page that `static/client.js` fills in -- mode is "view" or "edit"
+ */
+func (s *server) renderClientPage(w http.ResponseWriter, mode string,
+    pageID int, authorized bool) {
+
+    data := struct {
+        Mode       string
+        ID         int
+        Navbar     bool
+        Authorized bool
+    }{
+        mode,
+        pageID,
+        true,
+        authorized,
+    }
+    s.renderTemplate(w, "client.tmpl", data)
+}
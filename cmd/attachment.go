@@ -0,0 +1,314 @@
+package main
+
+/**
+ * This file implements attachments (see `pkg/attachment`):
+ *
+ *     GET  /attachments/<page-id>   list the page's attachments
+ *     POST /attachments/<page-id>   attach the uploaded file ("file") to the
+ *                                   page
+ *     GET  /attachment/<id>         download an attachment
+ *     POST /attachment/<id>         delete an attachment ("action=delete")
+ *
+ * Uploads are read straight from the request and downloads written straight to
+ * the response, encrypting and decrypting on the way, so a file is never held
+ * in memory or written to disk unencrypted. Only raster images are shown in
+ * the browser; anything else is downloaded.
+ */
+
+import (
+    "io"
+    "log"
+    "mime"
+    "errors"
+    "strconv"
+    "strings"
+    "net/http"
+    "path/filepath"
+    "database/sql"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/attachment"
+    "github.com/setonotes/pkg/permission"
+    "github.com/setonotes/pkg/encryption"
+)
+
+// room for the rest of an upload's form around the file
+const attachmentUploadOverhead = 1 << 20
+
+var errNoUpload = errors.New("choose a file to attach")
+
+func (s *server) attachmentsHandler(w http.ResponseWriter, r *http.Request) {
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    m := s.attachmentsPath.FindStringSubmatch(r.URL.Path)
+    if m == nil {
+        http.NotFound(w, r)
+        return
+    }
+    pageID, _ := strconv.Atoi(m[1])
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Println("failed to get user by ID for /attachments/")
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    p, err := s.permissionService.LoadAndDecryptPage(pageID, u)
+    if err == permission.ErrClientEncrypted {
+        http.Error(w, "Pages encrypted in the browser cannot have "+
+            "attachments.", http.StatusBadRequest)
+        return
+    }
+    if err == encryption.ErrPageTampered {
+        s.tamperedPageError(w, pageID)
+        return
+    }
+    if err != nil {
+        log.Printf("failed to load page-%v for /attachments/", pageID)
+        http.NotFound(w, r)
+        return
+    }
+
+    canEdit, err := s.permissionService.CheckUserCanEditPage(u.ID, pageID)
+    if err != nil {
+        log.Printf("failed to check user-%v can edit page-%v", u.ID, pageID)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    uploadError := ""
+    if r.Method == "POST" {
+        if !canEdit {
+            http.Error(w, "forbidden", http.StatusForbidden)
+            return
+        }
+        r.Body = http.MaxBytesReader(w, r.Body,
+            attachment.MaxSize+attachmentUploadOverhead)
+        _, err = s.uploadAttachment(r, u, pageID)
+        if err == nil {
+            http.Redirect(w, r, r.URL.Path, http.StatusFound)
+            return
+        }
+        log.Printf("failed to upload attachment to page-%v: %v", pageID, err)
+        uploadError = attachmentUploadError(err)
+    }
+
+    attachments, err := s.permissionService.GetAttachments(u, pageID)
+    if err != nil {
+        log.Printf("failed to get attachments of page-%v: %v", pageID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    type attachmentEntry struct {
+        ID    int
+        Name  string
+        Size  string
+        Link  string
+        Image bool
+    }
+    entries := []attachmentEntry{}
+    for _, a := range attachments {
+        entries = append(entries, attachmentEntry{
+            ID:    a.ID,
+            Name:  string(a.Name),
+            Size:  formatSize(a.Size),
+            Link:  attachment.Link(a.ID),
+            Image: attachment.IsImage(string(a.MIMEType)),
+        })
+    }
+
+    data := struct {
+        PageID      int
+        Title       string
+        Attachments []attachmentEntry
+        CanEdit     bool
+        MaxSize     string
+        Error       string
+        Navbar      bool
+        Authorized  bool
+    }{
+        p.ID,
+        string(p.Title),
+        entries,
+        canEdit,
+        formatSize(attachment.MaxSize),
+        uploadError,
+        true,
+        authorized,
+    }
+    s.renderTemplate(w, "attachments.tmpl", data)
+}
+
+/**
+ * Attach the file uploaded with a request to a page, reading it part by part
+ * rather than parsing the whole form, which would keep the file in memory or a
+ * temporary file unencrypted
+ */
+func (s *server) uploadAttachment(r *http.Request, u *user.User,
+    pageID int) (int, error) {
+
+    reader, err := r.MultipartReader()
+    if err != nil {
+        return 0, errNoUpload
+    }
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            return 0, errNoUpload
+        } else if err != nil {
+            return 0, err
+        }
+        if part.FormName() != "file" || part.FileName() == "" {
+            part.Close()
+            continue
+        }
+
+        name := filepath.Base(filepath.FromSlash(
+            strings.Replace(part.FileName(), `\`, "/", -1)))
+        mimeType := attachmentMIMEType(part.Header.Get("Content-Type"), name)
+        id, err := s.permissionService.AddAttachment(u, pageID, name,
+            mimeType, part)
+        part.Close()
+        return id, err
+    }
+}
+
+/**
+ * Settle the type of an upload from what the browser sent, or else from the
+ * file's extension
+ */
+func attachmentMIMEType(contentType, name string) string {
+    mediaType, params, err := mime.ParseMediaType(contentType)
+    if err != nil || mediaType == "application/octet-stream" {
+        mediaType, params, err = mime.ParseMediaType(
+            mime.TypeByExtension(filepath.Ext(name)))
+    }
+    if err != nil {
+        return "application/octet-stream"
+    }
+    return mime.FormatMediaType(mediaType, params)
+}
+
+/**
+ * Describe why an upload failed to the user
+ */
+func attachmentUploadError(err error) string {
+    switch {
+    case err == errNoUpload || err == attachment.ErrNoName:
+        return errNoUpload.Error()
+    case err == attachment.ErrTooLarge ||
+        strings.Contains(err.Error(), "request body too large"):
+        return "The file is larger than " + formatSize(attachment.MaxSize) +
+            "."
+    }
+    return "The file could not be attached."
+}
+
+/**
+ * Show a number of bytes for people
+ */
+func formatSize(n int64) string {
+    switch {
+    case n >= 1<<20:
+        return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + " MB"
+    case n >= 1<<10:
+        return strconv.FormatFloat(float64(n)/(1<<10), 'f', 1, 64) + " KB"
+    }
+    return strconv.FormatInt(n, 10) + " bytes"
+}
+
+func (s *server) attachmentHandler(w http.ResponseWriter, r *http.Request) {
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    m := s.attachmentPath.FindStringSubmatch(r.URL.Path)
+    if m == nil {
+        http.NotFound(w, r)
+        return
+    }
+    attachmentID, _ := strconv.Atoi(m[1])
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Println("failed to get user by ID for /attachment/")
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if r.Method == "POST" {
+        if r.FormValue("action") != "delete" {
+            http.Error(w, "unknown action", http.StatusBadRequest)
+            return
+        }
+        pageID, err := s.permissionService.DeleteAttachment(u, attachmentID)
+        if err != nil {
+            s.attachmentError(w, r, attachmentID, err)
+            return
+        }
+        http.Redirect(w, r, "/attachments/"+strconv.Itoa(pageID),
+            http.StatusFound)
+        return
+    }
+
+    a, contents, err := s.permissionService.OpenAttachment(u, attachmentID)
+    if err != nil {
+        s.attachmentError(w, r, attachmentID, err)
+        return
+    }
+    defer contents.Close()
+
+    // what is shown in the browser is limited to images, which cannot run
+    // scripts, and the type is not to be second-guessed
+    mimeType, disposition := string(a.MIMEType), "attachment"
+    if attachment.IsImage(mimeType) {
+        disposition = "inline"
+    }
+    w.Header().Set("Content-Type", mimeType)
+    w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition,
+        map[string]string{"filename": string(a.Name)}))
+    w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+    w.Header().Set("Cache-Control", "private, no-store")
+
+    // the contents are streamed, so an error part way (including a failed
+    // integrity check) can only cut the download short
+    _, err = io.Copy(w, contents)
+    if err != nil {
+        log.Printf("failed to send attachment-%v to user-%v: %v", a.ID, u.ID,
+            err)
+        return
+    }
+}
+
+/**
+ * Respond to a failure to open or delete an attachment
+ */
+func (s *server) attachmentError(w http.ResponseWriter, r *http.Request,
+    attachmentID int, err error) {
+
+    switch err {
+    case permission.ErrPermissionConflict, permission.ErrPageTrashed,
+        permission.ErrClientEncrypted, sql.ErrNoRows:
+        http.NotFound(w, r)
+    case encryption.ErrAttachmentTampered:
+        log.Printf("SECURITY: refusing to send attachment-%v, which failed "+
+            "authentication", attachmentID)
+        http.Error(w, "This attachment failed an integrity check and may "+
+            "have been tampered with.", http.StatusConflict)
+    default:
+        log.Printf("failed to open attachment-%v: %v", attachmentID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "io"
+    "bytes"
+    "errors"
+    "testing"
+    "io/ioutil"
+    "net/http"
+    "net/textproto"
+    "mime/multipart"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/attachment"
+)
+
+/**
+ * A permission service that only records the attachment added
+ */
+type uploadService struct {
+    permissionService
+    name, mimeType string
+    contents       []byte
+}
+
+func (s *uploadService) AddAttachment(u *user.User, pageID int, name,
+    mimeType string, r io.Reader) (int, error) {
+
+    var err error
+    s.name, s.mimeType = name, mimeType
+    s.contents, err = ioutil.ReadAll(r)
+    return 12, err
+}
+
+type uploadPart struct {
+    field, filename, contentType, contents string
+}
+
+func newUploadRequest(t *testing.T, parts []uploadPart) *http.Request {
+    var b bytes.Buffer
+    w := multipart.NewWriter(&b)
+    for _, p := range parts {
+        h := textproto.MIMEHeader{}
+        disposition := `form-data; name="` + p.field + `"`
+        if p.filename != "" {
+            disposition += `; filename="` + p.filename + `"`
+        }
+        h.Set("Content-Disposition", disposition)
+        if p.contentType != "" {
+            h.Set("Content-Type", p.contentType)
+        }
+        pw, err := w.CreatePart(h)
+        if err != nil {
+            t.Fatal(err)
+        }
+        pw.Write([]byte(p.contents))
+    }
+    w.Close()
+
+    r, err := http.NewRequest("POST", "/attachments/7", &b)
+    if err != nil {
+        t.Fatal(err)
+    }
+    r.Header.Set("Content-Type", w.FormDataContentType())
+    return r
+}
+
+func TestUploadAttachment(t *testing.T) {
+    for _, c := range []struct {
+        parts    []uploadPart
+        err      error
+        name     string
+        mimeType string
+        contents string
+    }{
+        {
+            parts: []uploadPart{
+                {"csrf", "", "", "token"},
+                {"file", "notes.txt", "text/plain", "some notes"},
+            },
+            name:     "notes.txt",
+            mimeType: "text/plain",
+            contents: "some notes",
+        },
+        // only the base of a path is kept, whichever separator it uses
+        {
+            parts: []uploadPart{
+                {"file", `C:\Users\me\..\diagram.png`,
+                    "application/octet-stream", "png"},
+            },
+            name:     "diagram.png",
+            mimeType: "image/png",
+            contents: "png",
+        },
+        {
+            parts: []uploadPart{
+                {"file", "../../etc/passwd", "", "root"},
+            },
+            name:     "passwd",
+            mimeType: "application/octet-stream",
+            contents: "root",
+        },
+        // a file in another field, or a field with no file, is not uploaded
+        {
+            parts: []uploadPart{
+                {"other", "notes.txt", "text/plain", "some notes"},
+                {"file", "", "", "not a file"},
+            },
+            err: errNoUpload,
+        },
+        {
+            parts: nil,
+            err:   errNoUpload,
+        },
+    } {
+        ps := &uploadService{}
+        s := &server{permissionService: ps}
+        r := newUploadRequest(t, c.parts)
+        id, err := s.uploadAttachment(r, &user.User{ID: 1}, 7)
+        if err != c.err {
+            t.Errorf("%v: uploading gave %v", c.parts, err)
+            continue
+        }
+        if err != nil {
+            continue
+        }
+        if id != 12 || ps.name != c.name || ps.mimeType != c.mimeType ||
+            string(ps.contents) != c.contents {
+            t.Errorf("%v: attached %v %q (%q): %q", c.parts, id, ps.name,
+                ps.mimeType, ps.contents)
+        }
+    }
+
+    // a request that is not a multipart form
+    r, err := http.NewRequest("POST", "/attachments/7",
+        bytes.NewReader([]byte("file=x")))
+    if err != nil {
+        t.Fatal(err)
+    }
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    s := &server{permissionService: &uploadService{}}
+    if _, err := s.uploadAttachment(r, &user.User{ID: 1}, 7); err !=
+        errNoUpload {
+
+        t.Errorf("uploading a form with no file gave %v", err)
+    }
+}
+
+func TestAttachmentMIMEType(t *testing.T) {
+    for _, c := range []struct {
+        contentType, name, want string
+    }{
+        {"text/plain; charset=utf-8", "notes", "text/plain; charset=utf-8"},
+        {"image/png", "diagram.jpg", "image/png"},
+        {"application/octet-stream", "diagram.png", "image/png"},
+        {"", "diagram.png", "image/png"},
+        {"not a type", "diagram.png", "image/png"},
+        {"", "archive.unknown-extension", "application/octet-stream"},
+        {"", "no-extension", "application/octet-stream"},
+    } {
+        got := attachmentMIMEType(c.contentType, c.name)
+        if got != c.want {
+            t.Errorf("%q / %q gave %q, want %q", c.contentType, c.name, got,
+                c.want)
+        }
+    }
+}
+
+func TestAttachmentUploadError(t *testing.T) {
+    for _, c := range []struct {
+        err  error
+        want string
+    }{
+        {errNoUpload, errNoUpload.Error()},
+        {attachment.ErrNoName, errNoUpload.Error()},
+        {attachment.ErrTooLarge, "The file is larger than 25.0 MB."},
+        {errors.New("http: request body too large"),
+            "The file is larger than 25.0 MB."},
+        {errors.New("disk full"), "The file could not be attached."},
+    } {
+        got := attachmentUploadError(c.err)
+        if got != c.want {
+            t.Errorf("%v gave %q, want %q", c.err, got, c.want)
+        }
+    }
+}
@@ -0,0 +1,94 @@
+package main
+
+/**
+ * This file implements the `backup` and `restore` commands (see `pkg/backup`):
+ *
+ *     ./setonotes_main backup <file>    back up every table and blob to a new
+ *                                       archive
+ *     ./setonotes_main restore <file>   check an archive and restore it into an
+ *                                       empty database and blob store
+ *
+ * The database must first be migrated to the schema version the backup was
+ * made at. Neither command needs any user's keys, since everything is copied
+ * as it is encrypted.
+ */
+
+import (
+    "os"
+    "log"
+    "errors"
+
+    "github.com/setonotes/pkg/backup"
+    "github.com/setonotes/pkg/attachment"
+)
+
+/**
+ * Back up the instance to a new file, which is removed again if the backup
+ * fails
+ */
+func runBackup(r backup.Repository, b attachment.BlobStore,
+    path string) (err error) {
+
+    if path == "" {
+        return errors.New("usage: backup <file>")
+    }
+
+    // the archive holds password hashes and wrapped keys, so only the owner
+    // may read it
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil {
+        log.Printf("failed to create backup file <%s>", path)
+        return err
+    }
+    defer func() {
+        closeErr := f.Close()
+        if err == nil {
+            err = closeErr
+        }
+        if err != nil {
+            os.Remove(path)
+        }
+    }()
+
+    log.Printf("backing up to <%s>...", path)
+    err = backup.Write(r, b, f)
+    if err != nil {
+        return err
+    }
+    err = f.Sync()
+    if err != nil {
+        return err
+    }
+    log.Printf("successfully backed up to <%s>", path)
+    return nil
+}
+
+/**
+ * Restore the instance from a backup file
+ */
+func runRestore(r backup.Repository, b attachment.BlobStore,
+    path string) error {
+
+    if path == "" {
+        return errors.New("usage: restore <file>")
+    }
+
+    f, err := os.Open(path)
+    if err != nil {
+        log.Printf("failed to open backup file <%s>", path)
+        return err
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        return err
+    }
+
+    log.Printf("restoring from <%s>...", path)
+    err = backup.Restore(r, b, f, info.Size())
+    if err != nil {
+        return err
+    }
+    log.Printf("successfully restored from <%s>", path)
+    return nil
+}
@@ -2,4 +2,18 @@ go build \
 main.go \
 server.go \
 handlers.go \
-user_auth.go
+user_auth.go \
+reencrypt.go \
+api.go \
+history.go \
+diff.go \
+collab.go \
+trash.go \
+notebook.go \
+tag.go \
+search.go \
+wiki.go \
+export.go \
+import.go \
+attachment.go \
+backup.go
@@ -0,0 +1,98 @@
+package main
+
+/**
+ * This file implements live editing of a page by several users at once (see
+ * `pkg/collab` and `static/collab.js`):
+ *
+ *     GET /collab/<id>     the live editor
+ *     GET /collab/<id>/ws  the WebSocket the editor sends and receives edits on
+ */
+
+import (
+    "log"
+    "strconv"
+    "net/http"
+    "database/sql"
+
+    "github.com/setonotes/pkg/permission"
+    "github.com/setonotes/pkg/encryption"
+
+    "github.com/gorilla/websocket"
+)
+
+// the default origin check refuses cross-site connections
+var upgrader = websocket.Upgrader{
+    ReadBufferSize:  4096,
+    WriteBufferSize: 4096,
+}
+
+const collabMaxMessageSize = 1 << 20
+
+func (s *server) collabHandler(w http.ResponseWriter, r *http.Request) {
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    // get page ID from URL
+    m := s.collabPath.FindStringSubmatch(r.URL.Path)
+    if m == nil {
+        http.NotFound(w, r)
+        return
+    }
+    pageID, _ := strconv.Atoi(m[1])
+
+    if m[2] == "" {
+        data := struct {
+            ID         int
+            Navbar     bool
+            Authorized bool
+        }{
+            pageID,
+            true,
+            authorized,
+        }
+        s.renderTemplate(w, "collab.tmpl", data)
+        return
+    }
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Printf("failed to get user-%v for live editing", userID)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    client, err := s.collabHub.Join(pageID, u)
+    switch err {
+    case nil:
+    case permission.ErrPermissionConflict, sql.ErrNoRows:
+        http.NotFound(w, r)
+        return
+    case permission.ErrClientEncrypted:
+        http.Error(w, "Browser-encrypted pages cannot be edited live.",
+            http.StatusNotImplemented)
+        return
+    case encryption.ErrPageTampered:
+        s.tamperedPageError(w, pageID)
+        return
+    default:
+        log.Printf("failed to join live editing of page-%v: %v", pageID, err)
+        http.NotFound(w, r)
+        return
+    }
+
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        // the upgrader has already replied
+        log.Printf("failed to upgrade connection for page-%v: %v", pageID,
+            err)
+        client.Leave()
+        return
+    }
+    conn.SetReadLimit(collabMaxMessageSize)
+
+    client.Serve(conn)
+}
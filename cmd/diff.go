@@ -0,0 +1,106 @@
+package main
+
+/**
+ * This file implements the line diff shown when a save conflicts with a newer
+ * revision of a page, so the two versions can be merged by hand
+ */
+
+import (
+    "strings"
+)
+
+type diffLine struct {
+    Op   string // "=" in both, "-" only in the current page, "+" only in yours
+    Text string
+}
+
+// beyond this many line pairs, the changed lines are shown as one block
+const maxDiffCells = 4000000
+
+/**
+ * Diff the lines of the current text against the lines of your text, using
+ * the longest common subsequence of the lines that differ
+ */
+func diffLines(current, yours string) []diffLine {
+    a := strings.Split(strings.Replace(current, "\r\n", "\n", -1), "\n")
+    b := strings.Split(strings.Replace(yours, "\r\n", "\n", -1), "\n")
+
+    // the common prefix and suffix need no table
+    prefix := 0
+    for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+        prefix++
+    }
+    suffix := 0
+    for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+        a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+        suffix++
+    }
+
+    diff := []diffLine{}
+    for _, line := range a[:prefix] {
+        diff = append(diff, diffLine{"=", line})
+    }
+    diff = append(diff, diffMiddle(a[prefix:len(a)-suffix],
+        b[prefix:len(b)-suffix])...)
+    for _, line := range a[len(a)-suffix:] {
+        diff = append(diff, diffLine{"=", line})
+    }
+    return diff
+}
+
+/**
+ * Diff two runs of lines that differ at both ends
+ */
+func diffMiddle(a, b []string) []diffLine {
+    diff := []diffLine{}
+    if len(a)*len(b) > maxDiffCells {
+        for _, line := range a {
+            diff = append(diff, diffLine{"-", line})
+        }
+        for _, line := range b {
+            diff = append(diff, diffLine{"+", line})
+        }
+        return diff
+    }
+
+    // lcs[i][j] is the length of the longest common subsequence of a[i:] and
+    // b[j:]
+    lcs := make([][]int, len(a)+1)
+    for i := range lcs {
+        lcs[i] = make([]int, len(b)+1)
+    }
+    for i := len(a) - 1; i >= 0; i-- {
+        for j := len(b) - 1; j >= 0; j-- {
+            if a[i] == b[j] {
+                lcs[i][j] = lcs[i+1][j+1] + 1
+            } else if lcs[i+1][j] >= lcs[i][j+1] {
+                lcs[i][j] = lcs[i+1][j]
+            } else {
+                lcs[i][j] = lcs[i][j+1]
+            }
+        }
+    }
+
+    i, j := 0, 0
+    for i < len(a) && j < len(b) {
+        switch {
+        case a[i] == b[j]:
+            diff = append(diff, diffLine{"=", a[i]})
+            i++
+            j++
+        case lcs[i+1][j] >= lcs[i][j+1]:
+            diff = append(diff, diffLine{"-", a[i]})
+            i++
+        default:
+            diff = append(diff, diffLine{"+", b[j]})
+            j++
+        }
+    }
+    for ; i < len(a); i++ {
+        diff = append(diff, diffLine{"-", a[i]})
+    }
+    for ; j < len(b); j++ {
+        diff = append(diff, diffLine{"+", b[j]})
+    }
+    return diff
+}
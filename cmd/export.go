@@ -0,0 +1,61 @@
+package main
+
+/**
+ * This file implements export:
+ *
+ *     GET /export/   download every page the user can read, decrypted, as a
+ *                    zip of Markdown files (see `pkg/export`)
+ *
+ * Pages encrypted in the browser are left out, as the server cannot read them.
+ */
+
+import (
+    "log"
+    "time"
+    "net/http"
+
+    "github.com/setonotes/pkg/export"
+)
+
+func (s *server) exportHandler(w http.ResponseWriter, r *http.Request) {
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+    if r.URL.Path != "/export/" {
+        http.NotFound(w, r)
+        return
+    }
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Println("failed to get user by ID for /export/")
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    pages, err := s.permissionService.ExportUserPages(u)
+    if err != nil {
+        log.Printf("failed to export pages of user-%v: %v", u.ID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    filename := "setonotes-" + time.Now().Format("2006-01-02") + ".zip"
+    w.Header().Set("Content-Type", "application/zip")
+    w.Header().Set("Content-Disposition",
+        `attachment; filename="`+filename+`"`)
+
+    // the zip is streamed, decrypting one page at a time, so an error part
+    // way can only be logged
+    n, err := export.WriteZip(w, pages, func(p *export.Page) error {
+        return s.permissionService.LoadExportPage(u, p)
+    })
+    if err != nil {
+        log.Printf("failed to write export of user-%v: %v", u.ID, err)
+        return
+    }
+    log.Printf("exported %v pages of user-%v", n, u.ID)
+}
@@ -6,10 +6,10 @@ import (
     "net/http"
     "html/template"
 
+    "github.com/setonotes/pkg/user"
     "github.com/setonotes/pkg/page"
-
-    "github.com/blackfriday"
-    "github.com/microcosm-cc/bluemonday"
+    "github.com/setonotes/pkg/permission"
+    "github.com/setonotes/pkg/encryption"
 )
 
 /**
@@ -59,6 +59,27 @@ func (s *server) makeHandler(fn func (http.ResponseWriter, *http.Request,
     }
 }
 
+/**
+ * Get the signed-in user along with the password-generated key of their
+ * session, which every encrypted operation needs
+ */
+func (s *server) getSessionUser(r *http.Request,
+    userID int) (*user.User, error) {
+
+    u, err := s.userService.GetByID(userID)
+    if err != nil {
+        return nil, err
+    }
+
+    u.SessionKey, err = s.authService.GetSessionKey(r)
+    if err != nil {
+        log.Printf("failed to get session key for user-%v", userID)
+        return nil, err
+    }
+
+    return u, nil
+}
+
 func (s *server) homePageHandler(w http.ResponseWriter, r *http.Request) {
     // check valid path
     if r.URL.Path != "/" {
@@ -87,31 +108,78 @@ func (s *server) directoryHandler(w http.ResponseWriter, r *http.Request,
     userID int, authorized bool) {
 
     // get user from ID
-    u, err := s.userService.GetByID(userID)
+    u, err := s.getSessionUser(r, userID)
     if err != nil {
         log.Println("failed to get user from ID for directory page")
         return // TODO: this should probably 404
     }
 
     // get page titles
-    tmplMapBytes, err := s.permissionService.GetPageTitles(u)
+    titles, err := s.permissionService.GetPageTitles(u)
     if err != nil {
         log.Printf("failed to get titles for user %v: %v", userID, err)
         return // TODO: this should also probably 404
     }
 
-    // convert byteslice titles to strings
-    tmplMap := make(map[int]string)
-    for k, v := range tmplMapBytes {
-        tmplMap[k] = string(v)
+    // get notebooks to arrange the pages in
+    notebooks, err := s.permissionService.GetNotebooks(u)
+    if err != nil {
+        log.Printf("failed to get notebooks for user %v: %v", userID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    // get tags to show on the pages
+    tags, err := s.permissionService.GetTags(u)
+    if err != nil {
+        log.Printf("failed to get tags for user %v: %v", userID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    // only show the pages with the tag being filtered on, if any
+    filterTagID, _ := strconv.Atoi(r.URL.Query().Get("tag"))
+    if filterTagID != 0 {
+        filtered := []*permission.PageTitle{}
+        for _, t := range titles {
+            for _, tagID := range t.TagIDs {
+                if tagID == filterTagID {
+                    filtered = append(filtered, t)
+                    break
+                }
+            }
+        }
+        titles = filtered
+    }
+
+    // convert byteslice titles to strings, mark shared pages and sort pages
+    // into notebooks (defined in `notebook.go`) -- browser-encrypted titles
+    // are filled in by `static/client.js`
+    clientEncrypted := false
+    for _, t := range titles {
+        clientEncrypted = clientEncrypted || t.ClientEncrypted
+    }
+    root := buildDirectory(u, titles, notebooks, tags)
+    if filterTagID != 0 {
+        pruneFolder(root)
+    }
+    tagChips := []directoryTag{}
+    for _, t := range tags {
+        tagChips = append(tagChips, directoryTag{t.ID, string(t.Name)})
     }
 
     data := struct {
-        Pages      map[int]string
-        Navbar     bool
-        Authorized bool
+        Root            *directoryFolder
+        Tags            []directoryTag
+        FilterTagID     int
+        ClientEncrypted bool
+        Navbar          bool
+        Authorized      bool
     }{
-        tmplMap,
+        root,
+        tagChips,
+        filterTagID,
+        clientEncrypted,
         true, // directory page always gets a navbar
         authorized,
     }
@@ -120,19 +188,21 @@ func (s *server) directoryHandler(w http.ResponseWriter, r *http.Request,
 }
 
 /**
- * Replace every '\r' in a byteslice with '\n'
- * Right now this is necessary to handle the text from the input
- * form on the edit page. If this issue isn't handled in a better
- * way eventually, this function should probably move to a different
- * file somewhere.
+ * Report a page that failed authentication -- its ciphertext has been altered
+ * or moved in storage, so it must not be shown or edited
  */
-func newlineDoctor(text []byte) []byte {
-    for i, c := range text {
-        if c == '\r' {
-            text[i] = '\n'
-        }
-    }
-    return text
+func (s *server) tamperedPageError(w http.ResponseWriter, pageID int) {
+    log.Printf("SECURITY: refusing to show page-%v, which failed "+
+        "authentication", pageID)
+    http.Error(w, "This page failed an integrity check and may have been "+
+        "tampered with.", http.StatusConflict)
+}
+
+/**
+ * Render a page body from Markdown to sanitized HTML
+ */
+func (s *server) renderMarkdown(body []byte) template.HTML {
+    return template.HTML(s.renderer.Render(body))
 }
 
 func (s *server) viewHandler(w http.ResponseWriter, r *http.Request, pageID int,
@@ -146,13 +216,21 @@ func (s *server) viewHandler(w http.ResponseWriter, r *http.Request, pageID int,
     }
 
     // get user
-    u, err := s.userService.GetByID(userID)
+    u, err := s.getSessionUser(r, userID)
     if err != nil {
         log.Println("failed to get user by ID for view page")
         return // TODO: this should probably 404
     }
 
     p, err := s.permissionService.LoadAndDecryptPage(pageID, u)
+    if err == permission.ErrClientEncrypted {
+        s.renderClientPage(w, "view", pageID, authorized)
+        return
+    }
+    if err == encryption.ErrPageTampered {
+        s.tamperedPageError(w, pageID)
+        return
+    }
     if err != nil {
         // don't do this because it's weird
         // http.Redirect(w, r, "/edit/"+string(pageID), http.StatusFound)
@@ -161,20 +239,21 @@ func (s *server) viewHandler(w http.ResponseWriter, r *http.Request, pageID int,
         return // TODO: this should probably 404
     }
 
-    // there is probably a better way to handle this issue
-    p.Body = newlineDoctor(p.Body)
-
-    // use blackfriday Markdown processor to get HTML
-    unsafeHTML := blackfriday.Run(p.Body)
-
-    // use bluemonday HTML sanitizer to make HTML safe
-    safeHTML := bluemonday.UGCPolicy().SanitizeBytes(unsafeHTML)
+    // resolve wiki links and find backlinks (defined in `wiki.go`)
+    markdown, backlinks, err := s.renderWikiPage(u, p)
+    if err != nil {
+        log.Printf("failed to render links of page-%v: %v", p.ID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
 
     // create a map to include markdown in template data
     md_tmpl := map[string]interface{} {
         "ID":    p.ID,
         "Title": string(p.Title),
-        "Markdown": template.HTML(safeHTML),
+        "Markdown": markdown,
+        "IsOwner": p.OwnerID == u.ID,
+        "Backlinks": backlinks,
     }
 
     // data for template
@@ -202,32 +281,68 @@ func (s *server) editHandler(w http.ResponseWriter, r *http.Request, pageID int,
     }
 
     // get user
-    u, err := s.userService.GetByID(userID)
+    u, err := s.getSessionUser(r, userID)
     if err != nil {
         log.Println("failed to get user by ID for edit page")
         return // TODO: this should probably 404
     }
 
     p, err := s.permissionService.LoadAndDecryptPage(pageID, u)
+    if err == permission.ErrClientEncrypted {
+        s.renderClientPage(w, "edit", pageID, authorized)
+        return
+    }
+    if err == permission.ErrPageTrashed {
+        http.Redirect(w, r, "/trash/", http.StatusFound)
+        return
+    }
+    if err == encryption.ErrPageTampered {
+        // never offer to overwrite a page that may have been tampered with
+        s.tamperedPageError(w, pageID)
+        return
+    }
+    if err != nil && u.ClientEncryption {
+        // new pages of browser-encryption users are made in the browser
+        s.renderClientPage(w, "edit", 0, authorized)
+        return
+    }
     if err != nil {
-        // create a new page
+        // create a new page, titled after the wiki link that led here if any
         // TODO: what if there is an unexpected error here?
-        p = &page.Page{ID: pageID, Title: []byte("New Page"), Body: []byte("")}
+        title := r.URL.Query().Get("title")
+        if title == "" {
+            title = "New Page"
+        }
+        p = &page.Page{ID: pageID, Title: []byte(title), Body: []byte("")}
     }
 
+    s.renderEditPage(w, p, nil, authorized)
+}
+
+/**
+ * Render the edit form for a page -- conflict is the diff shown when a save
+ * was rejected because the page changed since it was loaded, or nil
+ */
+func (s *server) renderEditPage(w http.ResponseWriter, p *page.Page,
+    conflict []diffLine, authorized bool) {
+
     // this struct is the same as a page.Page, but with a string title --
     // this is probably a temporary solution, because eventually we will have a
     // WYSIWYG editor and the titles will also be rendered in Markdown/LaTeX
     data := struct {
-        ID        int
-        Title     string
-        Body      []byte
+        ID         int
+        Title      string
+        Body       []byte
+        Revision   int
+        Conflict   []diffLine
         Navbar     bool
         Authorized bool
     }{
         p.ID,
         string(p.Title),
         p.Body,
+        p.Revision,
+        conflict,
         true, // `/edit/` always gets a navbar
         authorized,
     }
@@ -246,7 +361,7 @@ func (s *server) saveHandler(w http.ResponseWriter, r *http.Request, pageID int,
     }
 
     // get user
-    u, err := s.userService.GetByID(userID)
+    u, err := s.getSessionUser(r, userID)
     if err != nil {
         log.Println("failed to get user by ID for /save/")
         http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -255,9 +370,16 @@ func (s *server) saveHandler(w http.ResponseWriter, r *http.Request, pageID int,
 
     title := r.FormValue("title")
     body := r.FormValue("body")
+    // a missing revision never matches a saved page, so it is a conflict
+    revision, _ := strconv.Atoi(r.FormValue("revision"))
     // if pageID == 0, the value will not get used
-    p := &page.Page{ID: pageID, Title: []byte(title), Body: []byte(body)}
+    p := &page.Page{ID: pageID, Title: []byte(title), Body: []byte(body),
+        Revision: revision}
     pageID, err = s.permissionService.SavePage(p, u)
+    if err == page.ErrEditConflict {
+        s.editConflict(w, r, p, u, authorized)
+        return
+    }
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
@@ -266,6 +388,35 @@ func (s *server) saveHandler(w http.ResponseWriter, r *http.Request, pageID int,
     http.Redirect(w, r, "/view/"+strconv.Itoa(pageID), http.StatusFound)
 }
 
+/**
+ * Show the edit form again after a save was rejected because the page changed
+ * since it was loaded: the form keeps your text, is set to the current
+ * revision (so saving again overwrites it) and shows what differs
+ */
+func (s *server) editConflict(w http.ResponseWriter, r *http.Request,
+    yours *page.Page, u *user.User, authorized bool) {
+
+    log.Printf("save of page-%v by user-%v conflicts with a newer revision",
+        yours.ID, u.ID)
+    current, err := s.permissionService.LoadAndDecryptPage(yours.ID, u)
+    if err != nil {
+        log.Printf("failed to load current page-%v: %v", yours.ID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    conflict := []diffLine{}
+    if string(current.Title) != string(yours.Title) {
+        conflict = append(conflict, diffLine{"-", string(current.Title)},
+            diffLine{"+", string(yours.Title)}, diffLine{"=", ""})
+    }
+    conflict = append(conflict, diffLines(string(current.Body),
+        string(yours.Body))...)
+
+    yours.Revision = current.Revision
+    s.renderEditPage(w, yours, conflict, authorized)
+}
+
 func (s *server) deleteHandler(w http.ResponseWriter, r *http.Request,
     pageID int, userID int, authorized bool) {
 
@@ -276,12 +427,177 @@ func (s *server) deleteHandler(w http.ResponseWriter, r *http.Request,
         http.Redirect(w, r, "/", http.StatusNotFound)
     }
 
-    err := s.permissionService.DeletePage(pageID, userID)
+    // ask for confirmation first; only the POST moves the page to the trash
+    if r.Method != "POST" {
+        u, err := s.getSessionUser(r, userID)
+        if err != nil {
+            log.Println("failed to get user by ID for /delete/")
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        // the title of a browser-encrypted page is not known here
+        title := ""
+        p, err := s.permissionService.LoadAndDecryptPage(pageID, u)
+        if err == nil {
+            title = string(p.Title)
+        } else if err != permission.ErrClientEncrypted {
+            http.NotFound(w, r)
+            return
+        }
+
+        data := struct {
+            ID            int
+            Title         string
+            RetentionDays int
+            Navbar        bool
+            Authorized    bool
+        }{
+            pageID,
+            title,
+            s.trashRetentionDays,
+            true,
+            authorized,
+        }
+        s.renderTemplate(w, "delete.tmpl", data)
+        return
+    }
+
+    err := s.permissionService.TrashPage(pageID, userID)
+    if err == permission.ErrPermissionConflict {
+        http.Error(w, "Only the owner of a page can delete it.",
+            http.StatusForbidden)
+        return
+    }
     if err != nil {
-        log.Println("failed to delete page")
+        log.Printf("failed to move page-%v to the trash: %v", pageID, err)
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
     http.Redirect(w, r, "/", http.StatusFound)
 }
 
+
+func (s *server) shareHandler(w http.ResponseWriter, r *http.Request,
+    pageID int, userID int, authorized bool) {
+
+    // redirect visitors
+    if !authorized {
+        log.Println("unauthorized attempt to view /share/")
+        http.Redirect(w, r, "/", http.StatusFound)
+        return
+    }
+
+    // get user
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Println("failed to get user by ID for /share/")
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    // the title of a browser-encrypted page is not known here, but its
+    // shares can still be revoked
+    title := ""
+    p, err := s.permissionService.LoadAndDecryptPage(pageID, u)
+    if err == nil {
+        title = string(p.Title)
+    } else if err != permission.ErrClientEncrypted {
+        log.Println("failed to decrypt page for share page")
+        http.NotFound(w, r)
+        return
+    }
+
+    data := struct {
+        ID              int
+        Title           string
+        ClientEncrypted bool
+        Message         string
+        Shares          []*permission.Share
+        Navbar          bool
+        Authorized      bool
+    }{
+        ID:              pageID,
+        Title:           title,
+        ClientEncrypted: p == nil,
+        Navbar:          true, // `/share/` always gets a navbar
+        Authorized:      authorized,
+    }
+    if r.URL.Query().Get("key") == "unrotated" {
+        data.Message = "Access was revoked, but this page is encrypted in " +
+            "the browser, so its key could not be changed: anyone who " +
+            "already had access could still decrypt a copy of the page as " +
+            "it is now."
+    }
+
+    if r.Method == "POST" && !data.ClientEncrypted {
+        recipient := r.FormValue("username")
+        canEdit := r.FormValue("can_edit") == "on"
+        err = s.permissionService.SharePage(pageID, u, recipient, canEdit)
+        if err != nil {
+            log.Printf("failed to share page-%v with <%s>: %v", pageID,
+                recipient, err)
+            data.Message = "Could not share this page with " + recipient +
+                ": " + err.Error()
+        } else {
+            data.Message = "Shared with " + recipient + "."
+        }
+    }
+
+    data.Shares, err = s.permissionService.GetPageShares(pageID, u)
+    if err != nil {
+        log.Printf("failed to get shares for page-%v: %v", pageID, err)
+    }
+
+    s.renderTemplate(w, "share.tmpl", data)
+}
+
+func (s *server) revokeHandler(w http.ResponseWriter, r *http.Request,
+    pageID int, userID int, authorized bool) {
+
+    // redirect visitors
+    if !authorized {
+        log.Println("unauthorized attempt to view /revoke/")
+        http.Redirect(w, r, "/", http.StatusFound)
+        return
+    }
+
+    // revoking changes the page key, so it should never happen on a GET
+    if r.Method != "POST" {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // get user
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Println("failed to get user by ID for /revoke/")
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    revokedUserID, err := strconv.Atoi(r.FormValue("user_id"))
+    if err != nil {
+        http.Error(w, "invalid user", http.StatusBadRequest)
+        return
+    }
+
+    rotated, err := s.permissionService.RevokeAccess(pageID, u,
+        revokedUserID)
+    if err != nil {
+        log.Printf("failed to revoke user-%v access to page-%v: %v",
+            revokedUserID, pageID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    // a live editing session only checks access when the user joins
+    s.collabHub.Evict(pageID, revokedUserID)
+
+    // the owner is told when the revoked user may still hold the page key
+    target := "/share/" + strconv.Itoa(pageID)
+    if !rotated {
+        target += "?key=unrotated"
+    }
+    http.Redirect(w, r, target, http.StatusFound)
+}
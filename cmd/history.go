@@ -0,0 +1,156 @@
+package main
+
+/**
+ * This file implements the page history handlers:
+ *
+ *     GET  /history/<id>        list every revision of a page
+ *     GET  /history/<id>/<rev>  view an old revision
+ *     POST /history/<id>/<rev>  restore an old revision
+ */
+
+import (
+    "log"
+    "strconv"
+    "net/http"
+    "database/sql"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/permission"
+    "github.com/setonotes/pkg/encryption"
+)
+
+const historyTimeFormat = "2 Jan 2006 15:04 MST"
+
+func (s *server) historyHandler(w http.ResponseWriter, r *http.Request) {
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    // get page ID and (optional) revision number from URL
+    m := s.historyPath.FindStringSubmatch(r.URL.Path)
+    if m == nil {
+        http.NotFound(w, r)
+        return
+    }
+    pageID, _ := strconv.Atoi(m[1])
+    number, _ := strconv.Atoi(m[2]) // 0 if there is no revision number
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Printf("failed to get user-%v for page history", userID)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if number == 0 {
+        s.historyListHandler(w, r, pageID, u, authorized)
+        return
+    }
+
+    switch r.Method {
+    case "GET":
+        rev, err := s.permissionService.LoadAndDecryptRevision(pageID, number,
+            u)
+        if err != nil {
+            s.historyError(w, r, pageID, err)
+            return
+        }
+
+        data := struct {
+            PageID     int
+            Number     int
+            Title      string
+            Author     string
+            Time       string
+            Markdown   interface{}
+            Navbar     bool
+            Authorized bool
+        }{
+            pageID,
+            rev.Number,
+            string(rev.Title),
+            rev.AuthorUsername,
+            rev.CreatedAt.Format(historyTimeFormat),
+            s.renderMarkdown(rev.Body),
+            true,
+            authorized,
+        }
+        s.renderTemplate(w, "revision.tmpl", data)
+
+    case "POST":
+        pageID, err = s.permissionService.RestoreRevision(pageID, number, u)
+        if err != nil {
+            s.historyError(w, r, pageID, err)
+            return
+        }
+        http.Redirect(w, r, "/view/"+strconv.Itoa(pageID), http.StatusFound)
+
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+/**
+ * List every revision of a page
+ */
+func (s *server) historyListHandler(w http.ResponseWriter, r *http.Request,
+    pageID int, u *user.User, authorized bool) {
+
+    history, err := s.permissionService.GetPageHistory(pageID, u)
+    if err != nil {
+        s.historyError(w, r, pageID, err)
+        return
+    }
+
+    type historyEntry struct {
+        Number int
+        Title  string
+        Author string
+        Time   string
+    }
+    entries := []historyEntry{}
+    for _, rev := range history {
+        entries = append(entries, historyEntry{
+            Number: rev.Number,
+            Title:  string(rev.Title),
+            Author: rev.AuthorUsername,
+            Time:   rev.CreatedAt.Format(historyTimeFormat),
+        })
+    }
+
+    data := struct {
+        PageID     int
+        Revisions  []historyEntry
+        Navbar     bool
+        Authorized bool
+    }{
+        pageID,
+        entries,
+        true,
+        authorized,
+    }
+    s.renderTemplate(w, "history.tmpl", data)
+}
+
+/**
+ * Report an error from the permission service for a history page
+ */
+func (s *server) historyError(w http.ResponseWriter, r *http.Request,
+    pageID int, err error) {
+
+    switch err {
+    case permission.ErrPermissionConflict, sql.ErrNoRows:
+        http.NotFound(w, r)
+    case encryption.ErrPageTampered:
+        s.tamperedPageError(w, pageID)
+    case permission.ErrClientEncrypted:
+        http.Error(w, "The history of browser-encrypted pages is kept, but "+
+            "cannot be shown yet.", http.StatusNotImplemented)
+    default:
+        log.Printf("failed to get history of page-%v: %v", pageID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
@@ -0,0 +1,251 @@
+package main
+
+/**
+ * This file implements import, of a zip of Markdown files or an export from
+ * another app (see `pkg/importer`):
+ *
+ *     GET  /import/   show the upload form
+ *     POST /import/   import the uploaded export ("archive") in a format
+ *                     ("format", such as "enex") and list what became of each
+ *                     note
+ *
+ * and the `import` command, which does the same from a file or a directory of
+ * Markdown files on the server, reading the user's password from standard
+ * input -- the format of a file is told by its extension:
+ *
+ *     ./setonotes_main import <username> <file or directory>
+ */
+
+import (
+    "os"
+    "log"
+    "bufio"
+    "errors"
+    "strings"
+    "net/http"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/importer"
+)
+
+// the largest export that can be uploaded
+const importMaxUploadSize = 64 << 20
+
+func (s *server) importHandler(w http.ResponseWriter, r *http.Request) {
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+    if r.URL.Path != "/import/" {
+        http.NotFound(w, r)
+        return
+    }
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Println("failed to get user by ID for /import/")
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    type formatEntry struct {
+        Format      string
+        Description string
+        Extension   string
+    }
+    type resultEntry struct {
+        Name   string
+        PageID int
+        Error  string
+    }
+    data := struct {
+        Formats    []formatEntry
+        Done       bool
+        Error      string
+        Results    []resultEntry
+        Imported   int
+        Navbar     bool
+        Authorized bool
+    }{
+        Formats:    []formatEntry{},
+        Results:    []resultEntry{},
+        Navbar:     true,
+        Authorized: authorized,
+    }
+    for _, i := range importer.Importers() {
+        data.Formats = append(data.Formats,
+            formatEntry{i.Format(), i.Description(), i.Extension()})
+    }
+
+    if r.Method == "POST" {
+        r.Body = http.MaxBytesReader(w, r.Body, importMaxUploadSize)
+        results, err := s.importUpload(r, u)
+        if err != nil {
+            log.Printf("failed to import upload of user-%v: %v", u.ID, err)
+            data.Error = err.Error()
+        } else {
+            data.Done = true
+        }
+
+        for _, result := range results {
+            entry := resultEntry{Name: result.Name, PageID: result.PageID}
+            if result.Err != nil {
+                entry.Error = result.Err.Error()
+            }
+            if result.PageID != 0 {
+                data.Imported++
+            }
+            data.Results = append(data.Results, entry)
+        }
+    }
+
+    s.renderTemplate(w, "import.tmpl", data)
+}
+
+/**
+ * Import the export uploaded with a request, for the given user
+ */
+func (s *server) importUpload(r *http.Request,
+    u *user.User) ([]*importer.Result, error) {
+
+    imp, err := importer.Get(r.FormValue("format"))
+    if err != nil {
+        return nil, err
+    }
+    file, header, err := r.FormFile("archive")
+    if err != nil {
+        return nil, errors.New("choose a file to import")
+    }
+    defer file.Close()
+
+    notes, skipped, err := imp.Read(file, header.Size)
+    if err == importer.ErrTooManyFiles {
+        return nil, err
+    } else if err != nil {
+        return nil, errors.New("the file is not a " + imp.Description() +
+            " that can be read")
+    }
+
+    results := importer.Import(s.permissionService, u, notes)
+    return append(results, skipped...), nil
+}
+
+type importUserService interface {
+    GetByUsername(username string) (*user.User, error)
+}
+
+type importAuthService interface {
+    CheckPassHash(passwordHash, password []byte) (bool, error)
+}
+
+type importEncryptionService interface {
+    DeriveKey(password, salt []byte, params user.KDFParams) ([]byte, error)
+}
+
+/**
+ * Import an export or a directory of Markdown files for a user, whose password
+ * is read from standard input to unlock their keys
+ */
+func runImport(us importUserService, a importAuthService,
+    e importEncryptionService, p importer.PermissionService,
+    username, source string) error {
+
+    if username == "" || source == "" {
+        return errors.New("usage: import <username> <file or directory>")
+    }
+
+    u, err := us.GetByUsername(username)
+    if err != nil {
+        log.Printf("failed to get user <%s>", username)
+        return err
+    }
+    if u.Version != user.CurrentVersion {
+        return errors.New("the user must sign in once to upgrade their " +
+            "account before importing")
+    }
+
+    // unlock the user's keys as signing in does
+    password, err := readUserPassword(a, u)
+    if err != nil {
+        return err
+    }
+    u.SessionKey, err = e.DeriveKey([]byte(password), u.Salt, u.KDF)
+    if err != nil {
+        return err
+    }
+
+    log.Printf("reading notes from <%s>...", source)
+    notes, skipped, err := readImportSource(source)
+    if err != nil {
+        log.Printf("failed to read notes from <%s>", source)
+        return err
+    }
+
+    results := append(importer.Import(p, u, notes), skipped...)
+    imported, failed := 0, 0
+    for _, result := range results {
+        switch {
+        case result.Err == nil:
+            log.Printf("%s: page-%v", result.Name, result.PageID)
+        case result.PageID != 0:
+            log.Printf("%s: page-%v, but %v", result.Name, result.PageID,
+                result.Err)
+        default:
+            log.Printf("%s: %v", result.Name, result.Err)
+        }
+        if result.PageID != 0 {
+            imported++
+        } else {
+            failed++
+        }
+    }
+
+    log.Printf("imported %v notes for user-%v; %v were not imported",
+        imported, u.ID, failed)
+    return nil
+}
+
+/**
+ * Read a user's password from standard input and check it
+ */
+func readUserPassword(a importAuthService, u *user.User) (string, error) {
+    os.Stderr.WriteString("password for " + u.Username + ": ")
+    password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+    if err != nil && password == "" {
+        return "", err
+    }
+    password = strings.TrimRight(password, "\r\n")
+    ok, err := a.CheckPassHash(u.PasswordHash, []byte(password))
+    if err != nil || !ok {
+        return "", errors.New("wrong password")
+    }
+    return password, nil
+}
+
+/**
+ * Read the notes in an export, or in a directory of Markdown files
+ */
+func readImportSource(source string) ([]*importer.Note, []*importer.Result,
+    error) {
+
+    info, err := os.Stat(source)
+    if err != nil {
+        return nil, nil, err
+    }
+    if info.IsDir() {
+        return importer.ReadDir(source)
+    }
+
+    imp, err := importer.ForFile(source)
+    if err != nil {
+        return nil, nil, err
+    }
+    f, err := os.Open(source)
+    if err != nil {
+        return nil, nil, err
+    }
+    defer f.Close()
+    return imp.Read(f, info.Size())
+}
@@ -3,16 +3,22 @@ package main
 import (
     "flag"
     "log"
+    "time"
     "net/http"
 
     "github.com/setonotes/pkg/config"
     repo "github.com/setonotes/pkg/storage/postgres"
+    "github.com/setonotes/pkg/storage/filesystem"
     cache "github.com/setonotes/pkg/cache/redis"
     "github.com/setonotes/pkg/user"
     "github.com/setonotes/pkg/page"
+    "github.com/setonotes/pkg/notebook"
+    "github.com/setonotes/pkg/tag"
+    "github.com/setonotes/pkg/attachment"
     "github.com/setonotes/pkg/encryption"
     "github.com/setonotes/pkg/auth"
     "github.com/setonotes/pkg/permission"
+    "github.com/setonotes/pkg/collab"
 )
 
 /**
@@ -29,7 +35,9 @@ func httpsRedirect(w http.ResponseWriter, r *http.Request) {
 func main() {
     // define command line flags
     localFlag := flag.Bool("local", false,
-        "Usage: ./<setonotes main> -local")
+        "Usage: ./<setonotes main> -local [reencrypt [<user>] | "+
+            "import <user> <path> "+
+            "| backup <file> | restore <file>]")
 
     log.Println("starting setonotes main...")
     flag.Parse()
@@ -60,12 +68,27 @@ func main() {
 
     // create new encryption service
     log.Println("creating new encryption servic...")
-    encryptionService := encryption.NewService(sessionCache)
+    algorithm, err := encryption.ParseAlgorithm(conf.Cipher)
+    if err != nil {
+        log.Fatalf("unknown cipher <%s> in configuration", conf.Cipher)
+    }
+    kdf := encryption.DefaultKDFParams()
+    if conf.Argon2Time != 0 {
+        kdf.Iterations = conf.Argon2Time
+    }
+    if conf.Argon2MemoryKiB != 0 {
+        kdf.MemoryKiB = conf.Argon2MemoryKiB
+    }
+    if conf.Argon2Threads != 0 {
+        kdf.Threads = conf.Argon2Threads
+    }
+    encryptionService := encryption.NewService(algorithm, kdf)
     log.Println("successfully created new encryption service")
 
     // create new auth service
     log.Println("creating new authentication service...")
-    authService := auth.NewService(sessionCache)
+    authService := auth.NewService(sessionCache, encryptionService,
+        conf.BcryptCost)
     log.Println("successfully created new authentication service")
 
     // initialize user service
@@ -78,14 +101,91 @@ func main() {
     pageService := page.NewService(repository)
     log.Println("successfully created new page service")
 
+    // initialize notebook service
+    log.Println("creating new notebook service...")
+    notebookService := notebook.NewService(repository)
+    log.Println("successfully created new notebook service")
+
+    // initialize tag service
+    log.Println("creating new tag service...")
+    tagService := tag.NewService(repository)
+    log.Println("successfully created new tag service")
+
+    // initialize attachment service
+    log.Println("creating new attachment service...")
+    attachmentService := attachment.NewService(repository)
+    log.Println("successfully created new attachment service")
+
+    // create the blob store for the contents of attachments
+    log.Println("creating new blob store...")
+    var blobStore attachment.BlobStore
+    switch conf.BlobStore {
+    case "", "filesystem":
+        blobStore, err = filesystem.New(conf.BlobPath)
+        if err != nil {
+            log.Fatalf("failed to create filesystem blob store: %v", err)
+        }
+    case "postgres":
+        blobStore = repo.NewBlobStore(repository)
+    default:
+        log.Fatalf("unknown blob store <%s> in configuration", conf.BlobStore)
+    }
+    log.Println("successfully created new blob store")
+
     // initialize permission service
     log.Println("creating new permission service...")
     permissionService := permission.NewService(repository, encryptionService,
-        userService, pageService)
+        userService, pageService, notebookService, tagService,
+        attachmentService, blobStore)
     log.Println("successfully created new permission service")
 
+    // run a command instead of the server if one is given
+    switch flag.Arg(0) {
+    case "":
+    case "reencrypt":
+        err = runReencrypt(repository, userService, authService,
+            encryptionService, permissionService, flag.Arg(1))
+        if err != nil {
+            log.Fatalf("failed to re-encrypt: %v", err)
+        }
+        return
+    case "import":
+        err = runImport(userService, authService, encryptionService,
+            permissionService, flag.Arg(1), flag.Arg(2))
+        if err != nil {
+            log.Fatalf("failed to import notes: %v", err)
+        }
+        return
+    case "backup":
+        err = runBackup(repository, blobStore, flag.Arg(1))
+        if err != nil {
+            log.Fatalf("failed to back up: %v", err)
+        }
+        return
+    case "restore":
+        err = runRestore(repository, blobStore, flag.Arg(1))
+        if err != nil {
+            log.Fatalf("failed to restore: %v", err)
+        }
+        return
+    default:
+        log.Fatalf("unknown command <%s>", flag.Arg(0))
+    }
+
+    // initialize live-editing hub, which saves pages once editors pause
+    collabHub := collab.NewHub(permissionService, 2*time.Second)
+
+    // purge pages left in the trash past the retention period
+    trashRetentionDays := conf.TrashRetentionDays
+    if trashRetentionDays == 0 {
+        trashRetentionDays = defaultTrashRetentionDays
+    }
+    go runTrashPurge(permissionService,
+        time.Duration(trashRetentionDays)*24*time.Hour, trashPurgeInterval)
+
     // initialize server (defined in `server.go`)
-    server := newServer(userService, authService, permissionService)
+    server := newServer(userService, authService, permissionService,
+        collabHub, trashRetentionDays)
 
     // find proper CA-certificates and keys for HTTPS
     var tlsCertPath string
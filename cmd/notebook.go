@@ -0,0 +1,359 @@
+package main
+
+/**
+ * This file implements notebooks, which organise the directory into a tree:
+ *
+ *     GET  /notebooks/        list the user's notebooks
+ *     POST /notebooks/        create a notebook ("name", "parent")
+ *     POST /notebooks/<id>    rename ("action=rename", "name"), move
+ *                             ("action=move", "parent") or delete
+ *                             ("action=delete") a notebook
+ *     GET  /move/<page-id>    choose a notebook for a page
+ *     POST /move/<page-id>    move a page into a notebook ("notebook")
+ *
+ * A parent or notebook of 0 stands for the top level of the directory.
+ */
+
+import (
+    "log"
+    "sort"
+    "strings"
+    "strconv"
+    "net/http"
+    "database/sql"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/notebook"
+    "github.com/setonotes/pkg/tag"
+    "github.com/setonotes/pkg/permission"
+)
+
+/**
+ * A directoryFolder is a notebook as shown in the directory, holding its pages
+ * and the notebooks inside it -- the top level of the directory is a folder
+ * with an ID of 0
+ */
+type directoryFolder struct {
+    ID      int
+    Name    string
+    Pages   []directoryEntry
+    Folders []*directoryFolder
+}
+
+type directoryEntry struct {
+    ID              int
+    Title           string
+    Shared          bool
+    Owner           string
+    Tags            []directoryTag
+    ClientEncrypted bool
+}
+
+type directoryTag struct {
+    ID   int
+    Name string
+}
+
+/**
+ * A notebookOption is a notebook to choose from in a form, with its name
+ * indented by how deeply it is nested
+ */
+type notebookOption struct {
+    ID    int
+    Label string
+}
+
+/**
+ * Sort notebooks by name, and the notebooks inside them likewise
+ */
+func sortNotebooks(notebooks []*notebook.Notebook) {
+    sort.SliceStable(notebooks, func(i, j int) bool {
+        return strings.ToLower(string(notebooks[i].Name)) <
+            strings.ToLower(string(notebooks[j].Name))
+    })
+    for _, nb := range notebooks {
+        sortNotebooks(nb.Children)
+    }
+}
+
+/**
+ * Arrange a user's pages into their notebooks, along with their tags -- pages
+ * in a notebook that no longer exists are shown at the top level
+ */
+func buildDirectory(u *user.User, titles []*permission.PageTitle,
+    notebooks []*notebook.Notebook, tags []*tag.Tag) *directoryFolder {
+
+    roots := notebook.Tree(notebooks)
+    sortNotebooks(roots)
+
+    folders := map[int]*directoryFolder{}
+    var build func(nbs []*notebook.Notebook) []*directoryFolder
+    build = func(nbs []*notebook.Notebook) []*directoryFolder {
+        built := []*directoryFolder{}
+        for _, nb := range nbs {
+            f := &directoryFolder{ID: nb.ID, Name: string(nb.Name)}
+            folders[nb.ID] = f
+            f.Folders = build(nb.Children)
+            built = append(built, f)
+        }
+        return built
+    }
+    root := &directoryFolder{Folders: build(roots)}
+
+    tagNames := map[int]string{}
+    for _, t := range tags {
+        tagNames[t.ID] = string(t.Name)
+    }
+
+    for _, t := range titles {
+        pageTags := []directoryTag{}
+        for _, tagID := range t.TagIDs {
+            if name, ok := tagNames[tagID]; ok {
+                pageTags = append(pageTags, directoryTag{tagID, name})
+            }
+        }
+
+        f, ok := folders[t.NotebookID]
+        if !ok {
+            f = root
+        }
+        f.Pages = append(f.Pages, directoryEntry{
+            ID:              t.ID,
+            Title:           string(t.Title),
+            Shared:          t.OwnerID != u.ID,
+            Owner:           t.OwnerUsername,
+            Tags:            pageTags,
+            ClientEncrypted: t.ClientEncrypted,
+        })
+    }
+
+    return root
+}
+
+/**
+ * Leave out the notebooks inside a folder that hold no pages, however deeply
+ * nested -- returns whether anything is left in the folder
+ */
+func pruneFolder(f *directoryFolder) bool {
+    kept := []*directoryFolder{}
+    for _, child := range f.Folders {
+        if pruneFolder(child) {
+            kept = append(kept, child)
+        }
+    }
+    f.Folders = kept
+    return len(f.Folders) > 0 || len(f.Pages) > 0
+}
+
+/**
+ * List a user's notebooks in tree order for a form, starting with the top
+ * level
+ */
+func notebookOptions(notebooks []*notebook.Notebook) []notebookOption {
+    roots := notebook.Tree(notebooks)
+    sortNotebooks(roots)
+
+    options := []notebookOption{{0, "(top level)"}}
+    var add func(nbs []*notebook.Notebook, depth int)
+    add = func(nbs []*notebook.Notebook, depth int) {
+        for _, nb := range nbs {
+            // browsers collapse ordinary spaces in an option
+            label := strings.Repeat("\u00a0\u00a0", depth) + string(nb.Name)
+            options = append(options, notebookOption{nb.ID, label})
+            add(nb.Children, depth+1)
+        }
+    }
+    add(roots, 1)
+
+    return options
+}
+
+/**
+ * Report an error from a notebook action -- returns false if there was none
+ */
+func (s *server) notebookError(w http.ResponseWriter, r *http.Request,
+    err error) bool {
+
+    switch err {
+    case nil:
+        return false
+    case permission.ErrPermissionConflict, sql.ErrNoRows:
+        http.NotFound(w, r)
+    case permission.ErrEmptyNotebookName, notebook.ErrNotebookCycle:
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    default:
+        log.Printf("notebook action failed: %v", err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+    return true
+}
+
+func (s *server) notebooksHandler(w http.ResponseWriter, r *http.Request) {
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    m := s.notebooksPath.FindStringSubmatch(r.URL.Path)
+    if m == nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Println("failed to get user by ID for /notebooks/")
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if r.Method == "POST" {
+        name := []byte(strings.TrimSpace(r.FormValue("name")))
+        parentID, _ := strconv.Atoi(r.FormValue("parent"))
+
+        if m[1] == "" {
+            _, err = s.permissionService.CreateNotebook(u, parentID, name)
+        } else {
+            notebookID, _ := strconv.Atoi(m[1])
+            switch r.FormValue("action") {
+            case "rename":
+                err = s.permissionService.RenameNotebook(u, notebookID, name)
+            case "move":
+                err = s.permissionService.MoveNotebook(u, notebookID,
+                    parentID)
+            case "delete":
+                err = s.permissionService.DeleteNotebook(u, notebookID)
+            default:
+                http.Error(w, "unknown action", http.StatusBadRequest)
+                return
+            }
+        }
+        if s.notebookError(w, r, err) {
+            return
+        }
+
+        http.Redirect(w, r, "/notebooks/", http.StatusFound)
+        return
+    }
+    if m[1] != "" {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    notebooks, err := s.permissionService.GetNotebooks(u)
+    if err != nil {
+        log.Printf("failed to get notebooks of user-%v: %v", u.ID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    // every notebook is listed with the parent it can be moved to
+    type notebookEntry struct {
+        ID       int
+        Label    string
+        Name     string
+        ParentID int
+    }
+    names := map[int]string{}
+    parents := map[int]int{}
+    for _, nb := range notebooks {
+        names[nb.ID] = string(nb.Name)
+        parents[nb.ID] = nb.ParentID
+    }
+    options := notebookOptions(notebooks)
+    entries := []notebookEntry{}
+    for _, o := range options[1:] {
+        entries = append(entries, notebookEntry{
+            ID:       o.ID,
+            Label:    o.Label,
+            Name:     names[o.ID],
+            ParentID: parents[o.ID],
+        })
+    }
+
+    data := struct {
+        Notebooks  []notebookEntry
+        Options    []notebookOption
+        Navbar     bool
+        Authorized bool
+    }{
+        entries,
+        options,
+        true,
+        authorized,
+    }
+    s.renderTemplate(w, "notebooks.tmpl", data)
+}
+
+func (s *server) moveHandler(w http.ResponseWriter, r *http.Request,
+    pageID int, userID int, authorized bool) {
+
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Println("failed to get user by ID for /move/")
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if r.Method == "POST" {
+        notebookID, _ := strconv.Atoi(r.FormValue("notebook"))
+        err = s.permissionService.MovePage(u, pageID, notebookID)
+        if s.notebookError(w, r, err) {
+            return
+        }
+        http.Redirect(w, r, "/", http.StatusFound)
+        return
+    }
+
+    // the page's title and notebook come from the directory listing, which
+    // also covers browser-encrypted pages
+    titles, err := s.permissionService.GetPageTitles(u)
+    if err != nil {
+        log.Printf("failed to get titles for user-%v: %v", u.ID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    var title *permission.PageTitle
+    for _, t := range titles {
+        if t.ID == pageID {
+            title = t
+        }
+    }
+    if title == nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    notebooks, err := s.permissionService.GetNotebooks(u)
+    if err != nil {
+        log.Printf("failed to get notebooks of user-%v: %v", u.ID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    data := struct {
+        ID              int
+        Title           string
+        ClientEncrypted bool
+        NotebookID      int
+        Options         []notebookOption
+        Navbar          bool
+        Authorized      bool
+    }{
+        pageID,
+        string(title.Title),
+        title.ClientEncrypted,
+        title.NotebookID,
+        notebookOptions(notebooks),
+        true,
+        authorized,
+    }
+    s.renderTemplate(w, "move.tmpl", data)
+}
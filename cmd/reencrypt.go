@@ -0,0 +1,167 @@
+package main
+
+/**
+ * This file implements the `reencrypt` command, which upgrades keys and pages
+ * written under an older encryption algorithm or without a ciphertext
+ * envelope:
+ *
+ *     ./setonotes_main reencrypt              report the accounts and pages
+ *                                             still to be upgraded
+ *     ./setonotes_main reencrypt <username>   upgrade an account and its pages
+ *                                             now, reading the user's password
+ *                                             from standard input
+ *
+ * Everything that needs upgrading is wrapped under a user's password, and the
+ * server only ever holds it unwrapped while the user is signed in (their
+ * session key can only be decrypted with the secret in their cookie). So an
+ * account is upgraded when its user next signs in, or by this command with
+ * their password; an account whose user never signs in again cannot be
+ * upgraded at all. Upgrading an account issues a new recovery code if its old
+ * one was wrapped under a 128-bit key, which this command prints.
+ */
+
+import (
+    "os"
+    "log"
+
+    "github.com/setonotes/pkg/user"
+)
+
+type reencryptRepository interface {
+    GetUserIDs() ([]int, error)
+}
+
+type reencryptUserService interface {
+    GetByID(userID int) (*user.User, error)
+    GetByUsername(username string) (*user.User, error)
+    UpgradeCredentials(u *user.User, password string) error
+}
+
+type reencryptEncryptionService interface {
+    DeriveKey(password, salt []byte, params user.KDFParams) ([]byte, error)
+    UserKeysNeedUpgrade(u *user.User) bool
+}
+
+type reencryptPermissionService interface {
+    MigrateLegacyUser(u *user.User, password string) (string, error)
+    UpgradeUserKeys(u *user.User, password string) (string, error)
+    UpgradeUserPages(u *user.User) (int, error)
+    CountPagesToUpgrade(ownerID int) (int, error)
+}
+
+/**
+ * Upgrade a user's account and pages if a username is given, or else report
+ * every account and page still to be upgraded
+ */
+func runReencrypt(r reencryptRepository, us reencryptUserService,
+    a importAuthService, e reencryptEncryptionService,
+    p reencryptPermissionService, username string) error {
+
+    if username != "" {
+        return reencryptUser(us, a, e, p, username)
+    }
+
+    log.Println("getting users...")
+    userIDs, err := r.GetUserIDs()
+    if err != nil {
+        log.Printf("failed to get users: %v", err)
+        return err
+    }
+
+    pending, owners, accounts, failed := 0, 0, 0, 0
+    for _, userID := range userIDs {
+        u, err := us.GetByID(userID)
+        if err != nil {
+            log.Printf("failed to get user-%v: %v", userID, err)
+            failed++
+            continue
+        }
+        if u.Version < user.CurrentVersion || e.UserKeysNeedUpgrade(u) {
+            log.Printf("user-%v (%s) has keys to upgrade", u.ID, u.Username)
+            accounts++
+        }
+
+        n, err := p.CountPagesToUpgrade(userID)
+        if err != nil {
+            log.Printf("failed to check pages for user-%v: %v", userID, err)
+            failed++
+            continue
+        }
+        if n > 0 {
+            log.Printf("user-%v (%s) has %v pages to re-encrypt", u.ID,
+                u.Username, n)
+            pending += n
+            owners++
+        }
+    }
+
+    log.Printf("%v accounts and %v pages of %v owners will be upgraded when "+
+        "their users next sign in, or with `reencrypt <username>`; %v users "+
+        "failed", accounts, pending, owners, failed)
+    return nil
+}
+
+/**
+ * Upgrade a user's account and pages as signing in does, with their password
+ * read from standard input
+ */
+func reencryptUser(us reencryptUserService, a importAuthService,
+    e reencryptEncryptionService, p reencryptPermissionService,
+    username string) error {
+
+    u, err := us.GetByUsername(username)
+    if err != nil {
+        log.Printf("failed to get user <%s>", username)
+        return err
+    }
+    password, err := readUserPassword(a, u)
+    if err != nil {
+        return err
+    }
+
+    // a new recovery code is printed at once, so that it is not lost if a
+    // later step fails
+    recoveryCode, err := p.MigrateLegacyUser(u, password)
+    if err != nil {
+        log.Printf("failed to migrate user-%v", u.ID)
+        return err
+    }
+    printRecoveryCode(u, recoveryCode)
+    err = us.UpgradeCredentials(u, password)
+    if err != nil {
+        log.Printf("failed to upgrade credentials for user-%v", u.ID)
+        return err
+    }
+    recoveryCode, err = p.UpgradeUserKeys(u, password)
+    if err != nil {
+        log.Printf("failed to upgrade keys for user-%v", u.ID)
+        return err
+    }
+    printRecoveryCode(u, recoveryCode)
+
+    // the pages are then upgraded with the keys, as they would be in a session
+    u.SessionKey, err = e.DeriveKey([]byte(password), u.Salt, u.KDF)
+    if err != nil {
+        return err
+    }
+    n, err := p.UpgradeUserPages(u)
+    log.Printf("re-encrypted %v pages for user-%v", n, u.ID)
+    if err != nil {
+        log.Printf("failed to upgrade pages for user-%v", u.ID)
+        return err
+    }
+    return nil
+}
+
+/**
+ * Print a user's new recovery code, if one was issued, to standard output
+ * apart from the log
+ */
+func printRecoveryCode(u *user.User, code string) {
+    if code == "" {
+        return
+    }
+    log.Printf("user-%v has a new recovery code, which must be passed on to "+
+        "them; any code they had before no longer works", u.ID)
+    os.Stdout.WriteString(code + "\n")
+}
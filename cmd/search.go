@@ -0,0 +1,67 @@
+package main
+
+/**
+ * This file implements full-text search:
+ *
+ *     GET /search?q=<query>   the pages holding every word of the query, best
+ *                             first, each with a highlighted snippet
+ */
+
+import (
+    "log"
+    "strings"
+    "net/http"
+
+    "github.com/setonotes/pkg/search"
+)
+
+func (s *server) searchHandler(w http.ResponseWriter, r *http.Request) {
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Println("failed to get user by ID for /search")
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    query := strings.TrimSpace(r.URL.Query().Get("q"))
+    results, err := s.permissionService.Search(u, query)
+    if err != nil {
+        log.Printf("failed to search pages of user-%v: %v", u.ID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    type searchEntry struct {
+        ID      int
+        Title   string
+        Snippet []search.Fragment
+    }
+    entries := []searchEntry{}
+    for _, result := range results {
+        entries = append(entries, searchEntry{
+            ID:      result.ID,
+            Title:   string(result.Title),
+            Snippet: result.Snippet,
+        })
+    }
+
+    data := struct {
+        Query      string
+        Results    []searchEntry
+        Navbar     bool
+        Authorized bool
+    }{
+        query,
+        entries,
+        true,
+        authorized,
+    }
+    s.renderTemplate(w, "search.tmpl", data)
+}
@@ -16,7 +16,9 @@ package main
  */
 
 import (
+    "io"
     "log"
+    "time"
     "regexp"
     "path/filepath"
     "net/http"
@@ -24,6 +26,14 @@ import (
 
     "github.com/setonotes/pkg/user"
     "github.com/setonotes/pkg/page"
+    "github.com/setonotes/pkg/notebook"
+    "github.com/setonotes/pkg/tag"
+    "github.com/setonotes/pkg/attachment"
+    "github.com/setonotes/pkg/search"
+    "github.com/setonotes/pkg/permission"
+    "github.com/setonotes/pkg/collab"
+    "github.com/setonotes/pkg/export"
+    "github.com/setonotes/pkg/render"
 
     "github.com/oxtoacart/bpool"
 )
@@ -31,13 +41,20 @@ import (
 type userService interface {
     GetByID(userID int) (*user.User, error)
     GetByUsername(username string) (*user.User, error)
-    Create(username, email, password string) (*user.User, error)
+    Create(username, email, password string) (*user.User, string, error)
     TrackActivity(userID int, path string) error
     CheckBetaTesterWhitelist(username string) (bool, error)
+    EnsureKeyPair(u *user.User) error
+    ChangePassword(u *user.User, oldPassword, newPassword string) error
+    Recover(username, code, newPassword string) (*user.User, string, error)
+    ResetRecoveryCode(u *user.User, password string) (string, error)
+    UpgradeCredentials(u *user.User, password string) error
+    EnableClientEncryption(u *user.User, password string) error
 }
 
 type authService interface {
     CheckUserAuthStatus(r *http.Request) (int, bool, error)
+    GetSessionKey(r *http.Request) ([]byte, error)
     InitUserSession(w http.ResponseWriter, r *http.Request, u *user.User,
         password []byte) error
     EndUserSession(w http.ResponseWriter, r *http.Request, userID int) error
@@ -45,23 +62,84 @@ type authService interface {
 }
 
 type permissionService interface {
-    GetPageTitles(u *user.User) (map[int][]byte, error)
+    GetPageTitles(u *user.User) ([]*permission.PageTitle, error)
     SavePage(p *page.Page, u *user.User) (int, error)
     LoadAndDecryptPage(pageID int, u *user.User) (*page.Page, error)
+    TrashPage(pageID, userID int) error
+    RestorePage(pageID, userID int) error
     DeletePage(pageID, userID int) error
+    GetTrashedPages(u *user.User) ([]*permission.TrashedPage, error)
+    SharePage(pageID int, owner *user.User, recipientUsername string,
+        canEdit bool) error
+    GetPageShares(pageID int, owner *user.User) ([]*permission.Share, error)
+    RevokeAccess(pageID int, owner *user.User, userID int) (bool, error)
+    MigrateLegacyUser(u *user.User, password string) (string, error)
+    UpgradeUserKeys(u *user.User, password string) (string, error)
+    UpgradeUserPages(u *user.User) (int, error)
+    GetClientPage(pageID int, u *user.User) (*permission.ClientPage, error)
+    GetClientPages(u *user.User) ([]*permission.ClientPage, error)
+    CreateClientPage(u *user.User, userEncryptedPageKey []byte) (int, error)
+    SaveClientPage(p *page.Page, u *user.User) error
+    GetPageHistory(pageID int, u *user.User) ([]*permission.PageRevision,
+        error)
+    LoadAndDecryptRevision(pageID, number int,
+        u *user.User) (*permission.PageRevision, error)
+    RestoreRevision(pageID, number int, u *user.User) (int, error)
+    GetNotebooks(u *user.User) ([]*notebook.Notebook, error)
+    CreateNotebook(u *user.User, parentID int, name []byte) (int, error)
+    RenameNotebook(u *user.User, notebookID int, name []byte) error
+    MoveNotebook(u *user.User, notebookID, parentID int) error
+    DeleteNotebook(u *user.User, notebookID int) error
+    MovePage(u *user.User, pageID, notebookID int) error
+    GetTags(u *user.User) ([]*tag.Tag, error)
+    SetPageTags(u *user.User, pageID int, names []string) error
+    SetPageTimes(u *user.User, pageID int, created, updated time.Time) error
+    RenameTag(u *user.User, tagID int, name string) error
+    MergeTags(u *user.User, fromID, intoID int) error
+    DeleteTag(u *user.User, tagID int) error
+    Search(u *user.User, query string) ([]*search.Result, error)
+    ResolveWikiLinks(u *user.User, titles []string) (map[string]int, error)
+    GetBacklinks(u *user.User, pageID int,
+        title []byte) ([]*permission.PageTitle, error)
+    ExportUserPages(u *user.User) ([]*export.Page, error)
+    LoadExportPage(u *user.User, p *export.Page) error
+    CheckUserCanEditPage(userID, pageID int) (bool, error)
+    AddAttachment(u *user.User, pageID int, name, mimeType string,
+        r io.Reader) (int, error)
+    GetAttachments(u *user.User, pageID int) ([]*attachment.Attachment,
+        error)
+    OpenAttachment(u *user.User, attachmentID int) (*attachment.Attachment,
+        io.ReadCloser, error)
+    DeleteAttachment(u *user.User, attachmentID int) (int, error)
+}
 
+type collabHub interface {
+    Join(pageID int, u *user.User) (*collab.Client, error)
+    Evict(pageID, userID int)
 }
 
 type server struct {
     router           *http.ServeMux
     templates         map[string]*template.Template
     bufpool           *bpool.BufferPool // used for template rendering
+    renderer          *render.Renderer  // used for page bodies
 
     userService       userService
     authService       authService
     permissionService permissionService
+    collabHub         collabHub
+
+    trashRetentionDays int
 
     validPath         *regexp.Regexp
+    apiPagePath       *regexp.Regexp
+    historyPath       *regexp.Regexp
+    collabPath        *regexp.Regexp
+    trashPath         *regexp.Regexp
+    notebooksPath     *regexp.Regexp
+    tagsPath          *regexp.Regexp
+    attachmentsPath   *regexp.Regexp
+    attachmentPath    *regexp.Regexp
 }
 
 /**
@@ -71,12 +149,17 @@ type server struct {
  * hexagonal architecture, we would define a more general router interface, but
  * this is okay for now
 */
-func newServer(u userService, a authService, p permissionService) *server {
+func newServer(u userService, a authService, p permissionService,
+    h collabHub, trashRetentionDays int) *server {
+
     s := &server{
-        router:            http.NewServeMux(),
-        userService:       u,
-        authService:       a,
-        permissionService: p,
+        router:             http.NewServeMux(),
+        renderer:           render.New(render.DefaultOptions),
+        userService:        u,
+        authService:        a,
+        permissionService:  p,
+        collabHub:          h,
+        trashRetentionDays: trashRetentionDays,
     }
 
     log.Println("loading templates...")
@@ -101,13 +184,44 @@ func (s *server) routes() {
     s.router.HandleFunc("/signup/",  s.signupHandler)
     s.router.HandleFunc("/signin/",  s.signinHandler)
     s.router.HandleFunc("/signout/", s.makeHandler(s.signoutHandler))
+    s.router.HandleFunc("/recover/", s.recoverHandler)
+    s.router.HandleFunc("/settings/password", s.passwordHandler)
+    s.router.HandleFunc("/settings/recovery", s.recoveryCodeHandler)
+    s.router.HandleFunc("/settings/encryption", s.clientEncryptionHandler)
     s.router.HandleFunc("/view/",    s.makeHandler(s.viewHandler))
     s.router.HandleFunc("/save/",    s.makeHandler(s.saveHandler))
     s.router.HandleFunc("/edit/",    s.makeHandler(s.editHandler))
     s.router.HandleFunc("/delete/",  s.makeHandler(s.deleteHandler))
+    s.router.HandleFunc("/share/",   s.makeHandler(s.shareHandler))
+    s.router.HandleFunc("/revoke/",  s.makeHandler(s.revokeHandler))
+    s.router.HandleFunc("/move/",    s.makeHandler(s.moveHandler))
+    s.router.HandleFunc("/tag/",     s.makeHandler(s.tagHandler))
+    s.router.HandleFunc("/history/", s.historyHandler)
+    s.router.HandleFunc("/collab/",  s.collabHandler)
+    s.router.HandleFunc("/trash/",   s.trashHandler)
+    s.router.HandleFunc("/notebooks/", s.notebooksHandler)
+    s.router.HandleFunc("/tags/",    s.tagsHandler)
+    s.router.HandleFunc("/search",   s.searchHandler)
+    s.router.HandleFunc("/export/",  s.exportHandler)
+    s.router.HandleFunc("/import/",  s.importHandler)
+    s.router.HandleFunc("/attachments/", s.attachmentsHandler)
+    s.router.HandleFunc("/attachment/", s.attachmentHandler)
+    s.router.HandleFunc("/api/keys", s.apiKeysHandler)
+    s.router.HandleFunc("/api/pages", s.apiPagesHandler)
+    s.router.HandleFunc("/api/page/", s.apiPageHandler)
+    s.router.Handle("/static/",
+        http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
     s.validPath = regexp.MustCompile(
-        "^/(new|view|save|edit|delete|signout)/([0-9]*)$")
+        "^/(new|view|save|edit|delete|share|revoke|move|tag|signout)/([0-9]*)$")
+    s.apiPagePath = regexp.MustCompile("^/api/page/([0-9]+)$")
+    s.historyPath = regexp.MustCompile("^/history/([0-9]+)(?:/([0-9]+))?$")
+    s.collabPath = regexp.MustCompile("^/collab/([0-9]+)(/ws)?$")
+    s.trashPath = regexp.MustCompile("^/trash/([0-9]+)?$")
+    s.notebooksPath = regexp.MustCompile("^/notebooks/([0-9]+)?$")
+    s.tagsPath = regexp.MustCompile("^/tags/([0-9]+)?$")
+    s.attachmentsPath = regexp.MustCompile("^/attachments/([0-9]+)$")
+    s.attachmentPath = regexp.MustCompile("^/attachment/([0-9]+)$")
 }
 
 /**
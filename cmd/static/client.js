@@ -0,0 +1,510 @@
+/**
+ * Browser encryption for setonotes --
+ * This mirrors the key hierarchy and ciphertext envelope of the `encryption`
+ * package (see `pkg/encryption/envelope.go` and `pkg/encryption/page.go`):
+ *
+ *     password --PBKDF2--> password-generated key
+ *         unwraps the main-key
+ *             unwraps each page key
+ *                 encrypts the page title and body, bound to the page ID,
+ *                 field name and page version as additional data
+ *
+ * The server only ever sees wrapped keys and ciphertext for pages written here.
+ * WebCrypto offers neither Argon2id nor XChaCha20-Poly1305, so only PBKDF2 and
+ * AES-GCM are implemented; the server makes sure browser-encryption users only
+ * need those.
+ *
+ * The unwrapped main-key is kept in sessionStorage, so the password is only
+ * asked for once per tab. It is removed on sign-out, and ignored if another
+ * user signs in in the same tab.
+ */
+(function () {
+    "use strict";
+
+    var MAGIC            = [0x53, 0x4e]; // "SN"
+    var ENVELOPE_VERSION = 1;
+    var HEADER_SIZE      = 8;
+    var NONCE_SIZE       = 12;
+    var PAGE_VERSION_AD  = 3; // first page version bound to additional data
+
+    var ALG_AES128GCM         = 1;
+    var ALG_AES256GCM         = 2;
+    var ALG_XCHACHA20POLY1305 = 3;
+
+    var MAIN_KEY_STORAGE = "setonotes_main_key";
+
+    var encoder = new TextEncoder();
+    var decoder = new TextDecoder();
+
+    /*
+     * Byte helpers
+     */
+    function fromBase64(s) {
+        var bin = atob(s || "");
+        var out = new Uint8Array(bin.length);
+        for (var i = 0; i < bin.length; i++) {
+            out[i] = bin.charCodeAt(i);
+        }
+        return out;
+    }
+
+    function toBase64(bytes) {
+        var bin = "";
+        for (var i = 0; i < bytes.length; i++) {
+            bin += String.fromCharCode(bytes[i]);
+        }
+        return btoa(bin);
+    }
+
+    function concat(a, b) {
+        var out = new Uint8Array(a.length + b.length);
+        out.set(a, 0);
+        out.set(b, a.length);
+        return out;
+    }
+
+    function equal(a, b) {
+        if (a.length !== b.length) {
+            return false;
+        }
+        for (var i = 0; i < a.length; i++) {
+            if (a[i] !== b[i]) {
+                return false;
+            }
+        }
+        return true;
+    }
+
+    /*
+     * Envelope format -- see `pkg/encryption/envelope.go`
+     */
+    async function keyID(key) {
+        var digest = await crypto.subtle.digest("SHA-256",
+            concat(encoder.encode("setonotes key id\0"), key));
+        return new Uint8Array(digest).slice(0, 4);
+    }
+
+    function importKey(key) {
+        return crypto.subtle.importKey("raw", key, "AES-GCM", false,
+            ["encrypt", "decrypt"]);
+    }
+
+    async function seal(data, key, additionalData) {
+        var alg = key.length === 16 ? ALG_AES128GCM : ALG_AES256GCM;
+        var header = new Uint8Array(HEADER_SIZE);
+        header.set(MAGIC, 0);
+        header[2] = ENVELOPE_VERSION;
+        header[3] = alg;
+        header.set(await keyID(key), 4);
+
+        var nonce = crypto.getRandomValues(new Uint8Array(NONCE_SIZE));
+        var ciphertext = await crypto.subtle.encrypt({
+            name:           "AES-GCM",
+            iv:             nonce,
+            additionalData: concat(header, additionalData || new Uint8Array(0))
+        }, await importKey(key), data);
+
+        return concat(concat(header, nonce), new Uint8Array(ciphertext));
+    }
+
+    // data written before envelopes existed is a bare `nonce||ciphertext`
+    async function openHeaderless(data, key) {
+        if (data.length < NONCE_SIZE) {
+            throw new Error("ciphertext too short");
+        }
+        var plaintext = await crypto.subtle.decrypt({
+            name: "AES-GCM",
+            iv:   data.slice(0, NONCE_SIZE)
+        }, await importKey(key), data.slice(NONCE_SIZE));
+        return new Uint8Array(plaintext);
+    }
+
+    // data bound to additional data has only ever been written in an
+    // envelope, so it is never opened as headerless data -- that would let a
+    // ciphertext from elsewhere under the same key stand in for it
+    async function openOrFallBack(data, key, additionalData, err) {
+        if (additionalData) {
+            throw err;
+        }
+        try {
+            return await openHeaderless(data, key);
+        } catch (e) {
+            throw err;
+        }
+    }
+
+    async function open(data, key, additionalData) {
+        var alg = data[3];
+        if (data.length < HEADER_SIZE ||
+            data[0] !== MAGIC[0] || data[1] !== MAGIC[1] ||
+            data[2] !== ENVELOPE_VERSION ||
+            (alg !== ALG_AES128GCM && alg !== ALG_AES256GCM &&
+                alg !== ALG_XCHACHA20POLY1305)) {
+            if (additionalData) {
+                throw new Error("bound data is not in an envelope");
+            }
+            return openHeaderless(data, key);
+        }
+
+        // a headerless blob can start with a valid-looking header by chance
+        if (!equal(data.slice(4, HEADER_SIZE), await keyID(key))) {
+            return openOrFallBack(data, key, additionalData,
+                new Error("data was encrypted with another key"));
+        }
+        if (alg === ALG_XCHACHA20POLY1305) {
+            return openOrFallBack(data, key, additionalData,
+                new Error("XChaCha20-Poly1305 is not supported by browsers"));
+        }
+        if ((alg === ALG_AES128GCM && key.length !== 16) ||
+            (alg === ALG_AES256GCM && key.length !== 32)) {
+            throw new Error("key size does not suit algorithm");
+        }
+
+        var rest = data.slice(HEADER_SIZE);
+        if (rest.length < NONCE_SIZE) {
+            return openOrFallBack(data, key, additionalData,
+                new Error("ciphertext too short"));
+        }
+        var header = data.slice(0, HEADER_SIZE);
+        try {
+            var plaintext = await crypto.subtle.decrypt({
+                name:           "AES-GCM",
+                iv:             rest.slice(0, NONCE_SIZE),
+                additionalData: concat(header,
+                    additionalData || new Uint8Array(0))
+            }, await importKey(key), rest.slice(NONCE_SIZE));
+            return new Uint8Array(plaintext);
+        } catch (e) {
+            return openOrFallBack(data, key, additionalData,
+                new Error("page failed authentication"));
+        }
+    }
+
+    /*
+     * Key hierarchy -- see `pkg/encryption/kdf.go` and `pkg/encryption/user.go`
+     */
+    async function deriveKey(password, salt, kdf) {
+        // empty parameters mean the legacy PBKDF2 derivation
+        if (!kdf || !kdf.alg) {
+            kdf = {alg: "pbkdf2-sha256", t: 3e5, len: 16};
+        }
+        if (kdf.alg !== "pbkdf2-sha256") {
+            throw new Error("key derivation <" + kdf.alg +
+                "> is not supported by browsers");
+        }
+        var base = await crypto.subtle.importKey("raw",
+            encoder.encode(password), "PBKDF2", false, ["deriveBits"]);
+        var bits = await crypto.subtle.deriveBits({
+            name:       "PBKDF2",
+            hash:       "SHA-256",
+            salt:       salt,
+            iterations: kdf.t
+        }, base, kdf.len * 8);
+        return new Uint8Array(bits);
+    }
+
+    function pageAD(version, id, field) {
+        if (version < PAGE_VERSION_AD) {
+            return null;
+        }
+        return encoder.encode("setonotes page v" + version + " id " + id +
+            " " + field);
+    }
+
+    async function openPageField(p, key, field) {
+        var data = fromBase64(p[field]);
+        if (data.length === 0) {
+            return "";
+        }
+        return decoder.decode(await open(data, key,
+            pageAD(p.version, p.id, field)));
+    }
+
+    /*
+     * Server API -- see `cmd/api.go`
+     */
+    async function api(path, body) {
+        var options = {credentials: "same-origin"};
+        if (body !== undefined) {
+            options.method = "POST";
+            options.headers = {"Content-Type": "application/json"};
+            options.body = JSON.stringify(body);
+        }
+        var response = await fetch(path, options);
+        var result = await response.json();
+        if (!response.ok) {
+            var err = new Error(result.error || response.statusText);
+            err.fromServer = true;
+            err.status = response.status;
+            throw err;
+        }
+        return result;
+    }
+
+    function setStatus(message) {
+        var status = document.getElementById("client-status");
+        if (status) {
+            status.textContent = message;
+        }
+    }
+
+    /*
+     * Ask for the password and unwrap the main-key
+     */
+    function askForMainKey(keys) {
+        return new Promise(function (resolve) {
+            var container = document.getElementById("client-unlock");
+            var form = document.createElement("form");
+            var label = document.createElement("label");
+            var input = document.createElement("input");
+            var submit = document.createElement("input");
+            var message = document.createElement("p");
+            label.textContent = "password ";
+            input.type = "password";
+            submit.type = "submit";
+            submit.value = "Unlock";
+            label.appendChild(input);
+            form.appendChild(message);
+            form.appendChild(label);
+            form.appendChild(submit);
+            message.textContent = "Enter your password to decrypt your " +
+                "pages in this browser.";
+            container.appendChild(form);
+            input.focus();
+
+            form.addEventListener("submit", async function (event) {
+                event.preventDefault();
+                submit.disabled = true;
+                message.textContent = "Unlocking...";
+                try {
+                    var passwordKey = await deriveKey(input.value,
+                        fromBase64(keys.salt), keys.kdf);
+                    var mainKey = await open(fromBase64(keys.main_key),
+                        passwordKey);
+                    sessionStorage.setItem(MAIN_KEY_STORAGE, JSON.stringify({
+                        user: keys.user_id,
+                        key:  toBase64(mainKey)
+                    }));
+                    container.removeChild(form);
+                    resolve(mainKey);
+                } catch (e) {
+                    message.textContent = "Could not unlock: " + e.message;
+                    submit.disabled = false;
+                }
+            });
+        });
+    }
+
+    /*
+     * Run fn with the main-key and the user's key information -- a stored key
+     * that does not work is thrown away, and the password is asked for instead
+     */
+    async function withMainKey(fn) {
+        var keys = await api("/api/keys");
+        var stored = JSON.parse(sessionStorage.getItem(MAIN_KEY_STORAGE) ||
+            "null");
+        if (stored && stored.user === keys.user_id) {
+            try {
+                return await fn(fromBase64(stored.key), keys);
+            } catch (e) {
+                if (e.fromServer) {
+                    throw e;
+                }
+            }
+        }
+        sessionStorage.removeItem(MAIN_KEY_STORAGE);
+        return fn(await askForMainKey(keys), keys);
+    }
+
+    /*
+     * Line diff of the current text against yours -- see `cmd/diff.go`
+     */
+    function diffLines(current, yours) {
+        var a = current.replace(/\r\n/g, "\n").split("\n");
+        var b = yours.replace(/\r\n/g, "\n").split("\n");
+        var lcs = [], i, j;
+        for (i = a.length; i >= 0; i--) {
+            lcs[i] = [];
+            for (j = b.length; j >= 0; j--) {
+                if (i === a.length || j === b.length) {
+                    lcs[i][j] = 0;
+                } else if (a[i] === b[j]) {
+                    lcs[i][j] = lcs[i + 1][j + 1] + 1;
+                } else {
+                    lcs[i][j] = Math.max(lcs[i + 1][j], lcs[i][j + 1]);
+                }
+            }
+        }
+
+        var diff = [];
+        i = 0;
+        j = 0;
+        while (i < a.length || j < b.length) {
+            if (i < a.length && j < b.length && a[i] === b[j]) {
+                diff.push({op: "=", text: a[i++]});
+                j++;
+            } else if (j === b.length ||
+                (i < a.length && lcs[i + 1][j] >= lcs[i][j + 1])) {
+                diff.push({op: "-", text: a[i++]});
+            } else {
+                diff.push({op: "+", text: b[j++]});
+            }
+        }
+        return diff;
+    }
+
+    function showDiff(diff) {
+        var pre = document.getElementById("client-diff");
+        var classes = {"=": "diff-same", "-": "diff-del", "+": "diff-ins"};
+        pre.textContent = "";
+        diff.forEach(function (line) {
+            var span = document.createElement("span");
+            span.className = classes[line.op];
+            span.textContent = line.op + " " + line.text;
+            pre.appendChild(span);
+            pre.appendChild(document.createTextNode("\n"));
+        });
+        pre.hidden = false;
+    }
+
+    /*
+     * Pages
+     */
+    async function loadPage(id, mainKey) {
+        var p = await api("/api/page/" + id);
+        var key = await open(fromBase64(p.key), mainKey);
+        return {
+            meta:  p,
+            key:   key,
+            title: await openPageField(p, key, "title"),
+            body:  await openPageField(p, key, "body")
+        };
+    }
+
+    async function viewPage(id) {
+        var page = await withMainKey(function (mainKey) {
+            return loadPage(id, mainKey);
+        });
+        document.title = page.title + " – setonotes";
+        document.getElementById("client-title").textContent = page.title;
+        document.getElementById("client-body").textContent = page.body;
+        document.getElementById("client-share").hidden = !page.meta.is_owner;
+    }
+
+    async function editPage(id) {
+        var form = document.getElementById("client-form");
+        var mainKey, version;
+        var page = await withMainKey(async function (key, keys) {
+            mainKey = key;
+            version = keys.page_version;
+            return id !== 0 ? loadPage(id, key) : null;
+        });
+        if (page) {
+            form.elements.title.value = page.title;
+            form.elements.body.value = page.body;
+        }
+
+        form.addEventListener("submit", async function (event) {
+            event.preventDefault();
+            setStatus("Saving...");
+            try {
+                if (!page) {
+                    // the browser makes the page key; the server only ever
+                    // sees it wrapped with the main-key
+                    var key = crypto.getRandomValues(new Uint8Array(32));
+                    var created = await api("/api/page/0", {
+                        key: toBase64(await seal(key, mainKey))
+                    });
+                    id = created.id;
+                    page = {key: key};
+                }
+
+                var title = encoder.encode(form.elements.title.value);
+                var body = encoder.encode(form.elements.body.value);
+                await api("/api/page/" + id, {
+                    version:  version,
+                    revision: page.meta ? page.meta.revision : 0,
+                    title:    toBase64(await seal(title, page.key,
+                        pageAD(version, id, "title"))),
+                    body:     toBase64(await seal(body, page.key,
+                        pageAD(version, id, "body")))
+                });
+                window.location = "/view/" + id;
+            } catch (e) {
+                if (e.status !== 409) {
+                    setStatus("Could not save: " + e.message);
+                    return;
+                }
+
+                // the page changed since it was loaded: show what differs
+                // and save over the current revision next time
+                var yours = form.elements.title.value;
+                page = await loadPage(id, mainKey);
+                var diff = [];
+                if (page.title !== yours) {
+                    diff.push({op: "-", text: page.title},
+                        {op: "+", text: yours}, {op: "=", text: ""});
+                }
+                showDiff(diff.concat(diffLines(page.body,
+                    form.elements.body.value)));
+                setStatus("This page was changed since you started editing " +
+                    "it, so your changes were not saved. Lines marked - are " +
+                    "only in the current page and lines marked + are only " +
+                    "in your text. Merge them; saving again replaces the " +
+                    "current page.");
+            }
+        });
+    }
+
+    async function directory(links) {
+        var pages = await withMainKey(async function (mainKey) {
+            var result = await api("/api/pages");
+            var titles = {};
+            for (var i = 0; i < result.length; i++) {
+                var p = result[i];
+                var key = await open(fromBase64(p.key), mainKey);
+                titles[p.id] = await openPageField(p, key, "title");
+            }
+            return titles;
+        });
+        links.forEach(function (link) {
+            var id = link.getAttribute("data-client-page");
+            if (pages[id] !== undefined) {
+                link.textContent = pages[id];
+            }
+        });
+    }
+
+    /*
+     * Forget the main-key on sign-out
+     */
+    document.querySelectorAll('a[href="/signout/"]').forEach(function (link) {
+        link.addEventListener("click", function () {
+            sessionStorage.removeItem(MAIN_KEY_STORAGE);
+        });
+    });
+
+    var run;
+    var root = document.getElementById("client-page");
+    var links = document.querySelectorAll("[data-client-page]");
+    if (root) {
+        var id = parseInt(root.getAttribute("data-id"), 10) || 0;
+        run = root.getAttribute("data-mode") === "view" ?
+            viewPage(id) : editPage(id);
+    } else if (links.length > 0) {
+        run = directory(links);
+    }
+    if (run) {
+        run.catch(function (e) {
+            setStatus(e.message);
+        });
+    }
+
+    // exported for interoperability checks against the Go implementation
+    window.setonotesClient = {
+        seal:      seal,
+        open:      open,
+        deriveKey: deriveKey,
+        pageAD:    pageAD
+    };
+})();
@@ -0,0 +1,301 @@
+/**
+ * Live editing for setonotes --
+ * This is the browser side of `pkg/collab`. Edits are sent to the server as
+ * batches of operations made at the last revision the browser has seen. Only
+ * one batch is in flight at a time; edits made meanwhile are buffered. Batches
+ * from other users are transformed against the in-flight and buffered edits
+ * before being applied to the textarea, so every browser ends up with the same
+ * text as the server.
+ *
+ * The transformation rules mirror `pkg/collab/ot.go` -- any change here must
+ * be made there too. Positions count UTF-16 code units, like JavaScript
+ * strings.
+ */
+(function () {
+    "use strict";
+
+    /*
+     * Operational transformation -- see `pkg/collab/ot.go`
+     */
+    function isInsert(op) {
+        return !!op.insert;
+    }
+
+    function keep(op) {
+        if (!isInsert(op) && !op.delete) {
+            return [];
+        }
+        return [op];
+    }
+
+    function apply(text, ops) {
+        ops.forEach(function (op) {
+            text = text.slice(0, op.pos) + (op.insert || "") +
+                text.slice(op.pos + (op.delete || 0));
+        });
+        return text;
+    }
+
+    function deletedBefore(del, pos) {
+        return Math.max(0, Math.min(del.pos + del.delete, pos) - del.pos);
+    }
+
+    function insertAgainstDelete(ins, del) {
+        var n = ins.insert.length;
+        if (ins.pos <= del.pos) {
+            return [keep(ins), keep({pos: del.pos + n, delete: del.delete})];
+        }
+        if (ins.pos >= del.pos + del.delete) {
+            return [keep({pos: ins.pos - del.delete, insert: ins.insert}),
+                keep(del)];
+        }
+        return [keep({pos: del.pos, insert: ins.insert}), [
+            {pos: ins.pos + n, delete: del.pos + del.delete - ins.pos},
+            {pos: del.pos, delete: ins.pos - del.pos}
+        ]];
+    }
+
+    function transformOp(a, b) {
+        if (isInsert(a) && isInsert(b)) {
+            if (b.pos <= a.pos) {
+                return [keep({pos: a.pos + b.insert.length,
+                    insert: a.insert}), keep(b)];
+            }
+            return [keep(a), keep({pos: b.pos + a.insert.length,
+                insert: b.insert})];
+        }
+        if (isInsert(a)) {
+            return insertAgainstDelete(a, b);
+        }
+        if (isInsert(b)) {
+            var r = insertAgainstDelete(b, a);
+            return [r[1], r[0]];
+        }
+        var overlap = Math.max(0, Math.min(a.pos + a.delete,
+            b.pos + b.delete) - Math.max(a.pos, b.pos));
+        return [
+            keep({pos: a.pos - deletedBefore(b, a.pos),
+                delete: a.delete - overlap}),
+            keep({pos: b.pos - deletedBefore(a, b.pos),
+                delete: b.delete - overlap})
+        ];
+    }
+
+    /*
+     * Transform concurrent batches a and b, where b comes first in the
+     * server's order -- returns [a', b']
+     */
+    function transform(a, b) {
+        var out = [];
+        a.forEach(function (x) {
+            // x is transformed across all of b, and b across x
+            var xs = [x], next = [];
+            b.forEach(function (y) {
+                var r = transformSmall(xs, [y]);
+                xs = r[0];
+                next = next.concat(r[1]);
+            });
+            out = out.concat(xs);
+            b = next;
+        });
+        return [out, b];
+    }
+
+    function transformSmall(a, b) {
+        var r1, r2;
+        if (a.length === 0 || b.length === 0) {
+            return [a, b];
+        }
+        if (a.length === 1 && b.length === 1) {
+            return transformOp(a[0], b[0]);
+        }
+        if (a.length > 1) {
+            r1 = transformSmall(a.slice(0, 1), b);
+            r2 = transformSmall(a.slice(1), r1[1]);
+            return [r1[0].concat(r2[0]), r2[1]];
+        }
+        r1 = transformSmall(a, b.slice(0, 1));
+        r2 = transformSmall(r1[0], b.slice(1));
+        return [r2[0], r1[1].concat(r2[1])];
+    }
+
+    function isHighSurrogate(c) {
+        return c >= 0xd800 && c < 0xdc00;
+    }
+
+    function isLowSurrogate(c) {
+        return c >= 0xdc00 && c < 0xe000;
+    }
+
+    /*
+     * The operations that turn one text into another
+     */
+    function diff(from, to) {
+        var prefix = 0, suffix = 0, ops = [];
+        while (prefix < from.length && prefix < to.length &&
+            from.charCodeAt(prefix) === to.charCodeAt(prefix)) {
+            prefix++;
+        }
+        if (prefix > 0 && isHighSurrogate(from.charCodeAt(prefix - 1))) {
+            prefix--;
+        }
+        while (suffix < from.length - prefix && suffix < to.length - prefix &&
+            from.charCodeAt(from.length - 1 - suffix) ===
+                to.charCodeAt(to.length - 1 - suffix)) {
+            suffix++;
+        }
+        if (suffix > 0 &&
+            isLowSurrogate(from.charCodeAt(from.length - suffix))) {
+            suffix--;
+        }
+
+        if (from.length - prefix - suffix > 0) {
+            ops.push({pos: prefix, delete: from.length - prefix - suffix});
+        }
+        if (to.length - prefix - suffix > 0) {
+            ops.push({pos: prefix,
+                insert: to.slice(prefix, to.length - suffix)});
+        }
+        return ops;
+    }
+
+    /*
+     * Move a cursor position over another user's operations
+     */
+    function moveCursor(pos, ops) {
+        ops.forEach(function (op) {
+            if (isInsert(op)) {
+                if (op.pos < pos) {
+                    pos += op.insert.length;
+                }
+            } else if (op.pos < pos) {
+                pos -= Math.min(op.delete, pos - op.pos);
+            }
+        });
+        return pos;
+    }
+
+    /*
+     * Editor
+     */
+    var root = document.getElementById("collab-page");
+    if (!root) {
+        return;
+    }
+    var id = root.getAttribute("data-id");
+    var textarea = document.getElementById("collab-body");
+    var status = document.getElementById("collab-status");
+
+    var rev = 0;          // the last revision seen
+    var text = "";        // the text at rev, plus in-flight and buffered edits
+    var outstanding = null; // the batch sent but not yet acknowledged
+    var buffer = null;      // edits made while a batch is in flight
+
+    var scheme = window.location.protocol === "https:" ? "wss:" : "ws:";
+    var socket = new WebSocket(scheme + "//" + window.location.host +
+        "/collab/" + id + "/ws");
+
+    function send(ops) {
+        outstanding = ops;
+        socket.send(JSON.stringify({rev: rev, ops: ops}));
+    }
+
+    textarea.addEventListener("input", function () {
+        var ops = diff(text, textarea.value);
+        text = textarea.value;
+        if (ops.length === 0) {
+            return;
+        }
+        if (outstanding === null) {
+            send(ops);
+        } else {
+            buffer = (buffer || []).concat(ops);
+        }
+        status.textContent = "Saving...";
+    });
+
+    function receive(ops) {
+        var r;
+        if (outstanding !== null) {
+            r = transform(outstanding, ops);
+            outstanding = r[0];
+            ops = r[1];
+        }
+        if (buffer !== null) {
+            r = transform(buffer, ops);
+            buffer = r[0];
+            ops = r[1];
+        }
+
+        var start = moveCursor(textarea.selectionStart, ops);
+        var end = moveCursor(textarea.selectionEnd, ops);
+        text = apply(text, ops);
+        textarea.value = text;
+        if (document.activeElement === textarea) {
+            textarea.setSelectionRange(start, end);
+        }
+    }
+
+    function showPresence(users) {
+        var names = (users || []).map(function (u) {
+            return u.can_edit ? u.username : u.username + " (reading)";
+        });
+        document.getElementById("collab-presence").textContent =
+            names.join(", ");
+    }
+
+    socket.addEventListener("message", function (event) {
+        var m = JSON.parse(event.data);
+        switch (m.type) {
+        case "init":
+            rev = m.rev;
+            text = m.text || "";
+            textarea.value = text;
+            textarea.disabled = !m.can_edit;
+            document.getElementById("collab-title").textContent = m.title;
+            document.title = m.title + " – setonotes";
+            status.textContent = m.can_edit ? "" :
+                "You can only read this page.";
+            break;
+        case "ack":
+            rev = m.rev;
+            outstanding = null;
+            if (buffer !== null) {
+                var ops = buffer;
+                buffer = null;
+                send(ops);
+            } else {
+                status.textContent = "All changes sent.";
+            }
+            break;
+        case "ops":
+            rev = m.rev;
+            receive(m.ops || []);
+            break;
+        case "presence":
+            showPresence(m.users);
+            break;
+        case "saved":
+            if (!textarea.disabled && outstanding === null &&
+                buffer === null) {
+                status.textContent = "All changes saved.";
+            }
+            break;
+        case "unsaved":
+            status.textContent = "Could not save (" + m.error + "). " +
+                "Trying again; keep this page open until your changes are " +
+                "saved.";
+            break;
+        case "error":
+            textarea.disabled = true;
+            status.textContent = "Out of sync (" + m.error + "). Reload " +
+                "the page to keep editing.";
+            break;
+        }
+    });
+
+    socket.addEventListener("close", function () {
+        textarea.disabled = true;
+        status.textContent = "Disconnected. Reload the page to keep editing.";
+    });
+})();
@@ -0,0 +1,217 @@
+package main
+
+/**
+ * This file implements tags:
+ *
+ *     GET  /tags/           list the user's tags
+ *     POST /tags/<id>       rename ("action=rename", "name"), merge into
+ *                           another tag ("action=merge", "into") or delete
+ *                           ("action=delete") a tag
+ *     GET  /tag/<page-id>   edit the tags on a page
+ *     POST /tag/<page-id>   set the tags on a page ("tags", such as
+ *                           "#meeting #runbook")
+ *
+ * The directory is filtered on a tag with `/?tag=<id>`.
+ */
+
+import (
+    "log"
+    "strings"
+    "strconv"
+    "net/http"
+    "database/sql"
+
+    "github.com/setonotes/pkg/tag"
+    "github.com/setonotes/pkg/permission"
+)
+
+/**
+ * Report an error from a tag action -- returns false if there was none
+ */
+func (s *server) tagError(w http.ResponseWriter, r *http.Request,
+    err error) bool {
+
+    switch err {
+    case nil:
+        return false
+    case permission.ErrPermissionConflict, sql.ErrNoRows:
+        http.NotFound(w, r)
+    case tag.ErrInvalidName, tag.ErrTagExists:
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    default:
+        log.Printf("tag action failed: %v", err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+    return true
+}
+
+func (s *server) tagsHandler(w http.ResponseWriter, r *http.Request) {
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    m := s.tagsPath.FindStringSubmatch(r.URL.Path)
+    if m == nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Println("failed to get user by ID for /tags/")
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if m[1] != "" {
+        if r.Method != "POST" {
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        tagID, _ := strconv.Atoi(m[1])
+
+        switch r.FormValue("action") {
+        case "rename":
+            err = s.permissionService.RenameTag(u, tagID, r.FormValue("name"))
+        case "merge":
+            intoID, _ := strconv.Atoi(r.FormValue("into"))
+            err = s.permissionService.MergeTags(u, tagID, intoID)
+        case "delete":
+            err = s.permissionService.DeleteTag(u, tagID)
+        default:
+            http.Error(w, "unknown action", http.StatusBadRequest)
+            return
+        }
+        if s.tagError(w, r, err) {
+            return
+        }
+
+        http.Redirect(w, r, "/tags/", http.StatusFound)
+        return
+    }
+
+    tags, err := s.permissionService.GetTags(u)
+    if err != nil {
+        log.Printf("failed to get tags of user-%v: %v", u.ID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    // count the pages in the directory with each tag
+    titles, err := s.permissionService.GetPageTitles(u)
+    if err != nil {
+        log.Printf("failed to get titles for user-%v: %v", u.ID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    counts := map[int]int{}
+    for _, t := range titles {
+        for _, tagID := range t.TagIDs {
+            counts[tagID]++
+        }
+    }
+
+    type tagEntry struct {
+        ID    int
+        Name  string
+        Pages int
+    }
+    entries := []tagEntry{}
+    for _, t := range tags {
+        entries = append(entries, tagEntry{t.ID, string(t.Name), counts[t.ID]})
+    }
+
+    data := struct {
+        Tags       []tagEntry
+        Navbar     bool
+        Authorized bool
+    }{
+        entries,
+        true,
+        authorized,
+    }
+    s.renderTemplate(w, "tags.tmpl", data)
+}
+
+func (s *server) tagHandler(w http.ResponseWriter, r *http.Request,
+    pageID int, userID int, authorized bool) {
+
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Println("failed to get user by ID for /tag/")
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if r.Method == "POST" {
+        names, err := tag.ParseList(r.FormValue("tags"))
+        if s.tagError(w, r, err) {
+            return
+        }
+        err = s.permissionService.SetPageTags(u, pageID, names)
+        if s.tagError(w, r, err) {
+            return
+        }
+        http.Redirect(w, r, "/view/"+strconv.Itoa(pageID), http.StatusFound)
+        return
+    }
+
+    // the page's title and tags come from the directory listing, which also
+    // covers browser-encrypted pages
+    titles, err := s.permissionService.GetPageTitles(u)
+    if err != nil {
+        log.Printf("failed to get titles for user-%v: %v", u.ID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    var title *permission.PageTitle
+    for _, t := range titles {
+        if t.ID == pageID {
+            title = t
+        }
+    }
+    if title == nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    tags, err := s.permissionService.GetTags(u)
+    if err != nil {
+        log.Printf("failed to get tags of user-%v: %v", u.ID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    names := map[int]string{}
+    for _, t := range tags {
+        names[t.ID] = string(t.Name)
+    }
+    pageTags := []string{}
+    for _, tagID := range title.TagIDs {
+        pageTags = append(pageTags, "#"+names[tagID])
+    }
+
+    data := struct {
+        ID              int
+        Title           string
+        ClientEncrypted bool
+        Tags            string
+        Navbar          bool
+        Authorized      bool
+    }{
+        pageID,
+        string(title.Title),
+        title.ClientEncrypted,
+        strings.Join(pageTags, " "),
+        true,
+        authorized,
+    }
+    s.renderTemplate(w, "tag.tmpl", data)
+}
@@ -0,0 +1,143 @@
+package main
+
+/**
+ * This file implements the trash:
+ *
+ *     GET  /trash/       list the pages in the user's trash
+ *     POST /trash/<id>   restore a page ("action=restore") or delete it for
+ *                        good ("action=delete")
+ *
+ * and the job that deletes pages left in the trash for longer than the
+ * configured retention period.
+ */
+
+import (
+    "log"
+    "time"
+    "strconv"
+    "net/http"
+    "database/sql"
+
+    "github.com/setonotes/pkg/permission"
+)
+
+// the default number of days a page stays in the trash before it is purged
+const defaultTrashRetentionDays = 30
+
+// how often the trash is checked for pages to purge
+const trashPurgeInterval = time.Hour
+
+const trashTimeFormat = "2 Jan 2006"
+
+func (s *server) trashHandler(w http.ResponseWriter, r *http.Request) {
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    m := s.trashPath.FindStringSubmatch(r.URL.Path)
+    if m == nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    if m[1] != "" {
+        if r.Method != "POST" {
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        pageID, _ := strconv.Atoi(m[1])
+
+        var err error
+        switch r.FormValue("action") {
+        case "restore":
+            err = s.permissionService.RestorePage(pageID, userID)
+        case "delete":
+            err = s.permissionService.DeletePage(pageID, userID)
+        default:
+            http.Error(w, "unknown action", http.StatusBadRequest)
+            return
+        }
+        switch err {
+        case nil:
+        case permission.ErrPermissionConflict, permission.ErrPageNotTrashed,
+            sql.ErrNoRows:
+            http.NotFound(w, r)
+            return
+        default:
+            log.Printf("failed to %s page-%v: %v", r.FormValue("action"),
+                pageID, err)
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        http.Redirect(w, r, "/trash/", http.StatusFound)
+        return
+    }
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Println("failed to get user by ID for /trash/")
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    trashed, err := s.permissionService.GetTrashedPages(u)
+    if err != nil {
+        log.Printf("failed to get trash of user-%v: %v", u.ID, err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    type trashEntry struct {
+        ID              int
+        Title           string
+        DeletedAt       string
+        ClientEncrypted bool
+    }
+    entries := []trashEntry{}
+    for _, p := range trashed {
+        entries = append(entries, trashEntry{
+            ID:              p.ID,
+            Title:           string(p.Title),
+            DeletedAt:       p.DeletedAt.Format(trashTimeFormat),
+            ClientEncrypted: p.ClientEncrypted,
+        })
+    }
+
+    data := struct {
+        Pages         []trashEntry
+        RetentionDays int
+        Navbar        bool
+        Authorized    bool
+    }{
+        entries,
+        s.trashRetentionDays,
+        true,
+        authorized,
+    }
+    s.renderTemplate(w, "trash.tmpl", data)
+}
+
+type trashPurger interface {
+    PurgeTrash(retention time.Duration) (int, error)
+}
+
+/**
+ * Delete pages that have been in the trash for longer than retention, checking
+ * every interval -- this never returns, so run it in its own goroutine
+ */
+func runTrashPurge(p trashPurger, retention, interval time.Duration) {
+    for {
+        log.Println("purging trash...")
+        n, err := p.PurgeTrash(retention)
+        if err != nil {
+            log.Printf("failed to purge trash: %v", err)
+        } else {
+            log.Printf("purged %v pages from the trash", n)
+        }
+        time.Sleep(interval)
+    }
+}
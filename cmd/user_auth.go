@@ -13,6 +13,7 @@ import (
     "net/http"
 
     "github.com/setonotes/pkg/page"
+    "github.com/setonotes/pkg/user"
 )
 
 /**
@@ -52,6 +53,36 @@ func (s *server) signinHandler(w http.ResponseWriter, r *http.Request) {
             return // something better should be done here
         }
 
+        // version-1 accounts are upgraded before their session starts, as
+        // the session key depends on the salt created by the upgrade
+        recoveryCode, err := s.permissionService.MigrateLegacyUser(u,
+            password)
+        if err != nil {
+            log.Printf("failed to migrate user-%v: %v", u.ID, err)
+            http.Error(w, "failed to upgrade account; please sign in again",
+                http.StatusInternalServerError)
+            return
+        }
+
+        // older password hashes and key derivations are also upgraded now,
+        // while the password is known
+        err = s.userService.UpgradeCredentials(u, password)
+        if err != nil {
+            // the old credentials still work, so carry on
+            log.Printf("failed to upgrade credentials for user-%v: %v", u.ID,
+                err)
+        }
+
+        // as are keys from before envelopes existed, which may replace the
+        // recovery code
+        code, err := s.permissionService.UpgradeUserKeys(u, password)
+        if err != nil {
+            // the old keys still work, so carry on
+            log.Printf("failed to upgrade keys for user-%v: %v", u.ID, err)
+        } else if code != "" {
+            recoveryCode = code
+        }
+
         // initialize user session
         log.Printf("initializing session for user-%v...", u.ID)
         err = s.authService.InitUserSession(w, r, u, []byte(password))
@@ -62,6 +93,26 @@ func (s *server) signinHandler(w http.ResponseWriter, r *http.Request) {
         }
         log.Printf("successfully initialized session for user-%v", u.ID)
 
+        // older accounts were created without a key-pair
+        err = s.userService.EnsureKeyPair(u)
+        if err != nil {
+            log.Printf("failed to ensure key-pair for user-%v: %v", u.ID, err)
+        }
+
+        // pages under an older algorithm can only be re-encrypted while the
+        // owner's session key is at hand, so it is done in the background now
+        owner := *u
+        go func() {
+            n, err := s.permissionService.UpgradeUserPages(&owner)
+            if err != nil {
+                log.Printf("failed to upgrade pages for user-%v: %v",
+                    owner.ID, err)
+            }
+            if n > 0 {
+                log.Printf("re-encrypted %v pages for user-%v", n, owner.ID)
+            }
+        }()
+
         // track user
         err = s.userService.TrackActivity(u.ID, r.URL.Path)
         if err != nil {
@@ -69,6 +120,13 @@ func (s *server) signinHandler(w http.ResponseWriter, r *http.Request) {
         }
 
         log.Printf("signed user-%v in successfully\n", u.ID)
+
+        // migrated and re-keyed accounts get a recovery code, which is only
+        // shown once
+        if recoveryCode != "" {
+            s.renderRecoveryCode(w, recoveryCode)
+            return
+        }
         http.Redirect(w, r, "/", http.StatusFound)
 
     default:
@@ -113,9 +171,10 @@ func (s *server) signupHandler(w http.ResponseWriter, r *http.Request) {
         }
         // END
 
-        u, err := s.userService.Create(username, email, password)
+        u, recoveryCode, err := s.userService.Create(username, email,
+            password)
         if err != nil {
-            log.Println("failed to create new user: %v", err)
+            log.Printf("failed to create new user: %v", err)
             return
         }
 
@@ -135,14 +194,130 @@ func (s *server) signupHandler(w http.ResponseWriter, r *http.Request) {
             log.Printf("failed to track user activity: %v", err)
         }
         // create reference pages that demonstrates Markdown
-        err = s.createReferencePage(u.ID)
+        err = s.createReferencePage(u)
         if err != nil {
             log.Printf("failed to create reference page: %v", err)
             return
         }
 
-        http.Redirect(w, r, "/", http.StatusFound)
+        // the recovery code is only ever shown here
+        s.renderRecoveryCode(w, recoveryCode)
+    }
+}
+
+/**
+ * Render a newly-issued recovery code -- this is the only time the user will
+ * ever see it
+ */
+func (s *server) renderRecoveryCode(w http.ResponseWriter, code string) {
+    w.Header().Set("Cache-Control", "no-store")
+    data := struct {
+        Code       string
+        Navbar     bool
+        Authorized bool
+    }{
+        code,
+        true,
+        true,
+    }
+    s.renderTemplate(w, "recoverycode.tmpl", data)
+}
+
+/**
+ * Handle account recovery --
+ * The user gives their username, their recovery code and a new password. On
+ * success, a new session is started and the new recovery code is shown.
+ */
+func (s *server) recoverHandler(w http.ResponseWriter, r *http.Request) {
+    log.Println("handling account recovery...")
+
+    data := struct {
+        Message    string
+        Navbar     bool
+        Authorized bool
+    }{
+        Navbar:     true,
+        Authorized: false,
+    }
+
+    switch r.Method {
+    case "GET":
+        s.renderTemplate(w, "recover.tmpl", data)
+    case "POST":
+        username    := r.FormValue("username")
+        code        := r.FormValue("recovery_code")
+        newPassword := r.FormValue("new_password")
+        confirm     := r.FormValue("confirm_password")
+
+        if newPassword == "" || newPassword != confirm {
+            data.Message = "The new passwords are empty or do not match."
+            s.renderTemplate(w, "recover.tmpl", data)
+            return
+        }
+
+        u, recoveryCode, err := s.userService.Recover(username, code,
+            newPassword)
+        if err != nil {
+            log.Printf("failed to recover user <%s>: %v", username, err)
+            data.Message = "Wrong username or recovery code."
+            s.renderTemplate(w, "recover.tmpl", data)
+            return
+        }
+
+        // initialize user session
+        err = s.authService.InitUserSession(w, r, u, []byte(newPassword))
+        if err != nil {
+            log.Printf("failed to initialize session for user-%v", u.ID)
+            http.Redirect(w, r, "/signin/", http.StatusFound)
+            return
+        }
+
+        s.renderRecoveryCode(w, recoveryCode)
+    default:
+        http.Redirect(w, r, "/", http.StatusNotFound)
+    }
+}
+
+/**
+ * Handle replacing the recovery code for signed-in users
+ */
+func (s *server) recoveryCodeHandler(w http.ResponseWriter, r *http.Request) {
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    data := struct {
+        Message    string
+        Navbar     bool
+        Authorized bool
+    }{
+        Navbar:     true, // settings pages always get a navbar
+        Authorized: authorized,
     }
+
+    if r.Method == "POST" {
+        u, err := s.getSessionUser(r, userID)
+        if err != nil {
+            log.Printf("failed to get user-%v for recovery code", userID)
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        code, err := s.userService.ResetRecoveryCode(u,
+            r.FormValue("password"))
+        if err == nil {
+            s.renderRecoveryCode(w, code)
+            return
+        }
+        log.Printf("failed to reset recovery code for user-%v: %v", userID,
+            err)
+        data.Message = "Could not create a new recovery code: " + err.Error()
+    }
+
+    s.renderTemplate(w, "recovery.tmpl", data)
 }
 
 /**
@@ -154,13 +329,147 @@ func (s *server) signoutHandler(w http.ResponseWriter, r *http.Request, _,
     if authorized {
         err := s.authService.EndUserSession(w, r, userID)
         if err != nil {
-            log.Println("failed to end user-%v session", userID)
+            log.Printf("failed to end user-%v session", userID)
         }
     }
 
     http.Redirect(w, r, "/", http.StatusFound)
 }
 
+/**
+ * Handle password changes for signed-in users --
+ * The user service re-wraps the user's keys and ends every session, so a new
+ * session is started here with the new password
+ */
+func (s *server) passwordHandler(w http.ResponseWriter, r *http.Request) {
+    log.Println("handling password change...")
+
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    data := struct {
+        Message    string
+        Navbar     bool
+        Authorized bool
+    }{
+        Navbar:     true, // settings pages always get a navbar
+        Authorized: authorized,
+    }
+
+    if r.Method == "POST" {
+        oldPassword := r.FormValue("old_password")
+        newPassword := r.FormValue("new_password")
+        confirm     := r.FormValue("confirm_password")
+
+        u, err := s.getSessionUser(r, userID)
+        if err != nil {
+            log.Printf("failed to get user-%v for password change", userID)
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        switch {
+        case newPassword == "":
+            data.Message = "The new password cannot be empty."
+        case newPassword != confirm:
+            data.Message = "The new passwords do not match."
+        default:
+            err = s.userService.ChangePassword(u, oldPassword, newPassword)
+            if err == user.ErrWrongPassword {
+                data.Message = "The current password is wrong."
+                break
+            }
+            if err != nil {
+                log.Printf("failed to change password for user-%v: %v",
+                    userID, err)
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+            }
+
+            // every session was ended, so start this one again
+            err = s.authService.InitUserSession(w, r, u, []byte(newPassword))
+            if err != nil {
+                log.Printf("failed to initialize session for user-%v",
+                    userID)
+                http.Redirect(w, r, "/signin/", http.StatusFound)
+                return
+            }
+            data.Message = "Your password has been changed. You have been " +
+                "signed out everywhere else."
+        }
+    }
+
+    s.renderTemplate(w, "password.tmpl", data)
+}
+
+/**
+ * Handle turning on browser encryption for signed-in users -- like a password
+ * change, this re-wraps the user's keys and ends every session, so a new
+ * session is started here
+ */
+func (s *server) clientEncryptionHandler(w http.ResponseWriter,
+    r *http.Request) {
+
+    log.Println("handling browser encryption settings...")
+
+    // check user-authorization status
+    userID, authorized, _ := s.authService.CheckUserAuthStatus(r)
+    if !authorized {
+        http.Redirect(w, r, "/signin/", http.StatusFound)
+        return
+    }
+
+    u, err := s.getSessionUser(r, userID)
+    if err != nil {
+        log.Printf("failed to get user-%v for browser encryption", userID)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    data := struct {
+        Message    string
+        Enabled    bool
+        Navbar     bool
+        Authorized bool
+    }{
+        Navbar:     true, // settings pages always get a navbar
+        Authorized: authorized,
+    }
+
+    if r.Method == "POST" && !u.ClientEncryption {
+        password := r.FormValue("password")
+        err = s.userService.EnableClientEncryption(u, password)
+        switch err {
+        case nil:
+            // every session was ended, so start this one again
+            err = s.authService.InitUserSession(w, r, u, []byte(password))
+            if err != nil {
+                log.Printf("failed to initialize session for user-%v",
+                    userID)
+                http.Redirect(w, r, "/signin/", http.StatusFound)
+                return
+            }
+            data.Message = "Browser encryption is now on. You have been " +
+                "signed out everywhere else."
+        case user.ErrWrongPassword, user.ErrClientEncryption:
+            data.Message = "Could not turn on browser encryption: " +
+                err.Error()
+        default:
+            log.Printf("failed to enable browser encryption for user-%v: %v",
+                userID, err)
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    }
+    data.Enabled = u.ClientEncryption
+
+    s.renderTemplate(w, "encryption.tmpl", data)
+}
+
 /**
  * Create a reference page to demonstrate various features of Markdown
  * The actual data for the page should probably be stored in the database or in
@@ -169,7 +478,7 @@ func (s *server) signoutHandler(w http.ResponseWriter, r *http.Request, _,
  * it would be nice if there was just a single instance of this page that was
  * read-only to all users.
  */
-func (s *server) createReferencePage(userID int) error {
+func (s *server) createReferencePage(u *user.User) error {
     p := &page.Page{
         ID: 0,
         Title: []byte("Reference Page (click me!)"),
@@ -194,9 +503,11 @@ func (s *server) createReferencePage(userID int) error {
 
             "You can link to other web pages: [Google](https://google.com).\n\n" +
 
-            "You can include images.\n\n" +
-            "![I'm just a happy little piece of alt-text.](https://i2.kym" +
-            "-cdn.com/entries/icons/original/000/014/664/smallfctfrog.JPG)\n\n" +
+            "You can attach files and images to a page with `attachments`" +
+            " above. They are encrypted along with the page. Link to one" +
+            " with `[report](attachment:12)`, or show an image in the page" +
+            " with `![alt-text](attachment:12)` -- the list of attachments" +
+            " shows the link to copy for each one.\n\n" +
 
             "* You\n" +
             "* can\n" +
@@ -211,14 +522,7 @@ func (s *server) createReferencePage(userID int) error {
             "Fractions look nice: 1/2\n"),
     }
 
-    // get user
-    u, err := s.userService.GetByID(userID)
-    if err != nil {
-        log.Printf("failed to create reference page: %v", err)
-        return err
-    }
-
-    _, err = s.permissionService.SavePage(p, u)
+    _, err := s.permissionService.SavePage(p, u)
     if err != nil {
         log.Printf("failed to create reference page: %v", err)
         return err
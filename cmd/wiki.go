@@ -0,0 +1,53 @@
+package main
+
+/**
+ * This file renders the wiki-style links between pages: `[[Page Title]]` is
+ * resolved against the titles of the pages the user can read before the body
+ * is rendered as Markdown, and each page lists the pages that link to it. Both
+ * are looked up in the user's search index (see `pkg/permission/search.go`),
+ * so that a view only decrypts the pages it shows.
+ */
+
+import (
+    "html/template"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+    "github.com/setonotes/pkg/wiki"
+)
+
+type backlinkEntry struct {
+    ID    int
+    Title string
+}
+
+/**
+ * Render a decrypted page body with its wiki links resolved for a user, and
+ * list the pages of theirs that link to it
+ */
+func (s *server) renderWikiPage(u *user.User,
+    p *page.Page) (template.HTML, []backlinkEntry, error) {
+
+    // the oldest page wins a shared title -- browser-encrypted pages are
+    // never indexed, so their titles never match
+    pageIDs, err := s.permissionService.ResolveWikiLinks(u,
+        wiki.Links(p.Body))
+    if err != nil {
+        return "", nil, err
+    }
+    body := wiki.Rewrite(p.Body, func(title string) (int, bool) {
+        pageID, ok := pageIDs[title]
+        return pageID, ok
+    })
+
+    linking, err := s.permissionService.GetBacklinks(u, p.ID, p.Title)
+    if err != nil {
+        return "", nil, err
+    }
+    backlinks := []backlinkEntry{}
+    for _, t := range linking {
+        backlinks = append(backlinks, backlinkEntry{t.ID, string(t.Title)})
+    }
+
+    return s.renderMarkdown(body), backlinks, nil
+}
@@ -3,5 +3,5 @@ if [ -f to_server.zip ]; then
 fi
 
 cp main setonotes_main
-zip to_server.zip -r setonotes_main templates
+zip to_server.zip -r setonotes_main templates static
 rm setonotes_main
@@ -0,0 +1,5 @@
+-- second wrapping of each user's main-key and private key under a recovery code
+ALTER TABLE users
+    ADD COLUMN recovery_salt                  BYTEA,
+    ADD COLUMN main_key_recovery_encrypted    BYTEA,
+    ADD COLUMN private_key_recovery_encrypted BYTEA;
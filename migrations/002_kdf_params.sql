@@ -0,0 +1,4 @@
+-- per-user password KDF parameters (JSON); NULL means the original PBKDF2
+-- derivation
+ALTER TABLE users
+    ADD COLUMN kdf_params JSONB;
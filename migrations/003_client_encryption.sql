@@ -0,0 +1,7 @@
+-- accounts that encrypt and decrypt their pages in the browser, and the pages
+-- written that way (the server never decrypts these)
+ALTER TABLE users
+    ADD COLUMN client_encryption BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE pages
+    ADD COLUMN client_encrypted BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,19 @@
+-- every save of a page, encrypted exactly as the page was at the time (so each
+-- revision decrypts with the page key, like the page itself)
+CREATE TABLE page_revisions (
+    page_id    INTEGER     NOT NULL REFERENCES pages (id) ON DELETE CASCADE,
+    revision   INTEGER     NOT NULL,
+    author_id  INTEGER     NOT NULL REFERENCES users (id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    title      BYTEA       NOT NULL,
+    body       BYTEA       NOT NULL,
+    version    INTEGER     NOT NULL,
+    PRIMARY KEY (page_id, revision)
+);
+
+-- the current state of every page is its first revision (version-1 pages get
+-- theirs when their owner is migrated)
+INSERT INTO page_revisions (page_id, revision, author_id, title, body, version)
+    SELECT id, 1, author_id, title, body, version
+    FROM pages
+    WHERE version >= 2;
@@ -0,0 +1,9 @@
+-- the number of the latest revision of each page; a save must name the
+-- revision it was edited from, so a stale save cannot overwrite a newer one
+ALTER TABLE pages
+    ADD COLUMN revision INTEGER NOT NULL DEFAULT 0;
+
+UPDATE pages
+    SET revision = COALESCE(
+        (SELECT MAX(revision) FROM page_revisions WHERE page_id = pages.id),
+        0);
@@ -0,0 +1,6 @@
+-- when a page was moved to the trash; NULL for pages that are not in the trash
+ALTER TABLE pages
+    ADD COLUMN deleted_at TIMESTAMPTZ;
+
+CREATE INDEX pages_deleted_at ON pages (deleted_at)
+    WHERE deleted_at IS NOT NULL;
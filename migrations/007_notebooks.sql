@@ -0,0 +1,16 @@
+-- notebooks organise a user's directory; the name is encrypted with the
+-- owner's main-key, and parent_id is NULL for top-level notebooks
+CREATE TABLE notebooks (
+    id        SERIAL  PRIMARY KEY,
+    user_id   INTEGER NOT NULL REFERENCES users (id),
+    parent_id INTEGER REFERENCES notebooks (id),
+    name      BYTEA   NOT NULL
+);
+
+CREATE INDEX notebooks_user_id ON notebooks (user_id);
+
+-- the notebook a user keeps a page in is part of their permission, so a shared
+-- page sits in a different notebook for each user; NULL is the top level
+ALTER TABLE page_permissions
+    ADD COLUMN notebook_id INTEGER REFERENCES notebooks (id)
+        ON DELETE SET NULL;
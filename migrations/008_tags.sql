@@ -0,0 +1,18 @@
+-- tags belong to a single user; the name is encrypted with the owner's
+-- main-key, so tags are matched by name in the application, not here
+CREATE TABLE tags (
+    id      SERIAL  PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id),
+    name    BYTEA   NOT NULL
+);
+
+CREATE INDEX tags_user_id ON tags (user_id);
+
+-- the pages each tag is on (for the tag's owner only)
+CREATE TABLE page_tags (
+    tag_id  INTEGER NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+    page_id INTEGER NOT NULL REFERENCES pages (id) ON DELETE CASCADE,
+    PRIMARY KEY (tag_id, page_id)
+);
+
+CREATE INDEX page_tags_page_id ON page_tags (page_id);
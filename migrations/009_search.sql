@@ -0,0 +1,20 @@
+-- the revision of each page a user's search index was built from, so that
+-- pages changed since can be indexed again
+CREATE TABLE search_pages (
+    user_id  INTEGER NOT NULL REFERENCES users (id),
+    page_id  INTEGER NOT NULL REFERENCES pages (id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    PRIMARY KEY (user_id, page_id)
+);
+
+-- the blind index: for each of a user's pages, a keyed token for every word
+-- in it and how much the word counts towards the page's score
+CREATE TABLE search_tokens (
+    user_id INTEGER NOT NULL,
+    page_id INTEGER NOT NULL,
+    token   BYTEA   NOT NULL,
+    weight  INTEGER NOT NULL,
+    PRIMARY KEY (user_id, token, page_id),
+    FOREIGN KEY (user_id, page_id) REFERENCES search_pages (user_id, page_id)
+        ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+-- the search index now holds the wiki links in each page as well, so every
+-- page is indexed again the next time its readers search or view backlinks
+DELETE FROM search_pages;
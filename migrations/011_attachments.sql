@@ -0,0 +1,21 @@
+-- files attached to pages; the name and type are encrypted with the page key,
+-- and the contents, also encrypted with the page key, are kept in a blob store
+-- under blob_key (the blobs of a deleted page are deleted by the application)
+CREATE TABLE attachments (
+    id          SERIAL      PRIMARY KEY,
+    page_id     INTEGER     NOT NULL REFERENCES pages (id) ON DELETE CASCADE,
+    uploader_id INTEGER     NOT NULL REFERENCES users (id),
+    name        BYTEA       NOT NULL,
+    mime_type   BYTEA       NOT NULL,
+    size        BIGINT      NOT NULL,
+    blob_key    TEXT        NOT NULL UNIQUE,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX attachments_page_id ON attachments (page_id);
+
+-- the blobs of the "postgres" blob store, each a large object
+CREATE TABLE blobs (
+    key    TEXT PRIMARY KEY,
+    object OID  NOT NULL
+);
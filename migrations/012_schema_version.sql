@@ -0,0 +1,7 @@
+-- the version of the schema, which backups are checked against (see
+-- `pkg/backup`); every later migration sets it to its own number
+CREATE TABLE schema_version (
+    version INTEGER NOT NULL
+);
+
+INSERT INTO schema_version (version) VALUES (12);
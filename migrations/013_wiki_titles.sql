@@ -0,0 +1,6 @@
+-- the search index now holds the title of each page as well, so that wiki
+-- links are resolved without decrypting every title, and every page is
+-- indexed again the next time its readers search or view a page
+DELETE FROM search_pages;
+
+UPDATE schema_version SET version = 13;
@@ -0,0 +1,133 @@
+package attachment
+
+/**
+ * Like the page package, this is a light package that defines the attachment
+ * struct and what attachments are stored with. An attachment is a file kept
+ * with a page: its name and type are encrypted with the page key like the
+ * page's title, and its contents are encrypted with the page key as they are
+ * written to a BlobStore, so reading, adding and deleting attachments lives in
+ * the permission package.
+ *
+ * A page body refers to an attachment by ID, with a link such as
+ * `![diagram](attachment:12)`, which is shown as a link to Path(12).
+ */
+
+import (
+    "io"
+    "log"
+    "time"
+    "errors"
+    "strconv"
+    "strings"
+)
+
+type Attachment struct {
+    ID         int
+    PageID     int
+    UploaderID int
+    Name       []byte
+    MIMEType   []byte
+    Size       int64 // of the decrypted contents
+    CreatedAt  time.Time
+
+    // where the encrypted contents are in the blob store
+    BlobKey string
+}
+
+// the largest file that can be attached
+const MaxSize = 25 << 20
+
+// how a page body links to an attachment, before the attachment ID
+const Scheme = "attachment:"
+
+var (
+    ErrTooLarge   = errors.New("attachment is too large")
+    ErrNoName     = errors.New("attachment has no name")
+    ErrBlobExists = errors.New("a blob with that key already exists")
+)
+
+/**
+ * A BlobStore keeps the encrypted contents of attachments, by key. Blobs are
+ * streamed in and out, so a large file is never held in memory at once.
+ */
+type BlobStore interface {
+    // write a blob from r, which is read to its end -- returns the number of
+    // bytes written
+    Put(key string, r io.Reader) (int64, error)
+
+    // read a blob, which must be closed
+    Get(key string) (io.ReadCloser, error)
+
+    // delete a blob -- deleting a blob that is not there is not an error
+    Delete(key string) error
+}
+
+type Repository interface {
+    GetAttachmentByID(id int) (*Attachment, error)
+}
+
+type Service struct {
+    repo Repository
+}
+
+/**
+ * Creates a new Attachment Service
+ */
+func NewService(r Repository) *Service {
+    return &Service{
+        repo: r,
+    }
+}
+
+/**
+ * Returns a pointer to an attachment given the attachment's ID
+ */
+func (s *Service) GetByID(id int) (*Attachment, error) {
+    a, err := s.repo.GetAttachmentByID(id)
+    if err != nil {
+        log.Println("failed to get attachment by ID from repository")
+        return nil, err
+    }
+    return a, nil
+}
+
+/**
+ * The path an attachment is downloaded from
+ */
+func Path(id int) string {
+    return "/attachment/" + strconv.Itoa(id)
+}
+
+/**
+ * Read the attachment ID from a link to one, such as `attachment:12` -- returns
+ * false if the link is not to an attachment
+ */
+func ParseLink(link string) (int, bool) {
+    if !strings.HasPrefix(link, Scheme) {
+        return 0, false
+    }
+    id, err := strconv.Atoi(link[len(Scheme):])
+    if err != nil || id <= 0 {
+        return 0, false
+    }
+    return id, true
+}
+
+/**
+ * The link a page body refers to an attachment with
+ */
+func Link(id int) string {
+    return Scheme + strconv.Itoa(id)
+}
+
+/**
+ * Whether an attachment of a type is shown in the page as an image -- only
+ * raster images are, since an SVG can hold scripts
+ */
+func IsImage(mimeType string) bool {
+    switch mimeType {
+    case "image/png", "image/jpeg", "image/gif", "image/webp":
+        return true
+    }
+    return false
+}
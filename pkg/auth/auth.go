@@ -3,37 +3,80 @@ package auth
 import (
     "log"
     "time"
+    "errors"
+    "strings"
     "strconv"
     "net/http"
-    "crypto/sha256"
+    "encoding/base64"
 
     "github.com/setonotes/pkg/user"
 
     "github.com/satori/go.uuid"
     "golang.org/x/crypto/bcrypt"
-    "golang.org/x/crypto/pbkdf2"
 )
 
 type Cache interface {
-    Set(key, value interface{}) error
     SetEx(key, value interface{}, lifetime int) error
-    GetInt(key interface{}) (int, error)
     GetString(key interface{}) (string, error)
     Delete(key interface{}) error
+    Exists(key interface{}) (bool, error)
+    Expire(key interface{}, lifetime int) error
+    AddToSet(key, member interface{}) error
+    RemoveFromSet(key, member interface{}) error
+    GetSetMembers(key interface{}) ([]string, error)
+}
+
+var (
+    ErrMalformedSession = errors.New("malformed session")
+)
+
+// sessions last a day from sign-in
+const sessionLifetime = 86400
+
+/**
+ * The EncryptionService derives the password-generated key and wraps it for
+ * the session cache -- this is implemented by the encryption service so that
+ * the cryptography only lives in one place
+ */
+type EncryptionService interface {
+    NewSymmetricKey() ([]byte, error)
+    DeriveKey(password, salt []byte, params user.KDFParams) ([]byte, error)
+    EncryptData(data, key []byte) ([]byte, error)
+    DecryptData(data, key []byte) ([]byte, error)
 }
 
 type Service struct {
     sessionCache Cache
+    encryption   EncryptionService
+    bcryptCost   int
 }
 
-func NewService(sessionCache Cache) *Service {
-    return &Service{sessionCache: sessionCache}
+/**
+ * Creates a new auth service -- a bcryptCost of 0 means bcrypt.DefaultCost
+ */
+func NewService(sessionCache Cache, encryption EncryptionService,
+    bcryptCost int) *Service {
+
+    if bcryptCost == 0 {
+        bcryptCost = bcrypt.DefaultCost
+    }
+    return &Service{
+        sessionCache: sessionCache,
+        encryption:   encryption,
+        bcryptCost:   bcryptCost,
+    }
 }
 
 /**
- * Initialize a user session by storing a session token in the session cache,
- * storing a cookie on the user's browser and storing the password-generated key
- * in the cache
+ * Initialize a user session --
+ * Each session gets a random token and a random secret. The password-generated
+ * key is encrypted with the secret and stored in the session cache under the
+ * token along with the user-ID, while the token and secret are stored in a
+ * cookie on the user's browser. The secret is never stored on the server, so
+ * the cache alone cannot be used to decrypt anything.
+ *
+ * The password-generated key is also set on the given user, so that it can be
+ * used for the rest of the request
  */
 func (s *Service) InitUserSession(w http.ResponseWriter, r *http.Request,
     u *user.User, password []byte) error {
@@ -45,144 +88,111 @@ func (s *Service) InitUserSession(w http.ResponseWriter, r *http.Request,
         log.Println("failed to create new UUID session token")
         return err
     }
-    log.Println("successfully created new UUID session token")
-    log.Println("storing session token in cache with expiration 1 day...")
     sessionToken := sessionTokenTmp.String()
-    err = s.sessionCache.SetEx(sessionToken, u.ID, 86400) // 86400s == 1 day
+    log.Println("successfully created new UUID session token")
+
+    // create session secret
+    secret, err := s.encryption.NewSymmetricKey()
     if err != nil {
-        log.Println("failed to store session token in cache")
+        log.Println("failed to create session secret")
         return err
     }
-    log.Println("successfully stored session token in cache")
-
-    // create session cookie on user's browser
-    log.Println("setting cookie on user's brower...")
-    http.SetCookie(w, &http.Cookie{
-        Name:     "session_token",
-        Value:    sessionToken,
-        Expires:  time.Now().Add(86400 * time.Second),
-        Path:     "/",
-        HttpOnly: true,
-    })
 
     // generate password-generated key
     log.Println("generating key from password...")
-    key, err := s.generateKeyFromPassword([]byte(password), u.Salt)
+    key, err := s.encryption.DeriveKey(password, u.Salt, u.KDF)
     if err != nil {
         log.Println("failed to generate key from password")
         return err
     }
-    log.Println("successfully generated key from password; storing in cache...")
+    log.Println("successfully generated key from password")
 
-    // set key in session cache
-    err = s.sessionCache.SetEx("pgkey_"+strconv.Itoa(u.ID), key, 86400)
+    // wrap key with the session secret
+    keyEncrypted, err := s.encryption.EncryptData(key, secret)
     if err != nil {
-        log.Println("failed to store key in cache")
+        log.Println("failed to encrypt key with session secret")
         return err
     }
-    log.Println("successfully stored key in cache")
 
-    // increment user session count
-    log.Println("incrementing user's session count")
-    cacheString := "n_sessions_" + strconv.Itoa(u.ID)
-    numberUserSessions, err := s.sessionCache.GetInt(cacheString)
+    // store session in cache
+    log.Println("storing session in cache with expiration 1 day...")
+    err = s.sessionCache.SetEx(sessionToken,
+        encodeSession(u.ID, keyEncrypted), sessionLifetime)
     if err != nil {
-        log.Println("count not found; starting new count at 1...")
-        err2 := s.sessionCache.Set(cacheString, 1)
-        if err2 != nil {
-            // TODO: what action needs to be taken here?
-            log.Println("failed to start new count")
-        }
-        log.Println("successfully started count")
-    } else {
-        log.Println("count found; incrementing count...")
-        err2 := s.sessionCache.Set(cacheString, numberUserSessions + 1)
-        if err2 != nil {
-            // TODO: what action needs to be taken here?
-            log.Println("failed to increment count")
-        }
-        log.Println("successfully incremented count")
+        log.Println("failed to store session in cache")
+        return err
     }
+    log.Println("successfully stored session in cache")
+
+    // remember the token so every session can be ended at once
+    err = s.sessionCache.AddToSet(sessionsKey(u.ID), sessionToken)
+    if err != nil {
+        log.Println("failed to add session token to user's session set")
+        return err
+    }
+
+    // the set lasts as long as its newest session, and sessions that have
+    // expired since are taken out of it
+    err = s.sessionCache.Expire(sessionsKey(u.ID), sessionLifetime)
+    if err != nil {
+        log.Println("failed to set expiration of user's session set")
+        return err
+    }
+    err = s.pruneUserSessions(u.ID)
+    if err != nil {
+        // the set is only used to end sessions, which skips expired ones
+        log.Printf("failed to prune sessions of user-%v: %v", u.ID, err)
+    }
+
+    // create session cookie on user's browser
+    log.Println("setting cookie on user's brower...")
+    http.SetCookie(w, &http.Cookie{
+        Name:     "session_token",
+        Value:    sessionToken + "." +
+            base64.RawURLEncoding.EncodeToString(secret),
+        Expires:  time.Now().Add(sessionLifetime * time.Second),
+        Path:     "/",
+        HttpOnly: true,
+        Secure:   true,
+        SameSite: http.SameSiteLaxMode,
+    })
+
+    u.SessionKey = key
 
     return nil
 }
 
 /**
- * End the user session by removing their session token from the cache,
- * decrementing their session count (used for knowing when it is okay to remove
- * their password-generated key from the cache), and overwrite the cookie on
- * their browser with an immediately-expiring cookie
+ * End the user session by removing its entry from the cache and overwriting the
+ * cookie on their browser with an immediately-expiring cookie -- the user's
+ * other sessions are not affected
  */
 func (s *Service) EndUserSession(w http.ResponseWriter, r *http.Request,
     userID int) error {
 
     // look for cookie on user's browser
-    c, err := r.Cookie("session_token")
+    sessionToken, _, err := getSessionCookie(r)
     if err != nil {
-        if err == http.ErrNoCookie {
-            http.Redirect(w, r, "/", http.StatusFound)
-            return err
-        }
-        w.WriteHeader(http.StatusBadRequest)
+        return err
     }
-    sessionToken := c.Value
 
     // delete cookie
     http.SetCookie(w, &http.Cookie{
         Name:     "session_token",
-        Value:    sessionToken,
+        Value:    "",
         MaxAge:   -1,
         Path:     "/",
         HttpOnly: true,
     })
 
-    // look for token in Redis cache
-    _, err = s.sessionCache.GetInt(sessionToken)
-    if err != nil {
-        http.Redirect(w, r, "/", http.StatusFound)
-        return err
-    }
-
     // delete user session from cache
+    log.Printf("deleting session for user-%v...", userID)
     err = s.sessionCache.Delete(sessionToken)
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
+        log.Printf("failed to delete session for user-%v", userID)
         return err
     }
-
-    // delete user session from cache
-    err = s.sessionCache.Delete(sessionToken)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        return err
-    }
-
-    // get user session count
-    redisString := "n_sessions_" + strconv.Itoa(userID)
-    numberUserSessions, err := s.sessionCache.GetInt(redisString)
-    if err != nil {
-        log.Printf("failed to get cached session count for user-%v sign-out",
-            userID)
-
-        // delete the password-generated encryption key from the cache
-        s.sessionCache.Delete("pgkey_"+strconv.Itoa(userID))
-        // if err2 != nil {
-            // TODO:
-            // the case where the key is not found probably doesn't need to be
-            // handled; what about other errors? There should be a log here
-            // w.WriteHeader(http.StatusInternalServerError)
-            // return
-        // }
-    } else if numberUserSessions <= 1 {
-        log.Printf("session count for user-%v is now 0", userID)
-        s.sessionCache.Set(redisString, 0)
-
-        log.Printf("deleting password-generated key for user-%v...", userID)
-        s.sessionCache.Delete("pgkey_"+strconv.Itoa(userID))
-    } else {
-        log.Printf("decrementing session count for user-%v...", userID)
-        s.sessionCache.Set(redisString, numberUserSessions - 1)
-    }
+    s.sessionCache.RemoveFromSet(sessionsKey(userID), sessionToken)
 
     return nil
 }
@@ -192,17 +202,16 @@ func (s *Service) EndUserSession(w http.ResponseWriter, r *http.Request,
  */
 func (s *Service) CheckUserAuthStatus(r *http.Request) (int, bool, error) {
     log.Println("looking for session token cookie...")
-    c, err := r.Cookie("session_token")
+    sessionToken, _, err := getSessionCookie(r)
     if err != nil {
         log.Println("failed to find session token cookie")
         return 0, false, err
     }
     log.Println("successfully found session token cookie")
-    sessionToken := c.Value
 
     // look for token in cache
     log.Println("looking for session token in cache...")
-    response, err := s.sessionCache.GetInt(sessionToken)
+    userID, _, err := s.getSession(sessionToken)
     if err != nil {
         log.Println("failed to get session token from cache")
         return 0, false, err
@@ -210,7 +219,89 @@ func (s *Service) CheckUserAuthStatus(r *http.Request) (int, bool, error) {
     log.Println("successfully got session token from cache")
 
     // return true if no issues above
-    return response, true, nil
+    return userID, true, nil
+}
+
+/**
+ * Get the password-generated key of the request's session, which is decrypted
+ * with the secret from the session cookie
+ */
+func (s *Service) GetSessionKey(r *http.Request) ([]byte, error) {
+    sessionToken, secret, err := getSessionCookie(r)
+    if err != nil {
+        return nil, err
+    }
+
+    _, keyEncrypted, err := s.getSession(sessionToken)
+    if err != nil {
+        return nil, err
+    }
+
+    key, err := s.encryption.DecryptData(keyEncrypted, secret)
+    if err != nil {
+        log.Println("failed to decrypt session key")
+        return nil, err
+    }
+
+    return key, nil
+}
+
+/**
+ * Get the session token and secret from the session cookie
+ */
+func getSessionCookie(r *http.Request) (string, []byte, error) {
+    c, err := r.Cookie("session_token")
+    if err != nil {
+        return "", nil, err
+    }
+
+    // cookies from before session secrets existed only hold the token
+    parts := strings.SplitN(c.Value, ".", 2)
+    if len(parts) != 2 {
+        return "", nil, ErrMalformedSession
+    }
+    secret, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return "", nil, ErrMalformedSession
+    }
+
+    return parts[0], secret, nil
+}
+
+/**
+ * Get a session from the cache
+ * Returns the user-ID followed by the encrypted password-generated key
+ */
+func (s *Service) getSession(sessionToken string) (int, []byte, error) {
+    value, err := s.sessionCache.GetString(sessionToken)
+    if err != nil {
+        return 0, nil, err
+    }
+    return decodeSession(value)
+}
+
+/**
+ * Sessions are cached as "<user-ID>.<encrypted key>", with the key in base64
+ */
+func encodeSession(userID int, keyEncrypted []byte) string {
+    return strconv.Itoa(userID) + "." +
+        base64.RawStdEncoding.EncodeToString(keyEncrypted)
+}
+
+func decodeSession(value string) (int, []byte, error) {
+    parts := strings.SplitN(value, ".", 2)
+    if len(parts) != 2 {
+        return 0, nil, ErrMalformedSession
+    }
+    userID, err := strconv.Atoi(parts[0])
+    if err != nil {
+        return 0, nil, ErrMalformedSession
+    }
+    keyEncrypted, err := base64.RawStdEncoding.DecodeString(parts[1])
+    if err != nil {
+        return 0, nil, ErrMalformedSession
+    }
+    return userID, keyEncrypted, nil
 }
 
 /**
@@ -218,7 +309,7 @@ func (s *Service) CheckUserAuthStatus(r *http.Request) (int, bool, error) {
  * see https://medium.com/@jcox250/password-hash-salt-using-golang-b041dc94cb72
  */
 func (s *Service) HashAndSalt(password []byte) ([]byte, error) {
-    hash, err := bcrypt.GenerateFromPassword(password, bcrypt.MinCost)
+    hash, err := bcrypt.GenerateFromPassword(password, s.bcryptCost)
     if err != nil {
         log.Printf("bcrypt hash+password comparison failure: %v", err)
         return nil, err
@@ -226,6 +317,19 @@ func (s *Service) HashAndSalt(password []byte) ([]byte, error) {
     return hash, nil
 }
 
+/**
+ * Check whether a hash was made with a lower cost than the configured one, in
+ * which case it should be replaced the next time the password is known
+ */
+func (s *Service) CheckHashNeedsUpgrade(hash []byte) bool {
+    cost, err := bcrypt.Cost(hash)
+    if err != nil {
+        log.Printf("failed to get bcrypt cost: %v", err)
+        return false
+    }
+    return cost < s.bcryptCost
+}
+
 /**
  * Check the password and hash match
  */
@@ -239,25 +343,88 @@ func (s *Service) CheckPassHash(hash, password []byte) (bool, error) {
 }
 
 /**
- * Get password-generated encryption key from cache for a given user-ID
+ * Cache key for the set of a user's session tokens
+ */
+func sessionsKey(userID int) string {
+    return "sessions_" + strconv.Itoa(userID)
+}
+
+/**
+ * Cache keys sessions were kept under before session secrets existed -- the
+ * first held the password-generated key itself
  */
-func (s *Service) GetPasswordGeneratedKey(userID int) ([]byte, error) {
-    key, err := s.sessionCache.GetString("pgkey_"+strconv.Itoa(userID))
+func legacySessionKeys(userID int) []string {
+    return []string{
+        "pgkey_" + strconv.Itoa(userID),
+        "n_sessions_" + strconv.Itoa(userID),
+    }
+}
+
+/**
+ * Take the tokens of expired sessions out of a user's session set, and delete
+ * any of the user's sessions from before session secrets existed
+ */
+func (s *Service) pruneUserSessions(userID int) error {
+    for _, key := range legacySessionKeys(userID) {
+        err := s.sessionCache.Delete(key)
+        if err != nil {
+            log.Printf("failed to delete legacy session for user-%v", userID)
+            return err
+        }
+    }
+
+    tokens, err := s.sessionCache.GetSetMembers(sessionsKey(userID))
     if err != nil {
-        return nil, err
+        log.Printf("failed to get session set for user-%v", userID)
+        return err
     }
-    return []byte(key), nil
+    for _, token := range tokens {
+        exists, err := s.sessionCache.Exists(token)
+        if err != nil {
+            return err
+        }
+        if !exists {
+            err = s.sessionCache.RemoveFromSet(sessionsKey(userID), token)
+            if err != nil {
+                return err
+            }
+        }
+    }
+    return nil
 }
 
 /**
- * Generates a 128-bit encryption key given a user-specific salt and password
- * using PBKDF2
+ * End every session for a user -- all of the user's sessions are removed from
+ * the cache, so the user has to sign in again everywhere. This is used when the
+ * password-generated key changes.
  */
-func (s *Service) generateKeyFromPassword(password,
-    salt []byte) ([]byte, error) {
+func (s *Service) EndAllUserSessions(userID int) error {
+    log.Printf("ending all sessions for user-%v...", userID)
+    err := s.pruneUserSessions(userID)
+    if err != nil {
+        log.Printf("failed to prune sessions of user-%v", userID)
+        return err
+    }
+    tokens, err := s.sessionCache.GetSetMembers(sessionsKey(userID))
+    if err != nil {
+        log.Printf("failed to get session set for user-%v", userID)
+        return err
+    }
 
-    // use 3e5 iterations, 16 bytes == 128 bits
-    // error is returned because it's not clear why pdkdf2 does not return an
-    // error, and the error might be useful for forward-compatibility
-    return pbkdf2.Key(password, salt, 3e5, 16, sha256.New), nil
+    for _, token := range tokens {
+        err = s.sessionCache.Delete(token)
+        if err != nil {
+            log.Printf("failed to delete session for user-%v", userID)
+            return err
+        }
+    }
+
+    err = s.sessionCache.Delete(sessionsKey(userID))
+    if err != nil {
+        return err
+    }
+    log.Printf("successfully ended %v sessions for user-%v", len(tokens),
+        userID)
+
+    return nil
 }
@@ -0,0 +1,208 @@
+package backup
+
+/**
+ * This file holds the archive format. A backup is a zip:
+ *
+ *     manifest.json        what the archive holds (see Manifest)
+ *     tables/<name>.jsonl  the rows of a table, one JSON array per line, in
+ *                          the order of the table's columns
+ *     blobs/<key>          the contents of a blob, as kept in the blob store
+ *
+ * The manifest is written last, once the SHA-256 checksum of every other file
+ * is known. Values are written as JSON by the type of their column: bytea as
+ * base64, timestamps as RFC 3339, integers and booleans as themselves and
+ * anything else as text.
+ */
+
+import (
+    "io"
+    "hash"
+    "time"
+    "errors"
+    "strings"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+)
+
+// the version of the archive format, written in the manifest
+const FormatVersion = 1
+
+const (
+    manifestName = "manifest.json"
+    manifestKind = "setonotes backup"
+    tablePrefix  = "tables/"
+    tableSuffix  = ".jsonl"
+    blobPrefix   = "blobs/"
+)
+
+var (
+    ErrNotBackup     = errors.New("not a setonotes backup")
+    ErrFormatVersion = errors.New("backup is of another archive format")
+    ErrChecksum      = errors.New("backup failed its checksum")
+    ErrBadRow        = errors.New("backup has a malformed row")
+)
+
+/**
+ * The Manifest of an archive: its format, the schema version of the database
+ * it was made from, and each table and blob with its checksum
+ */
+type Manifest struct {
+    Kind          string
+    FormatVersion int
+    SchemaVersion int
+    Created       time.Time
+    Tables        []*Table
+    Blobs         []*Blob
+}
+
+/**
+ * A Table in an archive -- Columns are in the order of each row's values
+ */
+type Table struct {
+    Name    string
+    Columns []Column
+    Rows    int64
+    SHA256  string
+}
+
+/**
+ * A Column of a table, with its Postgres type name (such as "INT4")
+ */
+type Column struct {
+    Name string
+    Type string
+}
+
+/**
+ * A Blob in an archive
+ */
+type Blob struct {
+    Key    string
+    Size   int64
+    SHA256 string
+}
+
+func tableEntry(name string) string {
+    return tablePrefix + name + tableSuffix
+}
+
+func blobEntry(key string) string {
+    return blobPrefix + key
+}
+
+/**
+ * Hashes and counts what is written through it
+ */
+type hashWriter struct {
+    w   io.Writer
+    n   int64
+    sum hash.Hash
+}
+
+func newHashWriter(w io.Writer) *hashWriter {
+    return &hashWriter{w: w, sum: sha256.New()}
+}
+
+func (hw *hashWriter) Write(p []byte) (int, error) {
+    n, err := hw.w.Write(p)
+    hw.sum.Write(p[:n])
+    hw.n += int64(n)
+    return n, err
+}
+
+func (hw *hashWriter) checksum() string {
+    return hex.EncodeToString(hw.sum.Sum(nil))
+}
+
+/**
+ * Make a value scanned from a column ready to be written as JSON -- the
+ * Postgres driver gives text and other types it does not convert as bytes,
+ * which would otherwise be written as base64
+ */
+func encodeValue(column Column, value interface{}) interface{} {
+    if b, ok := value.([]byte); ok && column.Type != "BYTEA" {
+        return string(b)
+    }
+    return value
+}
+
+/**
+ * Read a value written by encodeValue() back for its column
+ */
+func decodeValue(column Column, raw json.RawMessage) (interface{}, error) {
+    if string(raw) == "null" {
+        return nil, nil
+    }
+
+    var err error
+    switch strings.ToUpper(column.Type) {
+    case "BYTEA":
+        var v []byte
+        err = json.Unmarshal(raw, &v)
+        return v, err
+    case "INT2", "INT4", "INT8":
+        var v int64
+        err = json.Unmarshal(raw, &v)
+        return v, err
+    case "FLOAT4", "FLOAT8":
+        var v float64
+        err = json.Unmarshal(raw, &v)
+        return v, err
+    case "BOOL":
+        var v bool
+        err = json.Unmarshal(raw, &v)
+        return v, err
+    case "TIMESTAMPTZ", "TIMESTAMP", "DATE":
+        var v time.Time
+        err = json.Unmarshal(raw, &v)
+        return v, err
+    }
+    var v string
+    err = json.Unmarshal(raw, &v)
+    return v, err
+}
+
+/**
+ * Reads the rows of a table from an archive
+ */
+type rowReader struct {
+    table   *Table
+    decoder *json.Decoder
+    rows    int64
+}
+
+func (rr *rowReader) Columns() []Column {
+    return rr.table.Columns
+}
+
+/**
+ * Read the next row -- returns io.EOF after the last, and ErrBadRow for a row
+ * that does not suit the table or a table with more or fewer rows than its
+ * manifest entry
+ */
+func (rr *rowReader) ReadRow() ([]interface{}, error) {
+    var raw []json.RawMessage
+    err := rr.decoder.Decode(&raw)
+    if err == io.EOF {
+        if rr.rows != rr.table.Rows {
+            return nil, ErrBadRow
+        }
+        return nil, io.EOF
+    } else if err != nil {
+        return nil, ErrBadRow
+    }
+    if len(raw) != len(rr.table.Columns) || rr.rows == rr.table.Rows {
+        return nil, ErrBadRow
+    }
+
+    values := make([]interface{}, len(raw))
+    for i, column := range rr.table.Columns {
+        values[i], err = decodeValue(column, raw[i])
+        if err != nil {
+            return nil, ErrBadRow
+        }
+    }
+    rr.rows++
+    return values, nil
+}
@@ -0,0 +1,484 @@
+/**
+ * Package backup writes the whole instance to a single archive and restores it
+ * into an empty database, for disaster recovery (see `archive.go` for the
+ * format).
+ *
+ * Everything a user wrote is already encrypted in the database and the blob
+ * store, so a backup is copied as it is: no key material is needed to make or
+ * restore one, and none is added. It does hold every user's password hash and
+ * wrapped keys, though, so it should be kept as privately as the database.
+ */
+package backup
+
+import (
+    "io"
+    "os"
+    "log"
+    "time"
+    "errors"
+    "archive/zip"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "database/sql"
+
+    "github.com/setonotes/pkg/attachment"
+)
+
+// the version of the database schema backups are made from and restored to,
+// which must match the `schema_version` table (see `migrations/`)
+const SchemaVersion = 13
+
+/**
+ * The Tables in a backup, in an order they can be restored in without breaking
+ * a foreign key -- the `blobs` table is left out, since the blobs themselves
+ * are backed up through the blob store
+ */
+var Tables = []string{
+    "users",
+    "beta_testers",
+    "user_activity",
+    "pages",
+    "page_revisions",
+    "notebooks",
+    "page_permissions",
+    "tags",
+    "page_tags",
+    "search_pages",
+    "search_tokens",
+    "attachments",
+}
+
+// the table and column holding the key of each blob to back up
+const (
+    blobTable  = "attachments"
+    blobColumn = "blob_key"
+)
+
+var (
+    ErrSchemaVersion = errors.New("backup is of another schema version")
+    ErrMissingFile   = errors.New("backup is missing a file")
+    ErrUnknownFile   = errors.New("backup has a file not in its manifest")
+    ErrNotEmpty      = errors.New("database is not empty")
+)
+
+/**
+ * A TableWriter is given every row of a table as it is dumped
+ */
+type TableWriter interface {
+    WriteRow(values []interface{}) error
+}
+
+/**
+ * A TableReader gives every row of a table as it is loaded, then io.EOF
+ */
+type TableReader interface {
+    Columns() []Column
+    ReadRow() ([]interface{}, error)
+}
+
+type Repository interface {
+    GetSchemaVersion() (int, error)
+    // dump each table, in one snapshot, to the writer returned for it
+    DumpTables(tables []string, dump func(name string,
+        columns []Column) (TableWriter, error)) error
+    CheckTablesEmpty(tables []string) (bool, error)
+    // load each table, in one transaction, from the reader returned for it
+    LoadTables(tables []string, load func(name string) (TableReader,
+        error)) error
+}
+
+/**
+ * Writes the rows of a table to its file in an archive, noting the keys of any
+ * blobs it refers to
+ */
+type tableWriter struct {
+    table    *Table
+    out      *hashWriter
+    encoder  *json.Encoder
+    blobKey  int
+    blobKeys *[]string
+}
+
+func (tw *tableWriter) WriteRow(values []interface{}) error {
+    if len(values) != len(tw.table.Columns) {
+        return ErrBadRow
+    }
+    row := make([]interface{}, len(values))
+    for i, column := range tw.table.Columns {
+        row[i] = encodeValue(column, values[i])
+    }
+    if tw.blobKey >= 0 {
+        if key, ok := row[tw.blobKey].(string); ok {
+            *tw.blobKeys = append(*tw.blobKeys, key)
+        }
+    }
+
+    tw.table.Rows++
+    return tw.encoder.Encode(row)
+}
+
+/**
+ * Write a backup of every table and blob to w
+ */
+func Write(repo Repository, blobs attachment.BlobStore, w io.Writer) error {
+    version, err := repo.GetSchemaVersion()
+    if err != nil {
+        log.Println("failed to get schema version")
+        return err
+    }
+    if version != SchemaVersion {
+        log.Printf("database is at schema version %v, not %v", version,
+            SchemaVersion)
+        return ErrSchemaVersion
+    }
+
+    archive := zip.NewWriter(w)
+    manifest := &Manifest{
+        Kind:          manifestKind,
+        FormatVersion: FormatVersion,
+        SchemaVersion: SchemaVersion,
+        Created:       time.Now().UTC(),
+        Tables:        []*Table{},
+        Blobs:         []*Blob{},
+    }
+
+    // dump the tables, each through a checksum
+    blobKeys := []string{}
+    outs := []*hashWriter{}
+    err = repo.DumpTables(Tables, func(name string,
+        columns []Column) (TableWriter, error) {
+
+        log.Printf("backing up table <%s>...", name)
+        f, err := archive.Create(tableEntry(name))
+        if err != nil {
+            return nil, err
+        }
+        tw := &tableWriter{
+            table:    &Table{Name: name, Columns: columns},
+            out:      newHashWriter(f),
+            blobKey:  -1,
+            blobKeys: &blobKeys,
+        }
+        tw.encoder = json.NewEncoder(tw.out)
+        if name == blobTable {
+            for i, column := range columns {
+                if column.Name == blobColumn {
+                    tw.blobKey = i
+                }
+            }
+        }
+        manifest.Tables = append(manifest.Tables, tw.table)
+        outs = append(outs, tw.out)
+        return tw, nil
+    })
+    if err != nil {
+        log.Printf("failed to back up tables: %v", err)
+        return err
+    }
+    for i, table := range manifest.Tables {
+        table.SHA256 = outs[i].checksum()
+        log.Printf("backed up %v rows of table <%s>", table.Rows, table.Name)
+    }
+
+    // copy the blobs as they are, since they are already encrypted
+    log.Printf("backing up %v blobs...", len(blobKeys))
+    for _, key := range blobKeys {
+        b, err := writeBlob(archive, blobs, key)
+        if os.IsNotExist(err) || err == sql.ErrNoRows {
+            // deleted along with its attachment since the tables were dumped
+            log.Printf("skipping blob <%s>, which no longer exists", key)
+            continue
+        } else if err != nil {
+            log.Printf("failed to back up blob <%s>: %v", key, err)
+            return err
+        }
+        manifest.Blobs = append(manifest.Blobs, b)
+    }
+
+    // write the manifest last, now every checksum is known
+    f, err := archive.Create(manifestName)
+    if err != nil {
+        return err
+    }
+    encoder := json.NewEncoder(f)
+    encoder.SetIndent("", "  ")
+    err = encoder.Encode(manifest)
+    if err != nil {
+        return err
+    }
+    err = archive.Close()
+    if err != nil {
+        log.Println("failed to finish backup archive")
+        return err
+    }
+
+    log.Printf("successfully backed up %v tables and %v blobs",
+        len(manifest.Tables), len(manifest.Blobs))
+    return nil
+}
+
+/**
+ * Copy a blob from the blob store into an archive
+ */
+func writeBlob(archive *zip.Writer, blobs attachment.BlobStore,
+    key string) (*Blob, error) {
+
+    contents, err := blobs.Get(key)
+    if err != nil {
+        return nil, err
+    }
+    defer contents.Close()
+
+    // blobs are encrypted, so compressing them would gain nothing
+    f, err := archive.CreateHeader(&zip.FileHeader{
+        Name:   blobEntry(key),
+        Method: zip.Store,
+    })
+    if err != nil {
+        return nil, err
+    }
+    out := newHashWriter(f)
+    _, err = io.Copy(out, contents)
+    if err != nil {
+        return nil, err
+    }
+    return &Blob{Key: key, Size: out.n, SHA256: out.checksum()}, nil
+}
+
+/**
+ * Restore a backup of size bytes from r into an empty database and blob store
+ * --
+ * The archive is checked in full before anything is written: it must be of
+ * this format and schema version, hold exactly the files in its manifest and
+ * pass every checksum. The tables are loaded in a single transaction; if that
+ * fails, the blobs already written are deleted again.
+ */
+func Restore(repo Repository, blobs attachment.BlobStore, r io.ReaderAt,
+    size int64) error {
+
+    archive, err := zip.NewReader(r, size)
+    if err != nil {
+        log.Println("failed to open backup archive")
+        return ErrNotBackup
+    }
+    manifest, files, err := readManifest(archive)
+    if err != nil {
+        return err
+    }
+
+    // check the backup suits both this program and the database
+    version, err := repo.GetSchemaVersion()
+    if err != nil {
+        log.Println("failed to get schema version")
+        return err
+    }
+    if manifest.SchemaVersion != SchemaVersion || version != SchemaVersion {
+        log.Printf("backup is at schema version %v and database at %v, "+
+            "but this program restores version %v", manifest.SchemaVersion,
+            version, SchemaVersion)
+        return ErrSchemaVersion
+    }
+
+    log.Println("verifying backup checksums...")
+    err = verifyFiles(manifest, files)
+    if err != nil {
+        return err
+    }
+    log.Println("successfully verified backup checksums")
+
+    empty, err := repo.CheckTablesEmpty(Tables)
+    if err != nil {
+        log.Println("failed to check the database is empty")
+        return err
+    }
+    if !empty {
+        return ErrNotEmpty
+    }
+
+    // write the blobs first, so no attachment is ever without its blob
+    log.Printf("restoring %v blobs...", len(manifest.Blobs))
+    restored := []string{}
+    for _, b := range manifest.Blobs {
+        err = restoreBlob(blobs, b, files[blobEntry(b.Key)])
+        if err != nil {
+            log.Printf("failed to restore blob <%s>: %v", b.Key, err)
+            deleteBlobs(blobs, restored)
+            return err
+        }
+        restored = append(restored, b.Key)
+    }
+
+    // then load every table at once
+    tables := map[string]*Table{}
+    for _, table := range manifest.Tables {
+        tables[table.Name] = table
+    }
+    opened := []io.Closer{}
+    err = repo.LoadTables(Tables, func(name string) (TableReader, error) {
+        log.Printf("restoring table <%s>...", name)
+        f, err := files[tableEntry(name)].Open()
+        if err != nil {
+            return nil, err
+        }
+        opened = append(opened, f)
+        return &rowReader{table: tables[name], decoder: json.NewDecoder(f)},
+            nil
+    })
+    for _, f := range opened {
+        f.Close()
+    }
+    if err != nil {
+        log.Printf("failed to restore tables: %v", err)
+        deleteBlobs(blobs, restored)
+        return err
+    }
+
+    log.Printf("successfully restored %v tables and %v blobs from backup "+
+        "made %v", len(manifest.Tables), len(manifest.Blobs),
+        manifest.Created.Format(time.RFC3339))
+    return nil
+}
+
+/**
+ * Read the manifest of an archive, checking it is of this format and holds
+ * every table -- returns the manifest and the other files by name
+ */
+func readManifest(archive *zip.Reader) (*Manifest, map[string]*zip.File,
+    error) {
+
+    files := map[string]*zip.File{}
+    for _, f := range archive.File {
+        if _, ok := files[f.Name]; ok {
+            log.Printf("backup has <%s> twice", f.Name)
+            return nil, nil, ErrUnknownFile
+        }
+        files[f.Name] = f
+    }
+    f, ok := files[manifestName]
+    if !ok {
+        log.Println("backup has no manifest")
+        return nil, nil, ErrNotBackup
+    }
+    delete(files, manifestName)
+
+    rc, err := f.Open()
+    if err != nil {
+        return nil, nil, err
+    }
+    defer rc.Close()
+    manifest := &Manifest{}
+    err = json.NewDecoder(rc).Decode(manifest)
+    if err != nil || manifest.Kind != manifestKind {
+        log.Println("failed to read backup manifest")
+        return nil, nil, ErrNotBackup
+    }
+    if manifest.FormatVersion != FormatVersion {
+        log.Printf("backup is of archive format %v, not %v",
+            manifest.FormatVersion, FormatVersion)
+        return nil, nil, ErrFormatVersion
+    }
+
+    if len(manifest.Tables) != len(Tables) {
+        log.Printf("backup has %v tables, not %v", len(manifest.Tables),
+            len(Tables))
+        return nil, nil, ErrNotBackup
+    }
+    for i, table := range manifest.Tables {
+        if table == nil || table.Name != Tables[i] {
+            log.Printf("backup lacks table <%s>", Tables[i])
+            return nil, nil, ErrNotBackup
+        }
+    }
+    for _, b := range manifest.Blobs {
+        if b == nil {
+            return nil, nil, ErrNotBackup
+        }
+    }
+
+    return manifest, files, nil
+}
+
+/**
+ * Check an archive holds exactly the files in its manifest, and each matches
+ * its checksum
+ */
+func verifyFiles(manifest *Manifest, files map[string]*zip.File) error {
+    listed := map[string]string{}
+    for _, table := range manifest.Tables {
+        listed[tableEntry(table.Name)] = table.SHA256
+    }
+    for _, b := range manifest.Blobs {
+        listed[blobEntry(b.Key)] = b.SHA256
+    }
+    for name := range files {
+        if _, ok := listed[name]; !ok {
+            log.Printf("backup has <%s>, which is not in its manifest", name)
+            return ErrUnknownFile
+        }
+    }
+
+    for name, checksum := range listed {
+        f, ok := files[name]
+        if !ok {
+            log.Printf("backup is missing <%s>", name)
+            return ErrMissingFile
+        }
+        sum, err := checksumFile(f)
+        if err != nil {
+            log.Printf("failed to read <%s> from backup", name)
+            return err
+        }
+        if sum != checksum {
+            log.Printf("<%s> in backup failed its checksum", name)
+            return ErrChecksum
+        }
+    }
+    return nil
+}
+
+func checksumFile(f *zip.File) (string, error) {
+    rc, err := f.Open()
+    if err != nil {
+        return "", err
+    }
+    defer rc.Close()
+    sum := sha256.New()
+    _, err = io.Copy(sum, rc)
+    if err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+/**
+ * Write a blob from an archive to the blob store
+ */
+func restoreBlob(blobs attachment.BlobStore, b *Blob, f *zip.File) error {
+    rc, err := f.Open()
+    if err != nil {
+        return err
+    }
+    defer rc.Close()
+    n, err := blobs.Put(b.Key, rc)
+    if err != nil {
+        return err
+    }
+    if n != b.Size {
+        blobs.Delete(b.Key)
+        return ErrChecksum
+    }
+    return nil
+}
+
+/**
+ * Delete the blobs written by a failed restore
+ */
+func deleteBlobs(blobs attachment.BlobStore, keys []string) {
+    for _, key := range keys {
+        err := blobs.Delete(key)
+        if err != nil {
+            log.Printf("failed to delete blob <%s>: %v", key, err)
+        }
+    }
+}
@@ -0,0 +1,412 @@
+package backup
+
+import (
+    "io"
+    "os"
+    "time"
+    "bytes"
+    "errors"
+    "reflect"
+    "testing"
+    "io/ioutil"
+    "archive/zip"
+)
+
+var errLoad = errors.New("load failed")
+
+type memTable struct {
+    columns []Column
+    rows    [][]interface{}
+}
+
+/**
+ * An in-memory database holding every backed up table -- loading is all or
+ * nothing, as in the transaction Postgres loads in
+ */
+type memRepository struct {
+    version  int
+    tables   map[string]*memTable
+    failLoad string // the table to fail loading, if any
+}
+
+func newMemRepository() *memRepository {
+    r := &memRepository{version: SchemaVersion, tables: map[string]*memTable{}}
+    for _, name := range Tables {
+        r.tables[name] = &memTable{columns: []Column{{"id", "INT8"}}}
+    }
+    return r
+}
+
+func (r *memRepository) GetSchemaVersion() (int, error) {
+    return r.version, nil
+}
+
+func (r *memRepository) DumpTables(tables []string, dump func(name string,
+    columns []Column) (TableWriter, error)) error {
+
+    for _, name := range tables {
+        t := r.tables[name]
+        tw, err := dump(name, t.columns)
+        if err != nil {
+            return err
+        }
+        for _, row := range t.rows {
+            err = tw.WriteRow(row)
+            if err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+func (r *memRepository) CheckTablesEmpty(tables []string) (bool, error) {
+    for _, name := range tables {
+        if len(r.tables[name].rows) > 0 {
+            return false, nil
+        }
+    }
+    return true, nil
+}
+
+func (r *memRepository) LoadTables(tables []string, load func(name string) (
+    TableReader, error)) error {
+
+    loaded := map[string]*memTable{}
+    for _, name := range tables {
+        if name == r.failLoad {
+            return errLoad
+        }
+        tr, err := load(name)
+        if err != nil {
+            return err
+        }
+        t := &memTable{columns: tr.Columns()}
+        for {
+            row, err := tr.ReadRow()
+            if err == io.EOF {
+                break
+            } else if err != nil {
+                return err
+            }
+            t.rows = append(t.rows, row)
+        }
+        loaded[name] = t
+    }
+    r.tables = loaded
+    return nil
+}
+
+/**
+ * An in-memory blob store
+ */
+type memBlobStore map[string][]byte
+
+func (s memBlobStore) Put(key string, r io.Reader) (int64, error) {
+    contents, err := ioutil.ReadAll(r)
+    if err != nil {
+        return 0, err
+    }
+    s[key] = contents
+    return int64(len(contents)), nil
+}
+
+func (s memBlobStore) Get(key string) (io.ReadCloser, error) {
+    contents, ok := s[key]
+    if !ok {
+        return nil, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+    }
+    return ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
+func (s memBlobStore) Delete(key string) error {
+    delete(s, key)
+    return nil
+}
+
+/**
+ * A database and blob store with a little of everything in them
+ */
+func newTestInstance() (*memRepository, memBlobStore) {
+    r := newMemRepository()
+    created := time.Date(2024, 3, 1, 12, 30, 0, 123456000, time.UTC)
+    r.tables["users"] = &memTable{
+        columns: []Column{
+            {"id", "INT4"},
+            {"username", "TEXT"},
+            {"main_key_encrypted", "BYTEA"},
+            {"created", "TIMESTAMPTZ"},
+            {"is_admin", "BOOL"},
+            {"recovery_salt", "BYTEA"},
+        },
+        rows: [][]interface{}{
+            // text comes from the driver as bytes
+            {int64(1), []byte("alice"), []byte{0, 1, 2, 255}, created, true,
+                nil},
+            {int64(2), []byte("bob ✓"), []byte{}, created, false,
+                []byte("salt")},
+        },
+    }
+    r.tables["attachments"] = &memTable{
+        columns: []Column{
+            {"id", "INT4"},
+            {"blob_key", "TEXT"},
+            {"size", "INT8"},
+        },
+        rows: [][]interface{}{
+            {int64(1), []byte("blob-1"), int64(3)},
+            {int64(2), []byte("blob-2"), int64(0)},
+        },
+    }
+
+    blobs := memBlobStore{
+        "blob-1": []byte{9, 8, 7},
+        "blob-2": []byte{},
+        // not referred to by any attachment, so not backed up
+        "orphan": []byte("x"),
+    }
+    return r, blobs
+}
+
+func writeBackup(t *testing.T, r *memRepository, blobs memBlobStore) []byte {
+    t.Helper()
+    var b bytes.Buffer
+    err := Write(r, blobs, &b)
+    if err != nil {
+        t.Fatalf("failed to write backup: %v", err)
+    }
+    return b.Bytes()
+}
+
+func restoreBackup(r *memRepository, blobs memBlobStore, data []byte) error {
+    return Restore(r, blobs, bytes.NewReader(data), int64(len(data)))
+}
+
+func TestWriteRestoreRoundTrip(t *testing.T) {
+    r, blobs := newTestInstance()
+    data := writeBackup(t, r, blobs)
+
+    restored, restoredBlobs := newMemRepository(), memBlobStore{}
+    err := restoreBackup(restored, restoredBlobs, data)
+    if err != nil {
+        t.Fatalf("failed to restore backup: %v", err)
+    }
+
+    for _, name := range Tables {
+        want, got := r.tables[name], restored.tables[name]
+        if !reflect.DeepEqual(got.columns, want.columns) {
+            t.Errorf("table <%s> restored with columns %v, want %v", name,
+                got.columns, want.columns)
+        }
+        if len(got.rows) != len(want.rows) {
+            t.Errorf("table <%s> restored with %v rows, want %v", name,
+                len(got.rows), len(want.rows))
+            continue
+        }
+        for i := range want.rows {
+            checkRow(t, name, got.columns, got.rows[i], want.rows[i])
+        }
+    }
+
+    want := memBlobStore{"blob-1": blobs["blob-1"], "blob-2": blobs["blob-2"]}
+    if !reflect.DeepEqual(restoredBlobs, want) {
+        t.Errorf("restored blobs %v, want %v", restoredBlobs, want)
+    }
+}
+
+/**
+ * Check a restored row holds what was dumped, as the values the Postgres
+ * driver would be given for its columns
+ */
+func checkRow(t *testing.T, table string, columns []Column, got,
+    want []interface{}) {
+
+    t.Helper()
+    for i, column := range columns {
+        w := want[i]
+        if b, ok := w.([]byte); ok && column.Type != "BYTEA" {
+            w = string(b)
+        }
+        if wt, ok := w.(time.Time); ok {
+            gt, ok := got[i].(time.Time)
+            if !ok || !gt.Equal(wt) {
+                t.Errorf("<%s.%s> restored as %v, want %v", table,
+                    column.Name, got[i], wt)
+            }
+            continue
+        }
+        if !reflect.DeepEqual(got[i], w) {
+            t.Errorf("<%s.%s> restored as %#v, want %#v", table, column.Name,
+                got[i], w)
+        }
+    }
+}
+
+func TestWriteSkipsDeletedBlob(t *testing.T) {
+    r, blobs := newTestInstance()
+    delete(blobs, "blob-2")
+    data := writeBackup(t, r, blobs)
+
+    restoredBlobs := memBlobStore{}
+    err := restoreBackup(newMemRepository(), restoredBlobs, data)
+    if err != nil {
+        t.Fatalf("failed to restore backup: %v", err)
+    }
+    if len(restoredBlobs) != 1 || restoredBlobs["blob-1"] == nil {
+        t.Errorf("restored blobs %v", restoredBlobs)
+    }
+}
+
+func TestSchemaVersionMustMatch(t *testing.T) {
+    r, blobs := newTestInstance()
+    r.version = SchemaVersion - 1
+    err := Write(r, blobs, ioutil.Discard)
+    if err != ErrSchemaVersion {
+        t.Errorf("backing up an old schema gave %v", err)
+    }
+
+    r.version = SchemaVersion
+    data := writeBackup(t, r, blobs)
+    restored := newMemRepository()
+    restored.version = SchemaVersion + 1
+    err = restoreBackup(restored, memBlobStore{}, data)
+    if err != ErrSchemaVersion {
+        t.Errorf("restoring into a newer schema gave %v", err)
+    }
+}
+
+func TestRestoreOnlyIntoEmptyDatabase(t *testing.T) {
+    r, blobs := newTestInstance()
+    data := writeBackup(t, r, blobs)
+
+    restoredBlobs := memBlobStore{}
+    err := restoreBackup(r, restoredBlobs, data)
+    if err != ErrNotEmpty {
+        t.Errorf("restoring into a database in use gave %v", err)
+    }
+    if len(restoredBlobs) != 0 {
+        t.Errorf("blobs were written: %v", restoredBlobs)
+    }
+}
+
+func TestFailedRestoreDeletesBlobs(t *testing.T) {
+    r, blobs := newTestInstance()
+    data := writeBackup(t, r, blobs)
+
+    restored, restoredBlobs := newMemRepository(), memBlobStore{}
+    restored.failLoad = "attachments"
+    err := restoreBackup(restored, restoredBlobs, data)
+    if err != errLoad {
+        t.Errorf("failed load gave %v", err)
+    }
+    if len(restoredBlobs) != 0 {
+        t.Errorf("blobs were left behind: %v", restoredBlobs)
+    }
+    if len(restored.tables["users"].rows) != 0 {
+        t.Error("tables were loaded in part")
+    }
+}
+
+/**
+ * Copy an archive, changing each file's contents through edit -- a file is
+ * left out if edit returns nil
+ */
+func rewriteArchive(t *testing.T, data []byte,
+    edit func(name string, contents []byte) []byte,
+    extra map[string][]byte) []byte {
+
+    t.Helper()
+    archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var b bytes.Buffer
+    out := zip.NewWriter(&b)
+    write := func(name string, contents []byte) {
+        w, err := out.Create(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        w.Write(contents)
+    }
+    for _, f := range archive.File {
+        rc, err := f.Open()
+        if err != nil {
+            t.Fatal(err)
+        }
+        contents, err := ioutil.ReadAll(rc)
+        rc.Close()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if contents = edit(f.Name, contents); contents != nil {
+            write(f.Name, contents)
+        }
+    }
+    for name, contents := range extra {
+        write(name, contents)
+    }
+    err = out.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return b.Bytes()
+}
+
+func TestRestoreRejectsDamagedBackups(t *testing.T) {
+    r, blobs := newTestInstance()
+    data := writeBackup(t, r, blobs)
+    keep := func(name string, contents []byte) []byte {
+        return contents
+    }
+
+    for _, c := range []struct {
+        name string
+        data []byte
+        want error
+    }{
+        {"not a zip", []byte("not a backup"), ErrNotBackup},
+        {"changed table", rewriteArchive(t, data,
+            func(name string, contents []byte) []byte {
+                if name == tableEntry("users") {
+                    return bytes.Replace(contents, []byte("alice"),
+                        []byte("mallory"), 1)
+                }
+                return contents
+            }, nil), ErrChecksum},
+        {"changed blob", rewriteArchive(t, data,
+            func(name string, contents []byte) []byte {
+                if name == blobEntry("blob-1") {
+                    return []byte{1, 2, 3}
+                }
+                return contents
+            }, nil), ErrChecksum},
+        {"missing blob", rewriteArchive(t, data,
+            func(name string, contents []byte) []byte {
+                if name == blobEntry("blob-1") {
+                    return nil
+                }
+                return contents
+            }, nil), ErrMissingFile},
+        {"missing manifest", rewriteArchive(t, data,
+            func(name string, contents []byte) []byte {
+                if name == manifestName {
+                    return nil
+                }
+                return contents
+            }, nil), ErrNotBackup},
+        {"extra file", rewriteArchive(t, data, keep,
+            map[string][]byte{blobEntry("extra"): []byte("x")}),
+            ErrUnknownFile},
+    } {
+        restored, restoredBlobs := newMemRepository(), memBlobStore{}
+        err := restoreBackup(restored, restoredBlobs, c.data)
+        if err != c.want {
+            t.Errorf("%s: restore gave %v, want %v", c.name, err, c.want)
+        }
+        if len(restoredBlobs) != 0 ||
+            len(restored.tables["users"].rows) != 0 {
+            t.Errorf("%s: restore wrote to the instance", c.name)
+        }
+    }
+}
@@ -76,3 +76,49 @@ func (c *Cache) Delete(key interface{}) error {
     _, err := c.conn.Do("DEL", key)
     return err
 }
+
+/**
+ * Check whether a key exists in cache
+ */
+func (c *Cache) Exists(key interface{}) (bool, error) {
+    response, err := redis.Bool(c.conn.Do("EXISTS", key))
+    if err != nil {
+        return false, err
+    }
+    return response, nil
+}
+
+/**
+ * Set the expiration lifetime of an existing key
+ */
+func (c *Cache) Expire(key interface{}, lifetime int) error {
+    _, err := c.conn.Do("EXPIRE", key, strconv.Itoa(lifetime))
+    return err
+}
+
+/**
+ * Add member to the set stored at key
+ */
+func (c *Cache) AddToSet(key, member interface{}) error {
+    _, err := c.conn.Do("SADD", key, member)
+    return err
+}
+
+/**
+ * Remove member from the set stored at key
+ */
+func (c *Cache) RemoveFromSet(key, member interface{}) error {
+    _, err := c.conn.Do("SREM", key, member)
+    return err
+}
+
+/**
+ * Get all members of the set stored at key
+ */
+func (c *Cache) GetSetMembers(key interface{}) ([]string, error) {
+    response, err := redis.Strings(c.conn.Do("SMEMBERS", key))
+    if err != nil {
+        return nil, err
+    }
+    return response, nil
+}
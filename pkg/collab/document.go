@@ -0,0 +1,70 @@
+package collab
+
+/**
+ * This file implements the server's copy of a document being edited. Every
+ * batch of operations the server accepts makes a new revision, and a batch
+ * made at an older revision is transformed against everything accepted since.
+ */
+
+import (
+    "errors"
+)
+
+// the number of revisions a client may fall behind by
+const maxHistory = 1000
+
+var ErrStaleRevision = errors.New("revision is too old or in the future")
+
+type Document struct {
+    text    []uint16
+    rev     int
+    base    int    // the revision history[0] was made at
+    history [][]Op // history[i] takes revision base+i to base+i+1
+}
+
+/**
+ * Creates a new document holding text at revision 0
+ */
+func NewDocument(text string) *Document {
+    return &Document{
+        text:    Encode(text),
+        history: [][]Op{},
+    }
+}
+
+func (d *Document) Text() string {
+    return Decode(d.text)
+}
+
+func (d *Document) Revision() int {
+    return d.rev
+}
+
+/**
+ * Accept a batch of operations made at revision rev -- returns the batch as it
+ * was applied to the current text, which is what every other client needs
+ */
+func (d *Document) Receive(rev int, ops []Op) ([]Op, error) {
+    if rev > d.rev || rev < d.base {
+        return nil, ErrStaleRevision
+    }
+
+    for _, h := range d.history[rev-d.base:] {
+        ops, _ = Transform(ops, h)
+    }
+
+    text, err := Apply(d.text, ops)
+    if err != nil {
+        return nil, err
+    }
+
+    d.text = text
+    d.history = append(d.history, ops)
+    d.rev++
+    if len(d.history) > maxHistory {
+        d.history = d.history[1:]
+        d.base++
+    }
+
+    return ops, nil
+}
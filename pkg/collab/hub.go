@@ -0,0 +1,538 @@
+package collab
+
+/**
+ * This file implements live editing sessions. While anyone is editing a page,
+ * the hub keeps a session holding the decrypted document in memory. Every
+ * accepted batch of operations is relayed to the other clients, and the
+ * document is written back encrypted through the permission service once the
+ * editors pause (and when the last one leaves).
+ *
+ * A client is anything that can send and receive JSON messages, such as a
+ * WebSocket connection.
+ */
+
+import (
+    "log"
+    "sync"
+    "time"
+    "errors"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+)
+
+type PermissionService interface {
+    LoadAndDecryptPage(pageID int, u *user.User) (*page.Page, error)
+    SavePage(p *page.Page, u *user.User) (int, error)
+    CheckUserCanEditPage(userID, pageID int) (bool, error)
+}
+
+type Conn interface {
+    ReadJSON(v interface{}) error
+    WriteJSON(v interface{}) error
+    Close() error
+}
+
+/**
+ * A Message is sent from the server to a client:
+ *     init:     the document when the client joins
+ *     ack:      the client's batch was accepted as revision Rev
+ *     ops:      another user's batch, which makes revision Rev
+ *     presence: the users in the session has changed
+ *     saved:    the document was saved at revision Rev
+ *     unsaved:  the document could not be saved; it is kept and saved again
+ *               later
+ *     error:    the client's batch was refused, or the user's access to the
+ *               page changed; it must reload
+ */
+type Message struct {
+    Type    string     `json:"type"`
+    Rev     int        `json:"rev"`
+    Title   string     `json:"title,omitempty"`
+    Text    string     `json:"text,omitempty"`
+    CanEdit bool       `json:"can_edit,omitempty"`
+    Ops     []Op       `json:"ops,omitempty"`
+    User    string     `json:"user,omitempty"`
+    Users   []Presence `json:"users,omitempty"`
+    Error   string     `json:"error,omitempty"`
+}
+
+/**
+ * An Edit is sent from a client to the server: a batch of operations made at
+ * revision Rev
+ */
+type Edit struct {
+    Rev int  `json:"rev"`
+    Ops []Op `json:"ops"`
+}
+
+type Presence struct {
+    Username string `json:"username"`
+    CanEdit  bool   `json:"can_edit"`
+}
+
+var (
+    ErrReadOnly      = errors.New("you cannot edit this page")
+    ErrAccessChanged = errors.New("your access to this page has changed")
+)
+
+// messages queued for a client that stops reading before it is dropped
+const sendQueueSize = 256
+
+// the number of times a conflicting save is merged and retried
+const maxSaveAttempts = 3
+
+// a failed save is tried again after a delay that doubles up to this many
+// times the save delay, and given up once nobody is left to lose their edits
+// and it has failed this many times
+const (
+    maxRetryBackoff = 32
+    maxSaveRetries  = 5
+)
+
+type Hub struct {
+    permission PermissionService
+    saveDelay  time.Duration
+
+    mu       sync.Mutex
+    sessions map[int]*session
+}
+
+type session struct {
+    hub    *Hub
+    pageID int
+
+    mu         sync.Mutex
+    doc        *Document
+    title      []byte
+    clients    map[*Client]bool
+    lastEditor *user.User
+    timer      *time.Timer
+    dirty      bool
+    failures   int // saves failed in a row
+
+    // the page as it was last loaded or saved: its revision in storage, its
+    // text and the document revision that text was at
+    pageRevision int
+    savedText    []uint16
+    savedRev     int
+
+    saveMu sync.Mutex // held for the whole of a save
+}
+
+type Client struct {
+    session *session
+    user    *user.User
+    canEdit bool
+    send    chan *Message
+}
+
+/**
+ * Creates a new hub -- sessions are saved once no edit has arrived for
+ * saveDelay
+ */
+func NewHub(p PermissionService, saveDelay time.Duration) *Hub {
+    return &Hub{
+        permission: p,
+        saveDelay:  saveDelay,
+        sessions:   map[int]*session{},
+    }
+}
+
+/**
+ * Join the session of a page, starting one if nobody is editing it -- the user
+ * must be able to read the page, and only users who can edit it may send edits
+ */
+func (h *Hub) Join(pageID int, u *user.User) (*Client, error) {
+    // this also checks the user can read the page
+    p, err := h.permission.LoadAndDecryptPage(pageID, u)
+    if err != nil {
+        log.Printf("user-%v cannot join session for page-%v", u.ID, pageID)
+        return nil, err
+    }
+    canEdit, err := h.permission.CheckUserCanEditPage(u.ID, pageID)
+    if err != nil {
+        return nil, err
+    }
+
+    h.mu.Lock()
+    s, ok := h.sessions[pageID]
+    if !ok {
+        log.Printf("starting session for page-%v", pageID)
+        doc := NewDocument(string(p.Body))
+        s = &session{
+            hub:          h,
+            pageID:       pageID,
+            doc:          doc,
+            title:        p.Title,
+            clients:      map[*Client]bool{},
+            pageRevision: p.Revision,
+            savedText:    doc.text,
+        }
+        h.sessions[pageID] = s
+    }
+
+    c := &Client{
+        session: s,
+        user:    u,
+        canEdit: canEdit,
+        send:    make(chan *Message, sendQueueSize),
+    }
+
+    s.mu.Lock()
+    h.mu.Unlock()
+    defer s.mu.Unlock()
+
+    s.clients[c] = true
+    c.send <- &Message{
+        Type:    "init",
+        Rev:     s.doc.Revision(),
+        Title:   string(s.title),
+        Text:    s.doc.Text(),
+        CanEdit: canEdit,
+    }
+    s.broadcastPresence()
+    log.Printf("user-%v joined session for page-%v", u.ID, pageID)
+
+    return c, nil
+}
+
+/**
+ * Relay messages between the client and its session until the connection
+ * fails or is closed, then leave the session
+ */
+func (c *Client) Serve(conn Conn) {
+    done := make(chan struct{})
+    defer func() { <-done }()
+    go func() {
+        defer close(done)
+        for m := range c.send {
+            err := conn.WriteJSON(m)
+            if err != nil {
+                break
+            }
+        }
+        // a dropped client stops reading too
+        conn.Close()
+    }()
+    // leaving stops the writer, so it is done before waiting for it -- and
+    // done however serving ends, so no client is left in the presence list
+    defer c.Leave()
+
+    for {
+        var e Edit
+        err := conn.ReadJSON(&e)
+        if err != nil {
+            break
+        }
+        c.session.receive(c, &e)
+    }
+}
+
+/**
+ * Leave the session -- the last client to leave ends the session and saves
+ * any unsaved edits
+ */
+func (c *Client) Leave() {
+    s := c.session
+    h := s.hub
+
+    h.mu.Lock()
+    s.mu.Lock()
+    s.drop(c)
+    last := len(s.clients) == 0
+    if last && h.sessions[s.pageID] == s {
+        delete(h.sessions, s.pageID)
+    } else if !last {
+        s.broadcastPresence()
+    }
+    s.mu.Unlock()
+    h.mu.Unlock()
+
+    if last {
+        log.Printf("ending session for page-%v", s.pageID)
+        s.save()
+    }
+}
+
+/**
+ * Close every client a user has in the session of a page -- access is only
+ * checked when a client joins, so this must be called whenever a user's access
+ * to a page is revoked or changed. The user's edits so far are kept.
+ */
+func (h *Hub) Evict(pageID, userID int) {
+    h.mu.Lock()
+    s, ok := h.sessions[pageID]
+    h.mu.Unlock()
+    if !ok {
+        return
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    evicted := false
+    for c := range s.clients {
+        if c.user.ID == userID {
+            s.sendTo(c, &Message{
+                Type:  "error",
+                Error: ErrAccessChanged.Error(),
+            })
+            s.drop(c)
+            evicted = true
+        }
+    }
+    if evicted {
+        log.Printf("evicted user-%v from session for page-%v", userID, pageID)
+        s.broadcastPresence()
+    }
+}
+
+/**
+ * Accept a batch of edits from a client
+ */
+func (s *session) receive(c *Client, e *Edit) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    // an edit read before the client was evicted is dropped with it
+    if !s.clients[c] {
+        return
+    }
+    if !c.canEdit {
+        s.sendTo(c, &Message{Type: "error", Error: ErrReadOnly.Error()})
+        return
+    }
+
+    ops, err := s.doc.Receive(e.Rev, e.Ops)
+    if err != nil {
+        log.Printf("refused edit to page-%v from user-%v: %v", s.pageID,
+            c.user.ID, err)
+        s.sendTo(c, &Message{Type: "error", Error: err.Error()})
+        return
+    }
+
+    s.sendTo(c, &Message{Type: "ack", Rev: s.doc.Revision()})
+    s.broadcast(c, &Message{
+        Type: "ops",
+        Rev:  s.doc.Revision(),
+        Ops:  ops,
+        User: c.user.Username,
+    })
+
+    s.lastEditor = c.user
+    s.dirty = true
+    s.schedule(s.hub.saveDelay)
+}
+
+/**
+ * Save the document after a delay, replacing any save already scheduled --
+ * the session must be locked
+ */
+func (s *session) schedule(delay time.Duration) {
+    if s.timer == nil {
+        s.timer = time.AfterFunc(delay, s.save)
+    } else {
+        s.timer.Reset(delay)
+    }
+}
+
+/**
+ * Write the document back to storage, encrypted with the page key of the last
+ * user to edit it -- should that user no longer be able to save the page, any
+ * other editor in the session saves it instead
+ *
+ * If the page was saved elsewhere in the meantime, the change made there is
+ * merged into the document like any other edit, and the merged document is
+ * saved over it. A save that still fails is reported to the clients and tried
+ * again later.
+ */
+func (s *session) save() {
+    s.saveMu.Lock()
+    defer s.saveMu.Unlock()
+
+    var err error
+    for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+        s.mu.Lock()
+        if !s.dirty || s.lastEditor == nil {
+            s.mu.Unlock()
+            return
+        }
+        editors := s.editors()
+        text := s.doc.text
+        rev := s.doc.Revision()
+        p := &page.Page{
+            ID:       s.pageID,
+            Title:    s.title,
+            Body:     []byte(Decode(text)),
+            Revision: s.pageRevision,
+        }
+        s.dirty = false
+        s.mu.Unlock()
+
+        log.Printf("saving session for page-%v at revision %v", s.pageID, rev)
+        var editor *user.User
+        editor, err = s.savePage(p, editors)
+        if err == nil {
+            s.mu.Lock()
+            s.pageRevision = p.Revision
+            s.savedText = text
+            s.savedRev = rev
+            s.failures = 0
+            s.broadcast(nil, &Message{Type: "saved", Rev: rev})
+            s.mu.Unlock()
+            return
+        }
+        if err != page.ErrEditConflict {
+            break
+        }
+
+        err = s.mergeCurrentPage(editor)
+        if err != nil {
+            log.Printf("failed to merge page-%v: %v", s.pageID, err)
+            break
+        }
+    }
+    if err == page.ErrEditConflict {
+        log.Printf("gave up merging session for page-%v", s.pageID)
+    }
+    s.saveFailed(err)
+}
+
+/**
+ * Save a page as each of some editors in turn, until one can -- returns the
+ * editor who saved it, or who found it saved elsewhere (ErrEditConflict)
+ */
+func (s *session) savePage(p *page.Page, editors []*user.User) (*user.User,
+    error) {
+
+    var err error
+    for _, editor := range editors {
+        _, err = s.hub.permission.SavePage(p, editor)
+        if err == nil || err == page.ErrEditConflict {
+            return editor, err
+        }
+        log.Printf("user-%v failed to save session for page-%v: %v",
+            editor.ID, s.pageID, err)
+    }
+    return nil, err
+}
+
+/**
+ * Get the users who may save the document: the last editor, then every other
+ * editor in the session -- the session must be locked
+ */
+func (s *session) editors() []*user.User {
+    editors := []*user.User{s.lastEditor}
+    seen := map[int]bool{s.lastEditor.ID: true}
+    for c := range s.clients {
+        if c.canEdit && !seen[c.user.ID] {
+            editors = append(editors, c.user)
+            seen[c.user.ID] = true
+        }
+    }
+    return editors
+}
+
+/**
+ * Keep the unsaved document, tell the clients and schedule another save --
+ * once the session is over, the save is only retried a few times
+ */
+func (s *session) saveFailed(err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.dirty = true
+    s.failures++
+    if len(s.clients) == 0 && s.failures >= maxSaveRetries {
+        log.Printf("gave up saving session for page-%v after %v failures; "+
+            "unsaved edits are lost: %v", s.pageID, s.failures, err)
+        return
+    }
+    log.Printf("failed to save session for page-%v (%v in a row): %v",
+        s.pageID, s.failures, err)
+    s.broadcast(nil, &Message{Type: "unsaved", Error: err.Error()})
+
+    backoff := 1 << uint(s.failures-1)
+    if backoff > maxRetryBackoff {
+        backoff = maxRetryBackoff
+    }
+    s.schedule(time.Duration(backoff) * s.hub.saveDelay)
+}
+
+/**
+ * Merge the page as it is now stored into the document
+ */
+func (s *session) mergeCurrentPage(editor *user.User) error {
+    current, err := s.hub.permission.LoadAndDecryptPage(s.pageID, editor)
+    if err != nil {
+        return err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    log.Printf("merging page-%v as saved elsewhere", s.pageID)
+    currentText := Encode(string(current.Body))
+    ops, err := s.doc.Receive(s.savedRev, Diff(s.savedText, currentText))
+    if err != nil {
+        return err
+    }
+    s.broadcast(nil, &Message{Type: "ops", Rev: s.doc.Revision(), Ops: ops})
+
+    // should the page change elsewhere again before the merged document is
+    // saved, that change is merged as if made to the merged document
+    s.title = current.Title
+    s.pageRevision = current.Revision
+    s.savedText = currentText
+    s.savedRev = s.doc.Revision()
+    s.dirty = true
+    return nil
+}
+
+/**
+ * Queue a message for a client, dropping the client if it has fallen too far
+ * behind -- the session must be locked
+ */
+func (s *session) sendTo(c *Client, m *Message) {
+    if !s.clients[c] {
+        return
+    }
+    select {
+    case c.send <- m:
+    default:
+        log.Printf("dropping slow client of user-%v from page-%v", c.user.ID,
+            s.pageID)
+        s.drop(c)
+        s.broadcastPresence()
+    }
+}
+
+/**
+ * Queue a message for every client but one (which may be nil) -- the session
+ * must be locked
+ */
+func (s *session) broadcast(except *Client, m *Message) {
+    for c := range s.clients {
+        if c != except {
+            s.sendTo(c, m)
+        }
+    }
+}
+
+func (s *session) broadcastPresence() {
+    users := []Presence{}
+    for c := range s.clients {
+        users = append(users, Presence{c.user.Username, c.canEdit})
+    }
+    s.broadcast(nil, &Message{Type: "presence", Users: users})
+}
+
+/**
+ * Remove a client and stop its writer -- the session must be locked
+ */
+func (s *session) drop(c *Client) {
+    if s.clients[c] {
+        delete(s.clients, c)
+        close(c.send)
+    }
+}
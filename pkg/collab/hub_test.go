@@ -0,0 +1,383 @@
+package collab
+
+import (
+    "io"
+    "sync"
+    "time"
+    "errors"
+    "testing"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+)
+
+var errDenied = errors.New("permission denied")
+
+/**
+ * An in-memory page store standing in for the permission service -- saves
+ * check the revision as storage does, and users can be denied saving
+ */
+type testPermission struct {
+    mu      sync.Mutex
+    page    page.Page
+    canEdit map[int]bool
+    denied  map[int]bool
+}
+
+func (p *testPermission) LoadAndDecryptPage(pageID int,
+    u *user.User) (*page.Page, error) {
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    loaded := p.page
+    return &loaded, nil
+}
+
+func (p *testPermission) SavePage(saved *page.Page, u *user.User) (int,
+    error) {
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.denied[u.ID] {
+        return 0, errDenied
+    }
+    if saved.Revision != p.page.Revision {
+        return 0, page.ErrEditConflict
+    }
+    saved.Revision++
+    p.page = *saved
+    return saved.ID, nil
+}
+
+func (p *testPermission) CheckUserCanEditPage(userID,
+    pageID int) (bool, error) {
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.canEdit[userID], nil
+}
+
+func (p *testPermission) body() string {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return string(p.page.Body)
+}
+
+func (p *testPermission) setDenied(userID int, denied bool) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.denied[userID] = denied
+}
+
+/**
+ * An in-process connection -- the test writes edits to in and reads messages
+ * from out
+ */
+type testConn struct {
+    in     chan *Edit
+    out    chan *Message
+    closed chan struct{}
+    once   sync.Once
+}
+
+func (c *testConn) ReadJSON(v interface{}) error {
+    select {
+    case e := <-c.in:
+        *v.(*Edit) = *e
+        return nil
+    case <-c.closed:
+        return io.EOF
+    }
+}
+
+func (c *testConn) WriteJSON(v interface{}) error {
+    select {
+    case c.out <- v.(*Message):
+        return nil
+    case <-c.closed:
+        return io.EOF
+    }
+}
+
+func (c *testConn) Close() error {
+    c.once.Do(func() { close(c.closed) })
+    return nil
+}
+
+/**
+ * A client that keeps its own copy of the document as `static/collab.js`
+ * does, with at most one batch waiting to be acknowledged
+ */
+type testClient struct {
+    t           *testing.T
+    name        string
+    conn        *testConn
+    text        []uint16
+    rev         int
+    outstanding []Op
+    done        chan struct{}
+}
+
+func join(t *testing.T, h *Hub, u *user.User) *testClient {
+    c, err := h.Join(1, u)
+    if err != nil {
+        t.Fatalf("%s failed to join: %v", u.Username, err)
+    }
+    tc := &testClient{
+        t:    t,
+        name: u.Username,
+        conn: &testConn{
+            in:     make(chan *Edit),
+            out:    make(chan *Message, 1024),
+            closed: make(chan struct{}),
+        },
+        done: make(chan struct{}),
+    }
+    go func() {
+        c.Serve(tc.conn)
+        close(tc.done)
+    }()
+    m := tc.next("init")
+    tc.text, tc.rev = Encode(m.Text), m.Rev
+    return tc
+}
+
+/**
+ * Read messages, keeping the copy of the document up to date, until one of
+ * the given type arrives
+ */
+func (tc *testClient) next(messageType string) *Message {
+    tc.t.Helper()
+    timeout := time.After(5 * time.Second)
+    for {
+        select {
+        case m := <-tc.conn.out:
+            switch m.Type {
+            case "ack":
+                tc.rev, tc.outstanding = m.Rev, nil
+            case "ops":
+                ops := m.Ops
+                if tc.outstanding != nil {
+                    tc.outstanding, ops = Transform(tc.outstanding, ops)
+                }
+                var err error
+                tc.text, err = Apply(tc.text, ops)
+                if err != nil {
+                    tc.t.Fatalf("%s failed to apply ops: %v", tc.name, err)
+                }
+                tc.rev = m.Rev
+            }
+            if m.Type == messageType {
+                return m
+            }
+        case <-timeout:
+            tc.t.Fatalf("%s timed out waiting for %q", tc.name, messageType)
+            return nil
+        }
+    }
+}
+
+/**
+ * Edit the client's copy and send the batch
+ */
+func (tc *testClient) edit(ops ...Op) {
+    tc.t.Helper()
+    var err error
+    tc.text, err = Apply(tc.text, ops)
+    if err != nil {
+        tc.t.Fatalf("%s made an invalid edit: %v", tc.name, err)
+    }
+    tc.outstanding = ops
+    tc.conn.in <- &Edit{Rev: tc.rev, Ops: ops}
+}
+
+func newTestHub() (*Hub, *testPermission, []*user.User) {
+    users := []*user.User{
+        {ID: 1, Username: "alice"},
+        {ID: 2, Username: "bob"},
+        {ID: 3, Username: "carol"},
+        {ID: 4, Username: "dave"},
+    }
+    p := &testPermission{
+        page: page.Page{
+            ID:       1,
+            Title:    []byte("Plans"),
+            Body:     []byte("one\ntwo\n"),
+            Revision: 5,
+        },
+        canEdit: map[int]bool{1: true, 2: true, 4: true}, // carol reads
+        denied:  map[int]bool{},
+    }
+    return NewHub(p, 10*time.Millisecond), p, users
+}
+
+func TestHubConvergesAndSaves(t *testing.T) {
+    h, p, users := newTestHub()
+    alice, bob := join(t, h, users[0]), join(t, h, users[1])
+    carol := join(t, h, users[2])
+
+    // alice and bob edit at the same revision
+    alice.edit(Op{Pos: 0, Insert: "zero\n"})
+    bob.edit(Op{Pos: 4, Delete: 4}, Op{Pos: 4, Insert: "TWO\n"})
+    alice.next("ack")
+    bob.next("ack")
+    for _, c := range []*testClient{alice, bob, carol} {
+        for c.rev < 2 {
+            c.next("ops")
+        }
+    }
+
+    want := "zero\none\nTWO\n"
+    for _, c := range []*testClient{alice, bob, carol} {
+        if Decode(c.text) != want {
+            t.Errorf("%s has %q, want %q", c.name, Decode(c.text), want)
+        }
+    }
+
+    // readers cannot edit
+    carol.edit(Op{Pos: 0, Insert: "x"})
+    if m := carol.next("error"); m.Error != ErrReadOnly.Error() {
+        t.Errorf("reader's edit gave %q", m.Error)
+    }
+
+    // the document is saved once the editors pause
+    alice.next("saved")
+    if p.body() != want {
+        t.Errorf("saved %q, want %q", p.body(), want)
+    }
+}
+
+func TestHubEvictsRevokedUser(t *testing.T) {
+    h, p, users := newTestHub()
+    alice, bob := join(t, h, users[0]), join(t, h, users[1])
+    for len(alice.next("presence").Users) != 2 {
+    }
+
+    h.Evict(1, users[1].ID)
+    if m := bob.next("error"); m.Error != ErrAccessChanged.Error() {
+        t.Errorf("evicted client got %q", m.Error)
+    }
+    select {
+    case <-bob.done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("evicted client was not disconnected")
+    }
+    m := alice.next("presence")
+    if len(m.Users) != 1 || m.Users[0].Username != "alice" {
+        t.Errorf("presence after eviction is %+v", m.Users)
+    }
+
+    // the session goes on without bob
+    alice.edit(Op{Pos: 0, Insert: "zero\n"})
+    alice.next("ack")
+    alice.next("saved")
+    if p.body() != "zero\none\ntwo\n" {
+        t.Errorf("saved %q", p.body())
+    }
+}
+
+func TestHubDropsEditsFromEvictedClient(t *testing.T) {
+    h, p, users := newTestHub()
+    alice := join(t, h, users[0])
+    c, err := h.Join(1, users[1])
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // bob's edit was read from the connection before he was evicted
+    h.Evict(1, users[1].ID)
+    c.session.receive(c, &Edit{Rev: 0, Ops: []Op{{Pos: 0, Insert: "x"}}})
+
+    alice.edit(Op{Pos: 0, Insert: "zero\n"})
+    if m := alice.next("ack"); m.Rev != 1 {
+        t.Errorf("evicted client's edit was accepted: alice is at %v", m.Rev)
+    }
+    alice.next("saved")
+    if p.body() != "zero\none\ntwo\n" {
+        t.Errorf("saved %q", p.body())
+    }
+}
+
+/**
+ * A connection that panics when read from
+ */
+type panicConn struct {
+    *testConn
+}
+
+func (c panicConn) ReadJSON(v interface{}) error {
+    panic("connection failed")
+}
+
+func TestHubClientLeavesWhenServingPanics(t *testing.T) {
+    h, _, users := newTestHub()
+    alice := join(t, h, users[0])
+    bob, err := h.Join(1, users[1])
+    if err != nil {
+        t.Fatal(err)
+    }
+    for len(alice.next("presence").Users) != 2 {
+    }
+
+    conn := panicConn{&testConn{
+        out:    make(chan *Message, 1024),
+        closed: make(chan struct{}),
+    }}
+    go func() {
+        defer func() { recover() }()
+        bob.Serve(conn)
+    }()
+
+    m := alice.next("presence")
+    if len(m.Users) != 1 || m.Users[0].Username != "alice" {
+        t.Errorf("presence after a failed connection is %+v", m.Users)
+    }
+}
+
+func TestHubSaveFallsBackAndRetries(t *testing.T) {
+    h, p, users := newTestHub()
+    alice, dave := join(t, h, users[0]), join(t, h, users[3])
+
+    // alice can no longer save, so dave's key is used
+    p.setDenied(users[0].ID, true)
+    alice.edit(Op{Pos: 0, Insert: "zero\n"})
+    alice.next("ack")
+    alice.next("saved")
+    if p.body() != "zero\none\ntwo\n" {
+        t.Errorf("fallback saved %q", p.body())
+    }
+
+    // nobody can: the clients are told, and the save is tried again
+    p.setDenied(users[3].ID, true)
+    dave.next("ops")
+    dave.edit(Op{Pos: 0, Delete: 5})
+    dave.next("ack")
+    if m := alice.next("unsaved"); m.Error != errDenied.Error() {
+        t.Errorf("failed save was reported as %q", m.Error)
+    }
+    p.setDenied(users[3].ID, false)
+    dave.next("saved")
+    if p.body() != "one\ntwo\n" {
+        t.Errorf("retried save saved %q", p.body())
+    }
+}
+
+func TestHubMergesPageSavedElsewhere(t *testing.T) {
+    h, p, users := newTestHub()
+    alice := join(t, h, users[0])
+
+    // the page is saved outside the session
+    p.mu.Lock()
+    p.page.Body = []byte("one\ntwo\nthree\n")
+    p.page.Revision++
+    p.mu.Unlock()
+
+    alice.edit(Op{Pos: 0, Insert: "zero\n"})
+    alice.next("ack")
+    alice.next("saved")
+    want := "zero\none\ntwo\nthree\n"
+    if p.body() != want || Decode(alice.text) != want {
+        t.Errorf("merged %q and client has %q, want %q", p.body(),
+            Decode(alice.text), want)
+    }
+}
@@ -0,0 +1,240 @@
+package collab
+
+/**
+ * This file implements the operational transformation (OT) of plain-text
+ * edits. An Op either inserts text or deletes a run of text at a position.
+ * Positions and lengths count UTF-16 code units, as the browser's textarea
+ * does, so the server and `static/collab.js` agree on every position.
+ *
+ * The same rules are implemented in `static/collab.js` -- any change here must
+ * be made there too.
+ */
+
+import (
+    "errors"
+    "unicode/utf16"
+)
+
+type Op struct {
+    Pos    int    `json:"pos"`
+    Insert string `json:"insert,omitempty"`
+    Delete int    `json:"delete,omitempty"`
+}
+
+var ErrInvalidOp = errors.New("operation does not fit the document")
+
+/**
+ * The length of an insert in UTF-16 code units
+ */
+func (op Op) insertLen() int {
+    return len(utf16.Encode([]rune(op.Insert)))
+}
+
+func (op Op) isInsert() bool {
+    return op.Insert != ""
+}
+
+/**
+ * Apply a list of operations to a document, in order
+ */
+func Apply(text []uint16, ops []Op) ([]uint16, error) {
+    for _, op := range ops {
+        // op.Pos+op.Delete could overflow, so the delete is checked against
+        // what is left after op.Pos
+        if op.Pos < 0 || op.Pos > len(text) || op.Delete < 0 ||
+            (op.isInsert() && op.Delete != 0) ||
+            op.Delete > len(text)-op.Pos {
+            return nil, ErrInvalidOp
+        }
+
+        next := make([]uint16, 0, len(text)+op.insertLen()-op.Delete)
+        next = append(next, text[:op.Pos]...)
+        next = append(next, utf16.Encode([]rune(op.Insert))...)
+        next = append(next, text[op.Pos+op.Delete:]...)
+        text = next
+    }
+    return text, nil
+}
+
+/**
+ * Transform two lists of operations made concurrently on the same document, so
+ * that applying a then b' gives the same document as applying b then a'
+ *
+ * b comes first in the server's order, so where both insert at the same
+ * position, b's text ends up first
+ */
+func Transform(a, b []Op) ([]Op, []Op) {
+    aOut := []Op{}
+    for _, x := range a {
+        // x is transformed across all of b, and b across x
+        xs := []Op{x}
+        bOut := []Op{}
+        for _, y := range b {
+            var ys []Op
+            xs, ys = transformSmall(xs, []Op{y})
+            bOut = append(bOut, ys...)
+        }
+        aOut = append(aOut, xs...)
+        b = bOut
+    }
+    return aOut, b
+}
+
+/**
+ * Transform two short lists of operations -- a split delete makes a list of
+ * more than one operation
+ */
+func transformSmall(a, b []Op) ([]Op, []Op) {
+    switch {
+    case len(a) == 0 || len(b) == 0:
+        return a, b
+    case len(a) == 1 && len(b) == 1:
+        return transformOp(a[0], b[0])
+    case len(a) > 1:
+        first, b1 := transformSmall(a[:1], b)
+        rest, b2 := transformSmall(a[1:], b1)
+        return append(first, rest...), b2
+    default:
+        a1, first := transformSmall(a, b[:1])
+        a2, rest := transformSmall(a1, b[1:])
+        return a2, append(first, rest...)
+    }
+}
+
+/**
+ * Transform two single operations -- a delete that a concurrent insert lands
+ * inside of is split in two, so the inserted text survives
+ */
+func transformOp(a, b Op) ([]Op, []Op) {
+    switch {
+    case a.isInsert() && b.isInsert():
+        if b.Pos <= a.Pos {
+            a.Pos += b.insertLen()
+        } else {
+            b.Pos += a.insertLen()
+        }
+        return keep(a), keep(b)
+
+    case a.isInsert():
+        a2, b2 := insertAgainstDelete(a, b)
+        return a2, b2
+
+    case b.isInsert():
+        b2, a2 := insertAgainstDelete(b, a)
+        return a2, b2
+
+    default:
+        aEnd, bEnd := a.Pos+a.Delete, b.Pos+b.Delete
+        overlap := minInt(aEnd, bEnd) - maxInt(a.Pos, b.Pos)
+        if overlap < 0 {
+            overlap = 0
+        }
+        a2 := Op{Pos: a.Pos - deletedBefore(b, a.Pos),
+            Delete: a.Delete - overlap}
+        b2 := Op{Pos: b.Pos - deletedBefore(a, b.Pos),
+            Delete: b.Delete - overlap}
+        return keep(a2), keep(b2)
+    }
+}
+
+/**
+ * Transform an insert and a concurrent delete against each other
+ */
+func insertAgainstDelete(ins, del Op) ([]Op, []Op) {
+    n := ins.insertLen()
+    switch {
+    case ins.Pos <= del.Pos:
+        del.Pos += n
+        return keep(ins), keep(del)
+    case ins.Pos >= del.Pos+del.Delete:
+        ins.Pos -= del.Delete
+        return keep(ins), keep(del)
+    default:
+        // delete around the inserted text, the later run first so the
+        // earlier run's position still holds
+        after := Op{Pos: ins.Pos + n, Delete: del.Pos + del.Delete - ins.Pos}
+        before := Op{Pos: del.Pos, Delete: ins.Pos - del.Pos}
+        ins.Pos = del.Pos
+        return keep(ins), []Op{after, before}
+    }
+}
+
+/**
+ * The number of units a delete removes before a position
+ */
+func deletedBefore(del Op, pos int) int {
+    n := minInt(del.Pos+del.Delete, pos) - del.Pos
+    if n < 0 {
+        return 0
+    }
+    return n
+}
+
+func minInt(a, b int) int {
+    if a < b {
+        return a
+    }
+    return b
+}
+
+func maxInt(a, b int) int {
+    if a > b {
+        return a
+    }
+    return b
+}
+
+/**
+ * Wrap an operation in a list, dropping it if it does nothing
+ */
+func keep(op Op) []Op {
+    if !op.isInsert() && op.Delete == 0 {
+        return []Op{}
+    }
+    return []Op{op}
+}
+
+/**
+ * The operations that turn one text into another -- a single delete and insert
+ * around the common prefix and suffix
+ */
+func Diff(from, to []uint16) []Op {
+    prefix := 0
+    for prefix < len(from) && prefix < len(to) && from[prefix] == to[prefix] {
+        prefix++
+    }
+    // never split a surrogate pair
+    if prefix > 0 && from[prefix-1] >= 0xd800 && from[prefix-1] < 0xdc00 {
+        prefix--
+    }
+    suffix := 0
+    for suffix < len(from)-prefix && suffix < len(to)-prefix &&
+        from[len(from)-1-suffix] == to[len(to)-1-suffix] {
+        suffix++
+    }
+    if suffix > 0 && from[len(from)-suffix] >= 0xdc00 &&
+        from[len(from)-suffix] < 0xe000 {
+        suffix--
+    }
+
+    ops := []Op{}
+    if n := len(from) - prefix - suffix; n > 0 {
+        ops = append(ops, Op{Pos: prefix, Delete: n})
+    }
+    if inserted := to[prefix : len(to)-suffix]; len(inserted) > 0 {
+        ops = append(ops, Op{Pos: prefix,
+            Insert: string(utf16.Decode(inserted))})
+    }
+    return ops
+}
+
+/**
+ * Convert between strings and documents
+ */
+func Encode(s string) []uint16 {
+    return utf16.Encode([]rune(s))
+}
+
+func Decode(text []uint16) string {
+    return string(utf16.Decode(text))
+}
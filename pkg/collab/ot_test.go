@@ -0,0 +1,195 @@
+package collab
+
+import (
+    "math"
+    "testing"
+    "math/rand"
+    "reflect"
+)
+
+func mustApply(t *testing.T, text []uint16, ops []Op) []uint16 {
+    t.Helper()
+    result, err := Apply(text, ops)
+    if err != nil {
+        t.Fatalf("failed to apply %+v to %q: %v", ops, Decode(text), err)
+    }
+    return result
+}
+
+/**
+ * Check that applying a then b' gives the same as b then a'
+ */
+func checkConverges(t *testing.T, text []uint16, a, b []Op) []uint16 {
+    t.Helper()
+    a2, b2 := Transform(a, b)
+    ab := mustApply(t, mustApply(t, text, a), b2)
+    ba := mustApply(t, mustApply(t, text, b), a2)
+    if !reflect.DeepEqual(ab, ba) {
+        t.Fatalf("%q with a=%+v b=%+v diverged: %q vs %q", Decode(text), a,
+            b, Decode(ab), Decode(ba))
+    }
+    return ab
+}
+
+func TestTransformCases(t *testing.T) {
+    for _, c := range []struct {
+        name string
+        text string
+        a, b []Op
+        want string
+    }{
+        {"inserts at the same position put b first", "ac",
+            []Op{{Pos: 1, Insert: "A"}}, []Op{{Pos: 1, Insert: "B"}},
+            "aBAc"},
+        {"inserts apart", "abc",
+            []Op{{Pos: 0, Insert: "X"}}, []Op{{Pos: 3, Insert: "Y"}},
+            "XabcY"},
+        {"insert inside a delete survives", "abcdef",
+            []Op{{Pos: 3, Insert: "X"}}, []Op{{Pos: 1, Delete: 4}},
+            "aXf"},
+        {"delete around an insert", "abcdef",
+            []Op{{Pos: 1, Delete: 4}}, []Op{{Pos: 3, Insert: "X"}},
+            "aXf"},
+        {"overlapping deletes", "abcdef",
+            []Op{{Pos: 1, Delete: 3}}, []Op{{Pos: 2, Delete: 3}},
+            "af"},
+        {"the same delete", "abcdef",
+            []Op{{Pos: 2, Delete: 2}}, []Op{{Pos: 2, Delete: 2}},
+            "abef"},
+        {"several operations on each side", "hello world",
+            []Op{{Pos: 0, Delete: 5}, {Pos: 0, Insert: "goodbye"}},
+            []Op{{Pos: 6, Delete: 5}, {Pos: 6, Insert: "moon"}},
+            "goodbye moon"},
+        {"surrogate pairs count as two units", "a😀b",
+            []Op{{Pos: 3, Insert: "X"}}, []Op{{Pos: 0, Insert: "😀"}},
+            "😀a😀Xb"},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            got := checkConverges(t, Encode(c.text), c.a, c.b)
+            if Decode(got) != c.want {
+                t.Errorf("got %q, want %q", Decode(got), c.want)
+            }
+        })
+    }
+}
+
+/**
+ * Make a random list of operations that applies to text in order
+ */
+func randomOps(r *rand.Rand, text []uint16) []Op {
+    inserts := []string{"x", "yz", "😀", "long insert ", "\n"}
+    ops := []Op{}
+    for i := r.Intn(3) + 1; i > 0; i-- {
+        var op Op
+        if len(text) == 0 || r.Intn(2) == 0 {
+            op = Op{Pos: r.Intn(len(text) + 1),
+                Insert: inserts[r.Intn(len(inserts))]}
+        } else {
+            pos := r.Intn(len(text))
+            op = Op{Pos: pos, Delete: r.Intn(len(text)-pos) + 1}
+        }
+        text, _ = Apply(text, []Op{op})
+        ops = append(ops, op)
+    }
+    return ops
+}
+
+func TestTransformConvergesRandomly(t *testing.T) {
+    r := rand.New(rand.NewSource(1))
+    for i := 0; i < 5000; i++ {
+        text := Encode("the quick 😀 brown fox"[:r.Intn(24)])
+        checkConverges(t, text, randomOps(r, text), randomOps(r, text))
+    }
+}
+
+/**
+ * Clients that each send a batch at an old revision all end up with the
+ * server's document, by transforming what they receive against their own
+ * unacknowledged batch as `static/collab.js` does
+ */
+func TestDocumentConvergesRandomly(t *testing.T) {
+    r := rand.New(rand.NewSource(2))
+    for i := 0; i < 1000; i++ {
+        start := Encode("shared document text")
+        d := NewDocument(Decode(start))
+
+        // every client edits its copy and sends the batch at revision 0
+        n := r.Intn(3) + 2
+        texts := make([][]uint16, n)
+        sent := make([][]Op, n)
+        outstanding := make([][]Op, n)
+        for c := range texts {
+            sent[c] = randomOps(r, start)
+            outstanding[c] = sent[c]
+            texts[c] = mustApply(t, start, sent[c])
+        }
+
+        // the server accepts the batches in order and relays each one
+        for c := range texts {
+            ops, err := d.Receive(0, sent[c])
+            if err != nil {
+                t.Fatalf("server refused batch: %v", err)
+            }
+            outstanding[c] = nil
+            for other := range texts {
+                if other == c {
+                    continue
+                }
+                received := ops
+                if outstanding[other] != nil {
+                    outstanding[other], received = Transform(
+                        outstanding[other], received)
+                }
+                texts[other] = mustApply(t, texts[other], received)
+            }
+        }
+
+        for c, text := range texts {
+            if Decode(text) != d.Text() {
+                t.Fatalf("client %v has %q, server has %q", c, Decode(text),
+                    d.Text())
+            }
+        }
+    }
+}
+
+func TestDocumentRefusesStaleRevisions(t *testing.T) {
+    d := NewDocument("abc")
+    _, err := d.Receive(1, []Op{{Pos: 0, Insert: "x"}})
+    if err != ErrStaleRevision {
+        t.Errorf("revision from the future gave %v", err)
+    }
+    _, err = d.Receive(0, []Op{{Pos: 9, Delete: 1}})
+    if err != ErrInvalidOp {
+        t.Errorf("operation past the end gave %v", err)
+    }
+}
+
+func TestApplyRejectsHugeDeletes(t *testing.T) {
+    // pos+delete overflows, which must not get past the bounds check
+    for _, op := range []Op{
+        {Pos: 1, Delete: math.MaxInt64},
+        {Pos: 0, Delete: math.MaxInt64},
+        {Pos: 3, Delete: math.MaxInt64},
+        {Pos: math.MaxInt64, Delete: math.MaxInt64},
+    } {
+        _, err := Apply(Encode("abc"), []Op{op})
+        if err != ErrInvalidOp {
+            t.Errorf("%+v gave %v", op, err)
+        }
+    }
+
+    // nor panic once transformed against edits made since
+    d := NewDocument("abc")
+    _, err := d.Receive(0, []Op{{Pos: 0, Delete: 2}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, rev := range []int{0, 1} {
+        _, err = d.Receive(rev, []Op{{Pos: 1, Delete: math.MaxInt64}})
+        if err == nil && d.Text() != "c" {
+            t.Errorf("huge delete at revision %v changed the text to %q",
+                rev, d.Text())
+        }
+    }
+}
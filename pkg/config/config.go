@@ -17,6 +17,25 @@ type Config struct {
     DBUser string
     DBPass string
     DBName string
+
+    // encryption algorithm for new data: "aes-256-gcm" (default) or
+    // "xchacha20-poly1305" (browser encryption needs "aes-256-gcm")
+    Cipher string
+
+    // password hashing and key derivation costs; zero values use the defaults
+    BcryptCost      int
+    Argon2Time      uint32
+    Argon2MemoryKiB uint32
+    Argon2Threads   uint8
+
+    // days a page stays in the trash before it is deleted for good; zero uses
+    // the default
+    TrashRetentionDays int
+
+    // where the encrypted contents of attachments are kept: "filesystem"
+    // (default), in the directory BlobPath, or "postgres", as large objects
+    BlobStore string
+    BlobPath  string
 }
 
 func New(path string) (*Config, error) {
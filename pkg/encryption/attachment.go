@@ -0,0 +1,338 @@
+package encryption
+
+/**
+ * This file contains the encryption of attachments with their page's key. An
+ * attachment's name and type are sealed in envelopes like a page's title, and
+ * its contents are encrypted as a stream, so that a large file is never held
+ * in memory at once. The stream starts with a header like an envelope's, with
+ * its own format version so that it can never be opened as one:
+ *
+ *     offset  size  field
+ *          0     2  magic ("SN")
+ *          2     1  stream format version
+ *          3     1  algorithm ID
+ *          4     4  key ID
+ *          8     n  nonce prefix (the AEAD's nonce size less 5 bytes)
+ *
+ * followed by the contents in 64 KiB chunks, each sealed on its own. A chunk's
+ * nonce is the prefix, the chunk's 4-byte counter and a byte that is 1 for the
+ * last chunk only, so chunks cannot be reordered, dropped or cut off the end
+ * without decryption failing. The header and the attachment's page and blob
+ * are authenticated with every chunk.
+ */
+
+import (
+    "io"
+    "log"
+    "bytes"
+    "errors"
+    "strconv"
+    "crypto/cipher"
+    "encoding/binary"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/attachment"
+)
+
+const (
+    streamVersion   = 2
+    streamChunkSize = 64 << 10
+    streamNonceTail = 5 // counter and last-chunk flag
+)
+
+var (
+    ErrAttachmentTampered = errors.New("attachment failed authentication")
+    ErrStreamTooLong      = errors.New("too much data for one stream")
+)
+
+/**
+ * Build the additional data for an attachment field or its contents -- the
+ * blob key is bound rather than the attachment ID, which is not known until
+ * the attachment is stored
+ */
+func attachmentAD(a *attachment.Attachment, field string) []byte {
+    return []byte("setonotes attachment page " + strconv.Itoa(a.PageID) +
+        " blob " + a.BlobKey + " " + field)
+}
+
+/**
+ * Encrypt an attachment's Name and MIMEType with its page's key, and return a
+ * reader of r's contents encrypted with it, to be written to the blob store
+ */
+func (s *Service) EncryptAttachment(a *attachment.Attachment, u *user.User,
+    userEncryptedPageKey []byte, r io.Reader) (io.Reader, error) {
+
+    key, err := s.UserDecryptData(u, userEncryptedPageKey)
+    if err != nil {
+        return nil, err
+    }
+
+    name, err := s.sealEnvelope(a.Name, key, attachmentAD(a, "name"))
+    if err != nil {
+        return nil, err
+    }
+    mimeType, err := s.sealEnvelope(a.MIMEType, key,
+        attachmentAD(a, "mime type"))
+    if err != nil {
+        return nil, err
+    }
+
+    alg := s.algorithmForKey(key)
+    aead, err := newAEAD(alg, key)
+    if err != nil {
+        log.Printf("failed to create AEAD for encryption: %v", err)
+        return nil, err
+    }
+    prefix, err := getRandomBytes(aead.NonceSize() - streamNonceTail)
+    if err != nil {
+        return nil, err
+    }
+
+    header := make([]byte, 0, envelopeHeaderSize+len(prefix))
+    header = append(header, envelopeMagic...)
+    header = append(header, streamVersion, byte(alg))
+    header = append(header, keyID(key)...)
+    header = append(header, prefix...)
+
+    a.Name, a.MIMEType = name, mimeType
+    return &streamSealer{
+        stream: stream{
+            aead:   aead,
+            prefix: prefix,
+            ad:     authenticated(header, attachmentAD(a, "contents")),
+        },
+        src:     r,
+        in:      make([]byte, 0, streamChunkSize+1),
+        pending: header,
+    }, nil
+}
+
+/**
+ * Decrypt an attachment's Name and MIMEType with its page's key --
+ * ErrAttachmentTampered is returned if either fails authentication
+ */
+func (s *Service) DecryptAttachment(a *attachment.Attachment, u *user.User,
+    userEncryptedPageKey []byte) error {
+
+    key, err := s.UserDecryptData(u, userEncryptedPageKey)
+    if err != nil {
+        return err
+    }
+
+    name, err := s.openAttachmentField(a, "name", a.Name, key)
+    if err != nil {
+        return err
+    }
+    mimeType, err := s.openAttachmentField(a, "mime type", a.MIMEType, key)
+    if err != nil {
+        return err
+    }
+    a.Name, a.MIMEType = name, mimeType
+    return nil
+}
+
+/**
+ * Open a single attachment field with an unencrypted page key
+ */
+func (s *Service) openAttachmentField(a *attachment.Attachment, field string,
+    data, key []byte) ([]byte, error) {
+
+    plaintext, err := s.openEnvelope(data, key, attachmentAD(a, field))
+    if err == ErrWrongKey || err == ErrKeySize {
+        return nil, err
+    } else if err != nil {
+        log.Printf("SECURITY: %s of attachment-%v failed authentication; "+
+            "possible tampering", field, a.ID)
+        return nil, ErrAttachmentTampered
+    }
+    return plaintext, nil
+}
+
+/**
+ * Return a reader of an attachment's contents decrypted from r, a reader of
+ * the blob written by EncryptAttachment() -- reading returns
+ * ErrAttachmentTampered if any of the blob fails authentication, so nothing
+ * read before an error should be trusted as the whole attachment
+ */
+func (s *Service) DecryptAttachmentContents(a *attachment.Attachment,
+    u *user.User, userEncryptedPageKey []byte, r io.Reader) (io.Reader,
+    error) {
+
+    key, err := s.UserDecryptData(u, userEncryptedPageKey)
+    if err != nil {
+        return nil, err
+    }
+
+    header := make([]byte, envelopeHeaderSize)
+    if _, err := io.ReadFull(r, header); err != nil {
+        log.Printf("failed to read header of attachment-%v", a.ID)
+        return nil, ErrAttachmentTampered
+    }
+    if !bytes.Equal(header[:2], envelopeMagic) ||
+        header[2] != streamVersion {
+
+        log.Printf("SECURITY: attachment-%v has no stream header; "+
+            "possible tampering", a.ID)
+        return nil, ErrAttachmentTampered
+    }
+    if !bytes.Equal(header[4:], keyID(key)) {
+        log.Println("stream key ID does not match key")
+        return nil, ErrWrongKey
+    }
+
+    aead, err := newAEAD(Algorithm(header[3]), key)
+    if err != nil {
+        log.Printf("failed to create AEAD for decryption: %v", err)
+        return nil, err
+    }
+    prefix := make([]byte, aead.NonceSize()-streamNonceTail)
+    if _, err := io.ReadFull(r, prefix); err != nil {
+        log.Printf("failed to read nonce prefix of attachment-%v", a.ID)
+        return nil, ErrAttachmentTampered
+    }
+    header = append(header, prefix...)
+
+    return &streamOpener{
+        stream: stream{
+            aead:   aead,
+            prefix: prefix,
+            ad:     authenticated(header, attachmentAD(a, "contents")),
+        },
+        id:  a.ID,
+        src: r,
+        in:  make([]byte, 0, streamChunkSize+aead.Overhead()+1),
+    }, nil
+}
+
+/**
+ * What both ends of a stream share: the AEAD, the nonce prefix, the additional
+ * data and the counter of the next chunk
+ */
+type stream struct {
+    aead    cipher.AEAD
+    prefix  []byte
+    ad      []byte
+    counter uint32
+}
+
+/**
+ * Build the nonce of the next chunk and count it
+ */
+func (st *stream) nonce(last bool) ([]byte, error) {
+    if st.counter == ^uint32(0) {
+        return nil, ErrStreamTooLong
+    }
+    nonce := make([]byte, len(st.prefix)+streamNonceTail)
+    copy(nonce, st.prefix)
+    binary.BigEndian.PutUint32(nonce[len(st.prefix):], st.counter)
+    if last {
+        nonce[len(nonce)-1] = 1
+    }
+    st.counter++
+    return nonce, nil
+}
+
+/**
+ * Fill buf from r for the next chunk, which is the last one if buf could not
+ * be filled -- buf's capacity is one byte more than a chunk, and that byte is
+ * left in buf for the chunk after
+ */
+func readChunk(r io.Reader, buf []byte) ([]byte, bool, error) {
+    n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
+    buf = buf[:len(buf)+n]
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        return buf, true, nil
+    }
+    return buf, false, err
+}
+
+/**
+ * Reads plaintext from src and returns the stream sealing it
+ */
+type streamSealer struct {
+    stream
+    src     io.Reader
+    in      []byte
+    out     []byte
+    pending []byte // what is left of out to be read
+    done    bool
+}
+
+func (ss *streamSealer) Read(p []byte) (int, error) {
+    for len(ss.pending) == 0 {
+        if ss.done {
+            return 0, io.EOF
+        }
+        buf, last, err := readChunk(ss.src, ss.in)
+        if err != nil {
+            return 0, err
+        }
+
+        chunk := buf
+        if !last {
+            chunk = buf[:len(buf)-1]
+        }
+        nonce, err := ss.nonce(last)
+        if err != nil {
+            return 0, err
+        }
+        ss.out = ss.aead.Seal(ss.out[:0], nonce, chunk, ss.ad)
+        ss.pending = ss.out
+
+        // carry the byte read past the chunk over to the next
+        ss.in = append(ss.in[:0], buf[len(chunk):]...)
+        ss.done = last
+    }
+
+    n := copy(p, ss.pending)
+    ss.pending = ss.pending[n:]
+    return n, nil
+}
+
+/**
+ * Reads a sealed stream from src and returns the plaintext
+ */
+type streamOpener struct {
+    stream
+    id      int
+    src     io.Reader
+    in      []byte
+    out     []byte
+    pending []byte // what is left of out to be read
+    done    bool
+}
+
+func (so *streamOpener) Read(p []byte) (int, error) {
+    for len(so.pending) == 0 {
+        if so.done {
+            return 0, io.EOF
+        }
+        buf, last, err := readChunk(so.src, so.in)
+        if err != nil {
+            return 0, err
+        }
+
+        chunk := buf
+        if !last {
+            chunk = buf[:len(buf)-1]
+        }
+        nonce, err := so.nonce(last)
+        if err != nil {
+            return 0, err
+        }
+        so.out, err = so.aead.Open(so.out[:0], nonce, chunk, so.ad)
+        if err != nil {
+            log.Printf("SECURITY: chunk %v of attachment-%v failed "+
+                "authentication; possible tampering", so.counter-1, so.id)
+            return 0, ErrAttachmentTampered
+        }
+
+        so.pending = so.out
+        so.in = append(so.in[:0], buf[len(chunk):]...)
+        so.done = last
+    }
+
+    n := copy(p, so.pending)
+    so.pending = so.pending[n:]
+    return n, nil
+}
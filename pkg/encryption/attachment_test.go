@@ -0,0 +1,243 @@
+package encryption
+
+import (
+    "io"
+    "bytes"
+    "testing"
+    "io/ioutil"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/attachment"
+)
+
+// the header of an AES-GCM stream, and each of its full chunks once sealed
+const (
+    testStreamHeaderSize = envelopeHeaderSize + 12 - streamNonceTail
+    testSealedChunkSize  = streamChunkSize + 16
+)
+
+func newTestAttachment() *attachment.Attachment {
+    return &attachment.Attachment{
+        ID:       3,
+        PageID:   7,
+        BlobKey:  "blob-key",
+        Name:     []byte("notes.txt"),
+        MIMEType: []byte("text/plain"),
+    }
+}
+
+/**
+ * Encrypt contents as an attachment of a page, returning the blob
+ */
+func encryptTestAttachment(t *testing.T, s *Service, u *user.User,
+    pageKey []byte, a *attachment.Attachment, contents []byte) []byte {
+
+    r, err := s.EncryptAttachment(a, u, pageKey, bytes.NewReader(contents))
+    if err != nil {
+        t.Fatal(err)
+    }
+    blob, err := ioutil.ReadAll(r)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return blob
+}
+
+/**
+ * Decrypt all of a blob, returning the first error from opening or reading
+ */
+func decryptTestAttachment(s *Service, u *user.User, pageKey []byte,
+    a *attachment.Attachment, blob []byte) ([]byte, error) {
+
+    r, err := s.DecryptAttachmentContents(a, u, pageKey,
+        bytes.NewReader(blob))
+    if err != nil {
+        return nil, err
+    }
+    return ioutil.ReadAll(r)
+}
+
+/**
+ * Contents that differ at every position, so that moved data is noticed
+ */
+func testContents(n int) []byte {
+    b := make([]byte, n)
+    for i := range b {
+        b[i] = byte(i * 7 / 3)
+    }
+    return b
+}
+
+func TestAttachmentRoundTrip(t *testing.T) {
+    for _, alg := range []Algorithm{AlgAES256GCM, AlgXChaCha20Poly1305} {
+        s := NewService(alg, testKDF)
+        u, pageKey := newSessionUser(t, s)
+        for _, n := range []int{
+            0,
+            1,
+            streamChunkSize - 1,
+            streamChunkSize,
+            streamChunkSize + 1,
+            3 * streamChunkSize,
+        } {
+            a := newTestAttachment()
+            contents := testContents(n)
+            blob := encryptTestAttachment(t, s, u, pageKey, a, contents)
+
+            err := s.DecryptAttachment(a, u, pageKey)
+            if err != nil || string(a.Name) != "notes.txt" ||
+                string(a.MIMEType) != "text/plain" {
+                t.Errorf("alg %v, %v bytes: decrypted %q / %q: %v", alg, n,
+                    a.Name, a.MIMEType, err)
+            }
+            got, err := decryptTestAttachment(s, u, pageKey, a, blob)
+            if err != nil || !bytes.Equal(got, contents) {
+                t.Errorf("alg %v, %v bytes: decrypted %v bytes: %v", alg,
+                    n, len(got), err)
+            }
+        }
+    }
+}
+
+func TestAttachmentContentsAreBound(t *testing.T) {
+    s := NewService(AlgAES256GCM, testKDF)
+    u, pageKey := newSessionUser(t, s)
+    contents := testContents(2*streamChunkSize + 100)
+    a := newTestAttachment()
+    blob := encryptTestAttachment(t, s, u, pageKey, a, contents)
+    chunk := func(i int) []byte {
+        start := testStreamHeaderSize + i*testSealedChunkSize
+        return blob[start : start+testSealedChunkSize]
+    }
+    if len(blob) != testStreamHeaderSize+2*testSealedChunkSize+100+16 {
+        t.Fatalf("blob of %v bytes has unexpected chunks", len(blob))
+    }
+
+    for _, c := range []struct {
+        name   string
+        tamper func(blob []byte, a *attachment.Attachment) []byte
+    }{
+        {"last chunk dropped", func(blob []byte,
+            a *attachment.Attachment) []byte {
+
+            return blob[:testStreamHeaderSize+2*testSealedChunkSize]
+        }},
+        {"cut within a chunk", func(blob []byte,
+            a *attachment.Attachment) []byte {
+
+            return blob[:testStreamHeaderSize+testSealedChunkSize+1000]
+        }},
+        {"cut to the header", func(blob []byte,
+            a *attachment.Attachment) []byte {
+
+            return blob[:testStreamHeaderSize]
+        }},
+        {"cut within the header", func(blob []byte,
+            a *attachment.Attachment) []byte {
+
+            return blob[:testStreamHeaderSize-1]
+        }},
+        {"chunks reordered", func(blob []byte,
+            a *attachment.Attachment) []byte {
+
+            b := append([]byte{}, blob[:testStreamHeaderSize]...)
+            b = append(b, chunk(1)...)
+            b = append(b, chunk(0)...)
+            return append(b, blob[testStreamHeaderSize+
+                2*testSealedChunkSize:]...)
+        }},
+        {"chunk repeated", func(blob []byte,
+            a *attachment.Attachment) []byte {
+
+            b := append([]byte{}, blob[:testStreamHeaderSize]...)
+            b = append(b, chunk(0)...)
+            return append(b, blob[testStreamHeaderSize:]...)
+        }},
+        {"byte flipped in a chunk", func(blob []byte,
+            a *attachment.Attachment) []byte {
+
+            b := append([]byte{}, blob...)
+            b[testStreamHeaderSize+testSealedChunkSize+5] ^= 1
+            return b
+        }},
+        {"byte flipped in the nonce prefix", func(blob []byte,
+            a *attachment.Attachment) []byte {
+
+            b := append([]byte{}, blob...)
+            b[testStreamHeaderSize-1] ^= 1
+            return b
+        }},
+        {"version changed", func(blob []byte,
+            a *attachment.Attachment) []byte {
+
+            b := append([]byte{}, blob...)
+            b[2] = envelopeVersion
+            return b
+        }},
+        {"blob of another attachment", func(blob []byte,
+            a *attachment.Attachment) []byte {
+
+            a.BlobKey = "other-blob-key"
+            return blob
+        }},
+        {"blob of another page", func(blob []byte,
+            a *attachment.Attachment) []byte {
+
+            a.PageID = 8
+            return blob
+        }},
+    } {
+        tampered := *a
+        got, err := decryptTestAttachment(s, u, pageKey, &tampered,
+            c.tamper(blob, &tampered))
+        if err != ErrAttachmentTampered {
+            t.Errorf("%s: decrypting gave %v bytes: %v", c.name, len(got),
+                err)
+        }
+    }
+
+    // whatever came before the tampering is no longer the whole attachment
+    b := append([]byte{}, blob...)
+    b[len(b)-1] ^= 1
+    r, err := s.DecryptAttachmentContents(a, u, pageKey, bytes.NewReader(b))
+    if err != nil {
+        t.Fatal(err)
+    }
+    n, err := io.Copy(ioutil.Discard, r)
+    if err != ErrAttachmentTampered || n > 2*streamChunkSize {
+        t.Errorf("read %v bytes of a tampered last chunk: %v", n, err)
+    }
+}
+
+func TestAttachmentFieldsAreBound(t *testing.T) {
+    s := NewService(AlgAES256GCM, testKDF)
+    u, pageKey := newSessionUser(t, s)
+    key, err := s.UserDecryptData(u, pageKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, c := range []struct {
+        name   string
+        tamper func(a *attachment.Attachment)
+    }{
+        {"name and type swapped", func(a *attachment.Attachment) {
+            a.Name, a.MIMEType = a.MIMEType, a.Name
+        }},
+        {"blob key changed", func(a *attachment.Attachment) {
+            a.BlobKey = "other-blob-key"
+        }},
+        {"headerless name", func(a *attachment.Attachment) {
+            a.Name = sealHeaderless(t, []byte("evil.html"), key)
+        }},
+    } {
+        a := newTestAttachment()
+        encryptTestAttachment(t, s, u, pageKey, a, nil)
+        c.tamper(a)
+        err := s.DecryptAttachment(a, u, pageKey)
+        if err != ErrAttachmentTampered {
+            t.Errorf("%s: decrypting gave %q / %q: %v", c.name, a.Name,
+                a.MIMEType, err)
+        }
+    }
+}
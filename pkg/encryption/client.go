@@ -0,0 +1,46 @@
+package encryption
+
+/**
+ * This file contains what the server needs to know about browser encryption
+ * (see `cmd/static/client.js`). The browser uses the same key hierarchy and
+ * envelope format as this package, but WebCrypto offers neither Argon2id nor
+ * XChaCha20-Poly1305, so browser-encryption users derive their
+ * password-generated key with PBKDF2 and everything they can read must be
+ * sealed with AES-GCM.
+ */
+
+import (
+    "github.com/setonotes/pkg/user"
+)
+
+/**
+ * The KDF parameters for browser-encryption users: PBKDF2-SHA256 with 6e5
+ * iterations, producing a 256-bit key
+ */
+func (s *Service) ClientKDFParams() user.KDFParams {
+    return user.KDFParams{
+        Algorithm:  user.KDFPBKDF2SHA256,
+        Iterations: 6e5,
+        KeyLength:  32,
+    }
+}
+
+/**
+ * Check whether browsers can decrypt what this server encrypts under 256-bit
+ * keys
+ */
+func (s *Service) ClientEncryptionSupported() bool {
+    return s.algorithm == AlgAES256GCM
+}
+
+/**
+ * Check that data from a browser is an AES-GCM envelope -- the server cannot
+ * decrypt it, but it can make sure it is something the browser can
+ */
+func (s *Service) CheckClientEnvelope(data []byte) bool {
+    alg, _, ok := parseEnvelope(data)
+    if !ok {
+        return false
+    }
+    return alg == AlgAES128GCM || alg == AlgAES256GCM
+}
@@ -0,0 +1,159 @@
+package encryption
+
+import (
+    "bytes"
+    "testing"
+    "os/exec"
+    "io/ioutil"
+    "encoding/json"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+)
+
+/**
+ * A clientFixture is a page and the keys to open it, as written and read by
+ * `testdata/client_harness.js`
+ */
+type clientFixture struct {
+    Password string         `json:"password"`
+    Salt     []byte         `json:"salt"`
+    KDF      user.KDFParams `json:"kdf"`
+    MainKey  []byte         `json:"main_key"`
+    PageKey  []byte         `json:"page_key"`
+    Page     struct {
+        ID      int    `json:"id"`
+        Version int    `json:"version"`
+        Title   []byte `json:"title"`
+        Body    []byte `json:"body"`
+    } `json:"page"`
+    Title string `json:"title"`
+    Body  string `json:"body"`
+}
+
+/**
+ * Open a fixture's page the way the server does for a signed-in user
+ */
+func openClientFixture(s *Service, f *clientFixture) (*page.Page, error) {
+    u := &user.User{Salt: f.Salt, KDF: f.KDF, MainKeyEncrypted: f.MainKey}
+    var err error
+    u.SessionKey, err = s.DeriveKey([]byte(f.Password), u.Salt, u.KDF)
+    if err != nil {
+        return nil, err
+    }
+    p := &page.Page{
+        ID:      f.Page.ID,
+        Version: f.Page.Version,
+        Title:   f.Page.Title,
+        Body:    f.Page.Body,
+    }
+    return p, s.DecryptPage(p, u, f.PageKey)
+}
+
+// regenerate with `node client_harness.js seal > client_fixtures.json`
+func TestDecryptClientFixtures(t *testing.T) {
+    data, err := ioutil.ReadFile("testdata/client_fixtures.json")
+    if err != nil {
+        t.Fatal(err)
+    }
+    fixtures := []*clientFixture{}
+    err = json.Unmarshal(data, &fixtures)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    s := NewService(AlgAES256GCM, DefaultKDFParams())
+    for _, f := range fixtures {
+        p, err := openClientFixture(s, f)
+        if err != nil {
+            t.Errorf("failed to decrypt fixture under KDF %+v: %v", f.KDF,
+                err)
+            continue
+        }
+        if string(p.Title) != f.Title || string(p.Body) != f.Body {
+            t.Errorf("decrypted %q / %q, want %q / %q", p.Title, p.Body,
+                f.Title, f.Body)
+        }
+    }
+}
+
+func TestClientDecryptsServerData(t *testing.T) {
+    node, err := exec.LookPath("node")
+    if err != nil {
+        t.Skip("node is not installed")
+    }
+
+    s := NewService(AlgAES256GCM, DefaultKDFParams())
+    fixtures := []*clientFixture{}
+    for _, kdf := range []user.KDFParams{s.ClientKDFParams(), {}} {
+        f := &clientFixture{
+            Password: "correct horse battery staple",
+            KDF:      kdf,
+            Title:    "Grüße from the server",
+            Body:     "# Notes\n\nWritten and encrypted in Go.",
+        }
+        u := &user.User{KDF: kdf}
+        u.Salt, err = s.NewSalt()
+        if err != nil {
+            t.Fatal(err)
+        }
+        u.SessionKey, err = s.DeriveKey([]byte(f.Password), u.Salt, u.KDF)
+        if err != nil {
+            t.Fatal(err)
+        }
+        mainKey, err := s.NewSymmetricKey()
+        if err != nil {
+            t.Fatal(err)
+        }
+        u.MainKeyEncrypted, err = s.EncryptData(mainKey, u.SessionKey)
+        if err != nil {
+            t.Fatal(err)
+        }
+        pageKey, err := s.NewUserEncryptedSymmetricKey(u)
+        if err != nil {
+            t.Fatal(err)
+        }
+        p := &page.Page{ID: 7, Title: []byte(f.Title), Body: []byte(f.Body)}
+        err = s.EncryptPage(p, u, pageKey)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        f.Salt, f.MainKey, f.PageKey = u.Salt, u.MainKeyEncrypted, pageKey
+        f.Page.ID, f.Page.Version = p.ID, p.Version
+        f.Page.Title, f.Page.Body = p.Title, p.Body
+        fixtures = append(fixtures, f)
+    }
+    input, err := json.Marshal(fixtures)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cmd := exec.Command(node, "testdata/client_harness.js", "open")
+    cmd.Stdin = bytes.NewReader(input)
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    output, err := cmd.Output()
+    if err != nil {
+        t.Fatalf("client failed to decrypt: %v\n%s", err, stderr.String())
+    }
+    results := []struct {
+        Title string `json:"title"`
+        Body  string `json:"body"`
+    }{}
+    err = json.Unmarshal(output, &results)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != len(fixtures) {
+        t.Fatalf("client decrypted %v of %v fixtures", len(results),
+            len(fixtures))
+    }
+    for i, result := range results {
+        if result.Title != fixtures[i].Title ||
+            result.Body != fixtures[i].Body {
+            t.Errorf("client decrypted %q / %q, want %q / %q", result.Title,
+                result.Body, fixtures[i].Title, fixtures[i].Body)
+        }
+    }
+}
@@ -3,35 +3,44 @@ package encryption
 import (
     "log"
     "io"
-    "crypto/sha256"
-    "crypto/aes"
-    "crypto/cipher"
+    "errors"
     "crypto/rand"
 
-    "golang.org/x/crypto/pbkdf2"
+    "golang.org/x/crypto/nacl/box"
+
+    "github.com/setonotes/pkg/user"
 )
 
-type CacheService interface {
-    GetString(key interface{}) (string, error)
-}
+var (
+    ErrInvalidPublicKey  = errors.New("invalid X25519 key")
+    ErrSealedBoxOpen     = errors.New("failed to open sealed box")
+    ErrNoRecoveryCode    = errors.New("user has no recovery code")
+    ErrWrongRecoveryCode = errors.New("wrong recovery code")
+    ErrShortCiphertext   = errors.New("ciphertext too short")
+    ErrNoSessionKey      = errors.New("user has no session key")
+)
 
 type Service struct{
-    cacheService CacheService
+    algorithm Algorithm      // used for new data under 256-bit keys
+    kdf       user.KDFParams // used for new password-generated keys
 }
 
-func NewService(c CacheService) *Service {
-    return &Service{c}
+func NewService(algorithm Algorithm, kdf user.KDFParams) *Service {
+    return &Service{
+        algorithm: algorithm,
+        kdf:       kdf,
+    }
 }
 
 /**
- * Creates a new 128-bit symmetric encryption key
+ * Creates a new 256-bit symmetric encryption key
  *
  * TODO: SECURITY-SENSITIVE -- This should not be exported. This package should
  * be the only package with the privilege of creating (and handling) an
  * unencrypted key.
  */
 func (s *Service) NewSymmetricKey() ([]byte, error) {
-    key , err := getRandomBytes(16)
+    key , err := getRandomBytes(32)
     if err != nil {
         return nil, err
     }
@@ -39,13 +48,60 @@ func (s *Service) NewSymmetricKey() ([]byte, error) {
 }
 
 /**
- * Creates a new 4096-bit RSA public key-pair
- * TODO: Implement this (the entire public-key system needs to be more carefully
- * designed and probably won't use RSA ultimately)
+ * Creates a new X25519 public key-pair for use with NaCl sealed boxes
+ * Returns the private key followed by the public key
+ *
+ * TODO: SECURITY-SENSITIVE -- This should not be exported for the same reasons
+ * as NewSymmetricKey()
  */
 func (s *Service) NewAssymetricKeyPair() ([]byte, []byte, error) {
-    log.Println("attempted to create assymetric key-pair; not implemented")
-    return nil, nil, nil
+    publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+    if err != nil {
+        log.Printf("failed to generate X25519 key-pair: %v", err)
+        return nil, nil, err
+    }
+    return privateKey[:], publicKey[:], nil
+}
+
+/**
+ * Encrypt data to the holder of the given public key using an anonymous NaCl
+ * sealed box (X25519 + XSalsa20-Poly1305)
+ *
+ * Only the holder of the matching private key can open the result, and the
+ * sender does not need a key-pair of their own
+ */
+func sealData(data, publicKey []byte) ([]byte, error) {
+    if len(publicKey) != 32 {
+        return nil, ErrInvalidPublicKey
+    }
+    var pub [32]byte
+    copy(pub[:], publicKey)
+
+    sealed, err := box.SealAnonymous(nil, data, &pub, rand.Reader)
+    if err != nil {
+        log.Printf("failed to seal data to public key: %v", err)
+        return nil, err
+    }
+    return sealed, nil
+}
+
+/**
+ * Open data that was sealed by sealData() given the matching key-pair
+ */
+func openSealedData(data, publicKey, privateKey []byte) ([]byte, error) {
+    if len(publicKey) != 32 || len(privateKey) != 32 {
+        return nil, ErrInvalidPublicKey
+    }
+    var pub, priv [32]byte
+    copy(pub[:], publicKey)
+    copy(priv[:], privateKey)
+
+    opened, ok := box.OpenAnonymous(nil, data, &pub, &priv)
+    if !ok {
+        log.Println("failed to open sealed box")
+        return nil, ErrSealedBoxOpen
+    }
+    return opened, nil
 }
 
 /**
@@ -72,82 +128,24 @@ func getRandomBytes(n int) ([]byte, error) {
 }
 
 /**
- * Generates a 128-bit encryption key given a user-specific salt and password
- * using PBKDF2
- *
- * TODO: SECURITY-SENSITIVE -- This should not be exported. This package should
- * be the only package with the privilege of generating (and handling) an
- * unencrypted key.
- */
-func (s *Service) GenerateKeyFromPassword(password,
-    salt []byte) ([]byte, error) {
-
-    // use 3e5 iterations, 16 bytes == 128 bits
-    // error is returned because it's not clear why pdkdf2 does not return an
-    // error, and the error might be useful for forward-compatibility
-    return pbkdf2.Key(password, salt, 3e5, 16, sha256.New), nil
-}
-
-/**
- * Encrypt byteslice of data using AES encryption
- * See https://www.thepolyglotdeveloper.com/2018/02/encrypt-decrypt-data-
- *     golang-application-crypto-packages/
+ * Encrypt byteslice of data in a versioned envelope (see envelope.go) --
+ * 256-bit keys use the service's configured algorithm, while 128-bit keys from
+ * before envelopes existed use AES-128-GCM
  *
  * TODO: This function probably doesn't need to be exported because no caller
  * outside this package should be able to supply an unencrypted key anyway.
  */
 func (s *Service) EncryptData(data, key []byte) ([]byte, error) {
-    block, err := aes.NewCipher(key)
-    if err != nil {
-        log.Printf("failed to create new AES cipher for encryption: %v", err)
-        return nil, err
-    }
-
-    gcm, err := cipher.NewGCM(block)
-    if err != nil {
-        log.Printf("failed to create new GCM for encryption: %v", err)
-        return nil, err
-    }
-
-    nonce, err := getRandomBytes(gcm.NonceSize())
-    if err != nil {
-        return nil, err
-    }
-
-    // in some places the below line is this instead:
-    // ciphertext := gcm.Seal(nil, nonce, data, nil)
-    ciphertext := gcm.Seal(nonce, nonce, data, nil)
-    return ciphertext, nil
+    return s.sealEnvelope(data, key, nil)
 }
 
 /**
- * Decrypt byteslice of data that was encrypted by encryptData()
- * See https://www.thepolyglotdeveloper.com/2018/02/encrypt-decrypt-data-
- *     golang-application-crypto-packages/
+ * Decrypt byteslice of data that was encrypted by EncryptData() -- data from
+ * before envelopes existed (bare AES-GCM `nonce||ciphertext`) is also accepted
  *
  * TODO: This function probably doesn't need to be exported because no caller
  * outside this package should be able to supply an unencrypted key anyway.
  */
 func (s *Service) DecryptData(data, key []byte) ([]byte, error) {
-    block, err := aes.NewCipher(key)
-    if err != nil {
-        log.Printf("failed to create new AES cipher for decrypttion: %v", err)
-        return nil, err
-    }
-
-    gcm, err := cipher.NewGCM(block)
-    if err != nil {
-        log.Printf("failed to create new GCM for decryption: %v", err)
-        return nil, err
-    }
-
-    nonceSize := gcm.NonceSize()
-    nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-    plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-    if err != nil {
-        log.Printf("failed to open GCM for decryption: %v", err)
-        return nil, err
-    }
-
-    return plaintext, nil
+    return s.openEnvelope(data, key, nil)
 }
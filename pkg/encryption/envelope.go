@@ -0,0 +1,272 @@
+package encryption
+
+/**
+ * This file defines the self-describing ciphertext envelope written by
+ * EncryptData(). Every envelope starts with an 8-byte header:
+ *
+ *     offset  size  field
+ *          0     2  magic ("SN")
+ *          2     1  envelope format version
+ *          3     1  algorithm ID
+ *          4     4  key ID (truncated SHA-256 fingerprint of the key)
+ *
+ * followed by the nonce and the AEAD ciphertext. The header is authenticated
+ * as additional data, so it cannot be changed without decryption failing.
+ *
+ * Data written before envelopes existed is a bare AES-GCM `nonce||ciphertext`
+ * with no header. Because that starts with a random nonce, anything that does
+ * not parse (and authenticate) as an envelope is decrypted the old way --
+ * except data bound to additional data, which has only ever been written in
+ * an envelope.
+ */
+
+import (
+    "log"
+    "bytes"
+    "errors"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/sha256"
+
+    "golang.org/x/crypto/chacha20poly1305"
+)
+
+type Algorithm byte
+
+const (
+    AlgAES128GCM         Algorithm = 1
+    AlgAES256GCM         Algorithm = 2
+    AlgXChaCha20Poly1305 Algorithm = 3
+)
+
+const (
+    envelopeVersion    = 1
+    envelopeHeaderSize = 8
+)
+
+var envelopeMagic = []byte("SN")
+
+var (
+    ErrUnknownAlgorithm = errors.New("unknown encryption algorithm")
+    ErrKeySize          = errors.New("key size does not suit algorithm")
+    ErrWrongKey         = errors.New("data was encrypted with another key")
+    ErrNoEnvelope       = errors.New("bound data is not in an envelope")
+)
+
+/**
+ * Parse an algorithm name as used in the configuration file
+ */
+func ParseAlgorithm(name string) (Algorithm, error) {
+    switch name {
+    case "", "aes-256-gcm":
+        return AlgAES256GCM, nil
+    case "xchacha20-poly1305":
+        return AlgXChaCha20Poly1305, nil
+    }
+    return 0, ErrUnknownAlgorithm
+}
+
+/**
+ * Create the AEAD for an algorithm and key
+ */
+func newAEAD(alg Algorithm, key []byte) (cipher.AEAD, error) {
+    switch alg {
+    case AlgAES128GCM, AlgAES256GCM:
+        if (alg == AlgAES128GCM && len(key) != 16) ||
+            (alg == AlgAES256GCM && len(key) != 32) {
+            return nil, ErrKeySize
+        }
+        block, err := aes.NewCipher(key)
+        if err != nil {
+            return nil, err
+        }
+        return cipher.NewGCM(block)
+    case AlgXChaCha20Poly1305:
+        if len(key) != chacha20poly1305.KeySize {
+            return nil, ErrKeySize
+        }
+        return chacha20poly1305.NewX(key)
+    }
+    return nil, ErrUnknownAlgorithm
+}
+
+/**
+ * Fingerprint a key so that an envelope records which key sealed it
+ */
+func keyID(key []byte) []byte {
+    sum := sha256.Sum256(append([]byte("setonotes key id\x00"), key...))
+    return sum[:4]
+}
+
+/**
+ * Choose the algorithm for a key -- 128-bit keys (everything created before
+ * envelopes existed) can only use AES-128-GCM
+ */
+func (s *Service) algorithmForKey(key []byte) Algorithm {
+    if len(key) == 16 {
+        return AlgAES128GCM
+    }
+    return s.algorithm
+}
+
+/**
+ * Seal data in an envelope, authenticating additionalData along with the
+ * header
+ */
+func (s *Service) sealEnvelope(data, key, additionalData []byte) ([]byte,
+    error) {
+
+    alg := s.algorithmForKey(key)
+    aead, err := newAEAD(alg, key)
+    if err != nil {
+        log.Printf("failed to create AEAD for encryption: %v", err)
+        return nil, err
+    }
+
+    nonce, err := getRandomBytes(aead.NonceSize())
+    if err != nil {
+        return nil, err
+    }
+
+    header := make([]byte, 0, envelopeHeaderSize)
+    header = append(header, envelopeMagic...)
+    header = append(header, envelopeVersion, byte(alg))
+    header = append(header, keyID(key)...)
+
+    out := make([]byte, 0, len(header)+len(nonce)+len(data)+aead.Overhead())
+    out = append(out, header...)
+    out = append(out, nonce...)
+    return aead.Seal(out, nonce, data, authenticated(header, additionalData)),
+        nil
+}
+
+/**
+ * Join the envelope header and the caller's additional data
+ */
+func authenticated(header, additionalData []byte) []byte {
+    result := make([]byte, 0, len(header)+len(additionalData))
+    result = append(result, header...)
+    return append(result, additionalData...)
+}
+
+/**
+ * Parse an envelope header
+ * Returns false if the data does not start with a recognised header
+ */
+func parseEnvelope(data []byte) (Algorithm, []byte, bool) {
+    if len(data) < envelopeHeaderSize ||
+        !bytes.Equal(data[:2], envelopeMagic) ||
+        data[2] != envelopeVersion {
+        return 0, nil, false
+    }
+    alg := Algorithm(data[3])
+    switch alg {
+    case AlgAES128GCM, AlgAES256GCM, AlgXChaCha20Poly1305:
+    default:
+        return 0, nil, false
+    }
+    return alg, data[4:envelopeHeaderSize], true
+}
+
+/**
+ * Open an envelope sealed by sealEnvelope(), falling back to the headerless
+ * format for older data
+ *
+ * Data opened with additionalData must be in an envelope: headerless data is
+ * not bound to anything, so falling back would accept a ciphertext from
+ * elsewhere under the same key (such as a field of an older page version) in
+ * place of the bound one
+ */
+func (s *Service) openEnvelope(data, key, additionalData []byte) ([]byte,
+    error) {
+
+    headerless := func(err error) ([]byte, error) {
+        if additionalData != nil {
+            return nil, err
+        }
+        return openHeaderless(data, key)
+    }
+
+    alg, id, ok := parseEnvelope(data)
+    if !ok {
+        if additionalData != nil {
+            log.Println("bound data is not in an envelope")
+        }
+        return headerless(ErrNoEnvelope)
+    }
+
+    if !bytes.Equal(id, keyID(key)) {
+        // a headerless blob can start with a valid-looking header by chance
+        if plaintext, err := headerless(ErrWrongKey); err == nil {
+            return plaintext, nil
+        }
+        log.Println("envelope key ID does not match key")
+        return nil, ErrWrongKey
+    }
+
+    aead, err := newAEAD(alg, key)
+    if err != nil {
+        log.Printf("failed to create AEAD for decryption: %v", err)
+        return nil, err
+    }
+
+    rest := data[envelopeHeaderSize:]
+    if len(rest) < aead.NonceSize() {
+        return headerless(ErrShortCiphertext)
+    }
+    nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+    header := data[:envelopeHeaderSize]
+    plaintext, err := aead.Open(nil, nonce, ciphertext,
+        authenticated(header, additionalData))
+    if err != nil {
+        if plaintext, err2 := headerless(err); err2 == nil {
+            return plaintext, nil
+        }
+        log.Printf("failed to open envelope: %v", err)
+        return nil, err
+    }
+
+    return plaintext, nil
+}
+
+/**
+ * Decrypt data written before envelopes existed (AES-GCM `nonce||ciphertext`)
+ */
+func openHeaderless(data, key []byte) ([]byte, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        log.Printf("failed to create new AES cipher for decryption: %v", err)
+        return nil, err
+    }
+
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        log.Printf("failed to create new GCM for decryption: %v", err)
+        return nil, err
+    }
+
+    nonceSize := gcm.NonceSize()
+    if len(data) < nonceSize {
+        return nil, ErrShortCiphertext
+    }
+    nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+    plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+    if err != nil {
+        log.Printf("failed to open GCM for decryption: %v", err)
+        return nil, err
+    }
+
+    return plaintext, nil
+}
+
+/**
+ * Check whether data should be re-encrypted -- that is, it has no envelope or
+ * was not sealed with the current algorithm
+ */
+func (s *Service) NeedsUpgrade(data []byte) bool {
+    if len(data) == 0 {
+        return false
+    }
+    alg, _, ok := parseEnvelope(data)
+    return !ok || alg != s.algorithm
+}
@@ -0,0 +1,95 @@
+package encryption
+
+/**
+ * This file contains the only password-based key derivation in setonotes.
+ * Each user's derivation parameters are stored with the user (see
+ * user.KDFParams), so the defaults can be raised over time and older accounts
+ * upgraded when they next sign in.
+ */
+
+import (
+    "log"
+    "errors"
+    "crypto/sha256"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/pbkdf2"
+
+    "github.com/setonotes/pkg/user"
+)
+
+var ErrUnknownKDF = errors.New("unknown key derivation function")
+
+/**
+ * The default parameters for new password-generated keys: Argon2id with
+ * 3 passes over 64 MiB, producing a 256-bit key
+ */
+func DefaultKDFParams() user.KDFParams {
+    return user.KDFParams{
+        Algorithm:  user.KDFArgon2id,
+        Iterations: 3,
+        MemoryKiB:  64 * 1024,
+        Threads:    4,
+        KeyLength:  32,
+    }
+}
+
+/**
+ * The parameters every user had before they were stored: PBKDF2-SHA256 with
+ * 3e5 iterations, producing a 128-bit key
+ */
+var legacyKDFParams = user.KDFParams{
+    Algorithm:  user.KDFPBKDF2SHA256,
+    Iterations: 3e5,
+    KeyLength:  16,
+}
+
+/**
+ * Recovery codes carry 160 bits of entropy, so they do not need a memory-hard
+ * derivation, but they do need a 256-bit key so that what they wrap is not
+ * sealed with AES-128 -- codes issued before were derived with the legacy
+ * parameters, which are told apart by the key ID of what they wrap (see
+ * recoveryKey())
+ */
+var recoveryKDFParams = user.KDFParams{
+    Algorithm:  user.KDFPBKDF2SHA256,
+    Iterations: 3e5,
+    KeyLength:  32,
+}
+
+var legacyRecoveryKDFParams = legacyKDFParams
+
+/**
+ * Derive a key from a password and salt with the given parameters -- empty
+ * parameters mean the legacy PBKDF2 derivation
+ *
+ * TODO: SECURITY-SENSITIVE -- This should not be exported. This package should
+ * be the only package with the privilege of generating (and handling) an
+ * unencrypted key.
+ */
+func (s *Service) DeriveKey(password, salt []byte,
+    params user.KDFParams) ([]byte, error) {
+
+    if params == (user.KDFParams{}) {
+        params = legacyKDFParams
+    }
+
+    switch params.Algorithm {
+    case user.KDFArgon2id:
+        return argon2.IDKey(password, salt, params.Iterations,
+            params.MemoryKiB, params.Threads, params.KeyLength), nil
+    case user.KDFPBKDF2SHA256:
+        return pbkdf2.Key(password, salt, int(params.Iterations),
+            int(params.KeyLength), sha256.New), nil
+    }
+
+    log.Printf("unknown key derivation function <%s>", params.Algorithm)
+    return nil, ErrUnknownKDF
+}
+
+/**
+ * Get the parameters used for new password-generated keys
+ */
+func (s *Service) CurrentKDFParams() user.KDFParams {
+    return s.kdf
+}
@@ -0,0 +1,120 @@
+package encryption
+
+/**
+ * This file contains the code for upgrading version-1 accounts. Under version
+ * 1, every page was encrypted directly with the hex-encoded MD5 hash of its
+ * sole owner's password. Version 2 introduced the main-key and per-page keys, which are
+ * created here for the legacy account. Nothing outside this package sees any
+ * of the unencrypted keys involved.
+ */
+
+import (
+    "log"
+    "crypto/md5"
+    "encoding/hex"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+)
+
+/**
+ * Derive the version-1 page key from a password -- the key was the MD5 hash
+ * as a hex string, so it is 32 bytes long and used for AES-256
+ */
+func legacyKeyFromPassword(password []byte) []byte {
+    sum := md5.Sum(password)
+    return []byte(hex.EncodeToString(sum[:]))
+}
+
+/**
+ * Upgrade a version-1 user and their pages to the version-2 key hierarchy --
+ * A salt, main-key and key-pair are created and wrapped under the password as
+ * in user.Service.Create(), along with a recovery code. Each page is decrypted
+ * with the legacy key and re-encrypted under a fresh page key.
+ *
+ * The user and pages are updated in place (including their versions) but
+ * nothing is stored; the caller must store everything atomically. Returns one
+ * user-encrypted page key per page, in the same order as the pages, followed
+ * by the new recovery code.
+ */
+func (s *Service) UpgradeLegacyUser(u *user.User, password []byte,
+    pages []*page.Page) ([][]byte, string, error) {
+
+    legacyKey := legacyKeyFromPassword(password)
+
+    // decrypt all pages before changing anything
+    plaintexts := make([][2][]byte, len(pages))
+    for i, p := range pages {
+        for j, field := range [][]byte{p.Title, p.Body} {
+            if len(field) == 0 {
+                continue
+            }
+            plaintext, err := s.DecryptData(field, legacyKey)
+            if err != nil {
+                log.Printf("failed to decrypt legacy page-%v", p.ID)
+                return nil, "", err
+            }
+            plaintexts[i][j] = plaintext
+        }
+    }
+
+    // create the version-2 user keys
+    salt, err := s.NewSalt()
+    if err != nil {
+        return nil, "", err
+    }
+    passwordGeneratedKey, err := s.DeriveKey(password, salt, s.kdf)
+    if err != nil {
+        return nil, "", err
+    }
+    mainKey, err := s.NewSymmetricKey()
+    if err != nil {
+        return nil, "", err
+    }
+    mainKeyEncrypted, err := s.EncryptData(mainKey, passwordGeneratedKey)
+    if err != nil {
+        return nil, "", err
+    }
+    privateKey, publicKey, err := s.NewAssymetricKeyPair()
+    if err != nil {
+        return nil, "", err
+    }
+    privateKeyEncrypted, err := s.EncryptData(privateKey, passwordGeneratedKey)
+    if err != nil {
+        return nil, "", err
+    }
+
+    u.Salt = salt
+    u.KDF = s.kdf
+    u.MainKeyEncrypted = mainKeyEncrypted
+    u.PrivateKeyEncrypted = privateKeyEncrypted
+    u.PublicKey = publicKey
+    u.Version = user.CurrentVersion
+
+    // create recovery code
+    recoveryCode, err := s.SetRecoveryCode(u, password)
+    if err != nil {
+        return nil, "", err
+    }
+
+    // re-encrypt each page under a fresh page key
+    pageKeys := make([][]byte, len(pages))
+    for i, p := range pages {
+        pageKey, err := s.NewSymmetricKey()
+        if err != nil {
+            return nil, "", err
+        }
+        pageKeys[i], err = s.EncryptData(pageKey, mainKey)
+        if err != nil {
+            return nil, "", err
+        }
+
+        p.Title, p.Body = plaintexts[i][0], plaintexts[i][1]
+        err = s.encryptPageFields(p, pageKey)
+        if err != nil {
+            return nil, "", err
+        }
+    }
+
+    return pageKeys, recoveryCode, nil
+}
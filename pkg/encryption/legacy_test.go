@@ -0,0 +1,92 @@
+package encryption
+
+import (
+    "testing"
+    "encoding/hex"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+)
+
+// a version-1 page of oe_test (password "testing"), from
+// `gen_test_users/create_encryption_test_users.sql`
+const (
+    legacyPassword = "testing"
+    legacyTitle    = "fbfc66192ab0ccf76ea2a4704ce0f53d9a9316ed12360b4af7f05" +
+        "024fdb3071c82032582f5dc48"
+    legacyBody = "9e8d2c77c75f1ec542e9b0b8a8a13f287d50c57ba88c3d0dcc24fbd49" +
+        "cf8ac52ff43d1736fa9706d2e2944a38cffb4de83b3f46416"
+)
+
+// cheap KDF parameters, so the tests do not spend their time deriving keys
+var testKDF = user.KDFParams{
+    Algorithm:  user.KDFArgon2id,
+    Iterations: 1,
+    MemoryKiB:  64,
+    Threads:    1,
+    KeyLength:  32,
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+    b, err := hex.DecodeString(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return b
+}
+
+func TestLegacyKeyDecryptsFixture(t *testing.T) {
+    s := NewService(AlgAES256GCM, testKDF)
+    key := legacyKeyFromPassword([]byte(legacyPassword))
+
+    for _, c := range []struct {
+        ciphertext string
+        want       string
+    }{
+        {legacyTitle, "Second Page"},
+        {legacyBody, "This is just a test page."},
+    } {
+        plaintext, err := s.DecryptData(mustDecodeHex(t, c.ciphertext), key)
+        if err != nil {
+            t.Fatalf("failed to decrypt fixture: %v", err)
+        }
+        if string(plaintext) != c.want {
+            t.Errorf("decrypted %q, want %q", plaintext, c.want)
+        }
+    }
+}
+
+func TestUpgradeLegacyUser(t *testing.T) {
+    s := NewService(AlgAES256GCM, testKDF)
+    u := &user.User{ID: 1, Version: 1}
+    p := &page.Page{
+        ID:    2,
+        Title: mustDecodeHex(t, legacyTitle),
+        Body:  mustDecodeHex(t, legacyBody),
+    }
+
+    pageKeys, recoveryCode, err := s.UpgradeLegacyUser(u,
+        []byte(legacyPassword), []*page.Page{p})
+    if err != nil {
+        t.Fatalf("failed to upgrade legacy user: %v", err)
+    }
+    if u.Version != user.CurrentVersion || len(pageKeys) != 1 ||
+        recoveryCode == "" {
+        t.Fatalf("user not upgraded: version %v, %v page keys", u.Version,
+            len(pageKeys))
+    }
+
+    // the page now opens with the new key hierarchy
+    u.SessionKey, err = s.DeriveKey([]byte(legacyPassword), u.Salt, u.KDF)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = s.DecryptPage(p, u, pageKeys[0])
+    if err != nil {
+        t.Fatalf("failed to decrypt upgraded page: %v", err)
+    }
+    if string(p.Title) != "Second Page" ||
+        string(p.Body) != "This is just a test page." {
+        t.Errorf("upgraded page decrypted to %q / %q", p.Title, p.Body)
+    }
+}
@@ -0,0 +1,69 @@
+package encryption
+
+/**
+ * This file contains the encryption of notebook names. A notebook belongs to a
+ * single user, so its name is encrypted with that user's main-key, bound to
+ * the notebook ID as AEAD additional data so that names cannot be swapped
+ * between notebooks.
+ */
+
+import (
+    "log"
+    "errors"
+    "strconv"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/notebook"
+)
+
+var ErrNotebookTampered = errors.New("notebook failed authentication")
+
+/**
+ * Build the additional data for a notebook name
+ */
+func notebookNameAD(nb *notebook.Notebook) []byte {
+    return []byte("setonotes notebook id " + strconv.Itoa(nb.ID) + " name")
+}
+
+/**
+ * Encrypt a notebook's Name with its owner's main-key
+ */
+func (s *Service) EncryptNotebookName(nb *notebook.Notebook,
+    u *user.User) error {
+
+    mainKey, err := s.getMainKey(u)
+    if err != nil {
+        return err
+    }
+
+    name, err := s.sealEnvelope(nb.Name, mainKey, notebookNameAD(nb))
+    if err != nil {
+        return err
+    }
+    nb.Name = name
+    return nil
+}
+
+/**
+ * Decrypt a notebook's Name with its owner's main-key -- ErrNotebookTampered
+ * is returned if the name fails authentication
+ */
+func (s *Service) DecryptNotebookName(nb *notebook.Notebook,
+    u *user.User) error {
+
+    mainKey, err := s.getMainKey(u)
+    if err != nil {
+        return err
+    }
+
+    name, err := s.openEnvelope(nb.Name, mainKey, notebookNameAD(nb))
+    if err == ErrWrongKey || err == ErrKeySize {
+        return err
+    } else if err != nil {
+        log.Printf("SECURITY: name of notebook-%v failed authentication; "+
+            "possible tampering", nb.ID)
+        return ErrNotebookTampered
+    }
+    nb.Name = name
+    return nil
+}
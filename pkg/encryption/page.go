@@ -5,35 +5,52 @@ package encryption
  * page. This is the only code allowed to handle unencrypted page-keys (for now
  * at least -- there may be another file related to permissions, but it will
  * also be contained within this package
+ *
+ * Since page version 3, the title and body are each bound to their page ID,
+ * field name and page version as AEAD additional data (see pageFieldAD()).
+ * This stops anyone with write access to the database from swapping a title
+ * into a body or moving ciphertexts between pages that share a key. Pages of
+ * older versions are still decrypted without additional data, and are upgraded
+ * the next time they are encrypted.
  */
 
 import (
+    "log"
+    "errors"
+    "strconv"
+
     "github.com/setonotes/pkg/user"
     "github.com/setonotes/pkg/page"
 )
 
+var ErrPageTampered = errors.New("page failed authentication")
+
+// first page version whose fields are bound to additional data
+const pageVersionAD = 3
+
 /**
- * Encrypt a page for a particular user --
- * Get the user-encrypted page key from the repo, decrypt it with
- * s.UserDecryptData(), and use it to encrypt the page
+ * Build the additional data for a page field
  */
-func (s *Service) EncryptPage(p *page.Page, u *user.User,
-    userEncryptedPageKey []byte) error {
+func pageFieldAD(p *page.Page, field string) []byte {
+    return []byte("setonotes page v" + strconv.Itoa(p.Version) + " id " +
+        strconv.Itoa(p.ID) + " " + field)
+}
 
-    // decrypt page-key with user-decrypt function
-    key, err := s.UserDecryptData(u, userEncryptedPageKey)
-    if err != nil {
-        return err
-    }
+/**
+ * Encrypt a page's Title and Body with an unencrypted page key, bound to the
+ * current page version
+ */
+func (s *Service) encryptPageFields(p *page.Page, key []byte) error {
+    p.Version = page.CurrentVersion
 
     // encrypt the page Title
-    title, err := s.EncryptData(p.Title, key)
+    title, err := s.sealEnvelope(p.Title, key, pageFieldAD(p, "title"))
     if err != nil {
         return err
     }
 
     // encrypt the page Body
-    body, err := s.EncryptData(p.Body, key)
+    body, err := s.sealEnvelope(p.Body, key, pageFieldAD(p, "body"))
     if err != nil {
         return err
     }
@@ -44,13 +61,59 @@ func (s *Service) EncryptPage(p *page.Page, u *user.User,
     return nil
 }
 
+/**
+ * Decrypt a single page field with an unencrypted page key
+ *
+ * Authentication failures under the right key are reported as tampering --
+ * the key ID in the envelope tells a wrong key apart from altered data
+ */
+func (s *Service) decryptPageField(p *page.Page, field string, data,
+    key []byte) ([]byte, error) {
+
+    var additionalData []byte
+    if p.Version >= pageVersionAD {
+        additionalData = pageFieldAD(p, field)
+    }
+
+    plaintext, err := s.openEnvelope(data, key, additionalData)
+    if err == nil {
+        return plaintext, nil
+    }
+    if err == ErrWrongKey || err == ErrKeySize {
+        return nil, err
+    }
+    log.Printf("SECURITY: %s of page-%v (version %v) failed authentication; "+
+        "possible tampering", field, p.ID, p.Version)
+    return nil, ErrPageTampered
+}
+
+/**
+ * Encrypt a page for a particular user --
+ * Get the user-encrypted page key from the repo, decrypt it with
+ * s.UserDecryptData(), and use it to encrypt the page
+ *
+ * The page's Version is set to the current page version
+ */
+func (s *Service) EncryptPage(p *page.Page, u *user.User,
+    userEncryptedPageKey []byte) error {
+
+    // decrypt page-key with user-decrypt function
+    key, err := s.UserDecryptData(u, userEncryptedPageKey)
+    if err != nil {
+        return err
+    }
+
+    return s.encryptPageFields(p, key)
+}
+
 /**
  * Decrypt a page for a particular user --
  * Get the user-encrypted page key from the repo, decrypt it with
  * s.UserDecryptData(), and use it to decrypt the page
  *
  * If either the Title or the Body of the page is an empty byteslice, it will be
- * left empty and decryption will not be attempted
+ * left empty and decryption will not be attempted. ErrPageTampered is returned
+ * if either field fails authentication.
  */
 func (s *Service) DecryptPage(p *page.Page, u *user.User,
     userEncryptedPageKey []byte) error {
@@ -63,7 +126,7 @@ func (s *Service) DecryptPage(p *page.Page, u *user.User,
 
     var title []byte
     if len(p.Title) > 0 {
-        title, err = s.DecryptData(p.Title, key)
+        title, err = s.decryptPageField(p, "title", p.Title, key)
         if err != nil {
             return err
         }
@@ -71,7 +134,7 @@ func (s *Service) DecryptPage(p *page.Page, u *user.User,
 
     var body []byte
     if len(p.Body) > 0 {
-        body, err = s.DecryptData(p.Body, key)
+        body, err = s.decryptPageField(p, "body", p.Body, key)
         if err != nil {
             return err
         }
@@ -82,4 +145,3 @@ func (s *Service) DecryptPage(p *page.Page, u *user.User,
     p.Body  = body
     return nil
 }
-
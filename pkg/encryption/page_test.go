@@ -0,0 +1,158 @@
+package encryption
+
+import (
+    "testing"
+    "crypto/aes"
+    "crypto/cipher"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+)
+
+/**
+ * Create a signed-in user, and a page key wrapped under their main-key
+ */
+func newSessionUser(t *testing.T, s *Service) (*user.User, []byte) {
+    u := &user.User{ID: 1, Version: user.CurrentVersion, KDF: testKDF}
+    var err error
+    u.Salt, err = s.NewSalt()
+    if err != nil {
+        t.Fatal(err)
+    }
+    u.SessionKey, err = s.DeriveKey([]byte("password"), u.Salt, u.KDF)
+    if err != nil {
+        t.Fatal(err)
+    }
+    mainKey, err := s.NewSymmetricKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    u.MainKeyEncrypted, err = s.EncryptData(mainKey, u.SessionKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pageKey, err := s.NewUserEncryptedSymmetricKey(u)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return u, pageKey
+}
+
+/**
+ * Encrypt data as it was before envelopes existed, with no header and no
+ * additional data
+ */
+func sealHeaderless(t *testing.T, data, key []byte) []byte {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        t.Fatal(err)
+    }
+    nonce, err := getRandomBytes(gcm.NonceSize())
+    if err != nil {
+        t.Fatal(err)
+    }
+    return gcm.Seal(nonce, nonce, data, nil)
+}
+
+func encryptTestPage(t *testing.T, s *Service, u *user.User, pageKey []byte,
+    id int, title, body string) *page.Page {
+
+    p := &page.Page{ID: id, Title: []byte(title), Body: []byte(body)}
+    err := s.EncryptPage(p, u, pageKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return p
+}
+
+func TestPageRoundTrip(t *testing.T) {
+    s := NewService(AlgXChaCha20Poly1305, testKDF)
+    u, pageKey := newSessionUser(t, s)
+    p := encryptTestPage(t, s, u, pageKey, 7, "Plans", "one\ntwo\n")
+    if p.Version != page.CurrentVersion {
+        t.Errorf("page encrypted at version %v", p.Version)
+    }
+
+    err := s.DecryptPage(p, u, pageKey)
+    if err != nil || string(p.Title) != "Plans" ||
+        string(p.Body) != "one\ntwo\n" {
+        t.Errorf("decrypted %q / %q: %v", p.Title, p.Body, err)
+    }
+}
+
+func TestPageFieldsAreBound(t *testing.T) {
+    s := NewService(AlgAES256GCM, testKDF)
+    u, pageKey := newSessionUser(t, s)
+    key, err := s.UserDecryptData(u, pageKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    other := encryptTestPage(t, s, u, pageKey, 8, "Other", "other body")
+
+    for _, c := range []struct {
+        name   string
+        tamper func(p *page.Page)
+    }{
+        {"title and body swapped", func(p *page.Page) {
+            p.Title, p.Body = p.Body, p.Title
+        }},
+        {"field of another page under the same key", func(p *page.Page) {
+            p.Body = other.Body
+        }},
+        {"page ID changed", func(p *page.Page) {
+            p.ID = other.ID
+        }},
+        {"version lowered", func(p *page.Page) {
+            p.Version = pageVersionAD - 1
+        }},
+        // as a field of a version-2 revision would be
+        {"headerless ciphertext replayed", func(p *page.Page) {
+            p.Body = sealHeaderless(t, []byte("old body"), key)
+        }},
+        {"envelope header stripped", func(p *page.Page) {
+            p.Body = p.Body[envelopeHeaderSize:]
+        }},
+        {"ciphertext cut short", func(p *page.Page) {
+            p.Title = p.Title[:envelopeHeaderSize+4]
+        }},
+    } {
+        p := encryptTestPage(t, s, u, pageKey, 7, "Plans", "one\ntwo\n")
+        c.tamper(p)
+        err := s.DecryptPage(p, u, pageKey)
+        if err != ErrPageTampered {
+            t.Errorf("%s: decrypting gave %v (%q / %q)", c.name, err,
+                p.Title, p.Body)
+        }
+    }
+}
+
+func TestOlderPageVersionsStillDecrypt(t *testing.T) {
+    s := NewService(AlgAES256GCM, testKDF)
+    u, pageKey := newSessionUser(t, s)
+    key, err := s.UserDecryptData(u, pageKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // version 2 pages were written headerless, then in envelopes without
+    // additional data
+    enveloped, err := s.sealEnvelope([]byte("enveloped"), key, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    p := &page.Page{
+        ID:      7,
+        Version: pageVersionAD - 1,
+        Title:   sealHeaderless(t, []byte("headerless"), key),
+        Body:    enveloped,
+    }
+    err = s.DecryptPage(p, u, pageKey)
+    if err != nil || string(p.Title) != "headerless" ||
+        string(p.Body) != "enveloped" {
+        t.Errorf("decrypted %q / %q: %v", p.Title, p.Body, err)
+    }
+}
@@ -0,0 +1,194 @@
+package encryption
+
+/**
+ * This file contains the account-recovery functionality. A recovery code is a
+ * high-entropy secret shown to the user once. A key derived from it wraps the
+ * user's main-key and private key a second time, so that a forgotten password
+ * does not make every page unreadable.
+ */
+
+import (
+    "bytes"
+    "strings"
+    "encoding/base32"
+
+    "github.com/setonotes/pkg/user"
+)
+
+// 20 random bytes encode to 32 base32 characters (160 bits)
+const recoveryCodeBytes = 20
+
+/**
+ * Format raw bytes as a recovery code, e.g. ABCD-EFGH-...
+ */
+func formatRecoveryCode(data []byte) string {
+    encoded := base32.StdEncoding.WithPadding(base32.NoPadding).
+        EncodeToString(data)
+    groups := []string{}
+    for i := 0; i < len(encoded); i += 4 {
+        end := i + 4
+        if end > len(encoded) {
+            end = len(encoded)
+        }
+        groups = append(groups, encoded[i:end])
+    }
+    return strings.Join(groups, "-")
+}
+
+/**
+ * Normalize a recovery code as typed by a user -- case, dashes and whitespace
+ * are ignored
+ */
+func normalizeRecoveryCode(code string) []byte {
+    code = strings.ToUpper(code)
+    code = strings.NewReplacer("-", "", " ", "", "\t", "", "\n", "",
+        "\r", "").Replace(code)
+    return []byte(code)
+}
+
+/**
+ * Create a new recovery code for a user and store a second wrapping of their
+ * main-key and private key on the user struct --
+ * The password is used to unwrap the current keys. The caller is responsible
+ * for storing the updated user fields.
+ *
+ * Returns the recovery code, which must be shown to the user and then
+ * forgotten
+ */
+func (s *Service) SetRecoveryCode(u *user.User,
+    password []byte) (string, error) {
+
+    // unwrap current keys
+    passwordGeneratedKey, err := s.DeriveKey(password, u.Salt, u.KDF)
+    if err != nil {
+        return "", err
+    }
+    mainKey, err := s.DecryptData(u.MainKeyEncrypted, passwordGeneratedKey)
+    if err != nil {
+        return "", err
+    }
+    var privateKey []byte
+    if len(u.PrivateKeyEncrypted) > 0 {
+        privateKey, err = s.DecryptData(u.PrivateKeyEncrypted,
+            passwordGeneratedKey)
+        if err != nil {
+            return "", err
+        }
+    }
+
+    return s.wrapRecoveryKeys(u, mainKey, privateKey)
+}
+
+/**
+ * Create a new recovery code and wrap an unwrapped main-key and private key
+ * (which may be empty) with it on the user struct
+ */
+func (s *Service) wrapRecoveryKeys(u *user.User, mainKey,
+    privateKey []byte) (string, error) {
+
+    // create recovery code and derive recovery key
+    codeBytes, err := getRandomBytes(recoveryCodeBytes)
+    if err != nil {
+        return "", err
+    }
+    code := formatRecoveryCode(codeBytes)
+    salt, err := s.NewSalt()
+    if err != nil {
+        return "", err
+    }
+    recoveryKey, err := s.DeriveKey(normalizeRecoveryCode(code), salt,
+        recoveryKDFParams)
+    if err != nil {
+        return "", err
+    }
+
+    // wrap keys with recovery key
+    mainKeyRecoveryEncrypted, err := s.EncryptData(mainKey, recoveryKey)
+    if err != nil {
+        return "", err
+    }
+    var privateKeyRecoveryEncrypted []byte
+    if len(privateKey) > 0 {
+        privateKeyRecoveryEncrypted, err = s.EncryptData(privateKey,
+            recoveryKey)
+        if err != nil {
+            return "", err
+        }
+    }
+
+    u.RecoverySalt = salt
+    u.MainKeyRecoveryEncrypted = mainKeyRecoveryEncrypted
+    u.PrivateKeyRecoveryEncrypted = privateKeyRecoveryEncrypted
+    return code, nil
+}
+
+/**
+ * Derive the key a recovery code wraps a user's keys with -- codes issued
+ * before recovery keys were 256 bits long use the legacy parameters, which is
+ * the case unless the wrapped main-key names the 256-bit key
+ */
+func (s *Service) recoveryKey(u *user.User, code string) ([]byte, error) {
+    key, err := s.DeriveKey(normalizeRecoveryCode(code), u.RecoverySalt,
+        recoveryKDFParams)
+    if err != nil {
+        return nil, err
+    }
+    _, id, ok := parseEnvelope(u.MainKeyRecoveryEncrypted)
+    if ok && bytes.Equal(id, keyID(key)) {
+        return key, nil
+    }
+    return s.DeriveKey(normalizeRecoveryCode(code), u.RecoverySalt,
+        legacyRecoveryKDFParams)
+}
+
+/**
+ * Unwrap a user's main-key and private key with a recovery code and wrap them
+ * under a new password, salt and KDF parameters
+ *
+ * Returns the new encrypted main-key followed by the new encrypted private key
+ * (which is empty if the user has no key-pair). A wrong recovery code fails
+ * authentication when the main-key is decrypted.
+ */
+func (s *Service) RecoverUserKeys(u *user.User, code string, newPassword,
+    newSalt []byte, newParams user.KDFParams) ([]byte, []byte, error) {
+
+    if len(u.MainKeyRecoveryEncrypted) == 0 {
+        return nil, nil, ErrNoRecoveryCode
+    }
+
+    // derive recovery key and new password-generated key
+    recoveryKey, err := s.recoveryKey(u, code)
+    if err != nil {
+        return nil, nil, err
+    }
+    newKey, err := s.DeriveKey(newPassword, newSalt, newParams)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    // re-wrap main-key
+    mainKey, err := s.DecryptData(u.MainKeyRecoveryEncrypted, recoveryKey)
+    if err != nil {
+        return nil, nil, ErrWrongRecoveryCode
+    }
+    mainKeyEncrypted, err := s.EncryptData(mainKey, newKey)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    // re-wrap private key
+    var privateKeyEncrypted []byte
+    if len(u.PrivateKeyRecoveryEncrypted) > 0 {
+        privateKey, err := s.DecryptData(u.PrivateKeyRecoveryEncrypted,
+            recoveryKey)
+        if err != nil {
+            return nil, nil, ErrWrongRecoveryCode
+        }
+        privateKeyEncrypted, err = s.EncryptData(privateKey, newKey)
+        if err != nil {
+            return nil, nil, err
+        }
+    }
+
+    return mainKeyEncrypted, privateKeyEncrypted, nil
+}
@@ -0,0 +1,55 @@
+package encryption
+
+/**
+ * This file contains the blind index used for full-text search. Instead of a
+ * word, the index holds a token for it: an HMAC of the word under a search key
+ * derived from the user's main-key. The same word always gives the same token
+ * for the same user, so pages can be looked up by token, but a token reveals
+ * nothing about the word without the main-key.
+ *
+ * The tokens do show which pages share words, and how often, to anyone who can
+ * read the database -- this is the price of searching on the server.
+ */
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+
+    "github.com/setonotes/pkg/user"
+)
+
+// tokens are truncated HMACs; 128 bits is plenty to avoid collisions
+const searchTokenSize = 16
+
+/**
+ * Derive a user's search key from their main-key
+ */
+func (s *Service) getSearchKey(u *user.User) ([]byte, error) {
+    mainKey, err := s.getMainKey(u)
+    if err != nil {
+        return nil, err
+    }
+    mac := hmac.New(sha256.New, mainKey)
+    mac.Write([]byte("setonotes search key"))
+    return mac.Sum(nil), nil
+}
+
+/**
+ * Compute a user's blind index token for each of the given words, in order
+ */
+func (s *Service) SearchTokens(u *user.User, words []string) ([][]byte,
+    error) {
+
+    key, err := s.getSearchKey(u)
+    if err != nil {
+        return nil, err
+    }
+
+    tokens := make([][]byte, len(words))
+    for i, word := range words {
+        mac := hmac.New(sha256.New, key)
+        mac.Write([]byte(word))
+        tokens[i] = mac.Sum(nil)[:searchTokenSize]
+    }
+    return tokens, nil
+}
@@ -0,0 +1,64 @@
+package encryption
+
+/**
+ * This file contains the encryption of tag names. Like notebooks, a tag
+ * belongs to a single user, so its name is encrypted with that user's
+ * main-key, bound to the tag ID as AEAD additional data.
+ */
+
+import (
+    "log"
+    "errors"
+    "strconv"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/tag"
+)
+
+var ErrTagTampered = errors.New("tag failed authentication")
+
+/**
+ * Build the additional data for a tag name
+ */
+func tagNameAD(t *tag.Tag) []byte {
+    return []byte("setonotes tag id " + strconv.Itoa(t.ID) + " name")
+}
+
+/**
+ * Encrypt a tag's Name with its owner's main-key
+ */
+func (s *Service) EncryptTagName(t *tag.Tag, u *user.User) error {
+    mainKey, err := s.getMainKey(u)
+    if err != nil {
+        return err
+    }
+
+    name, err := s.sealEnvelope(t.Name, mainKey, tagNameAD(t))
+    if err != nil {
+        return err
+    }
+    t.Name = name
+    return nil
+}
+
+/**
+ * Decrypt a tag's Name with its owner's main-key -- ErrTagTampered is returned
+ * if the name fails authentication
+ */
+func (s *Service) DecryptTagName(t *tag.Tag, u *user.User) error {
+    mainKey, err := s.getMainKey(u)
+    if err != nil {
+        return err
+    }
+
+    name, err := s.openEnvelope(t.Name, mainKey, tagNameAD(t))
+    if err == ErrWrongKey || err == ErrKeySize {
+        return err
+    } else if err != nil {
+        log.Printf("SECURITY: name of tag-%v failed authentication; "+
+            "possible tampering", t.ID)
+        return ErrTagTampered
+    }
+    t.Name = name
+    return nil
+}
@@ -0,0 +1,119 @@
+/**
+ * Runs the browser encryption of `cmd/static/client.js` under Node, for the
+ * interoperability tests in `pkg/encryption/client_test.go`:
+ *
+ *     node client_harness.js seal   write fixtures encrypted by the browser
+ *                                   code (see client_fixtures.json)
+ *     node client_harness.js open   decrypt fixtures read from standard
+ *                                   input, writing their plaintexts
+ *
+ * Fixtures hold a user's password, salt, KDF parameters and main-key wrapped
+ * under the password, a page key wrapped under the main-key, and a page
+ * encrypted with it.
+ */
+"use strict";
+
+const fs = require("fs");
+const path = require("path");
+const vm = require("vm");
+
+function loadClient() {
+    const context = {
+        window:         {},
+        document:       {
+            querySelectorAll: function () { return []; },
+            getElementById:   function () { return null; }
+        },
+        sessionStorage: {},
+        crypto:         globalThis.crypto,
+        TextEncoder:    TextEncoder,
+        TextDecoder:    TextDecoder,
+        atob:           atob,
+        btoa:           btoa
+    };
+    const source = fs.readFileSync(path.join(__dirname, "..", "..", "..",
+        "cmd", "static", "client.js"), "utf8");
+    vm.runInNewContext(source, context);
+    return context.window.setonotesClient;
+}
+
+const toBase64 = (bytes) => Buffer.from(bytes).toString("base64");
+const fromBase64 = (s) => new Uint8Array(Buffer.from(s, "base64"));
+
+async function seal(client) {
+    const encoder = new TextEncoder();
+    const cases = [
+        // as browser-encryption users are set up by the server
+        {kdf: {alg: "pbkdf2-sha256", t: 6e5, len: 32}, mainKeySize: 32},
+        // the legacy derivation, under which main-keys were 128 bits long
+        {kdf: {alg: "", t: 0, len: 0}, mainKeySize: 16}
+    ];
+    const fixtures = [];
+    for (const c of cases) {
+        const password = "correct horse battery staple";
+        const salt = crypto.getRandomValues(new Uint8Array(16));
+        const passwordKey = await client.deriveKey(password, salt, c.kdf);
+        const mainKey = crypto.getRandomValues(
+            new Uint8Array(c.mainKeySize));
+        const pageKey = crypto.getRandomValues(new Uint8Array(32));
+        const page = {id: 7, version: 3};
+        const title = "Grüße from the browser";
+        const body = "# Notes\n\nWritten and encrypted in client.js.";
+        fixtures.push({
+            password: password,
+            salt:     toBase64(salt),
+            kdf:      c.kdf,
+            main_key: toBase64(await client.seal(mainKey, passwordKey)),
+            page_key: toBase64(await client.seal(pageKey, mainKey)),
+            page:     {
+                id:      page.id,
+                version: page.version,
+                title:   toBase64(await client.seal(encoder.encode(title),
+                    pageKey, client.pageAD(page.version, page.id, "title"))),
+                body:    toBase64(await client.seal(encoder.encode(body),
+                    pageKey, client.pageAD(page.version, page.id, "body")))
+            },
+            title:    title,
+            body:     body
+        });
+    }
+    return fixtures;
+}
+
+async function open(client, fixtures) {
+    const decoder = new TextDecoder();
+    const results = [];
+    for (const f of fixtures) {
+        const passwordKey = await client.deriveKey(f.password,
+            fromBase64(f.salt), f.kdf);
+        const mainKey = await client.open(fromBase64(f.main_key),
+            passwordKey);
+        const pageKey = await client.open(fromBase64(f.page_key), mainKey);
+        const p = f.page;
+        results.push({
+            title: decoder.decode(await client.open(fromBase64(p.title),
+                pageKey, client.pageAD(p.version, p.id, "title"))),
+            body:  decoder.decode(await client.open(fromBase64(p.body),
+                pageKey, client.pageAD(p.version, p.id, "body")))
+        });
+    }
+    return results;
+}
+
+async function main() {
+    const client = loadClient();
+    let result;
+    if (process.argv[2] === "seal") {
+        result = await seal(client);
+    } else if (process.argv[2] === "open") {
+        result = await open(client, JSON.parse(fs.readFileSync(0, "utf8")));
+    } else {
+        throw new Error("usage: client_harness.js seal|open");
+    }
+    process.stdout.write(JSON.stringify(result, null, 4) + "\n");
+}
+
+main().catch(function (e) {
+    process.stderr.write(e.stack + "\n");
+    process.exit(1);
+});
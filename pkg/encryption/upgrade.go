@@ -0,0 +1,199 @@
+package encryption
+
+/**
+ * This file contains the upgrade of a user's own keys. Accounts created before
+ * envelopes existed have a 128-bit main-key, which can only seal with
+ * AES-128-GCM, and recovery keys were 128 bits long until recently. Upgrading
+ * replaces such a main-key with a new 256-bit one, re-wrapping everything it
+ * wrapped, and re-wraps the main-key and private key under the password and a
+ * new recovery code. Everything happens in memory; the caller stores it all
+ * at once.
+ */
+
+import (
+    "log"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/notebook"
+    "github.com/setonotes/pkg/tag"
+)
+
+// the size of a GCM or Poly1305 authentication tag
+const tagSize = 16
+
+/**
+ * Get the length of the data sealed in a ciphertext written by EncryptData(),
+ * without opening it
+ */
+func sealedSize(data []byte) int {
+    alg, _, ok := parseEnvelope(data)
+    if !ok {
+        return len(data) - 12 - tagSize
+    }
+    nonceSize := 12
+    if alg == AlgXChaCha20Poly1305 {
+        nonceSize = 24
+    }
+    return len(data) - envelopeHeaderSize - nonceSize - tagSize
+}
+
+/**
+ * Check whether a user's main-key is too short, or their main-key, private key
+ * or recovery wraps were not sealed with the current algorithm -- this needs
+ * no keys, so it can be checked for any user. Keys wrapped in the browser are
+ * left to the browser.
+ */
+func (s *Service) UserKeysNeedUpgrade(u *user.User) bool {
+    if u.ClientEncryption || u.Version < user.CurrentVersion {
+        return false
+    }
+    return sealedSize(u.MainKeyEncrypted) < 32 ||
+        s.NeedsUpgrade(u.MainKeyEncrypted) ||
+        s.NeedsUpgrade(u.PrivateKeyEncrypted) ||
+        s.NeedsUpgrade(u.MainKeyRecoveryEncrypted) ||
+        s.NeedsUpgrade(u.PrivateKeyRecoveryEncrypted)
+}
+
+/**
+ * Upgrade a user's keys (see UserKeysNeedUpgrade()) --
+ * The password unwraps the current keys. If the main-key is replaced, each of
+ * the given page keys (encrypted with the main-key, as held by the owner) and
+ * notebook and tag names is re-encrypted with the new one, and the user's
+ * search tokens no longer match, so their index must be rebuilt. A user with a
+ * recovery code is given a new one whenever their recovery wraps change.
+ *
+ * The user, notebooks and tags are updated in place but nothing is stored.
+ * Returns the page keys, in the same order, followed by the new recovery code
+ * (or an empty string if none was issued).
+ */
+func (s *Service) UpgradeUserKeys(u *user.User, password []byte,
+    pageKeys [][]byte, notebooks []*notebook.Notebook,
+    tags []*tag.Tag) ([][]byte, string, error) {
+
+    // unwrap current keys
+    passwordGeneratedKey, err := s.DeriveKey(password, u.Salt, u.KDF)
+    if err != nil {
+        return nil, "", err
+    }
+    mainKey, err := s.DecryptData(u.MainKeyEncrypted, passwordGeneratedKey)
+    if err != nil {
+        return nil, "", err
+    }
+    var privateKey []byte
+    if len(u.PrivateKeyEncrypted) > 0 {
+        privateKey, err = s.DecryptData(u.PrivateKeyEncrypted,
+            passwordGeneratedKey)
+        if err != nil {
+            return nil, "", err
+        }
+    }
+
+    // replace a 128-bit main-key, re-encrypting everything it encrypted
+    rotated := len(mainKey) < 32
+    if rotated {
+        log.Printf("replacing 128-bit main-key of user-%v...", u.ID)
+        newMainKey, err := s.NewSymmetricKey()
+        if err != nil {
+            return nil, "", err
+        }
+        pageKeys, err = s.rewrapPageKeys(pageKeys, mainKey, newMainKey)
+        if err != nil {
+            return nil, "", err
+        }
+        err = s.rewrapNames(notebooks, tags, mainKey, newMainKey)
+        if err != nil {
+            return nil, "", err
+        }
+        mainKey = newMainKey
+    }
+
+    // re-wrap main-key and private key under the password
+    mainKeyEncrypted, err := s.EncryptData(mainKey, passwordGeneratedKey)
+    if err != nil {
+        return nil, "", err
+    }
+    var privateKeyEncrypted []byte
+    if len(privateKey) > 0 {
+        privateKeyEncrypted, err = s.EncryptData(privateKey,
+            passwordGeneratedKey)
+        if err != nil {
+            return nil, "", err
+        }
+    }
+    u.MainKeyEncrypted = mainKeyEncrypted
+    u.PrivateKeyEncrypted = privateKeyEncrypted
+
+    // the old recovery code cannot be re-used, as only its derived key is
+    // known, so a new one is issued
+    recoveryCode := ""
+    if len(u.MainKeyRecoveryEncrypted) > 0 && (rotated ||
+        s.NeedsUpgrade(u.MainKeyRecoveryEncrypted) ||
+        s.NeedsUpgrade(u.PrivateKeyRecoveryEncrypted)) {
+
+        recoveryCode, err = s.wrapRecoveryKeys(u, mainKey, privateKey)
+        if err != nil {
+            return nil, "", err
+        }
+    }
+
+    return pageKeys, recoveryCode, nil
+}
+
+/**
+ * Re-encrypt page keys from an old main-key to a new one
+ */
+func (s *Service) rewrapPageKeys(pageKeys [][]byte, oldMainKey,
+    newMainKey []byte) ([][]byte, error) {
+
+    result := make([][]byte, len(pageKeys))
+    for i, pageKeyEncrypted := range pageKeys {
+        pageKey, err := s.DecryptData(pageKeyEncrypted, oldMainKey)
+        if err != nil {
+            log.Println("failed to decrypt page key with main-key")
+            return nil, err
+        }
+        result[i], err = s.EncryptData(pageKey, newMainKey)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return result, nil
+}
+
+/**
+ * Re-encrypt notebook and tag names from an old main-key to a new one --
+ * names not yet set are left empty
+ */
+func (s *Service) rewrapNames(notebooks []*notebook.Notebook, tags []*tag.Tag,
+    oldMainKey, newMainKey []byte) error {
+
+    for _, nb := range notebooks {
+        if len(nb.Name) == 0 {
+            continue
+        }
+        name, err := s.openEnvelope(nb.Name, oldMainKey, notebookNameAD(nb))
+        if err != nil {
+            log.Printf("failed to decrypt name of notebook-%v", nb.ID)
+            return err
+        }
+        nb.Name, err = s.sealEnvelope(name, newMainKey, notebookNameAD(nb))
+        if err != nil {
+            return err
+        }
+    }
+    for _, t := range tags {
+        if len(t.Name) == 0 {
+            continue
+        }
+        name, err := s.openEnvelope(t.Name, oldMainKey, tagNameAD(t))
+        if err != nil {
+            log.Printf("failed to decrypt name of tag-%v", t.ID)
+            return err
+        }
+        t.Name, err = s.sealEnvelope(name, newMainKey, tagNameAD(t))
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,163 @@
+package encryption
+
+import (
+    "bytes"
+    "testing"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/notebook"
+    "github.com/setonotes/pkg/tag"
+)
+
+const upgradePassword = "correct horse"
+
+/**
+ * Create a user as accounts were before envelopes existed: a 128-bit main-key
+ * and a recovery code under a 128-bit recovery key
+ */
+func newOldUser(t *testing.T, s *Service) (*user.User, []byte, string) {
+    u := &user.User{ID: 1, Version: user.CurrentVersion, KDF: testKDF}
+    var err error
+    u.Salt, err = s.NewSalt()
+    if err != nil {
+        t.Fatal(err)
+    }
+    passwordGeneratedKey, err := s.DeriveKey([]byte(upgradePassword), u.Salt,
+        u.KDF)
+    if err != nil {
+        t.Fatal(err)
+    }
+    mainKey, err := getRandomBytes(16)
+    if err != nil {
+        t.Fatal(err)
+    }
+    u.MainKeyEncrypted, err = s.EncryptData(mainKey, passwordGeneratedKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    code := formatRecoveryCode(make([]byte, recoveryCodeBytes))
+    u.RecoverySalt, err = s.NewSalt()
+    if err != nil {
+        t.Fatal(err)
+    }
+    recoveryKey, err := s.DeriveKey(normalizeRecoveryCode(code),
+        u.RecoverySalt, legacyRecoveryKDFParams)
+    if err != nil {
+        t.Fatal(err)
+    }
+    u.MainKeyRecoveryEncrypted, err = s.EncryptData(mainKey, recoveryKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return u, mainKey, code
+}
+
+func TestLegacyRecoveryCodeStillWorks(t *testing.T) {
+    s := NewService(AlgAES256GCM, testKDF)
+    u, mainKey, code := newOldUser(t, s)
+
+    newSalt, err := s.NewSalt()
+    if err != nil {
+        t.Fatal(err)
+    }
+    mainKeyEncrypted, _, err := s.RecoverUserKeys(u, code, []byte("new"),
+        newSalt, testKDF)
+    if err != nil {
+        t.Fatalf("failed to recover with legacy code: %v", err)
+    }
+    newKey, err := s.DeriveKey([]byte("new"), newSalt, testKDF)
+    if err != nil {
+        t.Fatal(err)
+    }
+    recovered, err := s.DecryptData(mainKeyEncrypted, newKey)
+    if err != nil || !bytes.Equal(recovered, mainKey) {
+        t.Errorf("recovered main-key does not match: %v", err)
+    }
+}
+
+func TestUpgradeUserKeys(t *testing.T) {
+    s := NewService(AlgXChaCha20Poly1305, testKDF)
+    u, mainKey, oldCode := newOldUser(t, s)
+    if !s.UserKeysNeedUpgrade(u) {
+        t.Fatal("user with a 128-bit main-key does not need upgrading")
+    }
+
+    // things encrypted with the old main-key
+    pageKey, err := s.NewSymmetricKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    pageKeyEncrypted, err := s.EncryptData(pageKey, mainKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    nb := &notebook.Notebook{ID: 3}
+    nb.Name, err = s.sealEnvelope([]byte("Work"), mainKey, notebookNameAD(nb))
+    if err != nil {
+        t.Fatal(err)
+    }
+    tg := &tag.Tag{ID: 4}
+    tg.Name, err = s.sealEnvelope([]byte("urgent"), mainKey, tagNameAD(tg))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    pageKeys, code, err := s.UpgradeUserKeys(u, []byte(upgradePassword),
+        [][]byte{pageKeyEncrypted}, []*notebook.Notebook{nb},
+        []*tag.Tag{tg})
+    if err != nil {
+        t.Fatalf("failed to upgrade keys: %v", err)
+    }
+    if s.UserKeysNeedUpgrade(u) {
+        t.Error("user still needs upgrading")
+    }
+    if code == "" || code == oldCode {
+        t.Fatal("no new recovery code was issued")
+    }
+
+    // everything opens with the new main-key
+    u.SessionKey, err = s.DeriveKey([]byte(upgradePassword), u.Salt, u.KDF)
+    if err != nil {
+        t.Fatal(err)
+    }
+    newMainKey, err := s.getMainKey(u)
+    if err != nil || len(newMainKey) != 32 {
+        t.Fatalf("main-key not replaced: %v", err)
+    }
+    got, err := s.UserDecryptData(u, pageKeys[0])
+    if err != nil || !bytes.Equal(got, pageKey) {
+        t.Errorf("page key not re-wrapped: %v", err)
+    }
+    err = s.DecryptNotebookName(nb, u)
+    if err != nil || string(nb.Name) != "Work" {
+        t.Errorf("notebook name not re-wrapped: %q, %v", nb.Name, err)
+    }
+    err = s.DecryptTagName(tg, u)
+    if err != nil || string(tg.Name) != "urgent" {
+        t.Errorf("tag name not re-wrapped: %q, %v", tg.Name, err)
+    }
+
+    // only the new recovery code opens the new wraps
+    newSalt, err := s.NewSalt()
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, _, err = s.RecoverUserKeys(u, oldCode, []byte("new"), newSalt, testKDF)
+    if err != ErrWrongRecoveryCode {
+        t.Errorf("old recovery code gave %v", err)
+    }
+    mainKeyEncrypted, _, err := s.RecoverUserKeys(u, code, []byte("new"),
+        newSalt, testKDF)
+    if err != nil {
+        t.Fatalf("failed to recover with new code: %v", err)
+    }
+    newKey, err := s.DeriveKey([]byte("new"), newSalt, testKDF)
+    if err != nil {
+        t.Fatal(err)
+    }
+    recovered, err := s.DecryptData(mainKeyEncrypted, newKey)
+    if err != nil || !bytes.Equal(recovered, newMainKey) {
+        t.Errorf("recovered main-key does not match: %v", err)
+    }
+}
@@ -2,27 +2,36 @@ package encryption
 
 /**
  * This file will contain all encryption functionality concerning a particular
- * user. This is the only code allowed to handle the cached password-generated
+ * user. This is the only code allowed to use the session's password-generated
  * keys or unencrypted main-keys.
  */
 
 import (
-    "strconv"
-
     "github.com/setonotes/pkg/user"
 )
 
 /**
- * Get a user's password-generated key from the cache (notice that this function
- * is not exported -- ideally, the password-generated key should not be passed
- * outside this package for any reason)
+ * Get a user's password-generated key from their session (notice that this
+ * function is not exported -- ideally, the password-generated key should not be
+ * used outside this package for any reason)
+ */
+func (s *Service) getPasswordGeneratedKey(u *user.User) ([]byte, error) {
+    if len(u.SessionKey) == 0 {
+        return nil, ErrNoSessionKey
+    }
+    return u.SessionKey, nil
+}
+
+/**
+ * Get a user's decrypted main-key, using the password-generated key from
+ * their session (not exported for the same reason)
  */
-func (s *Service) getPasswordGeneratedKey(userID int) ([]byte, error) {
-    key, err := s.cacheService.GetString("pgkey_"+strconv.Itoa(userID))
+func (s *Service) getMainKey(u *user.User) ([]byte, error) {
+    passwordGeneratedKey, err := s.getPasswordGeneratedKey(u)
     if err != nil {
         return nil, err
     }
-    return []byte(key), nil
+    return s.DecryptData(u.MainKeyEncrypted, passwordGeneratedKey)
 }
 
 /**
@@ -47,12 +56,12 @@ func (s *Service) NewUserEncryptedSymmetricKey(u *user.User) ([]byte, error) {
 
 /**
  * Encrypt data for a particular user --
- * This funciton gets the user's password-generated key from the cache, uses it
+ * This funciton gets the user's password-generated key from the session, uses it
  * to decrypt their main-key, and uses the main-key to encrypt the data.
  */
 func (s *Service) UserEncryptData(u *user.User, data []byte) ([]byte, error) {
     // get the user's password-generated key
-    passwordGeneratedKey, err := s.getPasswordGeneratedKey(u.ID)
+    passwordGeneratedKey, err := s.getPasswordGeneratedKey(u)
     if err != nil {
         return nil, err
     }
@@ -74,12 +83,12 @@ func (s *Service) UserEncryptData(u *user.User, data []byte) ([]byte, error) {
 
 /**
  * Decrypt data for a particular user --
- * This funciton gets the user's password-generated key from the cache, uses it
+ * This funciton gets the user's password-generated key from the session, uses it
  * to decrypt their main-key, and uses the main-key to decrypt the data.
  */
 func (s *Service) UserDecryptData(u *user.User, data []byte) ([]byte, error) {
     // get the user's password-generated key
-    passwordGeneratedKey, err := s.getPasswordGeneratedKey(u.ID)
+    passwordGeneratedKey, err := s.getPasswordGeneratedKey(u)
     if err != nil {
         return nil, err
     }
@@ -98,3 +107,163 @@ func (s *Service) UserDecryptData(u *user.User, data []byte) ([]byte, error) {
 
     return result, nil
 }
+
+/**
+ * Get a user's decrypted private key -- the private key is encrypted with the
+ * password-generated key rather than the main-key
+ */
+func (s *Service) getPrivateKey(u *user.User) ([]byte, error) {
+    if len(u.PrivateKeyEncrypted) == 0 || len(u.PublicKey) == 0 {
+        return nil, ErrInvalidPublicKey
+    }
+
+    // get the user's password-generated key
+    passwordGeneratedKey, err := s.getPasswordGeneratedKey(u)
+    if err != nil {
+        return nil, err
+    }
+
+    // decrypt user's private key
+    privateKey, err := s.DecryptData(u.PrivateKeyEncrypted,
+        passwordGeneratedKey)
+    if err != nil {
+        return nil, err
+    }
+
+    return privateKey, nil
+}
+
+/**
+ * Generate a new key-pair for a user that does not yet have one -- the private
+ * key is encrypted with the user's password-generated key from the session, just
+ * as it would have been at sign-up
+ *
+ * Returns the encrypted private key followed by the public key
+ */
+func (s *Service) NewUserEncryptedKeyPair(u *user.User) ([]byte, []byte,
+    error) {
+
+    // get the user's password-generated key
+    passwordGeneratedKey, err := s.getPasswordGeneratedKey(u)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    // generate new key-pair
+    privateKey, publicKey, err := s.NewAssymetricKeyPair()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    // encrypt private key
+    privateKeyEncrypted, err := s.EncryptData(privateKey, passwordGeneratedKey)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return privateKeyEncrypted, publicKey, nil
+}
+
+/**
+ * Re-wrap a key for another user --
+ * This function decrypts a key that was encrypted with the owner's main-key
+ * and seals it to the recipient's public key. Only the recipient can open the
+ * result (see UnsealUserEncryptedKey()).
+ */
+func (s *Service) SealUserEncryptedKey(owner *user.User,
+    userEncryptedKey []byte, recipient *user.User) ([]byte, error) {
+
+    // decrypt key with the owner's main-key
+    key, err := s.UserDecryptData(owner, userEncryptedKey)
+    if err != nil {
+        return nil, err
+    }
+
+    // seal key to the recipient's public key
+    sealedKey, err := sealData(key, recipient.PublicKey)
+    if err != nil {
+        return nil, err
+    }
+
+    return sealedKey, nil
+}
+
+/**
+ * Open a key that was sealed to a user's public key and re-encrypt it with the
+ * user's main-key, so that the result can be used anywhere a user-encrypted
+ * key is expected
+ */
+func (s *Service) UnsealUserEncryptedKey(u *user.User,
+    sealedKey []byte) ([]byte, error) {
+
+    // get the user's private key
+    privateKey, err := s.getPrivateKey(u)
+    if err != nil {
+        return nil, err
+    }
+
+    // open sealed key
+    key, err := openSealedData(sealedKey, u.PublicKey, privateKey)
+    if err != nil {
+        return nil, err
+    }
+
+    // user-encrypt key
+    keyEncrypted, err := s.UserEncryptData(u, key)
+    if err != nil {
+        return nil, err
+    }
+
+    return keyEncrypted, nil
+}
+
+/**
+ * Re-wrap a user's main-key and private key under a new password --
+ * The old password-generated key is derived from the old password with the
+ * user's current salt and KDF parameters, and the new one from the new
+ * password with the new salt and parameters. The password may be unchanged,
+ * which is how older KDF parameters are upgraded.
+ * The keys themselves do not change, so every page key encrypted with the
+ * main-key stays readable.
+ *
+ * Returns the new encrypted main-key followed by the new encrypted private key
+ * (which is empty if the user has no key-pair)
+ */
+func (s *Service) RewrapUserKeys(u *user.User, oldPassword, newPassword,
+    newSalt []byte, newParams user.KDFParams) ([]byte, []byte, error) {
+
+    // derive old and new password-generated keys
+    oldKey, err := s.DeriveKey(oldPassword, u.Salt, u.KDF)
+    if err != nil {
+        return nil, nil, err
+    }
+    newKey, err := s.DeriveKey(newPassword, newSalt, newParams)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    // re-wrap main-key
+    mainKey, err := s.DecryptData(u.MainKeyEncrypted, oldKey)
+    if err != nil {
+        return nil, nil, err
+    }
+    mainKeyEncrypted, err := s.EncryptData(mainKey, newKey)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    // re-wrap private key
+    var privateKeyEncrypted []byte
+    if len(u.PrivateKeyEncrypted) > 0 {
+        privateKey, err := s.DecryptData(u.PrivateKeyEncrypted, oldKey)
+        if err != nil {
+            return nil, nil, err
+        }
+        privateKeyEncrypted, err = s.EncryptData(privateKey, newKey)
+        if err != nil {
+            return nil, nil, err
+        }
+    }
+
+    return mainKeyEncrypted, privateKeyEncrypted, nil
+}
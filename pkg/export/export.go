@@ -0,0 +1,218 @@
+package export
+
+/**
+ * This package writes a user's decrypted pages out as a zip of Markdown files,
+ * one per page. Each file starts with YAML front matter holding what is known
+ * about the page:
+ *
+ *     ---
+ *     id: 42
+ *     title: "Meeting notes"
+ *     owner: "alice"
+ *     tags: ["work", "todo"]
+ *     created: 2020-01-02T15:04:05Z
+ *     updated: 2020-01-03T09:00:00Z
+ *     ---
+ *
+ * Strings are double-quoted with Go's escapes, which YAML reads the same way.
+ * File names are made from titles, so the same pages always give the same
+ * names: see Filenames.
+ */
+
+import (
+    "io"
+    "fmt"
+    "errors"
+    "time"
+    "bytes"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode"
+    "archive/zip"
+)
+
+/**
+ * A Page as it is exported -- Created and Updated are zero if unknown
+ */
+type Page struct {
+    ID      int
+    Title   string
+    Owner   string
+    Tags    []string
+    Created time.Time
+    Updated time.Time
+    Body    []byte
+}
+
+// the longest a file name (without extension) is cut to, in characters
+const maxNameLength = 100
+
+// characters left out of file names, along with control characters
+const unsafeChars = `/\:*?"<>|`
+
+// names that cannot be used for files on Windows, whatever the extension
+var reservedNames = map[string]bool{
+    "con": true, "prn": true, "aux": true, "nul": true,
+    "com1": true, "com2": true, "com3": true, "com4": true, "com5": true,
+    "com6": true, "com7": true, "com8": true, "com9": true,
+    "lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true,
+    "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// returned by a loader to leave a page out of the zip
+var ErrSkip = errors.New("page left out of export")
+
+/**
+ * Write pages to w as a zip, streaming each file as it is written, and return
+ * how many were written
+ *
+ * The pages need only their IDs and titles up front, which settle the file
+ * names. If load is given, it fills in the rest of each page in turn just
+ * before the page is written, so that only one body is held at a time -- a
+ * page it returns ErrSkip for is left out, and any other error stops the zip.
+ */
+func WriteZip(w io.Writer, pages []*Page, load func(p *Page) error) (int,
+    error) {
+
+    names := Filenames(pages)
+
+    z := zip.NewWriter(w)
+    written := 0
+    for _, p := range pages {
+        if load != nil {
+            err := load(p)
+            if err == ErrSkip {
+                continue
+            } else if err != nil {
+                return written, err
+            }
+        }
+
+        header := &zip.FileHeader{
+            Name:   names[p.ID],
+            Method: zip.Deflate,
+        }
+        if !p.Updated.IsZero() {
+            header.Modified = p.Updated
+        }
+
+        f, err := z.CreateHeader(header)
+        if err != nil {
+            return written, err
+        }
+        _, err = f.Write(Markdown(p))
+        if err != nil {
+            return written, err
+        }
+        if load != nil {
+            p.Body = nil
+        }
+        written++
+    }
+    return written, z.Close()
+}
+
+/**
+ * A page as a Markdown file: its front matter, then its body
+ */
+func Markdown(p *Page) []byte {
+    var b bytes.Buffer
+    b.WriteString("---\n")
+    fmt.Fprintf(&b, "id: %d\n", p.ID)
+    fmt.Fprintf(&b, "title: %s\n", strconv.Quote(p.Title))
+    fmt.Fprintf(&b, "owner: %s\n", strconv.Quote(p.Owner))
+
+    tags := make([]string, len(p.Tags))
+    for i, t := range p.Tags {
+        tags[i] = strconv.Quote(t)
+    }
+    fmt.Fprintf(&b, "tags: [%s]\n", strings.Join(tags, ", "))
+
+    if !p.Created.IsZero() {
+        fmt.Fprintf(&b, "created: %s\n", p.Created.UTC().Format(time.RFC3339))
+    }
+    if !p.Updated.IsZero() {
+        fmt.Fprintf(&b, "updated: %s\n", p.Updated.UTC().Format(time.RFC3339))
+    }
+    b.WriteString("---\n\n")
+
+    b.Write(p.Body)
+    if len(p.Body) > 0 && p.Body[len(p.Body)-1] != '\n' {
+        b.WriteByte('\n')
+    }
+    return b.Bytes()
+}
+
+/**
+ * Give each page a file name, by page ID
+ *
+ * Names are made from titles by Filename. Pages are taken in order of ID, so
+ * where titles collide (ignoring case, as many file systems do) the oldest
+ * page keeps the plain name, and the others get their ID added to it.
+ */
+func Filenames(pages []*Page) map[int]string {
+    sorted := make([]*Page, len(pages))
+    copy(sorted, pages)
+    sort.Slice(sorted, func(i, j int) bool {
+        return sorted[i].ID < sorted[j].ID
+    })
+
+    names := map[int]string{}
+    taken := map[string]bool{}
+    for _, p := range sorted {
+        base := Filename(p.Title)
+        name := base + ".md"
+        for n := 0; taken[strings.ToLower(name)]; n++ {
+            if n == 0 {
+                name = fmt.Sprintf("%s (%d).md", base, p.ID)
+            } else {
+                name = fmt.Sprintf("%s (%d-%d).md", base, p.ID, n)
+            }
+        }
+        taken[strings.ToLower(name)] = true
+        names[p.ID] = name
+    }
+    return names
+}
+
+/**
+ * Make a file name (without extension) from a title: characters that are
+ * unsafe in file names become dashes, runs of spaces become one, and the name
+ * is cut to maxNameLength characters -- it never starts with a dot, and an
+ * empty or reserved name becomes "untitled" or gets "-page" added
+ */
+func Filename(title string) string {
+    var b strings.Builder
+    space := false
+    for _, c := range title {
+        if unicode.IsSpace(c) {
+            space = true
+            continue
+        }
+        if space && b.Len() > 0 {
+            b.WriteByte(' ')
+        }
+        space = false
+
+        if unicode.IsControl(c) || strings.ContainsRune(unsafeChars, c) {
+            b.WriteByte('-')
+        } else {
+            b.WriteRune(c)
+        }
+    }
+
+    name := []rune(strings.TrimLeft(b.String(), ". "))
+    if len(name) > maxNameLength {
+        name = name[:maxNameLength]
+    }
+    result := strings.TrimRight(string(name), ". ")
+
+    if result == "" {
+        return "untitled"
+    }
+    if reservedNames[strings.ToLower(result)] {
+        return result + "-page"
+    }
+    return result
+}
@@ -0,0 +1,162 @@
+package export
+
+import (
+    "bytes"
+    "errors"
+    "strings"
+    "testing"
+    "io/ioutil"
+    "archive/zip"
+)
+
+func TestFilename(t *testing.T) {
+    for _, c := range []struct {
+        title, want string
+    }{
+        {"Meeting notes", "Meeting notes"},
+        {"", "untitled"},
+        {"   \t\n", "untitled"},
+        {"...", "untitled"},
+        {"  spaced \t  out\n", "spaced out"},
+        {"a/b\\c:d*e?f\"g<h>i|j", "a-b-c-d-e-f-g-h-i-j"},
+        {"bell\x07 and\x00null", "bell- and-null"},
+        {"../../etc/passwd", "-..-etc-passwd"},
+        {".hidden", "hidden"},
+        {"trailing dots. . .", "trailing dots"},
+        {"CON", "CON-page"},
+        {"lpt1", "lpt1-page"},
+        {"con.txt", "con.txt"},
+        {"Ünïcödé ✓ 日本", "Ünïcödé ✓ 日本"},
+        {strings.Repeat("é", 150), strings.Repeat("é", maxNameLength)},
+        {strings.Repeat("a", 99) + " .b", strings.Repeat("a", 99)},
+    } {
+        got := Filename(c.title)
+        if got != c.want {
+            t.Errorf("%q gave %q, want %q", c.title, got, c.want)
+        }
+    }
+}
+
+func TestFilenames(t *testing.T) {
+    pages := []*Page{
+        {ID: 9, Title: "notes"},
+        {ID: 3, Title: "Notes"},
+        {ID: 5, Title: "notes"},
+        {ID: 4, Title: ""},
+        {ID: 2, Title: "   "},
+        {ID: 6, Title: "a/b"},
+        {ID: 7, Title: "a:b"},
+        // a title that is already what a collision would give
+        {ID: 1, Title: "notes (5)"},
+        {ID: 8, Title: "untitled (4)"},
+    }
+    want := map[int]string{
+        1: "notes (5).md",
+        2: "untitled.md",
+        3: "Notes.md",
+        4: "untitled (4).md",
+        5: "notes (5-1).md",
+        6: "a-b.md",
+        7: "a-b (7).md",
+        8: "untitled (4) (8).md",
+        9: "notes (9).md",
+    }
+
+    // whatever order the pages come in, they are named the same
+    for i := 0; i < len(pages); i++ {
+        rotated := append(append([]*Page{}, pages[i:]...), pages[:i]...)
+        got := Filenames(rotated)
+        if len(got) != len(want) {
+            t.Errorf("rotation %v gave %v names", i, len(got))
+        }
+        for id, name := range want {
+            if got[id] != name {
+                t.Errorf("rotation %v named page-%v %q, want %q", i, id,
+                    got[id], name)
+            }
+        }
+    }
+}
+
+func TestMarkdown(t *testing.T) {
+    p := &Page{
+        ID:    42,
+        Title: "Say \"hi\"\n",
+        Owner: "alice",
+        Tags:  []string{"work", "to do"},
+        Body:  []byte("# Hi\nthere"),
+    }
+    want := "---\nid: 42\ntitle: \"Say \\\"hi\\\"\\n\"\nowner: \"alice\"\n" +
+        "tags: [\"work\", \"to do\"]\n---\n\n# Hi\nthere\n"
+    if got := string(Markdown(p)); got != want {
+        t.Errorf("got %q, want %q", got, want)
+    }
+}
+
+func TestWriteZipLoadsOnePageAtATime(t *testing.T) {
+    pages := []*Page{
+        {ID: 1, Title: "one"},
+        {ID: 2, Title: "two"},
+        {ID: 3, Title: "one"},
+    }
+    loaded := []int{}
+    load := func(p *Page) error {
+        for _, other := range pages {
+            if other.Body != nil {
+                t.Errorf("page-%v still held loading page-%v", other.ID,
+                    p.ID)
+            }
+        }
+        loaded = append(loaded, p.ID)
+        if p.ID == 2 {
+            return ErrSkip
+        }
+        p.Body = []byte("body of " + p.Title)
+        return nil
+    }
+
+    var b bytes.Buffer
+    n, err := WriteZip(&b, pages, load)
+    if err != nil || n != 2 {
+        t.Fatalf("wrote %v pages: %v", n, err)
+    }
+    if len(loaded) != 3 {
+        t.Errorf("loaded pages %v", loaded)
+    }
+
+    z, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := map[string]string{}
+    for _, f := range z.File {
+        r, err := f.Open()
+        if err != nil {
+            t.Fatal(err)
+        }
+        data, err := ioutil.ReadAll(r)
+        r.Close()
+        if err != nil {
+            t.Fatal(err)
+        }
+        got[f.Name] = string(data)
+    }
+    // the skipped page still settled the names
+    if len(got) != 2 ||
+        !strings.HasSuffix(got["one.md"], "\nbody of one\n") ||
+        !strings.HasSuffix(got["one (3).md"], "\nbody of one\n") {
+        t.Errorf("zip holds %q", got)
+    }
+
+    // any other error stops the zip
+    failure := errors.New("failed")
+    n, err = WriteZip(ioutil.Discard, pages, func(p *Page) error {
+        if p.ID == 2 {
+            return failure
+        }
+        return nil
+    })
+    if err != failure || n != 1 {
+        t.Errorf("failing load wrote %v pages: %v", n, err)
+    }
+}
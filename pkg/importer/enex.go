@@ -0,0 +1,245 @@
+package importer
+
+/**
+ * This file reads Evernote exports (ENEX): an XML file holding each note's
+ * title, tags, dates, its content as ENML (see `enml.go`) and the files
+ * embedded in it as base64:
+ *
+ *     <en-export>
+ *       <note>
+ *         <title>Meeting notes</title>
+ *         <content><![CDATA[<en-note>...</en-note>]]></content>
+ *         <created>20200102T150405Z</created>
+ *         <updated>20200103T090000Z</updated>
+ *         <tag>work</tag>
+ *         <resource>
+ *           <data encoding="base64">...</data>
+ *           <mime>image/png</mime>
+ *           <resource-attributes><file-name>a.png</file-name>
+ *           </resource-attributes>
+ *         </resource>
+ *       </note>
+ *     </en-export>
+ *
+ * The content refers to a resource by the MD5 hash of its data. Notes are read
+ * one at a time, so only one note's resources are held at once.
+ */
+
+import (
+    "io"
+    "time"
+    "errors"
+    "strings"
+    "crypto/md5"
+    "encoding/hex"
+    "encoding/xml"
+    "encoding/base64"
+)
+
+// the largest file embedded in a note that is imported
+const MaxResourceSize = 25 << 20
+
+const enexTimeFormat = "20060102T150405Z"
+
+var (
+    ErrNotENEX          = errors.New("not an Evernote export")
+    ErrResourceTooLarge = errors.New("an attachment of the note is too large")
+)
+
+type enexImporter struct{}
+
+func (enexImporter) Format() string {
+    return "enex"
+}
+
+func (enexImporter) Description() string {
+    return "Evernote export (.enex)"
+}
+
+func (enexImporter) Extension() string {
+    return ".enex"
+}
+
+type enexNote struct {
+    Title     string         `xml:"title"`
+    Content   string         `xml:"content"`
+    Created   string         `xml:"created"`
+    Updated   string         `xml:"updated"`
+    Tags      []string       `xml:"tag"`
+    Resources []enexResource `xml:"resource"`
+}
+
+type enexResource struct {
+    Data struct {
+        Encoding string `xml:"encoding,attr"`
+        Value    string `xml:",chardata"`
+    } `xml:"data"`
+    MIME     string `xml:"mime"`
+    FileName string `xml:"resource-attributes>file-name"`
+}
+
+/**
+ * Read the notes in an Evernote export -- notes are by their title
+ */
+func (enexImporter) Read(r io.ReaderAt, size int64) ([]*Note, []*Result,
+    error) {
+
+    d := xml.NewDecoder(io.NewSectionReader(r, 0, size))
+    notes, skipped := []*Note{}, []*Result{}
+    exported := false
+    for {
+        token, err := d.Token()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, nil, ErrNotENEX
+        }
+
+        start, ok := token.(xml.StartElement)
+        if !ok {
+            continue
+        }
+        switch start.Name.Local {
+        case "en-export":
+            exported = true
+        case "note":
+            if !exported {
+                return nil, nil, ErrNotENEX
+            }
+            if len(notes) == MaxFiles {
+                return nil, nil, ErrTooManyFiles
+            }
+
+            var en enexNote
+            err = d.DecodeElement(&en, &start)
+            if err != nil {
+                return nil, nil, err
+            }
+            n, err := en.note()
+            if err != nil {
+                skipped = append(skipped, &Result{Name: n.Path, Err: err})
+                continue
+            }
+            notes = append(notes, n)
+        }
+    }
+
+    if !exported {
+        return nil, nil, ErrNotENEX
+    }
+    return notes, skipped, nil
+}
+
+/**
+ * Make a Note from a note in an export -- the Note is returned along with any
+ * error, so that its title can be reported
+ */
+func (en *enexNote) note() (*Note, error) {
+    n := &Note{
+        Path:      strings.TrimSpace(en.Title),
+        Title:     strings.TrimSpace(en.Title),
+        Tags:      []string{},
+        Created:   parseENEXTime(en.Created),
+        Updated:   parseENEXTime(en.Updated),
+        Resources: []*Resource{},
+    }
+    if n.Title == "" {
+        n.Path, n.Title = "Untitled", "Untitled"
+    }
+    for _, t := range en.Tags {
+        if t = strings.TrimSpace(t); t != "" {
+            n.Tags = append(n.Tags, t)
+        }
+    }
+
+    resources := map[string]*Resource{}
+    for _, er := range en.Resources {
+        res, err := er.resource()
+        if err != nil {
+            return n, err
+        }
+        if res == nil {
+            continue
+        }
+        if _, ok := resources[res.Hash]; !ok {
+            resources[res.Hash] = res
+            n.Resources = append(n.Resources, res)
+        }
+    }
+
+    body, err := ENMLToMarkdown(en.Content, func(hash string) string {
+        return resourceLink(resources[strings.ToLower(hash)], hash)
+    })
+    if err != nil {
+        return n, err
+    }
+    n.Body = body
+    return n, nil
+}
+
+/**
+ * Decode a resource -- returns nil for one without data
+ */
+func (er *enexResource) resource() (*Resource, error) {
+    if er.Data.Encoding != "" && er.Data.Encoding != "base64" {
+        return nil, nil
+    }
+    encoded := strings.Map(func(c rune) rune {
+        if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+            return -1
+        }
+        return c
+    }, er.Data.Value)
+    if encoded == "" {
+        return nil, nil
+    }
+    if base64.StdEncoding.DecodedLen(len(encoded)) > MaxResourceSize {
+        return nil, ErrResourceTooLarge
+    }
+
+    data, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return nil, err
+    }
+    sum := md5.Sum(data)
+    return &Resource{
+        Hash: hex.EncodeToString(sum[:]),
+        Name: strings.TrimSpace(er.FileName),
+        MIME: strings.TrimSpace(er.MIME),
+        Data: data,
+    }, nil
+}
+
+/**
+ * Link to a resource from Markdown, as an image if it is one -- res is nil if
+ * the note has no resource with the hash
+ */
+func resourceLink(res *Resource, hash string) string {
+    name, image := "attachment", false
+    if res != nil {
+        if res.Name != "" {
+            name = res.Name
+        }
+        image = strings.HasPrefix(res.MIME, "image/")
+    }
+
+    target := "(resource:" + strings.ToLower(hash) + ")"
+    if image {
+        // alt text is written as it is, escapes and all, so it only loses the
+        // brackets that would end it
+        alt := strings.NewReplacer("[", "", "]", "").Replace(name)
+        return "![" + alt + "]" + target
+    }
+    return "[" + escapeMarkdown(name) + "]" + target
+}
+
+/**
+ * Read a date as Evernote writes them -- or the zero time if it is not one
+ */
+func parseENEXTime(value string) time.Time {
+    t, err := time.Parse(enexTimeFormat, strings.TrimSpace(value))
+    if err != nil {
+        return time.Time{}
+    }
+    return t
+}
@@ -0,0 +1,258 @@
+package importer
+
+import (
+    "io"
+    "flag"
+    "bytes"
+    "strings"
+    "testing"
+    "time"
+    "io/ioutil"
+    "encoding/json"
+
+    "github.com/setonotes/pkg/page"
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/attachment"
+)
+
+// regenerate the golden files with `go test -update` after a change to the
+// output, and check the difference by hand
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+/**
+ * Compare got with the golden file, or rewrite the file with -update
+ */
+func checkGolden(t *testing.T, path string, got interface{}) {
+    t.Helper()
+    var b bytes.Buffer
+    enc := json.NewEncoder(&b)
+    enc.SetEscapeHTML(false)
+    enc.SetIndent("", "    ")
+    err := enc.Encode(got)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data := b.Bytes()
+    if *update {
+        err = ioutil.WriteFile(path, data, 0644)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return
+    }
+
+    want, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(string(data), "\n")
+    wantLines := strings.Split(string(want), "\n")
+    for i := range lines {
+        if i >= len(wantLines) || lines[i] != wantLines[i] {
+            t.Errorf("%s differs at line %v (run with -update and compare):"+
+                "\n%s", path, i+1, lines[i])
+            return
+        }
+    }
+    if len(lines) != len(wantLines) {
+        t.Errorf("%s has lines past the output", path)
+    }
+}
+
+type goldenResource struct {
+    Hash string `json:"hash"`
+    Name string `json:"name"`
+    MIME string `json:"mime"`
+    Size int    `json:"size"`
+}
+
+type goldenNote struct {
+    Path      string            `json:"path"`
+    Title     string            `json:"title"`
+    Tags      []string          `json:"tags"`
+    Created   time.Time         `json:"created"`
+    Updated   time.Time         `json:"updated"`
+    Resources []*goldenResource `json:"resources"`
+    // split into lines, so that the golden file can be read
+    Body []string `json:"body"`
+}
+
+type goldenImport struct {
+    Notes   []*goldenNote `json:"notes"`
+    Skipped []string      `json:"skipped"`
+}
+
+func readTestExport(t *testing.T, i Importer, path string) ([]*Note,
+    []*Result) {
+
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    notes, skipped, err := i.Read(bytes.NewReader(data), int64(len(data)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return notes, skipped
+}
+
+func TestENEXGolden(t *testing.T) {
+    notes, skipped := readTestExport(t, enexImporter{},
+        "testdata/evernote.enex")
+
+    got := &goldenImport{Notes: []*goldenNote{}, Skipped: []string{}}
+    for _, n := range notes {
+        g := &goldenNote{
+            Path:      n.Path,
+            Title:     n.Title,
+            Tags:      n.Tags,
+            Created:   n.Created,
+            Updated:   n.Updated,
+            Resources: []*goldenResource{},
+            Body:      strings.Split(string(n.Body), "\n"),
+        }
+        for _, res := range n.Resources {
+            g.Resources = append(g.Resources, &goldenResource{
+                Hash: res.Hash,
+                Name: res.Name,
+                MIME: res.MIME,
+                Size: len(res.Data),
+            })
+        }
+        got.Notes = append(got.Notes, g)
+    }
+    for _, r := range skipped {
+        got.Skipped = append(got.Skipped, r.Name+": "+r.Err.Error())
+    }
+    checkGolden(t, "testdata/evernote.json", got)
+}
+
+func TestENEXMalformed(t *testing.T) {
+    for _, c := range []struct {
+        name, data string
+        err        error
+    }{
+        {"empty", "", ErrNotENEX},
+        {"not XML", "title,body\nnotes,text\n", ErrNotENEX},
+        {"another XML document", "<html><body>notes</body></html>",
+            ErrNotENEX},
+        {"note outside an export", "<note><title>x</title></note>",
+            ErrNotENEX},
+        {"unclosed export", "<en-export><note><title>x</title></note>",
+            ErrNotENEX},
+        {"mismatched tags", "<en-export><note></en-export>", nil},
+        {"cut short in a note", "<en-export><note><title>x</title>", nil},
+        {"bad character", "<en-export>\x00</en-export>", ErrNotENEX},
+    } {
+        r := strings.NewReader(c.data)
+        notes, _, err := enexImporter{}.Read(r, int64(len(c.data)))
+        if err == nil || c.err != nil && err != c.err {
+            t.Errorf("%s: read %v notes: %v", c.name, len(notes), err)
+        }
+    }
+
+    // ENML in the notes is forgiven its HTML habits, as far as it can be
+    for _, c := range []struct {
+        enml, want string
+    }{
+        {"", ""},
+        {"plain text", "plain text\n"},
+        {"<en-note><div>unclosed <b>bold</en-note>",
+            "unclosed **bold**\n"},
+        {"<en-note><p>a<p>b</en-note>", "a\n\nb\n"},
+        {"<en-note>a&nbsp;&mdash;&amp;&unknown;</en-note>",
+            "a —&&unknown;\n"},
+        {"<en-note></div></b>text</en-note>", "text\n"},
+        {"<en-note><div>a</div></div></en-note></en-note>b", "a\n\nb\n"},
+        {"<en-note>a<br>b<hr><en-todo>c<br>d</en-note>",
+            "a  \nb\n\n---\n\n- [ ] c  \nd\n"},
+        {"<EN-NOTE><DIV>shouting</DIV></EN-NOTE>", "shouting\n"},
+    } {
+        got, err := ENMLToMarkdown(c.enml, nil)
+        if err != nil || string(got) != c.want {
+            t.Errorf("%q gave %q: %v", c.enml, got, err)
+        }
+    }
+}
+
+/**
+ * A permission service that keeps what is imported
+ */
+type importService struct {
+    pages       map[int]*page.Page
+    attachments map[int]string
+}
+
+func (s *importService) SavePage(p *page.Page, u *user.User) (int, error) {
+    if p.ID == 0 {
+        p.ID = len(s.pages) + 1
+    }
+    s.pages[p.ID] = p
+    return p.ID, nil
+}
+
+func (s *importService) SetPageTags(u *user.User, pageID int,
+    names []string) error {
+    return nil
+}
+
+func (s *importService) SetPageTimes(u *user.User, pageID int, created,
+    updated time.Time) error {
+    return nil
+}
+
+func (s *importService) AddAttachment(u *user.User, pageID int, name,
+    mimeType string, r io.Reader) (int, error) {
+
+    data, err := ioutil.ReadAll(r)
+    if err != nil {
+        return 0, err
+    }
+    id := 100 + len(s.attachments)
+    s.attachments[id] = name + " " + mimeType + " " + string(data)
+    return id, nil
+}
+
+func TestENEXResourcesBecomeAttachments(t *testing.T) {
+    notes, _ := readTestExport(t, enexImporter{}, "testdata/evernote.enex")
+    for _, n := range notes {
+        if n.Title == "Resources" {
+            notes = []*Note{n}
+            break
+        }
+    }
+    if len(notes) != 1 {
+        t.Fatal("no note with resources")
+    }
+
+    s := &importService{
+        pages:       map[int]*page.Page{},
+        attachments: map[int]string{},
+    }
+    results := Import(s, &user.User{ID: 1}, notes)
+    if len(results) != 1 || results[0].Err != nil {
+        t.Fatalf("import gave %v", results[0].Err)
+    }
+
+    // the same data embedded twice is attached once
+    if len(s.attachments) != 2 ||
+        s.attachments[100] != "photo [1].png image/png "+
+            "\x89PNG fake image data" ||
+        s.attachments[101] != "Q1 *report*.pdf application/pdf "+
+            "%PDF-1.4 fake pdf" {
+        t.Errorf("attached %q", s.attachments)
+    }
+    body := string(s.pages[results[0].PageID].Body)
+    for _, want := range []string{
+        "A photo: ![photo 1.png](" + attachment.Link(100) + ")",
+        `A report: [Q1 \*report\*.pdf](` + attachment.Link(101) + ")",
+        "Gone: [attachment](resource:00000000000000000000000000000000)",
+    } {
+        if !strings.Contains(body, want) {
+            t.Errorf("body %q does not have %q", body, want)
+        }
+    }
+    if notes[0].Resources[0].Data != nil {
+        t.Errorf("resource data kept after it was attached")
+    }
+}
@@ -0,0 +1,528 @@
+package importer
+
+/**
+ * This file converts ENML, the XHTML subset Evernote notes are written in, to
+ * Markdown. The ENML is read into a tree first, since lists, quotes and tables
+ * need their contents before they can be written:
+ *
+ *     div, p, h1-h6         paragraphs and headings -- Evernote writes each
+ *                           line as a div, so each becomes a paragraph
+ *     b, i, s, code, a      emphasis, strikethrough, code and links
+ *     ul, ol, blockquote    lists and quotes, nested as deep as they go
+ *     pre                   fenced code
+ *     table                 a table, its first row as the header
+ *     en-todo               a task list checkbox
+ *     en-media              a link to a resource, through the media function
+ *     en-crypt              text encrypted by Evernote, which is left out
+ *
+ * Anything else (span, font, u, ...) is written as its contents.
+ */
+
+import (
+    "io"
+    "fmt"
+    "bytes"
+    "strings"
+    "encoding/xml"
+)
+
+type enmlNode struct {
+    name     string // empty for text
+    attrs    map[string]string
+    text     string
+    children []*enmlNode
+}
+
+type enmlConverter struct {
+    media     func(hash string) string
+    listDepth int
+}
+
+var blockElements = map[string]bool{
+    "div": true, "p": true, "ul": true, "ol": true, "li": true,
+    "blockquote": true, "pre": true, "table": true, "hr": true,
+    "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+    "center": true, "section": true, "article": true, "en-note": true,
+}
+
+// elements that hold nothing, which HTML leaves unclosed
+var voidElements = map[string]bool{
+    "br": true, "hr": true, "img": true, "en-media": true, "en-todo": true,
+    "input": true, "col": true, "wbr": true, "meta": true, "link": true,
+    "area": true, "base": true, "embed": true, "param": true,
+    "source": true, "track": true,
+}
+
+/**
+ * Convert a note's ENML to Markdown -- media gives the Markdown for the
+ * resource with a hash
+ */
+func ENMLToMarkdown(enml string,
+    media func(hash string) string) ([]byte, error) {
+
+    root, err := parseENML(enml)
+    if err != nil {
+        return nil, err
+    }
+
+    c := &enmlConverter{media: media}
+    body := joinBlocks(c.blocks(root.children))
+    if body == "" {
+        return []byte{}, nil
+    }
+    return []byte(body + "\n"), nil
+}
+
+/**
+ * Read ENML into a tree, forgiving the HTML habits (such as `<br>`, `&nbsp;`
+ * and end tags that close nothing) that are found in it -- elements are
+ * matched here rather than by the decoder, which gives up on a stray end tag
+ */
+func parseENML(enml string) (*enmlNode, error) {
+    d := xml.NewDecoder(strings.NewReader(enml))
+    d.Strict = false
+    d.Entity = xml.HTMLEntity
+
+    root := &enmlNode{name: "root"}
+    stack := []*enmlNode{root}
+    for {
+        token, err := d.RawToken()
+        if err != nil {
+            if err == io.EOF {
+                break
+            }
+            return nil, err
+        }
+
+        top := stack[len(stack)-1]
+        switch t := token.(type) {
+        case xml.StartElement:
+            n := &enmlNode{
+                name:  strings.ToLower(t.Name.Local),
+                attrs: map[string]string{},
+            }
+            for _, a := range t.Attr {
+                n.attrs[strings.ToLower(a.Name.Local)] = a.Value
+            }
+            top.children = append(top.children, n)
+            if !voidElements[n.name] {
+                stack = append(stack, n)
+            }
+        case xml.EndElement:
+            // close up to the matching element, if it is open at all
+            name := strings.ToLower(t.Name.Local)
+            for i := len(stack) - 1; i > 0; i-- {
+                if stack[i].name == name {
+                    stack = stack[:i]
+                    break
+                }
+            }
+        case xml.CharData:
+            top.children = append(top.children, &enmlNode{text: string(t)})
+        }
+    }
+    return root, nil
+}
+
+/**
+ * Write nodes as Markdown blocks -- runs of inline nodes between block
+ * elements become paragraphs
+ */
+func (c *enmlConverter) blocks(nodes []*enmlNode) []string {
+    blocks := []string{}
+    var inline strings.Builder
+    flush := func() {
+        if para := c.paragraph(inline.String()); para != "" {
+            blocks = append(blocks, para)
+        }
+        inline.Reset()
+    }
+
+    for _, n := range nodes {
+        if blockElements[n.name] {
+            flush()
+            blocks = append(blocks, c.block(n)...)
+        } else {
+            c.inline(&inline, n)
+        }
+    }
+    flush()
+    return blocks
+}
+
+/**
+ * Tidy up a paragraph of inline Markdown: trim each line, and make a paragraph
+ * starting with a checkbox a task list item
+ */
+func (c *enmlConverter) paragraph(text string) string {
+    lines := strings.Split(text, "\n")
+    kept := []string{}
+    for _, line := range lines {
+        line = strings.TrimSpace(line)
+        if line != "" {
+            kept = append(kept, escapeLineStart(line))
+        }
+    }
+    para := strings.Join(kept, "  \n")
+
+    if c.listDepth == 0 && (strings.HasPrefix(para, "[ ] ") ||
+        strings.HasPrefix(para, "[x] ")) {
+        para = "- " + para
+    }
+    return para
+}
+
+func (c *enmlConverter) block(n *enmlNode) []string {
+    switch n.name {
+    case "h1", "h2", "h3", "h4", "h5", "h6":
+        var b strings.Builder
+        c.inlineChildren(&b, n)
+        text := strings.Join(strings.Fields(b.String()), " ")
+        if text == "" {
+            return nil
+        }
+        return []string{strings.Repeat("#", int(n.name[1]-'0')) + " " + text}
+    case "hr":
+        return []string{"---"}
+    case "pre":
+        return []string{codeFence(n.textContent())}
+    case "blockquote":
+        inner := joinBlocks(c.blocks(n.children))
+        if inner == "" {
+            return nil
+        }
+        lines := strings.Split(inner, "\n")
+        for i, line := range lines {
+            lines[i] = strings.TrimRight("> "+line, " ")
+        }
+        return []string{strings.Join(lines, "\n")}
+    case "ul", "ol":
+        if list := c.list(n); list != "" {
+            return []string{list}
+        }
+        return nil
+    case "table":
+        if table := c.table(n); table != "" {
+            return []string{table}
+        }
+        return nil
+    }
+    return c.blocks(n.children)
+}
+
+/**
+ * Write a list, with its items' blocks indented under their markers
+ */
+func (c *enmlConverter) list(n *enmlNode) string {
+    items := []string{}
+    number := 1
+    marker := "- "
+    for _, child := range n.children {
+        if child.name == "" {
+            continue
+        }
+
+        // Evernote nests a list in the list itself, not in an item -- it goes
+        // under the item before it
+        if child.name == "ul" || child.name == "ol" {
+            if nested := c.list(child); nested != "" {
+                items = append(items,
+                    indent(nested, strings.Repeat(" ", len(marker))))
+            }
+            continue
+        }
+
+        if n.name == "ol" {
+            marker = fmt.Sprintf("%d. ", number)
+            number++
+        }
+        c.listDepth++
+        item := strings.Join(c.blocks([]*enmlNode{child}), "\n")
+        c.listDepth--
+        if item == "" && child.name != "li" {
+            continue
+        }
+        lines := strings.SplitN(item, "\n", 2)
+        if len(lines) == 2 {
+            lines[1] = indent(lines[1], strings.Repeat(" ", len(marker)))
+        }
+        items = append(items, marker+strings.Join(lines, "\n"))
+    }
+    return strings.Join(items, "\n")
+}
+
+/**
+ * Write a table -- cells are written on one line (a `|` in them is escaped like
+ * any text), and rows padded to the same number of cells
+ */
+func (c *enmlConverter) table(n *enmlNode) string {
+    rows := [][]string{}
+    columns := 0
+    var walk func(n *enmlNode)
+    walk = func(n *enmlNode) {
+        for _, child := range n.children {
+            switch child.name {
+            case "tr":
+                row := []string{}
+                for _, cell := range child.children {
+                    if cell.name != "td" && cell.name != "th" {
+                        continue
+                    }
+                    var b strings.Builder
+                    c.inlineChildren(&b, cell)
+                    text := strings.Join(strings.Fields(b.String()), " ")
+                    row = append(row, text)
+                }
+                if len(row) > columns {
+                    columns = len(row)
+                }
+                rows = append(rows, row)
+            case "thead", "tbody", "tfoot":
+                walk(child)
+            }
+        }
+    }
+    walk(n)
+    if len(rows) == 0 || columns == 0 {
+        return ""
+    }
+
+    lines := []string{}
+    for i, row := range rows {
+        for len(row) < columns {
+            row = append(row, "")
+        }
+        lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+        if i == 0 {
+            lines = append(lines,
+                "|"+strings.Repeat(" --- |", columns))
+        }
+    }
+    return strings.Join(lines, "\n")
+}
+
+/**
+ * Write an inline node as Markdown -- block elements found inside inline ones
+ * are written as their contents
+ */
+func (c *enmlConverter) inline(b *strings.Builder, n *enmlNode) {
+    switch n.name {
+    case "":
+        b.WriteString(escapeMarkdown(collapseSpace(n.text)))
+    case "br":
+        b.WriteString("\n")
+    case "b", "strong":
+        c.wrap(b, n, "**")
+    case "i", "em":
+        c.wrap(b, n, "*")
+    case "s", "strike", "del":
+        c.wrap(b, n, "~~")
+    case "code", "tt", "kbd":
+        b.WriteString(codeSpanFor(collapseSpace(n.textContent())))
+    case "a":
+        var text strings.Builder
+        c.inlineChildren(&text, n)
+        href := n.attrs["href"]
+        if href == "" || strings.TrimSpace(text.String()) == "" {
+            b.WriteString(text.String())
+            return
+        }
+        fmt.Fprintf(b, "[%s](%s)", strings.TrimSpace(text.String()),
+            escapeDestination(href))
+    case "en-todo":
+        if n.attrs["checked"] == "true" {
+            b.WriteString("[x] ")
+        } else {
+            b.WriteString("[ ] ")
+        }
+    case "en-media":
+        if c.media != nil {
+            b.WriteString(c.media(n.attrs["hash"]))
+        }
+    case "en-crypt":
+        b.WriteString("*(encrypted text, left out of the import)*")
+    default:
+        c.inlineChildren(b, n)
+    }
+}
+
+func (c *enmlConverter) inlineChildren(b *strings.Builder, n *enmlNode) {
+    for _, child := range n.children {
+        c.inline(b, child)
+    }
+}
+
+/**
+ * Write an inline node's contents between markers, keeping any space at either
+ * end outside them, as Markdown needs
+ */
+func (c *enmlConverter) wrap(b *strings.Builder, n *enmlNode, marker string) {
+    var inner strings.Builder
+    c.inlineChildren(&inner, n)
+    text := inner.String()
+    trimmed := strings.TrimSpace(text)
+    if trimmed == "" || strings.Contains(trimmed, "\n") {
+        b.WriteString(text)
+        return
+    }
+
+    if strings.HasPrefix(text, " ") {
+        b.WriteString(" ")
+    }
+    b.WriteString(marker + trimmed + marker)
+    if strings.HasSuffix(text, " ") {
+        b.WriteString(" ")
+    }
+}
+
+/**
+ * The text in a node and all below it, as it is written
+ */
+func (n *enmlNode) textContent() string {
+    if n.name == "" {
+        return n.text
+    }
+    var b strings.Builder
+    for _, child := range n.children {
+        if child.name == "br" {
+            b.WriteString("\n")
+        } else if blockElements[child.name] && b.Len() > 0 &&
+            !strings.HasSuffix(b.String(), "\n") {
+            b.WriteString("\n" + child.textContent())
+        } else {
+            b.WriteString(child.textContent())
+        }
+    }
+    return b.String()
+}
+
+/**
+ * Join blocks with blank lines between them, except between task list items,
+ * which make one list
+ */
+func joinBlocks(blocks []string) string {
+    var b strings.Builder
+    for i, block := range blocks {
+        if i > 0 {
+            if strings.HasPrefix(block, "- [") &&
+                strings.HasPrefix(blocks[i-1], "- [") {
+                b.WriteString("\n")
+            } else {
+                b.WriteString("\n\n")
+            }
+        }
+        b.WriteString(block)
+    }
+    return b.String()
+}
+
+/**
+ * Collapse runs of white space to one space, as HTML shows them
+ */
+func collapseSpace(text string) string {
+    var b strings.Builder
+    space := false
+    for _, c := range text {
+        if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ' ' {
+            space = true
+            continue
+        }
+        if space {
+            b.WriteByte(' ')
+        }
+        space = false
+        b.WriteRune(c)
+    }
+    if space {
+        b.WriteByte(' ')
+    }
+    return b.String()
+}
+
+/**
+ * Escape the characters in text that Markdown (or the math in it) would take
+ * as markup anywhere in a line
+ */
+func escapeMarkdown(text string) string {
+    var b strings.Builder
+    for _, c := range text {
+        if strings.ContainsRune("\\`*_[]<$~|", c) {
+            b.WriteByte('\\')
+        }
+        b.WriteRune(c)
+    }
+    return b.String()
+}
+
+/**
+ * Escape what would make a line of text a heading, quote or list item
+ */
+func escapeLineStart(line string) string {
+    for _, prefix := range []string{"#", ">", "- ", "+ ", "---"} {
+        if strings.HasPrefix(line, prefix) {
+            return `\` + line
+        }
+    }
+
+    digits := 0
+    for digits < len(line) && line[digits] >= '0' && line[digits] <= '9' {
+        digits++
+    }
+    if digits > 0 && digits < len(line) &&
+        (line[digits] == '.' || line[digits] == ')') {
+        return line[:digits] + `\` + line[digits:]
+    }
+    return line
+}
+
+/**
+ * Make a link destination safe to write in Markdown
+ */
+func escapeDestination(href string) string {
+    return strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29",
+        "<", "%3C", ">", "%3E").Replace(strings.TrimSpace(href))
+}
+
+/**
+ * Write text as a code span, with a run of backticks longer than any in it
+ */
+func codeSpanFor(text string) string {
+    if strings.TrimSpace(text) == "" {
+        return text
+    }
+    ticks := "`"
+    for strings.Contains(text, ticks) {
+        ticks += "`"
+    }
+    if strings.HasPrefix(text, "`") || strings.HasSuffix(text, "`") {
+        text = " " + text + " "
+    }
+    return ticks + text + ticks
+}
+
+/**
+ * Write text as a fenced code block, with a fence longer than any in it
+ */
+func codeFence(text string) string {
+    fence := "```"
+    for strings.Contains(text, fence) {
+        fence += "`"
+    }
+    return fence + "\n" + strings.Trim(text, "\n") + "\n" + fence
+}
+
+/**
+ * Indent every line of text
+ */
+func indent(text, prefix string) string {
+    var b bytes.Buffer
+    for i, line := range strings.Split(text, "\n") {
+        if i > 0 {
+            b.WriteString("\n")
+        }
+        if line != "" {
+            b.WriteString(prefix + line)
+        }
+    }
+    return b.String()
+}
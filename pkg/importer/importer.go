@@ -0,0 +1,278 @@
+package importer
+
+/**
+ * Package importer brings notes written elsewhere into setonotes. An Importer
+ * reads the export of another app into Notes:
+ *
+ *     markdown   a zip of Markdown files (see `markdown.go`), which can also
+ *                be read from a directory
+ *     enex       an Evernote export (see `enex.go`)
+ *
+ * and Import makes each Note a new page owned by the importing user, saved
+ * through the permission service so that it is encrypted under a fresh page
+ * key like any other new page. Importers for other apps only have to read
+ * their format into Notes, and are added to the importers list.
+ *
+ * Pages are created first and their links rewritten after (see `links.go`),
+ * since a link can only point to a page once the page has an ID. The files
+ * embedded in a note become attachments of its page, and its links to them
+ * are rewritten the same way.
+ */
+
+import (
+    "io"
+    "fmt"
+    "log"
+    "time"
+    "bytes"
+    "errors"
+
+    "github.com/setonotes/pkg/page"
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/attachment"
+)
+
+type PermissionService interface {
+    SavePage(p *page.Page, u *user.User) (int, error)
+    SetPageTags(u *user.User, pageID int, names []string) error
+    SetPageTimes(u *user.User, pageID int, created, updated time.Time) error
+    AddAttachment(u *user.User, pageID int, name, mimeType string,
+        r io.Reader) (int, error)
+}
+
+/**
+ * An Importer reads the notes in an export from another app
+ */
+type Importer interface {
+    // the short name of the format, used in forms and on the command line
+    Format() string
+
+    // what the user uploads, such as "Evernote export (.enex)"
+    Description() string
+
+    // the file extension of an export, such as ".enex"
+    Extension() string
+
+    // read the notes in an export, along with a Result for each file or note
+    // that could not be read -- the error is for an export that cannot be
+    // read at all
+    Read(r io.ReaderAt, size int64) ([]*Note, []*Result, error)
+}
+
+var importers = []Importer{
+    markdownImporter{},
+    enexImporter{},
+}
+
+var ErrUnknownFormat = errors.New("unknown import format")
+
+/**
+ * Get every Importer, in the order they are offered
+ */
+func Importers() []Importer {
+    return importers
+}
+
+/**
+ * Get the Importer for a format
+ */
+func Get(format string) (Importer, error) {
+    for _, i := range importers {
+        if i.Format() == format {
+            return i, nil
+        }
+    }
+    return nil, ErrUnknownFormat
+}
+
+/**
+ * Get the Importer for a file by its extension
+ */
+func ForFile(name string) (Importer, error) {
+    for _, i := range importers {
+        if hasExtension(name, i.Extension()) {
+            return i, nil
+        }
+    }
+    return nil, ErrUnknownFormat
+}
+
+/**
+ * A Note read from an export, ready to become a page
+ */
+type Note struct {
+    // where the note was in the export, such as a path in a zip or the title
+    // of an Evernote note -- relative links between notes are by path
+    Path    string
+    Title   string
+    Tags    []string
+    Body    []byte
+    Created time.Time // zero if unknown
+    Updated time.Time // zero if unknown
+
+    // files embedded in the note, such as images
+    Resources []*Resource
+}
+
+/**
+ * A Resource is a file embedded in a note -- the note's body links to it as
+ * `resource:<hash>`, which becomes a link to the attachment it is imported as
+ */
+type Resource struct {
+    Hash string
+    Name string
+    MIME string
+    Data []byte
+}
+
+/**
+ * The Result of importing one file or note -- PageID is 0 if no page was made,
+ * and Err is set if anything went wrong
+ */
+type Result struct {
+    Name   string
+    PageID int
+    Err    error
+}
+
+/**
+ * Create a page for each note, for the given user, and rewrite the links
+ * between them
+ *
+ * A note dated created and updated at different times is saved twice, so that
+ * its history can keep both. Returns a Result for each note, in the same
+ * order. A note that fails does not stop the others.
+ */
+func Import(p PermissionService, u *user.User, notes []*Note) []*Result {
+    log.Printf("importing %v notes for user-%v...", len(notes), u.ID)
+
+    results := []*Result{}
+    pageIDs := map[string]int{}
+    revisions := make([]int, len(notes))
+    attachmentIDs := make([]map[string]int, len(notes))
+    for i, n := range notes {
+        r := &Result{Name: n.Path}
+        results = append(results, r)
+
+        pg := &page.Page{Title: []byte(n.Title), Body: n.Body}
+        pageID, err := p.SavePage(pg, u)
+        if err != nil {
+            log.Printf("failed to import <%s> for user-%v: %v", n.Path, u.ID,
+                err)
+            r.Err = err
+            continue
+        }
+        r.PageID = pageID
+        pageIDs[n.Path] = pageID
+        revisions[i] = pg.Revision
+
+        if len(n.Tags) > 0 {
+            err = p.SetPageTags(u, pageID, n.Tags)
+            if err != nil {
+                log.Printf("failed to tag imported page-%v: %v", pageID, err)
+                r.Err = fmt.Errorf("page imported without its tags: %v", err)
+            }
+        }
+
+        attachmentIDs[i], err = attachResources(p, u, pageID, n.Resources)
+        if err != nil {
+            r.Err = err
+        }
+    }
+
+    // save again the pages that link to others or to attachments, now that
+    // those have IDs, and those with two dates
+    for i, n := range notes {
+        r := results[i]
+        if r.PageID == 0 {
+            continue
+        }
+        body, changed := RewriteLinks(n.Path, n.Body, pageIDs)
+        body, linked := linkResources(body, attachmentIDs[i])
+        changed = changed || linked
+        dated := !n.Created.IsZero() && !n.Updated.IsZero() &&
+            !n.Created.Equal(n.Updated)
+        if changed || dated {
+            pg := &page.Page{
+                ID:       r.PageID,
+                Revision: revisions[i],
+                Title:    []byte(n.Title),
+                Body:     body,
+            }
+            _, err := p.SavePage(pg, u)
+            if err != nil {
+                log.Printf("failed to save imported page-%v again: %v",
+                    r.PageID, err)
+                if changed {
+                    r.Err = fmt.Errorf("page imported without its links: %v",
+                        err)
+                }
+            }
+        }
+
+        if n.Created.IsZero() && n.Updated.IsZero() {
+            continue
+        }
+        err := p.SetPageTimes(u, r.PageID, n.Created, n.Updated)
+        if err != nil {
+            log.Printf("failed to date imported page-%v: %v", r.PageID, err)
+            r.Err = fmt.Errorf("page imported without its dates: %v", err)
+        }
+    }
+
+    log.Printf("imported %v notes for user-%v", len(pageIDs), u.ID)
+    return results
+}
+
+/**
+ * Attach the resources of a note to its page, returning the attachment ID of
+ * each by hash -- the error describes the resources that were left out, which
+ * does not stop the others
+ */
+func attachResources(p PermissionService, u *user.User, pageID int,
+    resources []*Resource) (map[string]int, error) {
+
+    ids := map[string]int{}
+    failed := 0
+    var lastErr error
+    for _, res := range resources {
+        name := res.Name
+        if name == "" {
+            name = "attachment"
+        }
+        id, err := p.AddAttachment(u, pageID, name, res.MIME,
+            bytes.NewReader(res.Data))
+        res.Data = nil // encrypted and stored, or given up on
+        if err != nil {
+            log.Printf("failed to attach resource of imported page-%v: %v",
+                pageID, err)
+            failed++
+            lastErr = err
+            continue
+        }
+        ids[res.Hash] = id
+    }
+
+    if failed > 0 {
+        return ids, fmt.Errorf("page imported without %v of its %v "+
+            "attachments: %v", failed, len(resources), lastErr)
+    }
+    return ids, nil
+}
+
+/**
+ * Make each `(resource:<hash>)` link in a body a link to the attachment the
+ * resource became -- returns false if there were none
+ */
+func linkResources(body []byte, ids map[string]int) ([]byte, bool) {
+    changed := false
+    for hash, id := range ids {
+        from := []byte("(resource:" + hash + ")")
+        if bytes.Contains(body, from) {
+            to := []byte("(" + attachment.Link(id) + ")")
+            body = bytes.Replace(body, from, to, -1)
+            changed = true
+        }
+    }
+    return body, changed
+}
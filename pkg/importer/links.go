@@ -0,0 +1,228 @@
+package importer
+
+/**
+ * This file rewrites relative links between imported files, such as
+ * `[notes](../meetings/monday.md#actions)`, into links to the pages made from
+ * them (`/view/42#actions`). Both inline links and reference definitions are
+ * rewritten; links in code, to other sites, or to files that were not imported
+ * are left as they are.
+ */
+
+import (
+    "fmt"
+    "path"
+    "bytes"
+    "strings"
+    "net/url"
+)
+
+/**
+ * Rewrite the links in the body of the file at from, given the page ID of each
+ * imported file by path -- returns the body and whether any link changed
+ */
+func RewriteLinks(from string, body []byte,
+    pageIDs map[string]int) ([]byte, bool) {
+
+    // paths are matched ignoring case, as on many file systems
+    ids := map[string]int{}
+    for p, id := range pageIDs {
+        ids[strings.ToLower(p)] = id
+    }
+
+    var out bytes.Buffer
+    changed := false
+    fence := ""
+    for i := 0; i < len(body); {
+        if i == 0 || body[i-1] == '\n' {
+            end := lineEnd(body, i)
+            line := body[i:end]
+            trimmed := string(bytes.TrimSpace(line))
+
+            // fenced code blocks are passed over a line at a time
+            if fence == "" && (strings.HasPrefix(trimmed, "```") ||
+                strings.HasPrefix(trimmed, "~~~")) {
+                fence = trimmed[:3]
+                out.Write(line)
+                i = end
+                continue
+            } else if fence != "" {
+                if strings.HasPrefix(trimmed, fence) {
+                    fence = ""
+                }
+                out.Write(line)
+                i = end
+                continue
+            }
+
+            if n := referenceDefinition(line); n > 0 {
+                dest, m := destination(line[n:])
+                out.Write(line[:n])
+                if link, ok := resolve(from, dest, ids); ok {
+                    out.WriteString(link)
+                    changed = true
+                } else {
+                    out.Write(line[n : n+m])
+                }
+                i += n + m
+                continue
+            }
+        }
+
+        switch {
+        case body[i] == '`':
+            n := codeSpan(body[i:])
+            out.Write(body[i : i+n])
+            i += n
+        case body[i] == '\\' && i+1 < len(body):
+            out.Write(body[i : i+2])
+            i += 2
+        case bytes.HasPrefix(body[i:], []byte("](")):
+            out.WriteString("](")
+            i += 2
+            dest, n := destination(body[i:])
+            if link, ok := resolve(from, dest, ids); ok {
+                out.WriteString(link)
+                changed = true
+            } else {
+                out.Write(body[i : i+n])
+            }
+            i += n
+        default:
+            out.WriteByte(body[i])
+            i++
+        }
+    }
+
+    return out.Bytes(), changed
+}
+
+/**
+ * The length of the start of a reference definition, such as `[id]: `, that a
+ * line starts with, up to its destination -- or 0 if it does not start with one
+ */
+func referenceDefinition(line []byte) int {
+    i := 0
+    for i < 3 && i < len(line) && line[i] == ' ' {
+        i++
+    }
+    // footnotes, `[^1]: ...`, look the same but hold no link
+    if i == len(line) || line[i] != '[' ||
+        bytes.HasPrefix(line[i:], []byte("[^")) {
+        return 0
+    }
+    end := bytes.Index(line[i:], []byte("]:"))
+    if end <= 1 {
+        return 0
+    }
+    i += end + 2
+    for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+        i++
+    }
+    return i
+}
+
+/**
+ * Read the link destination rest starts with, either in angle brackets or up
+ * to a space or an unmatched closing parenthesis -- returns the destination and
+ * the number of bytes it takes up
+ */
+func destination(rest []byte) (string, int) {
+    if len(rest) > 0 && rest[0] == '<' {
+        end := bytes.IndexAny(rest, ">\n")
+        if end < 0 || rest[end] != '>' {
+            return "", 0
+        }
+        return string(rest[1:end]), end + 1
+    }
+
+    depth := 0
+    for i, c := range rest {
+        switch {
+        case c == ' ' || c == '\t' || c == '\n':
+            return string(rest[:i]), i
+        case c == '(':
+            depth++
+        case c == ')':
+            if depth == 0 {
+                return string(rest[:i]), i
+            }
+            depth--
+        }
+    }
+    return string(rest), len(rest)
+}
+
+/**
+ * Find the page a link destination in the file at from points to -- returns
+ * the link to the page, or false if it does not point to an imported file
+ */
+func resolve(from, dest string, ids map[string]int) (string, bool) {
+    if dest == "" || strings.HasPrefix(dest, "/") ||
+        strings.HasPrefix(dest, "#") {
+        return "", false
+    }
+    // links with a scheme, such as https: or mailto:, go elsewhere
+    if i := strings.IndexAny(dest, ":/?#"); i >= 0 && dest[i] == ':' {
+        return "", false
+    }
+
+    target, fragment := dest, ""
+    if i := strings.Index(dest, "#"); i >= 0 {
+        target, fragment = dest[:i], dest[i:]
+    }
+    if i := strings.Index(target, "?"); i >= 0 {
+        target = target[:i]
+    }
+    if unescaped, err := url.PathUnescape(target); err == nil {
+        target = unescaped
+    }
+
+    target = strings.ToLower(cleanPath(path.Join(path.Dir(from), target)))
+    id, ok := ids[target]
+    if !ok {
+        // some editors leave the extension off links between notes
+        id, ok = ids[target+".md"]
+    }
+    if !ok {
+        return "", false
+    }
+    return fmt.Sprintf("/view/%d%s", id, fragment), true
+}
+
+/**
+ * The length of the code span rest starts with -- a run of backticks up to
+ * the next run as long, or just the run if there is none
+ */
+func codeSpan(rest []byte) int {
+    run := 0
+    for run < len(rest) && rest[run] == '`' {
+        run++
+    }
+
+    for i := run; i < len(rest); {
+        if rest[i] != '`' {
+            i++
+            continue
+        }
+        j := i
+        for j < len(rest) && rest[j] == '`' {
+            j++
+        }
+        if j-i == run {
+            return j
+        }
+        i = j
+    }
+    return run
+}
+
+/**
+ * The index just past the end of the line holding body[i]
+ */
+func lineEnd(body []byte, i int) int {
+    end := bytes.IndexByte(body[i:], '\n')
+    if end < 0 {
+        return len(body)
+    }
+    return i + end + 1
+}
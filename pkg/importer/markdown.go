@@ -0,0 +1,357 @@
+package importer
+
+/**
+ * This file reads Markdown files to import, from a zip or a directory. A file
+ * may start with YAML front matter, as written by `pkg/export`:
+ *
+ *     ---
+ *     title: "Meeting notes"
+ *     tags: ["work", "todo"]
+ *     created: 2020-01-02T15:04:05Z
+ *     updated: 2020-01-03T09:00:00Z
+ *     ---
+ *
+ * Only the title, tags and dates are used; a page gets a new ID and owner, and
+ * the other fields are ignored. Tags may also be a block list (`- work`) or a
+ * single name. A file without a title is named after its file name.
+ */
+
+import (
+    "io"
+    "os"
+    "path"
+    "bytes"
+    "time"
+    "errors"
+    "strconv"
+    "strings"
+    "path/filepath"
+    "archive/zip"
+
+    "github.com/setonotes/pkg/render"
+)
+
+// the most files read from one import, and the largest file read, so that a
+// small zip cannot be made to expand into something huge
+const (
+    MaxFiles    = 1000
+    MaxFileSize = 1 << 20
+)
+
+// some editors start UTF-8 files with one
+var byteOrderMark = []byte("\xef\xbb\xbf")
+
+var (
+    ErrNotMarkdown  = errors.New("not a Markdown file, skipped")
+    ErrFileTooLarge = errors.New("file is too large to import")
+    ErrTooManyFiles = errors.New("too many files to import at once")
+)
+
+type markdownImporter struct{}
+
+func (markdownImporter) Format() string {
+    return "markdown"
+}
+
+func (markdownImporter) Description() string {
+    return "Zip of Markdown files (.zip)"
+}
+
+func (markdownImporter) Extension() string {
+    return ".zip"
+}
+
+/**
+ * Read the Markdown files in a zip -- notes are by their path in the zip
+ */
+func (markdownImporter) Read(r io.ReaderAt, size int64) ([]*Note, []*Result,
+    error) {
+
+    z, err := zip.NewReader(r, size)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    notes, skipped := []*Note{}, []*Result{}
+    for _, entry := range z.File {
+        if entry.FileInfo().IsDir() {
+            continue
+        }
+        name := cleanPath(entry.Name)
+        if hidden(name) {
+            continue
+        }
+        if !isMarkdown(name) {
+            skipped = append(skipped, &Result{Name: name, Err: ErrNotMarkdown})
+            continue
+        }
+        if len(notes) == MaxFiles {
+            return nil, nil, ErrTooManyFiles
+        }
+
+        data, err := readZipEntry(entry)
+        if err != nil {
+            skipped = append(skipped, &Result{Name: name, Err: err})
+            continue
+        }
+        notes = append(notes, ParseMarkdown(name, data))
+    }
+    return notes, skipped, nil
+}
+
+func readZipEntry(entry *zip.File) ([]byte, error) {
+    if entry.UncompressedSize64 > MaxFileSize {
+        return nil, ErrFileTooLarge
+    }
+    rc, err := entry.Open()
+    if err != nil {
+        return nil, err
+    }
+    defer rc.Close()
+    return readLimited(rc)
+}
+
+/**
+ * Read the Markdown files in a directory and those below it, as from a zip
+ */
+func ReadDir(dir string) ([]*Note, []*Result, error) {
+    notes, skipped := []*Note{}, []*Result{}
+    err := filepath.Walk(dir, func(p string, info os.FileInfo,
+        err error) error {
+        if err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(dir, p)
+        if err != nil {
+            return err
+        }
+        name := cleanPath(filepath.ToSlash(rel))
+        if name != "" && hidden(name) {
+            if info.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if info.IsDir() {
+            return nil
+        }
+        if !isMarkdown(name) {
+            skipped = append(skipped, &Result{Name: name, Err: ErrNotMarkdown})
+            return nil
+        }
+        if len(notes) == MaxFiles {
+            return ErrTooManyFiles
+        }
+
+        data, err := readFile(p, info)
+        if err != nil {
+            skipped = append(skipped, &Result{Name: name, Err: err})
+            return nil
+        }
+        notes = append(notes, ParseMarkdown(name, data))
+        return nil
+    })
+    if err != nil {
+        return nil, nil, err
+    }
+    return notes, skipped, nil
+}
+
+func readFile(p string, info os.FileInfo) ([]byte, error) {
+    if info.Size() > MaxFileSize {
+        return nil, ErrFileTooLarge
+    }
+    f, err := os.Open(p)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    return readLimited(f)
+}
+
+/**
+ * Read all of r, failing if it holds more than MaxFileSize bytes -- sizes in
+ * zip headers cannot be trusted
+ */
+func readLimited(r io.Reader) ([]byte, error) {
+    data, err := io.ReadAll(io.LimitReader(r, MaxFileSize+1))
+    if err != nil {
+        return nil, err
+    }
+    if len(data) > MaxFileSize {
+        return nil, ErrFileTooLarge
+    }
+    return data, nil
+}
+
+/**
+ * Make a path in an import slash-separated and relative, with no `..` that
+ * could climb out of it
+ */
+func cleanPath(name string) string {
+    name = strings.Replace(name, `\`, "/", -1)
+    return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+/**
+ * Whether a path is one of the files archivers and file systems leave behind,
+ * such as `.DS_Store` or anything under `__MACOSX/`, or in a hidden directory
+ */
+func hidden(name string) bool {
+    for _, part := range strings.Split(name, "/") {
+        if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+            return true
+        }
+    }
+    return false
+}
+
+func isMarkdown(name string) bool {
+    return hasExtension(name, ".md") || hasExtension(name, ".markdown")
+}
+
+func hasExtension(name, extension string) bool {
+    return strings.EqualFold(path.Ext(name), extension)
+}
+
+/**
+ * Read a Markdown file: its front matter, if it has any, and its body
+ */
+func ParseMarkdown(name string, data []byte) *Note {
+    data = render.NormalizeNewlines(bytes.TrimPrefix(data, byteOrderMark))
+    n := &Note{Path: name, Tags: []string{}, Body: data}
+
+    if bytes.HasPrefix(data, []byte("---\n")) {
+        // from the newline ending the opening line, so that empty front
+        // matter closes at once
+        rest := data[3:]
+        end := bytes.Index(rest, []byte("\n---\n"))
+        if end >= 0 {
+            parseFrontMatter(n, string(rest[1:end+1]))
+            n.Body = bytes.TrimLeft(rest[end+5:], "\n")
+        } else if bytes.HasSuffix(rest, []byte("\n---")) {
+            parseFrontMatter(n, string(rest[1:len(rest)-3]))
+            n.Body = []byte{}
+        }
+    }
+
+    if strings.TrimSpace(n.Title) == "" {
+        base := path.Base(name)
+        n.Title = strings.TrimSuffix(base, path.Ext(base))
+    }
+    return n
+}
+
+/**
+ * Take the title, tags and dates from front matter, line by line
+ */
+func parseFrontMatter(n *Note, frontMatter string) {
+    inTags := false
+    for _, line := range strings.Split(frontMatter, "\n") {
+        trimmed := strings.TrimSpace(line)
+
+        // a block list of tags is a run of indented `- name` lines
+        if inTags && strings.HasPrefix(trimmed, "- ") {
+            n.Tags = append(n.Tags, unquote(trimmed[2:]))
+            continue
+        }
+        inTags = false
+
+        colon := strings.Index(line, ":")
+        if colon < 0 || strings.HasPrefix(line, " ") {
+            continue
+        }
+        key := strings.TrimSpace(line[:colon])
+        value := strings.TrimSpace(line[colon+1:])
+
+        switch key {
+        case "title":
+            n.Title = unquote(value)
+        case "tags":
+            if value == "" {
+                inTags = true
+            } else {
+                n.Tags = append(n.Tags, parseList(value)...)
+            }
+        case "created":
+            n.Created = parseTime(unquote(value))
+        case "updated":
+            n.Updated = parseTime(unquote(value))
+        }
+    }
+}
+
+/**
+ * Read a flow list of tags, such as `["work", todo]`, or a single tag
+ */
+func parseList(value string) []string {
+    if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+        return []string{unquote(value)}
+    }
+
+    items := []string{}
+    for _, item := range splitList(value[1 : len(value)-1]) {
+        item = unquote(strings.TrimSpace(item))
+        if item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+/**
+ * Split a flow list at the commas that are not inside quotes
+ */
+func splitList(list string) []string {
+    items := []string{}
+    start, quote := 0, byte(0)
+    for i := 0; i < len(list); i++ {
+        c := list[i]
+        switch {
+        case quote == '"' && c == '\\':
+            i++
+        case quote != 0 && c == quote:
+            quote = 0
+        case quote == 0 && (c == '"' || c == '\''):
+            quote = c
+        case quote == 0 && c == ',':
+            items = append(items, list[start:i])
+            start = i + 1
+        }
+    }
+    return append(items, list[start:])
+}
+
+/**
+ * Read a YAML scalar -- double-quoted strings have Go's escapes, and a quote
+ * is doubled in a single-quoted one
+ */
+func unquote(value string) string {
+    n := len(value)
+    switch {
+    case n >= 2 && value[0] == '"' && value[n-1] == '"':
+        s, err := strconv.Unquote(value)
+        if err == nil {
+            return s
+        }
+        return value[1 : n-1]
+    case n >= 2 && value[0] == '\'' && value[n-1] == '\'':
+        return strings.Replace(value[1:n-1], "''", "'", -1)
+    }
+    // a comment ends a plain scalar
+    if i := strings.Index(value, " #"); i >= 0 {
+        value = strings.TrimSpace(value[:i])
+    }
+    return value
+}
+
+/**
+ * Read a date as written by `pkg/export` -- or the zero time if it is not one
+ */
+func parseTime(value string) time.Time {
+    t, err := time.Parse(time.RFC3339, value)
+    if err != nil {
+        return time.Time{}
+    }
+    return t
+}
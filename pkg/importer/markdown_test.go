@@ -0,0 +1,317 @@
+package importer
+
+import (
+    "os"
+    "fmt"
+    "bytes"
+    "strings"
+    "testing"
+    "time"
+    "io/ioutil"
+    "path/filepath"
+    "archive/zip"
+)
+
+func TestParseMarkdown(t *testing.T) {
+    created := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+    updated := time.Date(2020, 1, 3, 9, 0, 0, 0, time.FixedZone("", 3600))
+
+    for _, c := range []struct {
+        name, data string
+        want       Note
+    }{
+        {
+            name: "notes/plain.md",
+            data: "# Hi\nthere\n",
+            want: Note{Title: "plain", Tags: []string{},
+                Body: []byte("# Hi\nthere\n")},
+        },
+        // as written by pkg/export
+        {
+            name: "exported.md",
+            data: "---\nid: 42\ntitle: \"Say \\\"hi\\\"\"\nowner: \"bob\"\n" +
+                "tags: [\"work\", \"to do\"]\n" +
+                "created: 2020-01-02T15:04:05Z\n" +
+                "updated: 2020-01-03T09:00:00+01:00\n---\n\nbody\n",
+            want: Note{Title: `Say "hi"`, Tags: []string{"work", "to do"},
+                Created: created, Updated: updated, Body: []byte("body\n")},
+        },
+        {
+            name: "block tags.md",
+            data: "---\ntitle: 'it''s'\ntags:\n  - one\n" +
+                "  - \"two, three\"\ncreated: \"2020-01-02T15:04:05Z\"\n" +
+                "---\nbody",
+            want: Note{Title: "it's", Tags: []string{"one", "two, three"},
+                Created: created, Body: []byte("body")},
+        },
+        {
+            name: "plain scalars.md",
+            data: "---\ntitle: Plain # comment\ntags: single\n---\n",
+            want: Note{Title: "Plain", Tags: []string{"single"},
+                Body: []byte{}},
+        },
+        {
+            name: "flow list.md",
+            data: "---\ntags: [a, 'b, c', \"d\\\"]\", , ]\n---\nx",
+            want: Note{Title: "flow list", Tags: []string{"a", "b, c",
+                "d\"]"}, Body: []byte("x")},
+        },
+        {
+            name: "bad dates.md",
+            data: "---\ncreated: yesterday\nupdated: 2020-01-02\n---\nx",
+            want: Note{Title: "bad dates", Tags: []string{},
+                Body: []byte("x")},
+        },
+        // an empty title is taken from the file name
+        {
+            name: "dir/empty title.markdown",
+            data: "---\ntitle: \"  \"\n---\nx",
+            want: Note{Title: "empty title", Tags: []string{},
+                Body: []byte("x")},
+        },
+        {
+            name: "empty.md",
+            data: "---\n---\nbody",
+            want: Note{Title: "empty", Tags: []string{},
+                Body: []byte("body")},
+        },
+        // front matter that is never closed is part of the body
+        {
+            name: "unclosed.md",
+            data: "---\ntitle: x\nbody",
+            want: Note{Title: "unclosed", Tags: []string{},
+                Body: []byte("---\ntitle: x\nbody")},
+        },
+        {
+            name: "not at start.md",
+            data: "\n---\ntitle: x\n---\n",
+            want: Note{Title: "not at start", Tags: []string{},
+                Body: []byte("\n---\ntitle: x\n---\n")},
+        },
+        {
+            name: "windows.md",
+            data: "\xef\xbb\xbf---\r\ntitle: CRLF\r\n---\r\nline\r\n",
+            want: Note{Title: "CRLF", Tags: []string{},
+                Body: []byte("line\n")},
+        },
+    } {
+        n := ParseMarkdown(c.name, []byte(c.data))
+        if n.Path != c.name || n.Title != c.want.Title ||
+            strings.Join(n.Tags, "|") != strings.Join(c.want.Tags, "|") ||
+            !bytes.Equal(n.Body, c.want.Body) ||
+            !n.Created.Equal(c.want.Created) ||
+            !n.Updated.Equal(c.want.Updated) {
+
+            t.Errorf("%s: got %q %q %v %v %q", c.name, n.Title, n.Tags,
+                n.Created, n.Updated, n.Body)
+        }
+        if n.Tags == nil {
+            t.Errorf("%s: got nil tags", c.name)
+        }
+    }
+}
+
+func TestRewriteLinks(t *testing.T) {
+    ids := map[string]int{
+        "notes/monday.md":       1,
+        "notes/Tuesday Plan.md": 2,
+        "index.md":              3,
+        "notes/a (b).md":        4,
+    }
+    for _, c := range []struct {
+        from, body, want string
+    }{
+        {"index.md", "[m](notes/monday.md)", "[m](/view/1)"},
+        {"notes/tuesday plan.md", "see [m](monday.md#actions \"t\")",
+            "see [m](/view/1#actions \"t\")"},
+        {"notes/monday.md", "[up](../index.md?x=1)", "[up](/view/3)"},
+        {"notes/monday.md", "[t](Tuesday%20Plan.md) [t](<Tuesday Plan.md>)",
+            "[t](/view/2) [t](/view/2)"},
+        {"index.md", "[c](NOTES/MONDAY.MD) [e](notes/monday)",
+            "[c](/view/1) [e](/view/1)"},
+        {"index.md", "[p](notes/a%20(b).md)", "[p](/view/4)"},
+        {"index.md", "![img](notes/monday.md)", "![img](/view/1)"},
+        // climbing out of the import goes no higher than its top
+        {"notes/monday.md", "[x](../../../index.md)", "[x](/view/3)"},
+        {"index.md", "[m]: notes/monday.md\n  [i]: <index.md> \"t\"\n",
+            "[m]: /view/1\n  [i]: /view/3 \"t\"\n"},
+
+        // left as they are
+        {"index.md", "[m](https://example.com/notes/monday.md)",
+            "[m](https://example.com/notes/monday.md)"},
+        {"index.md", "[m](mailto:a@example.com) [m](/notes/monday.md)",
+            "[m](mailto:a@example.com) [m](/notes/monday.md)"},
+        {"index.md", "[m](#notes) [m](missing.md) [m]()",
+            "[m](#notes) [m](missing.md) [m]()"},
+        {"index.md", "`[m](notes/monday.md)` \\[m\\](notes/monday.md)",
+            "`[m](notes/monday.md)` \\[m\\](notes/monday.md)"},
+        {"index.md", "```\n[m](notes/monday.md)\n```\n[m](index.md)",
+            "```\n[m](notes/monday.md)\n```\n[m](/view/3)"},
+        {"index.md", "~~~\n```\n[m](index.md)\n~~~\n",
+            "~~~\n```\n[m](index.md)\n~~~\n"},
+        {"index.md", "[^1]: index.md\n", "[^1]: index.md\n"},
+        {"index.md", "    [m]: index.md\n", "    [m]: index.md\n"},
+    } {
+        got, changed := RewriteLinks(c.from, []byte(c.body), ids)
+        if string(got) != c.want || changed != (c.want != c.body) {
+            t.Errorf("%q in %s gave %q (changed %v), want %q", c.body,
+                c.from, got, changed, c.want)
+        }
+    }
+}
+
+/**
+ * Write files to a new directory, by path
+ */
+func writeTestDir(t *testing.T, files map[string][]byte) string {
+    dir, err := ioutil.TempDir("", "setonotes-import-")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for name, data := range files {
+        p := filepath.Join(dir, filepath.FromSlash(name))
+        err := os.MkdirAll(filepath.Dir(p), 0700)
+        if err == nil {
+            err = ioutil.WriteFile(p, data, 0600)
+        }
+        if err != nil {
+            os.RemoveAll(dir)
+            t.Fatal(err)
+        }
+    }
+    return dir
+}
+
+func TestReadDir(t *testing.T) {
+    dir := writeTestDir(t, map[string][]byte{
+        "index.md":           []byte("# Index"),
+        "notes/monday.MD":    []byte("---\ntitle: Monday\n---\n"),
+        "notes/largest.md":   bytes.Repeat([]byte("x"), MaxFileSize),
+        "notes/too large.md": bytes.Repeat([]byte("x"), MaxFileSize+1),
+        "notes/photo.png":    []byte("png"),
+        ".git/config.md":     []byte("hidden"),
+        "notes/.DS_Store":    []byte("hidden"),
+        "__MACOSX/index.md":  []byte("hidden"),
+        "notes/.draft.md":    []byte("hidden"),
+    })
+    defer os.RemoveAll(dir)
+
+    notes, skipped, err := ReadDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := []string{}
+    for _, n := range notes {
+        got = append(got, n.Path+" "+n.Title)
+    }
+    want := "index.md index|notes/largest.md largest|notes/monday.MD Monday"
+    if strings.Join(got, "|") != want {
+        t.Errorf("read %q", got)
+    }
+    if len(skipped) != 2 || skipped[0].Name != "notes/photo.png" ||
+        skipped[0].Err != ErrNotMarkdown ||
+        skipped[1].Name != "notes/too large.md" ||
+        skipped[1].Err != ErrFileTooLarge {
+
+        t.Errorf("skipped %v then %v", skipped[0], skipped[1])
+    }
+}
+
+func TestReadDirTooManyFiles(t *testing.T) {
+    for _, n := range []int{MaxFiles, MaxFiles + 1} {
+        files := map[string][]byte{"photo.png": []byte("not counted")}
+        for i := 0; i < n; i++ {
+            files[fmt.Sprintf("dir %d/note %d.md", i%10, i)] = []byte("x")
+        }
+        dir := writeTestDir(t, files)
+        notes, _, err := ReadDir(dir)
+        os.RemoveAll(dir)
+
+        if n <= MaxFiles && (err != nil || len(notes) != n) {
+            t.Errorf("%v files: read %v: %v", n, len(notes), err)
+        } else if n > MaxFiles && err != ErrTooManyFiles {
+            t.Errorf("%v files: read %v: %v", n, len(notes), err)
+        }
+    }
+}
+
+/**
+ * Write files to a zip, in order
+ */
+func writeTestZip(t *testing.T, names []string, files [][]byte) []byte {
+    var b bytes.Buffer
+    z := zip.NewWriter(&b)
+    for i, name := range names {
+        f, err := z.Create(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        f.Write(files[i])
+    }
+    if err := z.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return b.Bytes()
+}
+
+func TestReadZip(t *testing.T) {
+    data := writeTestZip(t, []string{
+        "export/index.md",
+        "export/",
+        `export\windows.md`,
+        "../../escaped.md",
+        "export/too large.md",
+        "export/photo.png",
+        "__MACOSX/export/._index.md",
+    }, [][]byte{
+        []byte("# Index"),
+        nil,
+        []byte("x"),
+        []byte("x"),
+        bytes.Repeat([]byte("x"), MaxFileSize+1),
+        []byte("png"),
+        []byte("hidden"),
+    })
+
+    notes, skipped, err := markdownImporter{}.Read(bytes.NewReader(data),
+        int64(len(data)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := []string{}
+    for _, n := range notes {
+        got = append(got, n.Path)
+    }
+    if strings.Join(got, "|") != "export/index.md|export/windows.md|"+
+        "escaped.md" {
+        t.Errorf("read %q", got)
+    }
+    if len(skipped) != 2 || skipped[0].Err != ErrFileTooLarge ||
+        skipped[1].Err != ErrNotMarkdown {
+        t.Errorf("skipped %v then %v", skipped[0], skipped[1])
+    }
+
+    names, files := []string{}, [][]byte{}
+    for i := 0; i <= MaxFiles; i++ {
+        names = append(names, fmt.Sprintf("note %d.md", i))
+        files = append(files, []byte("x"))
+    }
+    data = writeTestZip(t, names, files)
+    _, _, err = markdownImporter{}.Read(bytes.NewReader(data),
+        int64(len(data)))
+    if err != ErrTooManyFiles {
+        t.Errorf("reading %v files gave %v", len(names), err)
+    }
+}
+
+func TestReadLimited(t *testing.T) {
+    // the size in a zip header may be a lie, so what is read is counted too
+    for _, n := range []int{0, MaxFileSize, MaxFileSize + 1, 2 * MaxFileSize} {
+        data, err := readLimited(bytes.NewReader(make([]byte, n)))
+        if n <= MaxFileSize && (err != nil || len(data) != n) {
+            t.Errorf("%v bytes: read %v: %v", n, len(data), err)
+        } else if n > MaxFileSize && err != ErrFileTooLarge {
+            t.Errorf("%v bytes: read %v: %v", n, len(data), err)
+        }
+    }
+}
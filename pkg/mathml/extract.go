@@ -0,0 +1,321 @@
+package mathml
+
+/**
+ * This file takes the math out of a Markdown body before it is rendered, and
+ * puts it back as MathML once the rendered HTML has been sanitized. Left in,
+ * the Markdown renderer would take the TeX apart (`_` and `*` are emphasis, `\`
+ * escapes), and the sanitizer would strip the MathML.
+ *
+ * Math is written as:
+ *     $...$     \(...\)    inline
+ *     $$...$$   \[...\]    display
+ * A `$` only opens inline math if it is not followed by a space, and the next
+ * `$` only closes it if not preceded by one nor followed by a digit, so that
+ * amounts like "$5 and $10" stay as they are. Inline math stays on one line,
+ * display math within one paragraph, and math inside code is left alone.
+ */
+
+import (
+    "bytes"
+    "html"
+    "strconv"
+    "strings"
+    "encoding/hex"
+    "crypto/rand"
+)
+
+/**
+ * The Formulas taken out of a body, each replaced by a placeholder
+ */
+type Formulas struct {
+    // placeholders are alphanumeric so that they go through Markdown and the
+    // sanitizer unchanged, and random so that no body can forge one
+    prefix   string
+    formulas []formula
+}
+
+type formula struct {
+    source  string // as written, with its delimiters
+    tex     string
+    display bool
+    literal bool // an escaped dollar sign, put back as the text in tex
+}
+
+/**
+ * Take the math out of a body, returning the body with placeholders in its
+ * stead
+ */
+func Extract(body []byte) ([]byte, *Formulas) {
+    nonce := make([]byte, 8)
+    rand.Read(nonce)
+    f := &Formulas{prefix: "math" + hex.EncodeToString(nonce) + "x"}
+
+    var out bytes.Buffer
+    fence := ""
+    for i := 0; i < len(body); {
+        // fenced code blocks are passed over a line at a time
+        if i == 0 || body[i-1] == '\n' {
+            end := lineEnd(body, i)
+            trimmed := string(bytes.TrimSpace(body[i:end]))
+            if fence == "" && (strings.HasPrefix(trimmed, "```") ||
+                strings.HasPrefix(trimmed, "~~~")) {
+                fence = trimmed[:3]
+            } else if fence != "" && strings.HasPrefix(trimmed, fence) {
+                fence = ""
+                out.Write(body[i:end])
+                i = end
+                continue
+            }
+            if fence != "" {
+                out.Write(body[i:end])
+                i = end
+                continue
+            }
+        }
+
+        i += f.next(&out, body[i:])
+    }
+
+    return out.Bytes(), f
+}
+
+/**
+ * Copy the start of rest to out, taking out any math it starts with --
+ * returns the number of bytes used
+ */
+func (f *Formulas) next(out *bytes.Buffer, rest []byte) int {
+    switch {
+    case bytes.HasPrefix(rest, []byte("$$")):
+        if n := f.take(out, rest, "$$", "$$", true); n > 0 {
+            return n
+        }
+        out.WriteString("$$")
+        return 2
+    case bytes.HasPrefix(rest, []byte(`\[`)):
+        if n := f.take(out, rest, `\[`, `\]`, true); n > 0 {
+            return n
+        }
+    case bytes.HasPrefix(rest, []byte(`\(`)):
+        if n := f.take(out, rest, `\(`, `\)`, false); n > 0 {
+            return n
+        }
+    case rest[0] == '$':
+        if n := f.takeInline(out, rest); n > 0 {
+            return n
+        }
+    case rest[0] == '`':
+        n := codeSpan(rest)
+        out.Write(rest[:n])
+        return n
+    }
+
+    // Markdown has no escape for a dollar sign, so an escaped one is taken out
+    // like math and put back as a plain one -- any other escaped character is
+    // kept as it is
+    if bytes.HasPrefix(rest, []byte(`\$`)) {
+        f.formulas = append(f.formulas, formula{
+            source:  `\$`,
+            tex:     "$",
+            literal: true,
+        })
+        out.WriteString(f.prefix + strconv.Itoa(len(f.formulas)-1) + "x")
+        return 2
+    }
+    if rest[0] == '\\' && len(rest) > 1 {
+        out.Write(rest[:2])
+        return 2
+    }
+    out.WriteByte(rest[0])
+    return 1
+}
+
+/**
+ * Take out the math rest starts with, between open and close, if close comes
+ * before the end of the paragraph -- returns the number of bytes used, or 0
+ */
+func (f *Formulas) take(out *bytes.Buffer, rest []byte, open, close string,
+    display bool) int {
+    para := rest
+    if end := bytes.Index(rest, []byte("\n\n")); end >= 0 {
+        para = rest[:end]
+    }
+
+    end := bytes.Index(para[len(open):], []byte(close))
+    if end < 0 {
+        return 0
+    }
+    tex := para[len(open) : len(open)+end]
+    if len(bytes.TrimSpace(tex)) == 0 {
+        return 0
+    }
+
+    n := len(open) + end + len(close)
+    f.add(out, rest[:n], tex, display)
+    return n
+}
+
+/**
+ * Take out the inline math rest starts with, between single dollar signs --
+ * returns the number of bytes used, or 0
+ */
+func (f *Formulas) takeInline(out *bytes.Buffer, rest []byte) int {
+    line := rest[:lineEnd(rest, 0)]
+    if len(line) < 3 || isSpace(line[1]) {
+        return 0
+    }
+
+    for k := 2; k < len(line); k++ {
+        if line[k] != '$' || line[k-1] == '\\' {
+            continue
+        }
+        // the next dollar sign closes the math or there is none
+        if isSpace(line[k-1]) {
+            return 0
+        }
+        if k+1 < len(line) && line[k+1] >= '0' && line[k+1] <= '9' {
+            return 0
+        }
+        f.add(out, rest[:k+1], rest[1:k], false)
+        return k + 1
+    }
+    return 0
+}
+
+func (f *Formulas) add(out *bytes.Buffer, source, tex []byte, display bool) {
+    out.WriteString(f.prefix + strconv.Itoa(len(f.formulas)) + "x")
+    f.formulas = append(f.formulas, formula{
+        source:  string(source),
+        tex:     string(tex),
+        display: display,
+    })
+}
+
+/**
+ * Put the math back into the sanitized HTML rendered from the body, as MathML
+ *
+ * A formula that ended up inside a tag, as part of an attribute, or inside code
+ * (such as an indented code block) is put back as it was written instead
+ */
+func (f *Formulas) Restore(h []byte) []byte {
+    if len(f.formulas) == 0 {
+        return h
+    }
+
+    var out bytes.Buffer
+    inTag, inCode := false, false
+    for i := 0; i < len(h); {
+        if n, fm := f.placeholder(h[i:]); n > 0 {
+            switch {
+            case inCode:
+                out.WriteString(html.EscapeString(fm.source))
+            case fm.literal:
+                out.WriteString(html.EscapeString(fm.tex))
+            case inTag:
+                out.WriteString(html.EscapeString(fm.source))
+            default:
+                out.WriteString(Render(fm.tex, fm.display))
+            }
+            i += n
+            continue
+        }
+
+        switch h[i] {
+        case '<':
+            inTag = true
+            if bytes.HasPrefix(h[i:], []byte("<code")) {
+                inCode = true
+            } else if bytes.HasPrefix(h[i:], []byte("</code>")) {
+                inCode = false
+            }
+        case '>':
+            inTag = false
+        }
+        out.WriteByte(h[i])
+        i++
+    }
+    return out.Bytes()
+}
+
+/**
+ * Put the math back into plain text taken from the body, as it was written
+ */
+func (f *Formulas) Source(text []byte) []byte {
+    if len(f.formulas) == 0 {
+        return text
+    }
+
+    var out bytes.Buffer
+    for i := 0; i < len(text); {
+        if n, fm := f.placeholder(text[i:]); n > 0 {
+            out.WriteString(fm.source)
+            i += n
+            continue
+        }
+        out.WriteByte(text[i])
+        i++
+    }
+    return out.Bytes()
+}
+
+/**
+ * Read the placeholder rest starts with -- returns its length and formula, or
+ * 0 if rest does not start with one
+ */
+func (f *Formulas) placeholder(rest []byte) (int, *formula) {
+    if !bytes.HasPrefix(rest, []byte(f.prefix)) {
+        return 0, nil
+    }
+
+    n := len(f.prefix)
+    end := bytes.IndexByte(rest[n:], 'x')
+    if end < 0 {
+        return 0, nil
+    }
+    index, err := strconv.Atoi(string(rest[n : n+end]))
+    if err != nil || index < 0 || index >= len(f.formulas) {
+        return 0, nil
+    }
+    return n + end + 1, &f.formulas[index]
+}
+
+/**
+ * The length of the code span rest starts with -- a run of backticks up to
+ * the next run as long, or just the run if there is none
+ */
+func codeSpan(rest []byte) int {
+    run := 0
+    for run < len(rest) && rest[run] == '`' {
+        run++
+    }
+
+    for i := run; i < len(rest); {
+        if rest[i] != '`' {
+            i++
+            continue
+        }
+        j := i
+        for j < len(rest) && rest[j] == '`' {
+            j++
+        }
+        if j-i == run {
+            return j
+        }
+        i = j
+    }
+    return run
+}
+
+/**
+ * The index just past the end of the line holding body[i]
+ */
+func lineEnd(body []byte, i int) int {
+    end := bytes.IndexByte(body[i:], '\n')
+    if end < 0 {
+        return len(body)
+    }
+    return i + end + 1
+}
+
+func isSpace(c byte) bool {
+    return c == ' ' || c == '\t' || c == '\n'
+}
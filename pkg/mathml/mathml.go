@@ -0,0 +1,676 @@
+package mathml
+
+/**
+ * Package mathml renders TeX math to MathML on the server, so notes show their
+ * formulas without any script in the browser.
+ *
+ * Only the part of TeX people write in notes is understood: letters, numbers
+ * and operators, sub- and superscripts, fractions, roots, accents, fonts,
+ * text, fences and matrix-like environments, along with the usual symbols.
+ * Anything else is shown as an error in place of the formula part, never as
+ * markup: every piece of the source that makes it into the output is escaped.
+ */
+
+
+import (
+    "bytes"
+    "fmt"
+    "html"
+    "strings"
+    "unicode"
+)
+
+/**
+ * How deeply groups and commands may nest -- anything deeper is shown as an
+ * error, so that no formula can run the parser out of stack
+ */
+const maxDepth = 32
+
+/**
+ * Render a TeX formula as a MathML <math> element -- display math is set as
+ * its own block, and the source is kept as an annotation
+ */
+func Render(tex string, display bool) string {
+    var b bytes.Buffer
+    p := &parser{src: []rune(tex), display: display, out: &b}
+
+    b.WriteString(`<math xmlns="http://www.w3.org/1998/Math/MathML"`)
+    if display {
+        b.WriteString(` display="block"`)
+    }
+    b.WriteString(`><semantics><mrow>`)
+    for !p.eof() {
+        p.parseExpr(false)
+        if !p.eof() {
+            // a stray }, & or \right
+            p.parseStray()
+        }
+    }
+    b.WriteString(`</mrow><annotation encoding="application/x-tex">`)
+    b.WriteString(html.EscapeString(tex))
+    b.WriteString(`</annotation></semantics></math>`)
+
+    return b.String()
+}
+
+/**
+ * A parser writes the MathML for its source to out as it goes, rather than
+ * returning it, so that a group is not copied again into every group around
+ * it -- only an item with scripts is copied, once, to put them in order
+ */
+type parser struct {
+    src     []rune
+    pos     int
+    display bool
+    out     *bytes.Buffer
+    depth   int
+}
+
+/**
+ * A parser for a part of the source read as raw text, writing to the same
+ * output at the same depth
+ */
+func (p *parser) sub(src []rune) *parser {
+    return &parser{src: src, display: p.display, out: p.out, depth: p.depth}
+}
+
+func (p *parser) eof() bool {
+    return p.pos >= len(p.src)
+}
+
+func (p *parser) peek() rune {
+    if p.eof() {
+        return 0
+    }
+    return p.src[p.pos]
+}
+
+func (p *parser) skipSpace() {
+    for !p.eof() && unicode.IsSpace(p.peek()) {
+        p.pos++
+    }
+}
+
+/**
+ * Read the name of a command, p.pos being just past its backslash -- a name is
+ * either letters or a single other character
+ */
+func (p *parser) readCommand() string {
+    start := p.pos
+    for !p.eof() && isLetter(p.peek()) {
+        p.pos++
+    }
+    if p.pos == start && !p.eof() {
+        p.pos++
+    }
+    return string(p.src[start:p.pos])
+}
+
+/**
+ * Look at the command at p.pos without reading it
+ */
+func (p *parser) peekCommand() string {
+    if p.peek() != '\\' {
+        return ""
+    }
+    start := p.pos
+    p.pos++
+    name := p.readCommand()
+    p.pos = start
+    return name
+}
+
+/**
+ * Read a braced argument as raw text, or a single character if unbraced
+ */
+func (p *parser) readRaw() string {
+    p.skipSpace()
+    if p.eof() {
+        return ""
+    }
+    if p.peek() != '{' {
+        p.pos++
+        return string(p.src[p.pos-1])
+    }
+
+    p.pos++
+    start := p.pos
+    depth := 0
+    for !p.eof() {
+        switch p.peek() {
+        case '\\':
+            p.pos++
+        case '{':
+            depth++
+        case '}':
+            if depth == 0 {
+                raw := string(p.src[start:p.pos])
+                p.pos++
+                return raw
+            }
+            depth--
+        }
+        p.pos++
+    }
+    return string(p.src[start:])
+}
+
+/**
+ * Parse items until the end of the source or of the enclosing group, fence or
+ * environment -- within a table, cells and rows end at & and \\
+ */
+func (p *parser) parseExpr(inTable bool) {
+    for {
+        p.skipSpace()
+        if p.eof() || p.peek() == '}' {
+            break
+        }
+        if inTable && p.peek() == '&' {
+            break
+        }
+        name := p.peekCommand()
+        if name == "right" || name == "end" || name == "middle" {
+            break
+        }
+        if inTable && name == "\\" {
+            break
+        }
+        p.parseItem()
+    }
+}
+
+/**
+ * Render what stopped an expression where it is not expected
+ */
+func (p *parser) parseStray() {
+    if p.peek() == '\\' {
+        p.pos++
+        name := p.readCommand()
+        if name == "right" || name == "middle" {
+            p.readDelimiter()
+        } else if name == "end" {
+            p.readRaw()
+        }
+        p.out.WriteString(merror("\\" + name))
+        return
+    }
+    p.pos++
+    p.out.WriteString(merror(string(p.src[p.pos-1])))
+}
+
+/**
+ * A sub- or superscript or prime, as the part of the output it was written to
+ */
+type script struct {
+    sub        bool
+    start, end int
+}
+
+/**
+ * Parse an atom along with any sub- and superscripts and primes
+ */
+func (p *parser) parseItem() {
+    start := p.out.Len()
+    limits := false
+    if c := p.peek(); c != '_' && c != '^' {
+        limits = p.parseAtom()
+    }
+    baseEnd := p.out.Len()
+
+    // the scripts are written as they come, and put in order after
+    scripts := []script{}
+    for {
+        p.skipSpace()
+        c := p.peek()
+        if c != '_' && c != '^' && c != '\'' {
+            break
+        }
+        p.pos++
+        s := script{sub: c == '_', start: p.out.Len()}
+        if c == '\'' {
+            p.out.WriteString("<mo>′</mo>")
+        } else {
+            p.parseArgument()
+        }
+        s.end = p.out.Len()
+        scripts = append(scripts, s)
+    }
+    if len(scripts) == 0 {
+        return
+    }
+
+    written := append([]byte{}, p.out.Bytes()[start:]...)
+    p.out.Truncate(start)
+    base := written[:baseEnd-start]
+    var sub, sup []byte
+    hasSub, hasSup := false, false
+    for _, s := range scripts {
+        text := written[s.start-start : s.end-start]
+        if s.sub {
+            // as before, a second subscript replaces the first
+            sub, hasSub = text, true
+        } else {
+            sup, hasSup = append(sup, text...), true
+        }
+    }
+
+    under, over, both := "msub", "msup", "msubsup"
+    if limits && p.display {
+        under, over, both = "munder", "mover", "munderover"
+    }
+    tag := over
+    if hasSub && hasSup {
+        tag = both
+    } else if hasSub {
+        tag = under
+    }
+
+    p.out.WriteString("<" + tag + ">")
+    if len(base) == 0 {
+        p.out.WriteString("<mrow></mrow>")
+    }
+    p.out.Write(base)
+    if hasSub {
+        p.out.WriteString("<mrow>")
+        p.out.Write(sub)
+        p.out.WriteString("</mrow>")
+    }
+    if hasSup {
+        p.out.WriteString("<mrow>")
+        p.out.Write(sup)
+        p.out.WriteString("</mrow>")
+    }
+    p.out.WriteString("</" + tag + ">")
+}
+
+/**
+ * Parse the argument of a command or script: a group or a single atom
+ */
+func (p *parser) parseArgument() {
+    p.skipSpace()
+    if p.eof() || p.peek() == '}' {
+        return
+    }
+    // as in TeX, \frac12 is a half and x^23 is x squared times three
+    if c := p.peek(); c >= '0' && c <= '9' {
+        p.pos++
+        p.out.WriteString(element("mn", string(c)))
+        return
+    }
+    p.parseAtom()
+}
+
+/**
+ * Parse a single atom: a group, a command, a number or a character --
+ * returns whether any scripts belong above and below it in display math
+ */
+func (p *parser) parseAtom() (limits bool) {
+    c := p.peek()
+    if (c == '{' || c == '\\') && p.depth >= maxDepth {
+        p.parseTooDeep()
+        return false
+    }
+
+    switch {
+    case c == '{':
+        p.pos++
+        p.depth++
+        p.out.WriteString("<mrow>")
+        p.parseExpr(false)
+        p.out.WriteString("</mrow>")
+        p.depth--
+        if p.peek() == '}' {
+            p.pos++
+        }
+        return false
+    case c == '\\':
+        p.pos++
+        p.depth++
+        limits = p.parseCommand(p.readCommand())
+        p.depth--
+        return limits
+    case c >= '0' && c <= '9':
+        p.parseNumber()
+        return false
+    }
+
+    p.pos++
+    switch {
+    case unicode.IsLetter(c):
+        p.out.WriteString(element("mi", string(c)))
+    case c == '-':
+        p.out.WriteString(element("mo", "−"))
+    case c == '*':
+        p.out.WriteString(element("mo", "∗"))
+    case c == '~':
+        p.out.WriteString("<mtext> </mtext>")
+    default:
+        p.out.WriteString(element("mo", string(c)))
+    }
+    return false
+}
+
+/**
+ * Show a group or command nested too deeply as an error -- a group is passed
+ * over whole, and a command's arguments are then read as groups are
+ */
+func (p *parser) parseTooDeep() {
+    start := p.pos
+    if p.peek() == '\\' {
+        p.pos++
+        p.readCommand()
+    } else {
+        p.readRaw()
+    }
+    p.out.WriteString(merror(string(p.src[start:p.pos])))
+}
+
+func (p *parser) parseNumber() {
+    start := p.pos
+    for !p.eof() {
+        c := p.peek()
+        if c >= '0' && c <= '9' {
+            p.pos++
+            continue
+        }
+        next := p.pos + 1
+        if c == '.' && next < len(p.src) &&
+            p.src[next] >= '0' && p.src[next] <= '9' {
+            p.pos++
+            continue
+        }
+        break
+    }
+    p.out.WriteString(element("mn", string(p.src[start:p.pos])))
+}
+
+/**
+ * Parse a command, its name already read -- returns whether any scripts
+ * belong above and below it in display math
+ */
+func (p *parser) parseCommand(name string) (limits bool) {
+    if s, ok := identifiers[name]; ok {
+        p.out.WriteString(element("mi", s))
+        return false
+    }
+    if s, ok := uprightIdentifiers[name]; ok {
+        p.out.WriteString(`<mi mathvariant="normal">` + s + "</mi>")
+        return false
+    }
+    if s, ok := operators[name]; ok {
+        p.out.WriteString(element("mo", s))
+        return false
+    }
+    if s, ok := largeOperators[name]; ok {
+        p.out.WriteString(element("mo", s))
+        return true
+    }
+    if functions[name] {
+        p.out.WriteString(element("mi", name))
+        return false
+    }
+    if s, ok := limitFunctions[name]; ok {
+        p.out.WriteString(element("mi", s))
+        return true
+    }
+    if width, ok := spaces[name]; ok {
+        p.out.WriteString(`<mspace width="` + width + `"></mspace>`)
+        return false
+    }
+    if s, ok := accents[name]; ok {
+        p.out.WriteString(`<mover accent="true"><mrow>`)
+        p.parseArgument()
+        p.out.WriteString("</mrow>" + stretchy(s) + "</mover>")
+        return false
+    }
+    if s, ok := underAccents[name]; ok {
+        p.out.WriteString(`<munder accentunder="true"><mrow>`)
+        p.parseArgument()
+        p.out.WriteString("</mrow>" + stretchy(s) + "</munder>")
+        return false
+    }
+    if variant, ok := fonts[name]; ok {
+        p.parseFont(variant)
+        return false
+    }
+    if texts[name] {
+        p.out.WriteString(element("mtext", p.readRaw()))
+        return false
+    }
+    if size, ok := bigSizes[name]; ok {
+        fmt.Fprintf(p.out, `<mo minsize="%s" maxsize="%s">%s</mo>`, size,
+            size, html.EscapeString(p.readDelimiter()))
+        return false
+    }
+    if ignored[name] {
+        return false
+    }
+
+    switch name {
+    case "frac", "dfrac", "tfrac", "cfrac":
+        p.out.WriteString("<mfrac><mrow>")
+        p.parseArgument()
+        p.out.WriteString("</mrow><mrow>")
+        p.parseArgument()
+        p.out.WriteString("</mrow></mfrac>")
+    case "binom", "dbinom", "tbinom":
+        p.out.WriteString(`<mrow><mo>(</mo><mfrac linethickness="0"><mrow>`)
+        p.parseArgument()
+        p.out.WriteString("</mrow><mrow>")
+        p.parseArgument()
+        p.out.WriteString("</mrow></mfrac><mo>)</mo></mrow>")
+    case "sqrt":
+        p.parseRoot()
+    case "operatorname":
+        p.out.WriteString(element("mi", strings.TrimSpace(p.readRaw())))
+    case "left":
+        p.parseFence()
+    case "begin":
+        p.parseEnvironment()
+    case "\\":
+        p.out.WriteString(`<mspace linebreak="newline"></mspace>`)
+    default:
+        p.out.WriteString(merror("\\" + name))
+    }
+    return false
+}
+
+/**
+ * Parse a font command's argument, setting each letter and digit in the font
+ */
+func (p *parser) parseFont(variant string) {
+    raw := p.readRaw()
+    if strings.ContainsAny(raw, "\\{}^_") {
+        // too involved to set in a font: rendered as is
+        p.out.WriteString("<mrow>")
+        p.sub([]rune(raw)).parseExpr(false)
+        p.out.WriteString("</mrow>")
+        return
+    }
+    if variant == "normal" {
+        text := strings.Join(strings.Fields(raw), "")
+        p.out.WriteString(`<mi mathvariant="normal">` +
+            html.EscapeString(text) + "</mi>")
+        return
+    }
+
+    p.out.WriteString("<mrow>")
+    for _, c := range raw {
+        switch {
+        case unicode.IsSpace(c):
+        case c >= '0' && c <= '9':
+            fmt.Fprintf(p.out, `<mn mathvariant="%s">%c</mn>`, variant, c)
+        case isLetter(c):
+            fmt.Fprintf(p.out, `<mi mathvariant="%s">%c</mi>`, variant, c)
+        default:
+            p.out.WriteString(element("mo", string(c)))
+        }
+    }
+    p.out.WriteString("</mrow>")
+}
+
+/**
+ * Parse a square root, or an nth root given in square brackets
+ */
+func (p *parser) parseRoot() {
+    p.skipSpace()
+    if p.peek() != '[' {
+        p.out.WriteString("<msqrt>")
+        p.parseArgument()
+        p.out.WriteString("</msqrt>")
+        return
+    }
+
+    p.pos++
+    start := p.pos
+    for !p.eof() && p.peek() != ']' {
+        p.pos++
+    }
+    index := p.src[start:p.pos]
+    if !p.eof() {
+        p.pos++
+    }
+    // the index comes first in the source but last in the output
+    p.out.WriteString("<mroot><mrow>")
+    p.parseArgument()
+    p.out.WriteString("</mrow><mrow>")
+    p.sub(index).parseExpr(false)
+    p.out.WriteString("</mrow></mroot>")
+}
+
+/**
+ * Read the delimiter after \left, \right or \big -- a full stop for none
+ */
+func (p *parser) readDelimiter() string {
+    p.skipSpace()
+    if p.eof() {
+        return ""
+    }
+    if p.peek() == '\\' {
+        p.pos++
+        name := p.readCommand()
+        if s, ok := operators[name]; ok {
+            return s
+        }
+        return ""
+    }
+    c := p.peek()
+    p.pos++
+    if c == '.' {
+        return ""
+    }
+    return string(c)
+}
+
+/**
+ * Parse the fenced expression after \left, up to its \right
+ */
+func (p *parser) parseFence() {
+    p.out.WriteString("<mrow>")
+    p.out.WriteString(fence(p.readDelimiter()))
+    for {
+        p.parseExpr(false)
+        name := p.peekCommand()
+        if name == "middle" {
+            p.pos += len("\\middle")
+            p.out.WriteString(fence(p.readDelimiter()))
+            continue
+        }
+        if name == "right" {
+            p.pos += len("\\right")
+            p.out.WriteString(fence(p.readDelimiter()))
+        }
+        break
+    }
+    p.out.WriteString("</mrow>")
+}
+
+/**
+ * Parse an environment after \begin, up to its \end -- every environment is
+ * set as a table, with fences for the matrices and cases
+ */
+func (p *parser) parseEnvironment() {
+    name := strings.TrimSpace(p.readRaw())
+    if name == "array" {
+        // the column specification
+        p.readRaw()
+    }
+
+    align := ""
+    switch strings.TrimSuffix(name, "*") {
+    case "aligned", "align", "split", "alignat", "eqnarray":
+        align = ` columnalign="right left right left right left"`
+    case "cases":
+        align = ` columnalign="left left"`
+    }
+    open, close := "", ""
+    if name == "cases" {
+        open, close = "<mrow>"+fence("{"), "</mrow>"
+    } else if fences, ok := matrices[name]; ok && fences[0] != "" {
+        open, close = "<mrow>"+fence(fences[0]), fence(fences[1])+"</mrow>"
+    }
+
+    p.out.WriteString(open + "<mtable" + align + ">")
+    for rows := 1; ; rows++ {
+        rowStart := p.out.Len()
+        p.out.WriteString("<mtr><mtd>")
+        cellStart := p.out.Len()
+        cells := 1
+        for {
+            p.parseExpr(true)
+            if p.peek() != '&' {
+                break
+            }
+            p.pos++
+            cells++
+            p.out.WriteString("</mtd><mtd>")
+        }
+        empty := cells == 1 && p.out.Len() == cellStart
+        p.out.WriteString("</mtd></mtr>")
+        if p.peekCommand() == "\\" {
+            p.pos += len("\\\\")
+            continue
+        }
+
+        // a trailing \\ leaves an empty last row
+        if rows > 1 && empty {
+            p.out.Truncate(rowStart)
+        }
+        if p.peekCommand() == "end" {
+            p.pos += len("\\end")
+            p.readRaw()
+        }
+        break
+    }
+    p.out.WriteString("</mtable>" + close)
+}
+
+func isLetter(c rune) bool {
+    return c < unicode.MaxASCII && unicode.IsLetter(c)
+}
+
+/**
+ * An element holding escaped text
+ */
+func element(tag, text string) string {
+    return "<" + tag + ">" + html.EscapeString(text) + "</" + tag + ">"
+}
+
+func stretchy(s string) string {
+    return `<mo stretchy="true">` + html.EscapeString(s) + "</mo>"
+}
+
+func fence(s string) string {
+    if s == "" {
+        return ""
+    }
+    return `<mo fence="true" stretchy="true">` + html.EscapeString(s) +
+        "</mo>"
+}
+
+/**
+ * An error in place of a formula part
+ */
+func merror(s string) string {
+    return `<merror><mtext>` + html.EscapeString(s) + `</mtext></merror>`
+}
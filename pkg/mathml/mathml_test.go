@@ -0,0 +1,193 @@
+package mathml
+
+import (
+    "flag"
+    "bytes"
+    "strings"
+    "testing"
+    "io/ioutil"
+    "encoding/json"
+)
+
+// regenerate the golden files with `go test -update` after a change to the
+// output, and check the difference by hand
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+/**
+ * Compare got with the golden file, or rewrite the file with -update
+ */
+func checkGolden(t *testing.T, path string, got interface{}) {
+    t.Helper()
+    var b bytes.Buffer
+    enc := json.NewEncoder(&b)
+    enc.SetEscapeHTML(false)
+    enc.SetIndent("", "    ")
+    err := enc.Encode(got)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data := b.Bytes()
+    if *update {
+        err = ioutil.WriteFile(path, data, 0644)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return
+    }
+
+    want, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(string(data), "\n")
+    wantLines := strings.Split(string(want), "\n")
+    for i := range lines {
+        if i >= len(wantLines) || lines[i] != wantLines[i] {
+            t.Errorf("%s differs at line %v (run with -update and compare):"+
+                "\n%s", path, i+1, lines[i])
+            return
+        }
+    }
+    if len(lines) != len(wantLines) {
+        t.Errorf("%s has lines past the output", path)
+    }
+}
+
+type renderCase struct {
+    TeX     string `json:"tex"`
+    Display bool   `json:"display,omitempty"`
+    MathML  string `json:"mathml"`
+}
+
+func TestRenderGolden(t *testing.T) {
+    cases := []*renderCase{
+        {TeX: `x`},
+        {TeX: `3.14 r^2`},
+        {TeX: `a_1 + b^{n+1} - c_i^2`},
+        {TeX: `x^a_b`},
+        {TeX: `f'(x) = f''_0`},
+        {TeX: `\frac{1}{2} + \frac12 + x^23`},
+        {TeX: `\binom{n}{k}`, Display: true},
+        {TeX: `\sqrt{2} \sqrt[3]{x+1}`},
+        {TeX: `\sum_{i=0}^n i`},
+        {TeX: `\sum_{i=0}^n i`, Display: true},
+        {TeX: `\lim_{x \to 0} \frac{\sin x}{x}`, Display: true},
+        {TeX: `\alpha \Gamma \infty \leq \neq`},
+        {TeX: `\hat{x} \vec v \overline{AB} \underbrace{a+b}`},
+        {TeX: `\mathbb{R} \mathbf{v1} \mathrm{d}x \mathcal{\alpha}`},
+        {TeX: `\text{if } x < y \operatorname{rank} A`},
+        {TeX: `\left( \frac{a}{b} \middle| c \right.`},
+        {TeX: `\bigl( x \bigr]`},
+        {TeX: `a\,b\quad c~d`},
+        {TeX: `\begin{pmatrix} 1 & 2 \\ 3 & 4 \\ \end{pmatrix}`},
+        {TeX: `f(x) = \begin{cases} 0 & x < 0 \\ x & x \ge 0 \end{cases}`},
+        {TeX: `\begin{aligned} a &= b \\ &= c \end{aligned}`,
+            Display: true},
+        {TeX: `\begin{array}{cc} a & b \end{array}`},
+
+        // errors and escaping
+        {TeX: `\unknown{x}`},
+        {TeX: `a } b & c \right) \end{x}`},
+        {TeX: `<script>alert("&")</script>`},
+        {TeX: `\text{<b>&amp;</b>}`},
+        {TeX: `\operatorname{<i>}`},
+        {TeX: `\mathrm{"<>"}`},
+        {TeX: `\left< x \right>`},
+        {TeX: `{{{x`},
+        {TeX: `\frac{`},
+        {TeX: `x^`},
+        {TeX: `\`},
+
+        // nesting too deep to render
+        {TeX: strings.Repeat("{", 40) + "x" + strings.Repeat("}", 40)},
+        {TeX: strings.Repeat(`\sqrt{`, 40) + "x" +
+            strings.Repeat("}", 40)},
+        {TeX: strings.Repeat(`\left(`, 40) + "x" +
+            strings.Repeat(`\right)`, 40)},
+    }
+    for _, c := range cases {
+        c.MathML = Render(c.TeX, c.Display)
+    }
+    checkGolden(t, "testdata/render.json", cases)
+}
+
+func TestRenderDeepNesting(t *testing.T) {
+    // neither the stack nor the output grows with the depth beyond the cap
+    for _, depth := range []int{1000, 100000} {
+        tex := strings.Repeat("{", depth) + "x" + strings.Repeat("}", depth)
+        mathml := Render(tex, false)
+        if !strings.Contains(mathml, "<merror>") {
+            t.Errorf("nesting %v deep was not cut short", depth)
+        }
+        if strings.Count(mathml, "<mrow>") > maxDepth+1 {
+            t.Errorf("nesting %v deep gave %v rows", depth,
+                strings.Count(mathml, "<mrow>"))
+        }
+    }
+}
+
+type extractCase struct {
+    Body string `json:"body"`
+    // the HTML the Markdown renderer would give for the body, %s standing
+    // for the body taken out
+    HTML      string `json:"html,omitempty"`
+    Extracted string `json:"extracted"`
+    Restored  string `json:"restored"`
+    Source    string `json:"source"`
+}
+
+func TestExtractRestoreGolden(t *testing.T) {
+    cases := []*extractCase{
+        {Body: `inline $x^2$ and \(y_1\) math`},
+        {Body: "display $$\\frac{a}{b}$$ and \\[\\sqrt{2}\\]"},
+        {Body: `costs $5 and $10, or $ 5$ and $5 $`},
+        {Body: `a $x$$y$ b`},
+        {Body: "no math across lines $x\ny$ or paragraphs $$x\n\ny$$"},
+        {Body: "display math within a paragraph $$x\n= y$$"},
+        {Body: `empty $$ $$ and \[ \] stay`},
+
+        // escaped dollar signs
+        {Body: `a \$ sign, \$5 and \$x\$`},
+        {Body: `$a \$ b$`},
+        {Body: `\\$x$`},
+        {Body: `other \escapes \( stay \*`},
+
+        // code
+        {Body: "code `$x$` and ``a ` $y$`` spans"},
+        {Body: "an unclosed `` $x$ span"},
+        {Body: "```\n$x$ \\$\n```\n$y$"},
+        {Body: "~~~tex\n$$x$$\n~~~\n"},
+        {Body: "    $x$ in an indented block",
+            HTML: "<pre><code>%s</code></pre>"},
+
+        // formulas that end up where no markup can go
+        {Body: `[link]($x$)`, HTML: `<a href="%s">link</a>`},
+        {Body: `$<b>$ \(a & b\)`},
+        {Body: `$"><script>$`, HTML: `<img alt="%s">`},
+
+        // placeholders cannot be forged
+        {Body: `math0000000000000000x0x`},
+    }
+    for _, c := range cases {
+        body, f := Extract([]byte(c.Body))
+        format := c.HTML
+        if format == "" {
+            format = "<p>%s</p>"
+        }
+        h := strings.Replace(format, "%s", escape(string(body)), 1)
+
+        // the random prefix is replaced so that the output can be compared
+        c.Extracted = strings.Replace(string(body), f.prefix, "MATH", -1)
+        c.Restored = string(f.Restore([]byte(h)))
+        c.Source = string(f.Source(body))
+    }
+    checkGolden(t, "testdata/extract.json", cases)
+}
+
+/**
+ * Escape text as the Markdown renderer does
+ */
+func escape(s string) string {
+    return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;",
+        `"`, "&quot;").Replace(s)
+}
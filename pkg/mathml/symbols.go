@@ -0,0 +1,126 @@
+package mathml
+
+/**
+ * This file holds the TeX commands the renderer knows, by the MathML element
+ * each becomes
+ */
+
+// letters and other symbols rendered as identifiers (<mi>)
+var identifiers = map[string]string{
+    "alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ",
+    "varepsilon": "ε", "zeta": "ζ", "eta": "η", "theta": "θ",
+    "vartheta": "ϑ", "iota": "ι", "kappa": "κ", "lambda": "λ", "mu": "μ",
+    "nu": "ν", "xi": "ξ", "pi": "π", "varpi": "ϖ", "rho": "ρ",
+    "varrho": "ϱ", "sigma": "σ", "varsigma": "ς", "tau": "τ",
+    "upsilon": "υ", "phi": "ϕ", "varphi": "φ", "chi": "χ", "psi": "ψ",
+    "omega": "ω",
+
+    "infty": "∞", "partial": "∂", "nabla": "∇", "emptyset": "∅",
+    "varnothing": "∅", "ell": "ℓ", "hbar": "ℏ", "aleph": "ℵ", "Re": "ℜ",
+    "Im": "ℑ", "wp": "℘",
+}
+
+// upright capital Greek letters
+var uprightIdentifiers = map[string]string{
+    "Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ",
+    "Pi": "Π", "Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ",
+    "Omega": "Ω",
+}
+
+// symbols rendered as operators (<mo>), including the escaped characters
+var operators = map[string]string{
+    "cdot": "⋅", "times": "×", "div": "÷", "pm": "±", "mp": "∓",
+    "ast": "∗", "star": "⋆", "circ": "∘", "bullet": "∙", "oplus": "⊕",
+    "otimes": "⊗", "le": "≤", "leq": "≤", "ge": "≥", "geq": "≥",
+    "neq": "≠", "ne": "≠", "ll": "≪", "gg": "≫", "approx": "≈",
+    "equiv": "≡", "sim": "∼", "simeq": "≃", "cong": "≅", "propto": "∝",
+    "to": "→", "rightarrow": "→", "leftarrow": "←", "gets": "←",
+    "Rightarrow": "⇒", "Leftarrow": "⇐", "Leftrightarrow": "⇔",
+    "iff": "⟺", "implies": "⟹", "leftrightarrow": "↔", "mapsto": "↦",
+    "uparrow": "↑", "downarrow": "↓", "in": "∈", "notin": "∉", "ni": "∋",
+    "subset": "⊂", "subseteq": "⊆", "supset": "⊃", "supseteq": "⊇",
+    "cup": "∪", "cap": "∩", "setminus": "∖", "forall": "∀",
+    "exists": "∃", "nexists": "∄", "neg": "¬", "lnot": "¬", "land": "∧",
+    "lor": "∨", "wedge": "∧", "vee": "∨", "mid": "∣", "parallel": "∥",
+    "perp": "⊥", "angle": "∠", "ldots": "…", "cdots": "⋯", "vdots": "⋮",
+    "ddots": "⋱", "dots": "…", "prime": "′", "langle": "⟨",
+    "rangle": "⟩", "lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈",
+    "rceil": "⌉", "vert": "|", "Vert": "‖", "colon": ":",
+
+    "int": "∫", "iint": "∬", "iiint": "∭", "oint": "∮",
+
+    "{": "{", "}": "}", "|": "‖", "%": "%", "$": "$", "#": "#", "&": "&",
+    "_": "_",
+}
+
+// large operators whose limits go above and below them in display math
+var largeOperators = map[string]string{
+    "sum": "∑", "prod": "∏", "coprod": "∐", "bigcup": "⋃", "bigcap": "⋂",
+    "bigoplus": "⨁", "bigotimes": "⨂", "bigvee": "⋁", "bigwedge": "⋀",
+}
+
+// named functions, set upright
+var functions = map[string]bool{
+    "sin": true, "cos": true, "tan": true, "cot": true, "sec": true,
+    "csc": true, "arcsin": true, "arccos": true, "arctan": true,
+    "sinh": true, "cosh": true, "tanh": true, "log": true, "ln": true,
+    "lg": true, "exp": true, "det": true, "dim": true, "ker": true,
+    "deg": true, "gcd": true, "hom": true, "arg": true,
+}
+
+// named functions whose limits go below them in display math
+var limitFunctions = map[string]string{
+    "lim": "lim", "liminf": "lim inf", "limsup": "lim sup", "max": "max",
+    "min": "min", "sup": "sup", "inf": "inf", "Pr": "Pr",
+}
+
+// spacing commands, by width
+var spaces = map[string]string{
+    ",": "0.1667em", ":": "0.2222em", ";": "0.2778em", " ": "0.3333em",
+    "quad": "1em", "qquad": "2em",
+}
+
+// accents put over (or under) their argument
+var accents = map[string]string{
+    "hat": "^", "widehat": "^", "bar": "¯", "overline": "‾", "vec": "→",
+    "tilde": "˜", "widetilde": "˜", "dot": "˙", "ddot": "¨", "check": "ˇ",
+    "breve": "˘", "acute": "´", "grave": "`", "overbrace": "⏞",
+}
+
+var underAccents = map[string]string{
+    "underline": "‾", "underbrace": "⏟",
+}
+
+// font commands, by MathML mathvariant
+var fonts = map[string]string{
+    "mathbb": "double-struck", "mathbf": "bold", "mathit": "italic",
+    "mathcal": "script", "mathfrak": "fraktur", "mathsf": "sans-serif",
+    "mathtt": "monospace", "mathrm": "normal", "boldsymbol": "bold-italic",
+}
+
+// text commands, set as text
+var texts = map[string]bool{
+    "text": true, "textrm": true, "textit": true, "textbf": true,
+    "textsf": true, "texttt": true, "mbox": true,
+}
+
+// the sizes of \big and friends
+var bigSizes = map[string]string{
+    "big": "1.2em", "bigl": "1.2em", "bigr": "1.2em", "bigm": "1.2em",
+    "Big": "1.8em", "Bigl": "1.8em", "Bigr": "1.8em", "Bigm": "1.8em",
+    "bigg": "2.4em", "biggl": "2.4em", "biggr": "2.4em", "biggm": "2.4em",
+    "Bigg": "3em", "Biggl": "3em", "Biggr": "3em", "Biggm": "3em",
+}
+
+// matrix environments, by the fences around them
+var matrices = map[string][2]string{
+    "matrix": {"", ""}, "pmatrix": {"(", ")"}, "bmatrix": {"[", "]"},
+    "Bmatrix": {"{", "}"}, "vmatrix": {"|", "|"}, "Vmatrix": {"‖", "‖"},
+    "smallmatrix": {"", ""},
+}
+
+// commands that change nothing here
+var ignored = map[string]bool{
+    "displaystyle": true, "textstyle": true, "limits": true,
+    "nolimits": true, "!": true,
+}
@@ -0,0 +1,102 @@
+package notebook
+
+/**
+ * Like the page package, this is a light package that just defines the
+ * notebook struct and allows us to get it from a repository. Notebooks belong
+ * to a single user and their names are encrypted with that user's main-key, so
+ * creating, renaming and filling them lives in the permission package.
+ *
+ * Notebooks nest: a notebook with a ParentID of 0 sits at the top of its
+ * owner's directory.
+ */
+
+import (
+    "log"
+    "errors"
+)
+
+type Notebook struct {
+    ID       int
+    OwnerID  int
+    ParentID int
+    Name     []byte
+
+    // only filled in when notebooks are arranged into a tree
+    Children []*Notebook
+}
+
+var ErrNotebookCycle = errors.New("a notebook cannot be moved into itself")
+
+type Repository interface {
+    GetNotebookByID(id int) (*Notebook, error)
+}
+
+type Service struct {
+    repo Repository
+}
+
+/**
+ * Creates a new Notebook Service
+ */
+func NewService(r Repository) *Service {
+    return &Service{
+        repo: r,
+    }
+}
+
+/**
+ * Returns a pointer to a notebook given the notebook's ID
+ */
+func (s *Service) GetByID(id int) (*Notebook, error) {
+    nb, err := s.repo.GetNotebookByID(id)
+    if err != nil {
+        log.Println("failed to get notebook by ID from repository")
+        return nil, err
+    }
+    return nb, nil
+}
+
+/**
+ * Arrange a user's notebooks into a tree -- returns the top-level notebooks,
+ * with every notebook's Children filled in. A notebook whose parent is missing
+ * is put at the top level.
+ */
+func Tree(notebooks []*Notebook) []*Notebook {
+    byID := map[int]*Notebook{}
+    for _, nb := range notebooks {
+        nb.Children = nil
+        byID[nb.ID] = nb
+    }
+
+    roots := []*Notebook{}
+    for _, nb := range notebooks {
+        parent, ok := byID[nb.ParentID]
+        if nb.ParentID == 0 || !ok {
+            roots = append(roots, nb)
+            continue
+        }
+        parent.Children = append(parent.Children, nb)
+    }
+    return roots
+}
+
+/**
+ * Check whether moving notebook id under parentID would put it inside itself,
+ * given all of the owner's notebooks
+ */
+func WouldCycle(notebooks []*Notebook, id, parentID int) bool {
+    parents := map[int]int{}
+    for _, nb := range notebooks {
+        parents[nb.ID] = nb.ParentID
+    }
+
+    // walk up from the new parent; the walk is bounded in case the stored
+    // notebooks already hold a cycle
+    for n := 0; parentID != 0 && n <= len(notebooks); n++ {
+        if parentID == id {
+            return true
+        }
+        parentID = parents[parentID]
+    }
+    return false
+}
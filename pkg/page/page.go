@@ -9,6 +9,8 @@ package page
 
 import (
     "log"
+    "time"
+    "errors"
 )
 
 type Page struct {
@@ -17,8 +19,52 @@ type Page struct {
     Body    []byte
     OwnerID int
     Version int
+
+    // the number of the page's latest revision when it was loaded -- a page is
+    // only updated if this is still its latest revision
+    Revision int
+
+    // when the page was moved to the trash, or nil
+    DeletedAt *time.Time
+
+    // encrypted and decrypted in the browser; the server never decrypts it
+    ClientEncrypted bool
 }
 
+/**
+ * The page version records how a page is encrypted:
+ *     1: encrypted with the MD5 hash of the sole owner's password
+ *     2: encrypted with a page key held in `page_permissions`
+ *     3: as version 2, with the title and body bound to the page ID, field name
+ *        and version as AEAD additional data
+ */
+const CurrentVersion = 3
+
+/**
+ * A Revision is a page as it was saved at some point -- Page holds the ID,
+ * Title, Body and Version the page had then, so a revision is encrypted and
+ * decrypted exactly like a page
+ */
+type Revision struct {
+    Number    int
+    AuthorID  int
+    CreatedAt time.Time
+    Page      *Page
+}
+
+/**
+ * The Times a page was first and last saved, from its revisions
+ */
+type Times struct {
+    Created time.Time
+    Updated time.Time
+}
+
+/**
+ * Returned when a page is saved from a revision that is no longer its latest
+ */
+var ErrEditConflict = errors.New("page was changed since it was loaded")
+
 type Repository interface {
     GetPageByID(id int) (*Page, error)
 }
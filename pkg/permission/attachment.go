@@ -0,0 +1,362 @@
+package permission
+
+/**
+ * This file contains attachments: files kept with a page and encrypted with its
+ * page key (see `pkg/attachment`). Anyone who can edit a page can add and
+ * delete its attachments, and anyone who can read it can download them. The
+ * contents are streamed through the encryption service to and from the blob
+ * store, so they are never held in memory or written anywhere unencrypted.
+ */
+
+import (
+    "io"
+    "log"
+    "strings"
+
+    "github.com/satori/go.uuid"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/attachment"
+    "github.com/setonotes/pkg/encryption" // for errors
+)
+
+/**
+ * Counts what is read through it, failing once more than max has been read
+ */
+type sizeLimiter struct {
+    r   io.Reader
+    n   int64
+    max int64
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+    n, err := l.r.Read(p)
+    l.n += int64(n)
+    if l.n > l.max {
+        return n, attachment.ErrTooLarge
+    }
+    return n, err
+}
+
+/**
+ * A blob is closed along with the reader decrypting it
+ */
+type attachmentReader struct {
+    io.Reader
+    io.Closer
+}
+
+/**
+ * Check a page can have attachments read or changed: it must exist outside the
+ * trash and be encrypted on the server
+ */
+func (s *Service) checkAttachmentPage(pageID int) error {
+    p, err := s.pageService.GetByID(pageID)
+    if err != nil {
+        return err
+    }
+    if p.ClientEncrypted {
+        return ErrClientEncrypted
+    }
+    if p.DeletedAt != nil {
+        return ErrPageTrashed
+    }
+    return nil
+}
+
+/**
+ * Attach a file read from r to a page the user can edit, returning the
+ * attachment's ID
+ */
+func (s *Service) AddAttachment(u *user.User, pageID int, name,
+    mimeType string, r io.Reader) (int, error) {
+
+    canEdit, err := s.repo.CheckUserCanEditPage(u.ID, pageID)
+    if err != nil || !canEdit {
+        log.Printf("user-%v cannot add attachments to page-%v", u.ID, pageID)
+        return 0, ErrPermissionConflict
+    }
+    err = s.checkAttachmentPage(pageID)
+    if err != nil {
+        return 0, err
+    }
+    name = strings.TrimSpace(name)
+    if name == "" {
+        return 0, attachment.ErrNoName
+    }
+    if mimeType == "" {
+        mimeType = "application/octet-stream"
+    }
+
+    key, err := s.GetUserEncryptedPageKey(u, pageID)
+    if err != nil {
+        log.Printf("failed to get user-%v-encrypted page-%v key", u.ID,
+            pageID)
+        return 0, err
+    }
+
+    blobKey, err := uuid.NewV4()
+    if err != nil {
+        log.Println("failed to create UUID blob key")
+        return 0, err
+    }
+    a := &attachment.Attachment{
+        PageID:     pageID,
+        UploaderID: u.ID,
+        Name:       []byte(name),
+        MIMEType:   []byte(mimeType),
+        BlobKey:    blobKey.String(),
+    }
+
+    log.Printf("adding attachment to page-%v...", pageID)
+    counted := &sizeLimiter{r: r, max: attachment.MaxSize}
+    id, err := s.storeAttachment(a, u, key, counted)
+    if err != nil {
+        log.Printf("failed to add attachment to page-%v: %v", pageID, err)
+        return 0, err
+    }
+    log.Printf("successfully added attachment-%v to page-%v", id, pageID)
+    return id, nil
+}
+
+/**
+ * Encrypt an attachment and its contents from r with a page key, write them to
+ * the blob store and store the attachment -- the blob is deleted again if the
+ * attachment cannot be stored
+ */
+func (s *Service) storeAttachment(a *attachment.Attachment, u *user.User,
+    userEncryptedPageKey []byte, r *sizeLimiter) (int, error) {
+
+    encrypted, err := s.encryption.EncryptAttachment(a, u,
+        userEncryptedPageKey, r)
+    if err != nil {
+        return 0, err
+    }
+    _, err = s.blobs.Put(a.BlobKey, encrypted)
+    if err != nil {
+        s.deleteBlob(a.BlobKey)
+        return 0, err
+    }
+
+    a.Size = r.n
+    id, err := s.repo.CreateAttachment(a)
+    if err != nil {
+        s.deleteBlob(a.BlobKey)
+        return 0, err
+    }
+    return id, nil
+}
+
+/**
+ * Delete a blob that is no longer needed -- a failure is only logged, since it
+ * leaves nothing but an unreadable blob behind
+ */
+func (s *Service) deleteBlob(key string) {
+    err := s.blobs.Delete(key)
+    if err != nil {
+        log.Printf("failed to delete blob <%s>: %v", key, err)
+    }
+}
+
+/**
+ * Get the attachments of a page the user can read, with their names and types
+ * decrypted
+ */
+func (s *Service) GetAttachments(u *user.User,
+    pageID int) ([]*attachment.Attachment, error) {
+
+    exists, err := s.repo.CheckPagePermissionExists(u.ID, pageID)
+    if err != nil || !exists {
+        return nil, ErrPermissionConflict
+    }
+    err = s.checkAttachmentPage(pageID)
+    if err != nil {
+        return nil, err
+    }
+
+    attachments, err := s.repo.GetPageAttachments(pageID)
+    if err != nil {
+        return nil, err
+    }
+    if len(attachments) == 0 {
+        return attachments, nil
+    }
+
+    key, err := s.GetUserEncryptedPageKey(u, pageID)
+    if err != nil {
+        log.Printf("failed to get user-%v-encrypted page-%v key", u.ID,
+            pageID)
+        return nil, err
+    }
+    for _, a := range attachments {
+        err = s.encryption.DecryptAttachment(a, u, key)
+        if err == encryption.ErrAttachmentTampered {
+            // keep the list usable, but make the problem visible
+            a.Name = []byte("[attachment failed integrity check]")
+            a.MIMEType = []byte("application/octet-stream")
+        } else if err != nil {
+            log.Printf("failed to decrypt attachment-%v", a.ID)
+            return nil, err
+        }
+    }
+
+    return attachments, nil
+}
+
+/**
+ * Open an attachment of a page the user can read, returning it with its name
+ * and type decrypted and a reader of its decrypted contents, which must be
+ * closed
+ *
+ * The contents are authenticated as they are read, so a read can fail with
+ * encryption.ErrAttachmentTampered part way through
+ */
+func (s *Service) OpenAttachment(u *user.User,
+    attachmentID int) (*attachment.Attachment, io.ReadCloser, error) {
+
+    a, err := s.attachmentService.GetByID(attachmentID)
+    if err != nil {
+        return nil, nil, err
+    }
+    exists, err := s.repo.CheckPagePermissionExists(u.ID, a.PageID)
+    if err != nil || !exists {
+        log.Printf("user-%v cannot read attachment-%v", u.ID, a.ID)
+        return nil, nil, ErrPermissionConflict
+    }
+    err = s.checkAttachmentPage(a.PageID)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    key, err := s.GetUserEncryptedPageKey(u, a.PageID)
+    if err != nil {
+        log.Printf("failed to get user-%v-encrypted page-%v key", u.ID,
+            a.PageID)
+        return nil, nil, err
+    }
+    err = s.encryption.DecryptAttachment(a, u, key)
+    if err != nil {
+        log.Printf("failed to decrypt attachment-%v", a.ID)
+        return nil, nil, err
+    }
+
+    blob, err := s.blobs.Get(a.BlobKey)
+    if err != nil {
+        log.Printf("failed to get blob of attachment-%v", a.ID)
+        return nil, nil, err
+    }
+    contents, err := s.encryption.DecryptAttachmentContents(a, u, key, blob)
+    if err != nil {
+        blob.Close()
+        return nil, nil, err
+    }
+
+    return a, &attachmentReader{contents, blob}, nil
+}
+
+/**
+ * Delete an attachment of a page the user can edit, returning the page's ID
+ */
+func (s *Service) DeleteAttachment(u *user.User, attachmentID int) (int,
+    error) {
+
+    a, err := s.attachmentService.GetByID(attachmentID)
+    if err != nil {
+        return 0, err
+    }
+    canEdit, err := s.repo.CheckUserCanEditPage(u.ID, a.PageID)
+    if err != nil || !canEdit {
+        log.Printf("user-%v cannot delete attachment-%v", u.ID, a.ID)
+        return 0, ErrPermissionConflict
+    }
+    err = s.checkAttachmentPage(a.PageID)
+    if err != nil {
+        return 0, err
+    }
+
+    err = s.repo.DeleteAttachment(a.ID)
+    if err != nil {
+        return 0, err
+    }
+    s.deleteBlob(a.BlobKey)
+    return a.PageID, nil
+}
+
+/**
+ * Re-encrypt the attachments of a page with a new page key, each into a new
+ * blob -- returns the attachments as they were, and re-encrypted to be stored
+ * along with the new key. If this fails, the new blobs are deleted again.
+ */
+func (s *Service) rekeyAttachments(owner *user.User, pageID int, oldKey,
+    newKey []byte) ([]*attachment.Attachment, []*attachment.Attachment,
+    error) {
+
+    attachments, err := s.repo.GetPageAttachments(pageID)
+    if err != nil {
+        log.Printf("failed to get attachments of page-%v", pageID)
+        return nil, nil, err
+    }
+
+    rekeyed := []*attachment.Attachment{}
+    for _, old := range attachments {
+        a, err := s.rekeyAttachment(owner, old, oldKey, newKey)
+        if err != nil {
+            log.Printf("failed to re-encrypt attachment-%v of page-%v",
+                old.ID, pageID)
+            s.deleteAttachmentBlobs(rekeyed)
+            return nil, nil, err
+        }
+        rekeyed = append(rekeyed, a)
+    }
+
+    return attachments, rekeyed, nil
+}
+
+/**
+ * Re-encrypt a single attachment with a new page key into a new blob
+ */
+func (s *Service) rekeyAttachment(owner *user.User, old *attachment.Attachment,
+    oldKey, newKey []byte) (*attachment.Attachment, error) {
+
+    a := *old
+    err := s.encryption.DecryptAttachment(&a, owner, oldKey)
+    if err != nil {
+        return nil, err
+    }
+    blob, err := s.blobs.Get(old.BlobKey)
+    if err != nil {
+        return nil, err
+    }
+    defer blob.Close()
+    contents, err := s.encryption.DecryptAttachmentContents(old, owner,
+        oldKey, blob)
+    if err != nil {
+        return nil, err
+    }
+
+    blobKey, err := uuid.NewV4()
+    if err != nil {
+        return nil, err
+    }
+    a.BlobKey = blobKey.String()
+    encrypted, err := s.encryption.EncryptAttachment(&a, owner, newKey,
+        contents)
+    if err != nil {
+        return nil, err
+    }
+    _, err = s.blobs.Put(a.BlobKey, encrypted)
+    if err != nil {
+        s.deleteBlob(a.BlobKey)
+        return nil, err
+    }
+    return &a, nil
+}
+
+/**
+ * Delete the blobs of attachments
+ */
+func (s *Service) deleteAttachmentBlobs(attachments []*attachment.Attachment) {
+    for _, a := range attachments {
+        s.deleteBlob(a.BlobKey)
+    }
+}
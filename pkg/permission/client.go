@@ -0,0 +1,189 @@
+package permission
+
+/**
+ * This file contains the storage side of browser encryption. Browser-encrypted
+ * pages are encrypted and decrypted by the user's browser with the same key
+ * hierarchy and envelope format as the encryption service, so these functions
+ * only ever pass ciphertext and wrapped keys between the browser and the
+ * repository, checking permissions on the way.
+ */
+
+import (
+    "log"
+    "sort"
+    "errors"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+)
+
+var (
+    ErrClientEncrypted    = errors.New("page is encrypted in the browser")
+    ErrNotClientEncrypted = errors.New("page is not encrypted in the browser")
+    ErrClientDisabled     = errors.New("browser encryption is not enabled")
+    ErrInvalidCiphertext  = errors.New("invalid ciphertext from browser")
+)
+
+/**
+ * A ClientPage is a browser-encrypted page along with the page key of the user
+ * requesting it, encrypted with that user's main-key
+ */
+type ClientPage struct {
+    Page                 *page.Page
+    CanEdit              bool
+    UserEncryptedPageKey []byte
+}
+
+/**
+ * Get a browser-encrypted page and the user's page key, without decrypting
+ * either
+ */
+func (s *Service) GetClientPage(pageID int, u *user.User) (*ClientPage,
+    error) {
+
+    perm, err := s.repo.GetPagePermission(u.ID, pageID)
+    if err != nil {
+        log.Printf("user-%v has no permission for page-%v", u.ID, pageID)
+        return nil, ErrPermissionConflict
+    }
+
+    p, err := s.pageService.GetByID(pageID)
+    if err != nil {
+        return nil, err
+    }
+    if !p.ClientEncrypted {
+        return nil, ErrNotClientEncrypted
+    }
+    if p.DeletedAt != nil {
+        return nil, ErrPageTrashed
+    }
+
+    key, err := s.GetUserEncryptedPageKey(u, pageID)
+    if err != nil {
+        return nil, err
+    }
+
+    return &ClientPage{
+        Page:                 p,
+        CanEdit:              perm.CanEdit,
+        UserEncryptedPageKey: key,
+    }, nil
+}
+
+/**
+ * Get every browser-encrypted page the user can read, with encrypted titles and
+ * without bodies, ordered by page ID
+ */
+func (s *Service) GetClientPages(u *user.User) ([]*ClientPage, error) {
+    pages, err := s.repo.GetUserDisembodiedPages(u.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    result := []*ClientPage{}
+    for _, p := range pages {
+        if !p.ClientEncrypted {
+            continue
+        }
+        key, err := s.GetUserEncryptedPageKey(u, p.ID)
+        if err != nil {
+            log.Printf("failed to get user-%v-encrypted page-%v key", u.ID,
+                p.ID)
+            return nil, err
+        }
+        result = append(result, &ClientPage{
+            Page:                 p,
+            UserEncryptedPageKey: key,
+        })
+    }
+
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].Page.ID < result[j].Page.ID
+    })
+
+    return result, nil
+}
+
+/**
+ * Create an empty browser-encrypted page --
+ * The browser generates the page key and encrypts it with the user's main-key.
+ * The page has to exist before its title and body are encrypted, because they
+ * are bound to its ID (see SaveClientPage()).
+ *
+ * Returns page ID
+ */
+func (s *Service) CreateClientPage(u *user.User,
+    userEncryptedPageKey []byte) (int, error) {
+
+    if !u.ClientEncryption {
+        return 0, ErrClientDisabled
+    }
+    if !s.encryption.CheckClientEnvelope(userEncryptedPageKey) {
+        return 0, ErrInvalidCiphertext
+    }
+
+    log.Println("generating ID for new browser-encrypted page...")
+    pageID, err := s.repo.CreatePage(&page.Page{
+        Title:           []byte(``),
+        Body:            []byte(``),
+        ClientEncrypted: true,
+    }, u.ID)
+    if err != nil {
+        log.Println("failed to generate ID")
+        return 0, err
+    }
+
+    log.Println("creating new page permission...")
+    err = s.repo.CreatePagePermission(u.ID, pageID, true, true,
+        userEncryptedPageKey)
+    if err != nil {
+        log.Println("failed to create page permission")
+        return 0, err
+    }
+    log.Printf("successfully created browser-encrypted page-%v", pageID)
+
+    return pageID, nil
+}
+
+/**
+ * Store the title and body of a browser-encrypted page as they were encrypted
+ * by the browser -- they must be envelopes the browser can open, and must be
+ * encrypted for the current page version
+ */
+func (s *Service) SaveClientPage(p *page.Page, u *user.User) error {
+    stored, err := s.pageService.GetByID(p.ID)
+    if err != nil {
+        return err
+    }
+    if !stored.ClientEncrypted {
+        return ErrNotClientEncrypted
+    }
+    if stored.DeletedAt != nil {
+        return ErrPageTrashed
+    }
+
+    canEdit, err := s.CheckUserCanEditPage(u.ID, p.ID)
+    if err != nil {
+        log.Println("failed to check permission")
+        return err
+    }
+    if !canEdit {
+        log.Printf("user-%v cannot edit page-%v", u.ID, p.ID)
+        return ErrPermissionConflict
+    }
+
+    if p.Version != page.CurrentVersion ||
+        !s.encryption.CheckClientEnvelope(p.Title) ||
+        !s.encryption.CheckClientEnvelope(p.Body) {
+        return ErrInvalidCiphertext
+    }
+
+    log.Printf("storing browser-encrypted page-%v", p.ID)
+    err = s.repo.UpdatePage(p, u.ID)
+    if err != nil {
+        log.Printf("failed to update page-%v", p.ID)
+        return err
+    }
+
+    return nil
+}
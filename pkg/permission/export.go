@@ -0,0 +1,90 @@
+package permission
+
+/**
+ * This file gathers a user's pages for export (see `pkg/export`)
+ */
+
+import (
+    "log"
+    "sort"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/export"
+    "github.com/setonotes/pkg/encryption" // for errors
+)
+
+/**
+ * Get every page a user can read for export, without its body, along with its
+ * owner, the user's tags on it and when it was first and last saved -- ordered
+ * by page ID. Each body is loaded by LoadExportPage() as the page is written
+ * (see export.WriteZip), so that a large export is never held in memory.
+ *
+ * Pages encrypted in the browser cannot be decrypted here, so they are left
+ * out.
+ */
+func (s *Service) ExportUserPages(u *user.User) ([]*export.Page, error) {
+    titles, err := s.GetPageTitles(u)
+    if err != nil {
+        return nil, err
+    }
+    tags, err := s.GetTags(u)
+    if err != nil {
+        return nil, err
+    }
+    times, err := s.repo.GetUserPageTimes(u.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    tagNames := map[int]string{}
+    for _, t := range tags {
+        tagNames[t.ID] = string(t.Name)
+    }
+
+    pages := []*export.Page{}
+    for _, t := range titles {
+        if t.ClientEncrypted {
+            log.Printf("leaving browser-encrypted page-%v out of export",
+                t.ID)
+            continue
+        }
+
+        exported := &export.Page{
+            ID:    t.ID,
+            Title: string(t.Title),
+            Owner: t.OwnerUsername,
+            Tags:  []string{},
+        }
+        for _, tagID := range t.TagIDs {
+            exported.Tags = append(exported.Tags, tagNames[tagID])
+        }
+        sort.Strings(exported.Tags)
+        if pt, ok := times[t.ID]; ok {
+            exported.Created = pt.Created
+            exported.Updated = pt.Updated
+        }
+
+        pages = append(pages, exported)
+    }
+
+    return pages, nil
+}
+
+/**
+ * Decrypt the body of a page returned by ExportUserPages() -- a page that
+ * fails its integrity check must not be trusted, so export.ErrSkip is returned
+ * for it
+ */
+func (s *Service) LoadExportPage(u *user.User, exported *export.Page) error {
+    p, err := s.LoadAndDecryptPage(exported.ID, u)
+    if err == encryption.ErrPageTampered {
+        log.Printf("leaving tampered page-%v out of export", exported.ID)
+        return export.ErrSkip
+    } else if err != nil {
+        log.Printf("failed to export page-%v for user-%v", exported.ID, u.ID)
+        return err
+    }
+    exported.Title = string(p.Title)
+    exported.Body = p.Body
+    return nil
+}
@@ -0,0 +1,189 @@
+package permission
+
+/**
+ * This file contains page history. Every save of a page is kept as a revision,
+ * encrypted with the page key just like the page itself, so only users who can
+ * read a page can read its history.
+ */
+
+import (
+    "log"
+    "time"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+    "github.com/setonotes/pkg/encryption" // for errors
+)
+
+/**
+ * A PageRevision is a decrypted revision along with the username of whoever
+ * saved it
+ */
+type PageRevision struct {
+    Number         int
+    AuthorID       int
+    AuthorUsername string
+    CreatedAt      time.Time
+    Title          []byte
+    Body           []byte
+}
+
+/**
+ * Get every revision of a page with decrypted titles (but no bodies), newest
+ * first
+ */
+func (s *Service) GetPageHistory(pageID int, u *user.User) ([]*PageRevision,
+    error) {
+
+    // check user can read the page
+    ok, err := s.repo.CheckPagePermissionExists(u.ID, pageID)
+    if err != nil {
+        return nil, err
+    }
+    if !ok {
+        return nil, ErrPermissionConflict
+    }
+
+    revisions, err := s.repo.GetPageRevisions(pageID)
+    if err != nil {
+        log.Printf("failed to get revisions of page-%v", pageID)
+        return nil, err
+    }
+
+    usernames := map[int]string{u.ID: u.Username}
+    history := []*PageRevision{}
+    for _, rev := range revisions {
+        rev.Page.Body = nil
+        err = s.UserDecryptPage(u, rev.Page)
+        if err == encryption.ErrPageTampered {
+            // keep the history usable, but make the problem visible
+            rev.Page.Title = []byte("[revision failed integrity check]")
+        } else if err != nil {
+            log.Printf("failed to decrypt revision %v of page-%v", rev.Number,
+                pageID)
+            return nil, err
+        }
+
+        r, err := s.newPageRevision(rev, usernames)
+        if err != nil {
+            return nil, err
+        }
+        history = append(history, r)
+    }
+
+    return history, nil
+}
+
+/**
+ * Load and decrypt a single revision of a page
+ */
+func (s *Service) LoadAndDecryptRevision(pageID, number int,
+    u *user.User) (*PageRevision, error) {
+
+    rev, err := s.repo.GetPageRevision(pageID, number)
+    if err != nil {
+        log.Printf("failed to get revision %v of page-%v", number, pageID)
+        return nil, err
+    }
+
+    // the page key is only found if the user can read the page
+    err = s.UserDecryptPage(u, rev.Page)
+    if err != nil {
+        log.Printf("failed to decrypt revision %v of page-%v for user-%v",
+            number, pageID, u.ID)
+        return nil, err
+    }
+
+    return s.newPageRevision(rev, map[int]string{u.ID: u.Username})
+}
+
+/**
+ * Restore an old revision of a page -- the revision is saved like any other
+ * edit, so it becomes the newest revision and nothing is lost
+ *
+ * Returns page ID
+ */
+func (s *Service) RestoreRevision(pageID, number int,
+    u *user.User) (int, error) {
+
+    rev, err := s.LoadAndDecryptRevision(pageID, number, u)
+    if err != nil {
+        return 0, err
+    }
+
+    // restoring is a deliberate overwrite of whatever the page holds now
+    current, err := s.pageService.GetByID(pageID)
+    if err != nil {
+        return 0, err
+    }
+
+    log.Printf("restoring revision %v of page-%v...", number, pageID)
+    return s.SavePage(&page.Page{
+        ID:       pageID,
+        Title:    rev.Title,
+        Body:     rev.Body,
+        Revision: current.Revision,
+    }, u)
+}
+
+/**
+ * Date a page's history as it was kept elsewhere, for pages brought in by an
+ * import -- the first revision is dated created and every later one updated.
+ * Either time may be zero if it is unknown. Only the page's owner can do this.
+ */
+func (s *Service) SetPageTimes(u *user.User, pageID int, created,
+    updated time.Time) error {
+
+    p, err := s.pageService.GetByID(pageID)
+    if err != nil {
+        return err
+    }
+    if p.OwnerID != u.ID {
+        return ErrPermissionConflict
+    }
+
+    if created.IsZero() {
+        created = updated
+    }
+    if updated.IsZero() {
+        updated = created
+    }
+    if created.IsZero() {
+        return nil
+    }
+
+    log.Printf("dating history of page-%v from %v", pageID, created)
+    return s.repo.SetPageTimes(pageID, &page.Times{
+        Created: created,
+        Updated: updated,
+    })
+}
+
+/**
+ * Build a PageRevision from a decrypted revision, looking up the author's
+ * username unless it is already in usernames
+ */
+func (s *Service) newPageRevision(rev *page.Revision,
+    usernames map[int]string) (*PageRevision, error) {
+
+    username, ok := usernames[rev.AuthorID]
+    if !ok {
+        author, err := s.userService.GetByID(rev.AuthorID)
+        if err != nil {
+            log.Printf("failed to get author of page-%v revision %v",
+                rev.Page.ID, rev.Number)
+            return nil, err
+        }
+        username = author.Username
+        usernames[rev.AuthorID] = username
+    }
+
+    return &PageRevision{
+        Number:         rev.Number,
+        AuthorID:       rev.AuthorID,
+        AuthorUsername: username,
+        CreatedAt:      rev.CreatedAt,
+        Title:          rev.Page.Title,
+        Body:           rev.Page.Body,
+    }, nil
+}
@@ -0,0 +1,60 @@
+package permission
+
+/**
+ * This file contains the migration of version-1 accounts (whose pages were all
+ * encrypted with the MD5 hash of the owner's password) to the version-2 key
+ * hierarchy of main-keys, page keys and page permissions.
+ */
+
+import (
+    "log"
+
+    "github.com/setonotes/pkg/user"
+)
+
+/**
+ * Migrate a version-1 user to the current version --
+ * This must be called at sign-in, before the user's session is initialized,
+ * because the password is needed both to decrypt the legacy pages and to wrap
+ * the new main-key. Everything is stored in a single transaction, so an
+ * interrupted migration leaves the account untouched and is simply run again
+ * at the next sign-in.
+ *
+ * The given user is updated in place. Returns the user's new recovery code, or
+ * an empty string if the user did not need migrating.
+ */
+func (s *Service) MigrateLegacyUser(u *user.User,
+    password string) (string, error) {
+
+    if u.Version != 1 {
+        return "", nil
+    }
+    log.Printf("migrating version-1 user-%v...", u.ID)
+
+    // get every version-1 page owned by the user
+    pages, err := s.repo.GetLegacyPages(u.ID)
+    if err != nil {
+        log.Printf("failed to get legacy pages for user-%v", u.ID)
+        return "", err
+    }
+
+    // re-key user and pages in memory
+    migrated := *u
+    pageKeys, recoveryCode, err := s.encryption.UpgradeLegacyUser(&migrated,
+        []byte(password), pages)
+    if err != nil {
+        log.Printf("failed to upgrade keys for user-%v", u.ID)
+        return "", err
+    }
+
+    // store user, pages and permissions at once
+    err = s.repo.StoreLegacyMigration(&migrated, pages, pageKeys)
+    if err != nil {
+        log.Printf("failed to store migration for user-%v", u.ID)
+        return "", err
+    }
+    *u = migrated
+    log.Printf("successfully migrated user-%v and %v pages", u.ID, len(pages))
+
+    return recoveryCode, nil
+}
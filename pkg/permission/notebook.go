@@ -0,0 +1,194 @@
+package permission
+
+/**
+ * This file contains notebooks, which organise a user's directory. Notebooks
+ * belong to a single user and nest inside one another. Where a page is kept is
+ * part of each user's permission for it, so a shared page starts at the top of
+ * the recipient's directory and can be moved without affecting anyone else.
+ */
+
+import (
+    "log"
+    "errors"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/notebook"
+    "github.com/setonotes/pkg/encryption" // for errors
+)
+
+var ErrEmptyNotebookName error = errors.New("notebook name cannot be empty")
+
+/**
+ * Get a notebook after checking the user owns it
+ */
+func (s *Service) getOwnedNotebook(u *user.User,
+    notebookID int) (*notebook.Notebook, error) {
+
+    nb, err := s.notebookService.GetByID(notebookID)
+    if err != nil {
+        return nil, err
+    }
+    if nb.OwnerID != u.ID {
+        log.Printf("user-%v does not own notebook-%v", u.ID, notebookID)
+        return nil, ErrPermissionConflict
+    }
+    return nb, nil
+}
+
+/**
+ * Get all of a user's notebooks with their names decrypted, ordered by ID
+ */
+func (s *Service) GetNotebooks(u *user.User) ([]*notebook.Notebook, error) {
+    notebooks, err := s.repo.GetUserNotebooks(u.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, nb := range notebooks {
+        if len(nb.Name) == 0 {
+            continue
+        }
+        err = s.encryption.DecryptNotebookName(nb, u)
+        if err == encryption.ErrNotebookTampered {
+            nb.Name = []byte("[notebook failed integrity check]")
+        } else if err != nil {
+            log.Printf("failed to decrypt notebook-%v", nb.ID)
+            return nil, err
+        }
+    }
+
+    return notebooks, nil
+}
+
+/**
+ * Create a notebook inside parentID (0 for the top level), returning its ID
+ */
+func (s *Service) CreateNotebook(u *user.User, parentID int,
+    name []byte) (int, error) {
+
+    if len(name) == 0 {
+        return 0, ErrEmptyNotebookName
+    }
+    if parentID != 0 {
+        _, err := s.getOwnedNotebook(u, parentID)
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    // like a page, the notebook is created empty to get its ID, which its
+    // encrypted name is bound to
+    id, err := s.repo.CreateNotebook(u.ID, parentID)
+    if err != nil {
+        return 0, err
+    }
+
+    nb := &notebook.Notebook{
+        ID:       id,
+        OwnerID:  u.ID,
+        ParentID: parentID,
+        Name:     name,
+    }
+    err = s.encryption.EncryptNotebookName(nb, u)
+    if err != nil {
+        log.Printf("failed to encrypt name of notebook-%v", id)
+        return 0, err
+    }
+    err = s.repo.UpdateNotebook(nb)
+    if err != nil {
+        return 0, err
+    }
+
+    return id, nil
+}
+
+/**
+ * Give one of a user's notebooks a new name
+ */
+func (s *Service) RenameNotebook(u *user.User, notebookID int,
+    name []byte) error {
+
+    if len(name) == 0 {
+        return ErrEmptyNotebookName
+    }
+    nb, err := s.getOwnedNotebook(u, notebookID)
+    if err != nil {
+        return err
+    }
+
+    nb.Name = name
+    err = s.encryption.EncryptNotebookName(nb, u)
+    if err != nil {
+        log.Printf("failed to encrypt name of notebook-%v", nb.ID)
+        return err
+    }
+    return s.repo.UpdateNotebook(nb)
+}
+
+/**
+ * Move one of a user's notebooks inside another (or to the top level, if
+ * parentID is 0)
+ *
+ * notebook.ErrNotebookCycle is returned if the notebook would end up inside
+ * itself
+ */
+func (s *Service) MoveNotebook(u *user.User, notebookID, parentID int) error {
+    nb, err := s.getOwnedNotebook(u, notebookID)
+    if err != nil {
+        return err
+    }
+    if parentID != 0 {
+        _, err = s.getOwnedNotebook(u, parentID)
+        if err != nil {
+            return err
+        }
+    }
+
+    notebooks, err := s.repo.GetUserNotebooks(u.ID)
+    if err != nil {
+        return err
+    }
+    if notebook.WouldCycle(notebooks, nb.ID, parentID) {
+        return notebook.ErrNotebookCycle
+    }
+
+    // the stored name is kept as it is, since it is bound to the ID only
+    nb.ParentID = parentID
+    return s.repo.UpdateNotebook(nb)
+}
+
+/**
+ * Delete one of a user's notebooks -- the notebooks and pages inside it are
+ * moved up into its parent, so nothing else is deleted
+ */
+func (s *Service) DeleteNotebook(u *user.User, notebookID int) error {
+    nb, err := s.getOwnedNotebook(u, notebookID)
+    if err != nil {
+        return err
+    }
+    return s.repo.DeleteNotebook(nb.ID)
+}
+
+/**
+ * Move a page into one of the user's notebooks (or to the top level, if
+ * notebookID is 0) -- the user only has to be able to read the page, since
+ * this only changes where it is listed for them
+ */
+func (s *Service) MovePage(u *user.User, pageID, notebookID int) error {
+    exists, err := s.repo.CheckPagePermissionExists(u.ID, pageID)
+    if err != nil {
+        return err
+    }
+    if !exists {
+        log.Printf("user-%v cannot read page-%v", u.ID, pageID)
+        return ErrPermissionConflict
+    }
+    if notebookID != 0 {
+        _, err = s.getOwnedNotebook(u, notebookID)
+        if err != nil {
+            return err
+        }
+    }
+
+    return s.repo.SetPageNotebook(u.ID, pageID, notebookID)
+}
@@ -7,102 +7,284 @@ package permission
  */
 
 import (
+    "io"
     "log"
+    "sort"
+    "time"
     "errors"
 
     "github.com/setonotes/pkg/user"
     "github.com/setonotes/pkg/page"
+    "github.com/setonotes/pkg/notebook"
+    "github.com/setonotes/pkg/tag"
+    "github.com/setonotes/pkg/attachment"
+    "github.com/setonotes/pkg/search"
+    "github.com/setonotes/pkg/encryption" // for errors
 )
 
+/**
+ * A Permission is a single row of the `page_permissions` table, connecting a
+ * user to a page. The page key held by the owner is encrypted with the owner's
+ * main-key, while the page key held by any other user is sealed to that user's
+ * public key.
+ */
+type Permission struct {
+    UserID               int
+    PageID               int
+    IsOwner              bool
+    CanEdit              bool
+    UserEncryptedPageKey []byte
+}
+
+/**
+ * A PageTitle is a decrypted page title along with the information needed to
+ * list the page in a user's directory
+ */
+type PageTitle struct {
+    ID            int
+    Title         []byte
+    OwnerID       int
+    OwnerUsername string
+
+    // the user's notebook the page is kept in, or 0 for the top level
+    NotebookID int
+
+    // the IDs of the tags the user has put on the page
+    TagIDs []int
+
+    // the title of a browser-encrypted page is left empty for the browser
+    ClientEncrypted bool
+}
+
 type Repository interface {
     CheckPageExists(pageID int) (bool, error)
-    UpdatePage(p *page.Page) error
+    UpdatePage(p *page.Page, authorID int) error
     CreatePage(p *page.Page, userID int) (int, error) // returns pageID
+    TrashPage(pageID int) error
+    RestorePage(pageID int) error
     DeletePage(pageID int) error
+    GetTrashedPages(ownerID int) ([]*page.Page, error)
+    GetPagesTrashedBefore(before time.Time) ([]int, error)
     GetUserEncryptedPageKey(userID, pageID int) ([]byte, error)
     GetUserDisembodiedPages(userID int) ([]*page.Page, error)
     CreatePagePermission(userID, pageID int, isOwner, canEdit bool,
         userEncryptedPageKey []byte) error
+    GetPagePermission(userID, pageID int) (*Permission, error)
+    GetPagePermissions(pageID int) ([]*Permission, error)
+    DeletePagePermission(userID, pageID int) error
+    RotatePageKey(p *page.Page, revokedUserID int,
+        permissions []*Permission, revisions []*page.Revision,
+        attachments []*attachment.Attachment) error
+    GetPageRevisions(pageID int) ([]*page.Revision, error)
+    GetPageRevision(pageID, number int) (*page.Revision, error)
+    GetLegacyPages(userID int) ([]*page.Page, error)
+    GetOwnedPageIDs(userID int) ([]int, error)
+    StoreLegacyMigration(u *user.User, pages []*page.Page,
+        userEncryptedPageKeys [][]byte) error
+    StoreUserKeyUpgrade(u *user.User, oldMainKeyEncrypted []byte,
+        pageKeys, notebookNames, tagNames []*Rewrap) error
+    CheckPagePermissionExists(userID, pageID int) (bool, error)
     CheckUserCanEditPage(userID, pageID int) (bool, error)
+    GetUserNotebooks(ownerID int) ([]*notebook.Notebook, error)
+    CreateNotebook(ownerID, parentID int) (int, error) // returns notebookID
+    UpdateNotebook(nb *notebook.Notebook) error
+    DeleteNotebook(notebookID int) error
+    SetPageNotebook(userID, pageID, notebookID int) error
+    GetUserPageNotebooks(userID int) (map[int]int, error)
+    GetUserTags(ownerID int) ([]*tag.Tag, error)
+    CreateTag(ownerID int) (int, error) // returns tagID
+    UpdateTag(t *tag.Tag) error
+    DeleteTag(tagID int) error
+    MergeTags(fromID, intoID int) error
+    SetPageTags(userID, pageID int, tagIDs []int) error
+    GetUserPageTags(userID int) (map[int][]int, error)
+    GetUserPageTimes(userID int) (map[int]*page.Times, error)
+    SetPageTimes(pageID int, t *page.Times) error
+    StoreSearchTokens(userID, pageID, revision int, tokens [][]byte,
+        weights []int) error
+    GetUnindexedPageIDs(userID int) ([]int, error)
+    SearchPages(userID int, tokens [][]byte, limit int) ([]*search.Hit,
+        error)
+    GetPageAttachments(pageID int) ([]*attachment.Attachment, error)
+    CreateAttachment(a *attachment.Attachment) (int, error) // returns ID
+    DeleteAttachment(id int) error
 }
 
 type EncryptionService interface {
     EncryptPage(p *page.Page, u *user.User, userEncryptedPageKey []byte) (error)
     DecryptPage(p *page.Page, u *user.User, userEncryptedPageKey []byte) (error)
     NewUserEncryptedSymmetricKey(u *user.User) ([]byte, error)
+    SealUserEncryptedKey(owner *user.User, userEncryptedKey []byte,
+        recipient *user.User) ([]byte, error)
+    UnsealUserEncryptedKey(u *user.User, sealedKey []byte) ([]byte, error)
+    UpgradeLegacyUser(u *user.User, password []byte,
+        pages []*page.Page) ([][]byte, string, error)
+    UpgradeUserKeys(u *user.User, password []byte, pageKeys [][]byte,
+        notebooks []*notebook.Notebook, tags []*tag.Tag) ([][]byte, string,
+        error)
+    UserKeysNeedUpgrade(u *user.User) bool
+    NeedsUpgrade(data []byte) bool
+    CheckClientEnvelope(data []byte) bool
+    EncryptNotebookName(nb *notebook.Notebook, u *user.User) error
+    DecryptNotebookName(nb *notebook.Notebook, u *user.User) error
+    EncryptTagName(t *tag.Tag, u *user.User) error
+    DecryptTagName(t *tag.Tag, u *user.User) error
+    SearchTokens(u *user.User, words []string) ([][]byte, error)
+    EncryptAttachment(a *attachment.Attachment, u *user.User,
+        userEncryptedPageKey []byte, r io.Reader) (io.Reader, error)
+    DecryptAttachment(a *attachment.Attachment, u *user.User,
+        userEncryptedPageKey []byte) error
+    DecryptAttachmentContents(a *attachment.Attachment, u *user.User,
+        userEncryptedPageKey []byte, r io.Reader) (io.Reader, error)
 }
 
 /**
  * Service holds interfaces for a repository and an encryption service. It also
- * holds pointers to user and pages services. Notice that these do not have to
- * use an interface, as this package is below the domain level and thus can
- * depend on domain-level packages.
+ * holds pointers to user, page, notebook, tag and attachment services. Notice
+ * that these do not have to use an interface, as this package is below the
+ * domain level and thus can depend on domain-level packages. The contents of
+ * attachments are kept in a blob store.
  */
 type Service struct {
     repo        Repository
     encryption  EncryptionService
     userService *user.Service
     pageService *page.Service
+
+    notebookService   *notebook.Service
+    tagService        *tag.Service
+    attachmentService *attachment.Service
+    blobs             attachment.BlobStore
 }
 
 /**
  * Creates a new permission service
  */
 func NewService(r Repository, e EncryptionService, u *user.Service,
-    p *page.Service) *Service {
+    p *page.Service, n *notebook.Service, t *tag.Service,
+    a *attachment.Service, b attachment.BlobStore) *Service {
 
     return &Service {
         repo:        r,
         encryption:  e,
         userService: u,
         pageService: p,
+
+        notebookService:   n,
+        tagService:        t,
+        attachmentService: a,
+        blobs:             b,
     }
 }
 
-var ErrNotImplemented error = errors.New("not yet implemented")
+var (
+    ErrNotImplemented    error = errors.New("not yet implemented")
+    ErrNoPublicKey       error = errors.New("recipient has no public key")
+    ErrAlreadyShared     error = errors.New("page already shared with user")
+    ErrShareWithSelf     error = errors.New("cannot share a page with yourself")
+    ErrNotShared         error = errors.New("page not shared with user")
+)
 
 /**
  * Gets a particular user's encrypted page-key
+ *
+ * Page keys held by users other than the owner are stored sealed to that
+ * user's public key, so they are unsealed here and returned encrypted with the
+ * user's main-key like any other user-encrypted key
  */
-func (s *Service) GetUserEncryptedPageKey(userID, pageID int) ([]byte, error) {
-    key, err := s.repo.GetUserEncryptedPageKey(userID, pageID)
-    return key, err
+func (s *Service) GetUserEncryptedPageKey(u *user.User,
+    pageID int) ([]byte, error) {
+
+    perm, err := s.repo.GetPagePermission(u.ID, pageID)
+    if err != nil {
+        return nil, err
+    }
+
+    if perm.IsOwner {
+        return perm.UserEncryptedPageKey, nil
+    }
+
+    key, err := s.encryption.UnsealUserEncryptedKey(u,
+        perm.UserEncryptedPageKey)
+    if err != nil {
+        log.Printf("failed to unseal page-%v key for user-%v", pageID, u.ID)
+        return nil, err
+    }
+    return key, nil
 }
 
 /**
- * Get all page titles for which the given user has read-permission
- * Returns a map from pageID to page Title
- * 
- * TODO: passing back owner info will be necessary for displaying owernship of
- * shared pages -- disembodied pages already contain the ownerID, but that info
- * is not passed back here.
+ * Get all page titles for which the given user has read-permission, ordered by
+ * page ID
  *
  * Page titles are returned encrypted from the database, and then decrypted with
- * the encryption service
+ * the encryption service. The owner's username is included so that shared
+ * pages can be displayed as such, and the notebook and tags the user has given
+ * each page so that the directory can be shown as a tree and filtered.
  */
-func (s *Service) GetPageTitles(u *user.User) (map[int][]byte, error) {
+func (s *Service) GetPageTitles(u *user.User) ([]*PageTitle, error) {
     // get titles from database
-    // titles, err := s.repo.GetUserPageTitles(u.ID)
     pages, err := s.repo.GetUserDisembodiedPages(u.ID)
     if err != nil {
         return nil, err
     }
 
+    pageNotebooks, err := s.repo.GetUserPageNotebooks(u.ID)
+    if err != nil {
+        return nil, err
+    }
+    pageTags, err := s.repo.GetUserPageTags(u.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    // remember usernames so each owner is only looked up once
+    usernames := map[int]string{u.ID: u.Username}
+
     // loop over titles and decrypt each
-    titles := make(map[int][]byte)
+    titles := []*PageTitle{}
     for _, p := range pages {
         log.Println("decrypting disembodied page...")
         err = s.UserDecryptPage(u, p)
-        if err != nil {
+        if err == ErrClientEncrypted {
+            p.Title = nil
+        } else if err == encryption.ErrPageTampered {
+            // keep the directory usable, but make the problem visible
+            p.Title = []byte("[page failed integrity check]")
+        } else if err != nil {
             log.Println("failed to decrypt disembodied page")
             return nil, err
         }
         log.Println("successfully decrypted disembodied page")
 
-        // add title to title map
-        titles[p.ID] = p.Title
+        // get owner's username
+        ownerUsername, ok := usernames[p.OwnerID]
+        if !ok {
+            owner, err := s.userService.GetByID(p.OwnerID)
+            if err != nil {
+                log.Printf("failed to get owner of page-%v", p.ID)
+                return nil, err
+            }
+            ownerUsername = owner.Username
+            usernames[p.OwnerID] = ownerUsername
+        }
+
+        titles = append(titles, &PageTitle{
+            ID:            p.ID,
+            Title:         p.Title,
+            OwnerID:       p.OwnerID,
+            OwnerUsername: ownerUsername,
+            NotebookID:    pageNotebooks[p.ID],
+            TagIDs:        pageTags[p.ID],
+
+            ClientEncrypted: p.ClientEncrypted,
+        })
     }
 
+    sort.Slice(titles, func(i, j int) bool {
+        return titles[i].ID < titles[j].ID
+    })
+
     return titles, nil
 }
 
@@ -110,8 +292,12 @@ func (s *Service) GetPageTitles(u *user.User) (map[int][]byte, error) {
  * Gets a user's encrypted page key and encrypts a page
  */
 func (s *Service) UserEncryptPage(u *user.User, p *page.Page) error {
+    if p.ClientEncrypted {
+        return ErrClientEncrypted
+    }
+
     // get user-encrypted page key
-    key, err := s.GetUserEncryptedPageKey(u.ID, p.ID)
+    key, err := s.GetUserEncryptedPageKey(u, p.ID)
     if err != nil {
         log.Printf("failed to get user-%v-encrypted page-%v key", u.ID, p.ID)
         return err
@@ -131,8 +317,12 @@ func (s *Service) UserEncryptPage(u *user.User, p *page.Page) error {
  * Gets a user's encrypted page key and decrypts a page
  */
 func (s *Service) UserDecryptPage(u *user.User, p *page.Page) error {
+    if p.ClientEncrypted {
+        return ErrClientEncrypted
+    }
+
     // get user-encrypted page key
-    key, err := s.GetUserEncryptedPageKey(u.ID, p.ID)
+    key, err := s.GetUserEncryptedPageKey(u, p.ID)
     if err != nil {
         log.Printf("failed to get user-%v-encrypted page-%v key", u.ID, p.ID)
         return err
@@ -173,6 +363,9 @@ func (s *Service) LoadAndDecryptPage(pageID int,
         log.Println("failed to get page by ID")
         return nil, err
     }
+    if p.DeletedAt != nil {
+        return nil, ErrPageTrashed
+    }
 
     // decrypt page
     err = s.UserDecryptPage(u, p)
@@ -188,11 +381,19 @@ func (s *Service) LoadAndDecryptPage(pageID int,
  * Encrypt and save page -- check existance and update page or create new page,
  * encryption is performed by the update/create function
  *
+ * An existing page is only updated if p.Revision is still its latest revision,
+ * otherwise page.ErrEditConflict is returned
+ *
+ * The saved page is indexed for the user's searches
+ *
  * returns page ID
  */
 func (s *Service) SavePage(p *page.Page, u *user.User) (int, error) {
     log.Println("saving page...")
 
+    // the page is encrypted as it is saved, so keep the text for the index
+    title, body := p.Title, p.Body
+
     // check existance
     log.Println("checking page existance...")
     pageExists, err := s.repo.CheckPageExists(p.ID)
@@ -202,6 +403,18 @@ func (s *Service) SavePage(p *page.Page, u *user.User) (int, error) {
     }
 
     if pageExists {
+        // browser-encrypted pages are only ever saved by the browser
+        stored, err := s.pageService.GetByID(p.ID)
+        if err != nil {
+            return 0, err
+        }
+        if stored.ClientEncrypted {
+            return 0, ErrClientEncrypted
+        }
+        if stored.DeletedAt != nil {
+            return 0, ErrPageTrashed
+        }
+
         log.Println("page already exists; updating page...")
         pageID, err := s.updatePage(p, u)
         if err != nil {
@@ -209,6 +422,7 @@ func (s *Service) SavePage(p *page.Page, u *user.User) (int, error) {
             return 0, err
         }
         log.Println("updated page successfully")
+        s.indexSavedPage(u, pageID, p.Revision, title, body)
         return pageID, nil
     }
 
@@ -219,9 +433,24 @@ func (s *Service) SavePage(p *page.Page, u *user.User) (int, error) {
         return 0, err
     }
     log.Println("successfully created new entry")
+    s.indexSavedPage(u, pageID, p.Revision, title, body)
     return pageID, nil
 }
 
+/**
+ * Index a page that has just been saved -- a failure is only logged, since the
+ * page is saved all the same and is indexed again by the user's next search
+ */
+func (s *Service) indexSavedPage(u *user.User, pageID, revision int, title,
+    body []byte) {
+
+    err := s.indexPage(u, pageID, revision, title, body)
+    if err != nil {
+        log.Printf("failed to index page-%v for user-%v: %v", pageID, u.ID,
+            err)
+    }
+}
+
 /**
  * Update page's Title and Body attributes in storage
  *
@@ -237,7 +466,7 @@ func (s *Service) updatePage(p *page.Page, u *user.User) (int, error) {
     }
     if !canEdit {
         log.Printf("user-%v cannot edit page-%v", u.ID, p.ID)
-        return 0, err
+        return 0, ErrPermissionConflict
     }
 
     // encrypt page
@@ -248,11 +477,11 @@ func (s *Service) updatePage(p *page.Page, u *user.User) (int, error) {
     }
 
     // store page
-    log.Println("storing updated page-%v", p.ID)
-    err = s.repo.UpdatePage(p)
+    log.Printf("storing updated page-%v", p.ID)
+    err = s.repo.UpdatePage(p, u.ID)
     if err != nil {
         // should we decrypt the page in memory here?
-        log.Println("failed to update page-%v", p.ID)
+        log.Printf("failed to update page-%v", p.ID)
         return 0, err
     }
     log.Printf("succesfully stored updated page-%v", p.ID)
@@ -287,8 +516,9 @@ func (s *Service) createPage(p *page.Page, u *user.User) (int, error) {
     }
     log.Println("successfully generated ID")
 
-    // update page with meaningful ID
+    // update page with meaningful ID (a new page has no revisions yet)
     p.ID = pageID
+    p.Revision = 0
 
     // create new symmetric key for page
     log.Println("creating symmetric key for new page...")
@@ -316,26 +546,3 @@ func (s *Service) createPage(p *page.Page, u *user.User) (int, error) {
 }
 
 var ErrPermissionConflict = errors.New("permission conflict")
-
-/**
- * Delete a page after checking the user has delete-permission (is the owner of
- * the page)
- *
- * The page is built from the pageID within this function so that the caller
- * does not have to do it, as the caller is likely a handler that only has the
- * page ID at hand
- */
-func (s *Service) DeletePage(pageID, userID int) (error) {
-    // get the page
-    p, err := s.pageService.GetByID(pageID)
-    if err != nil {
-        return err
-    }
-
-    // check user has delete-permission (is the owner)
-    if p.OwnerID != userID {
-        return ErrPermissionConflict
-    }
-
-    return s.repo.DeletePage(p.ID)
-}
@@ -0,0 +1,237 @@
+package permission
+
+/**
+ * This file contains full-text search. Each user has their own blind index of
+ * the pages they can read, made of tokens only their main-key can produce (see
+ * `pkg/encryption/search.go`). A page is indexed for the user who saves it;
+ * everyone else who can read it has it indexed again the next time they
+ * search, as do pages that have not been indexed for them yet.
+ *
+ * The index also holds the wiki links in each page (see `pkg/wiki`) and the
+ * page's own title, as terms no search query can produce, so that the pages
+ * linking to a page, and the page a link goes to, can be found without storing
+ * or decrypting every title.
+ *
+ * Browser-encrypted pages cannot be read by the server, so they are never
+ * indexed.
+ */
+
+import (
+    "log"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/search"
+    "github.com/setonotes/pkg/wiki"
+    "github.com/setonotes/pkg/encryption" // for errors
+)
+
+// the most results a search returns
+const maxSearchResults = 50
+
+// the most pages listed as linking to a page
+const maxBacklinks = 100
+
+/**
+ * The index term for a wiki link to a (normalized) title -- search words are
+ * only ever letters and digits, so a term with brackets is never searched for
+ */
+func linkTerm(title string) string {
+    return "[[" + title + "]]"
+}
+
+/**
+ * The index term for a page's own (normalized) title, which wiki links to it
+ * are resolved by
+ */
+func titleTerm(title string) string {
+    return "title [[" + title + "]]"
+}
+
+/**
+ * Index a decrypted page for a user, at the revision it was saved as
+ */
+func (s *Service) indexPage(u *user.User, pageID, revision int, title,
+    body []byte) error {
+
+    weights := search.Weigh(string(title), string(body))
+    for _, target := range wiki.Links(body) {
+        weights[linkTerm(target)]++
+    }
+    if normalized := wiki.Normalize(string(title)); normalized != "" {
+        weights[titleTerm(normalized)] = 1
+    }
+    words := make([]string, 0, len(weights))
+    for word := range weights {
+        words = append(words, word)
+    }
+
+    tokens, err := s.encryption.SearchTokens(u, words)
+    if err != nil {
+        return err
+    }
+    tokenWeights := make([]int, len(words))
+    for i, word := range words {
+        tokenWeights[i] = weights[word]
+    }
+
+    return s.repo.StoreSearchTokens(u.ID, pageID, revision, tokens,
+        tokenWeights)
+}
+
+/**
+ * Index every page the user can read that has changed since it was last
+ * indexed for them -- a page that fails to index is left for next time
+ */
+func (s *Service) updateSearchIndex(u *user.User) error {
+    pageIDs, err := s.repo.GetUnindexedPageIDs(u.ID)
+    if err != nil {
+        return err
+    }
+
+    for _, pageID := range pageIDs {
+        p, err := s.LoadAndDecryptPage(pageID, u)
+        if err != nil {
+            log.Printf("failed to load page-%v for indexing: %v", pageID, err)
+            continue
+        }
+        err = s.indexPage(u, p.ID, p.Revision, p.Title, p.Body)
+        if err != nil {
+            log.Printf("failed to index page-%v: %v", pageID, err)
+        }
+    }
+    return nil
+}
+
+/**
+ * Search the pages a user can read for every word of a query, returning the
+ * best matches with their titles and a snippet of each
+ */
+func (s *Service) Search(u *user.User,
+    query string) ([]*search.Result, error) {
+
+    results := []*search.Result{}
+    words := search.QueryWords(query)
+    if len(words) == 0 {
+        return results, nil
+    }
+
+    err := s.updateSearchIndex(u)
+    if err != nil {
+        log.Printf("failed to update search index of user-%v", u.ID)
+        return nil, err
+    }
+
+    tokens, err := s.encryption.SearchTokens(u, words)
+    if err != nil {
+        return nil, err
+    }
+    hits, err := s.repo.SearchPages(u.ID, tokens, maxSearchResults)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, hit := range hits {
+        p, err := s.LoadAndDecryptPage(hit.PageID, u)
+        if err == encryption.ErrPageTampered {
+            continue
+        } else if err != nil {
+            log.Printf("failed to load search result page-%v", hit.PageID)
+            return nil, err
+        }
+
+        results = append(results, &search.Result{
+            ID:      p.ID,
+            Title:   p.Title,
+            Score:   hit.Score,
+            Snippet: search.Snippet(string(p.Body), words),
+        })
+    }
+
+    return results, nil
+}
+
+/**
+ * Find the page each of the given (normalized) titles is linked to for a user,
+ * by title -- titles of no page the user can read are left out, and where
+ * pages share a title the oldest has it
+ */
+func (s *Service) ResolveWikiLinks(u *user.User,
+    titles []string) (map[string]int, error) {
+
+    pageIDs := map[string]int{}
+    if len(titles) == 0 {
+        return pageIDs, nil
+    }
+
+    err := s.updateSearchIndex(u)
+    if err != nil {
+        log.Printf("failed to update search index of user-%v", u.ID)
+        return nil, err
+    }
+
+    terms := make([]string, len(titles))
+    for i, title := range titles {
+        terms[i] = titleTerm(title)
+    }
+    tokens, err := s.encryption.SearchTokens(u, terms)
+    if err != nil {
+        return nil, err
+    }
+    for i, token := range tokens {
+        // every page with a title scores the same for it, so hits come in
+        // page ID order
+        hits, err := s.repo.SearchPages(u.ID, [][]byte{token}, 1)
+        if err != nil {
+            return nil, err
+        }
+        if len(hits) > 0 {
+            pageIDs[titles[i]] = hits[0].PageID
+        }
+    }
+    return pageIDs, nil
+}
+
+/**
+ * Get the pages a user can read that link to a title, other than the page
+ * itself, most links first -- only their IDs and titles are filled in, and
+ * pages that fail their integrity check are left out
+ */
+func (s *Service) GetBacklinks(u *user.User, pageID int,
+    title []byte) ([]*PageTitle, error) {
+
+    backlinks := []*PageTitle{}
+    target := wiki.Normalize(string(title))
+    if target == "" {
+        return backlinks, nil
+    }
+
+    err := s.updateSearchIndex(u)
+    if err != nil {
+        log.Printf("failed to update search index of user-%v", u.ID)
+        return nil, err
+    }
+
+    tokens, err := s.encryption.SearchTokens(u, []string{linkTerm(target)})
+    if err != nil {
+        return nil, err
+    }
+    hits, err := s.repo.SearchPages(u.ID, tokens, maxBacklinks+1)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, hit := range hits {
+        if hit.PageID == pageID || len(backlinks) == maxBacklinks {
+            continue
+        }
+        p, err := s.LoadAndDecryptPage(hit.PageID, u)
+        if err == encryption.ErrPageTampered {
+            continue
+        } else if err != nil {
+            log.Printf("failed to load backlink page-%v", hit.PageID)
+            return nil, err
+        }
+        backlinks = append(backlinks, &PageTitle{ID: p.ID, Title: p.Title})
+    }
+    return backlinks, nil
+}
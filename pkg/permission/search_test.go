@@ -0,0 +1,223 @@
+package permission
+
+import (
+    "sort"
+    "testing"
+
+    "github.com/setonotes/pkg/page"
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/search"
+    "github.com/setonotes/pkg/encryption" // for errors
+)
+
+/**
+ * A repository of plaintext pages owned by one user, with a search index
+ */
+type indexRepo struct {
+    Repository
+    pages   map[int]*page.Page
+    indexed map[int]int            // revision, by page ID
+    tokens  map[int]map[string]int // weight by token, by page ID
+}
+
+func newIndexRepo() *indexRepo {
+    return &indexRepo{
+        pages:   map[int]*page.Page{},
+        indexed: map[int]int{},
+        tokens:  map[int]map[string]int{},
+    }
+}
+
+func (r *indexRepo) save(id int, title, body string) {
+    revision := 1
+    if p, ok := r.pages[id]; ok {
+        revision = p.Revision + 1
+    }
+    r.pages[id] = &page.Page{
+        ID:       id,
+        Revision: revision,
+        Title:    []byte(title),
+        Body:     []byte(body),
+    }
+}
+
+func (r *indexRepo) GetPageByID(id int) (*page.Page, error) {
+    p := *r.pages[id]
+    return &p, nil
+}
+
+func (r *indexRepo) GetPagePermission(userID,
+    pageID int) (*Permission, error) {
+
+    return &Permission{UserID: userID, PageID: pageID, IsOwner: true}, nil
+}
+
+func (r *indexRepo) GetUnindexedPageIDs(userID int) ([]int, error) {
+    ids := []int{}
+    for id, p := range r.pages {
+        if r.indexed[id] != p.Revision {
+            ids = append(ids, id)
+        }
+    }
+    sort.Ints(ids)
+    return ids, nil
+}
+
+func (r *indexRepo) StoreSearchTokens(userID, pageID, revision int,
+    tokens [][]byte, weights []int) error {
+
+    r.indexed[pageID] = revision
+    r.tokens[pageID] = map[string]int{}
+    for i, token := range tokens {
+        r.tokens[pageID][string(token)] = weights[i]
+    }
+    return nil
+}
+
+func (r *indexRepo) SearchPages(userID int, tokens [][]byte,
+    limit int) ([]*search.Hit, error) {
+
+    hits := []*search.Hit{}
+    for id, weights := range r.tokens {
+        hit := &search.Hit{PageID: id}
+        for _, token := range tokens {
+            weight, ok := weights[string(token)]
+            if !ok {
+                hit = nil
+                break
+            }
+            hit.Score += weight
+        }
+        if hit != nil {
+            hits = append(hits, hit)
+        }
+    }
+    sort.Slice(hits, func(i, j int) bool {
+        if hits[i].Score != hits[j].Score {
+            return hits[i].Score > hits[j].Score
+        }
+        return hits[i].PageID < hits[j].PageID
+    })
+    if len(hits) > limit {
+        hits = hits[:limit]
+    }
+    return hits, nil
+}
+
+/**
+ * An encryption service that leaves pages as they are, and whose search
+ * tokens are the words they stand for
+ */
+type indexEncryption struct {
+    EncryptionService
+    tampered map[int]bool
+}
+
+func (e *indexEncryption) DecryptPage(p *page.Page, u *user.User,
+    userEncryptedPageKey []byte) error {
+
+    if e.tampered[p.ID] {
+        return encryption.ErrPageTampered
+    }
+    return nil
+}
+
+func (e *indexEncryption) SearchTokens(u *user.User,
+    words []string) ([][]byte, error) {
+
+    tokens := make([][]byte, len(words))
+    for i, word := range words {
+        tokens[i] = []byte(word)
+    }
+    return tokens, nil
+}
+
+func backlinkIDs(titles []*PageTitle) []int {
+    ids := []int{}
+    for _, t := range titles {
+        ids = append(ids, t.ID)
+    }
+    return ids
+}
+
+func equalIDs(a, b []int) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func TestWikiLinksAndBacklinks(t *testing.T) {
+    r := newIndexRepo()
+    e := &indexEncryption{tampered: map[int]bool{}}
+    s := NewService(r, e, nil, page.NewService(r), nil, nil, nil, nil)
+    u := &user.User{ID: 1}
+
+    r.save(1, "Home", "See [[Plans]], [[ghost]] and `[[Code]]`")
+    r.save(2, "Plans", "Back [[home]], and to [[Plans]] itself")
+    r.save(3, "  PLANS ", "[[Home]] twice: [[HOME]]\n```\n[[Home]]\n```")
+    r.save(4, "Code", "no links")
+
+    // the oldest of the pages sharing a title has it
+    ids, err := s.ResolveWikiLinks(u, []string{"plans", "ghost", "home",
+        "code"})
+    if err != nil || len(ids) != 3 || ids["plans"] != 2 ||
+        ids["home"] != 1 || ids["code"] != 4 {
+        t.Errorf("resolved %v: %v", ids, err)
+    }
+    if ids, err := s.ResolveWikiLinks(u, nil); err != nil || len(ids) != 0 {
+        t.Errorf("resolved %v with no links: %v", ids, err)
+    }
+
+    // each page links to a title once, so they come in page ID order,
+    // leaving out the page itself and links in code
+    for _, c := range []struct {
+        pageID int
+        title  string
+        want   []int
+    }{
+        {1, "Home", []int{2, 3}},
+        {2, "Plans", []int{1}},
+        {3, "plans", []int{1, 2}},
+        {4, "Code", []int{}},
+        {0, "Ghost", []int{1}},
+        {0, " ", []int{}},
+    } {
+        backlinks, err := s.GetBacklinks(u, c.pageID, []byte(c.title))
+        if err != nil || !equalIDs(backlinkIDs(backlinks), c.want) {
+            t.Errorf("backlinks of %q gave %v, want %v: %v", c.title,
+                backlinkIDs(backlinks), c.want, err)
+        }
+    }
+    backlinks, err := s.GetBacklinks(u, 0, []byte("home"))
+    if err != nil || !equalIDs(backlinkIDs(backlinks), []int{2, 3}) ||
+        string(backlinks[1].Title) != "  PLANS " {
+        t.Errorf("backlinks of home gave %v: %v", backlinkIDs(backlinks),
+            err)
+    }
+
+    // a renamed page loses its title, and links no longer lead to it
+    r.save(2, "Roadmap", "Back [[home]]")
+    ids, err = s.ResolveWikiLinks(u, []string{"plans", "roadmap"})
+    if err != nil || ids["plans"] != 3 || ids["roadmap"] != 2 {
+        t.Errorf("resolved %v after a rename: %v", ids, err)
+    }
+    backlinks, err = s.GetBacklinks(u, 3, []byte("Plans"))
+    if err != nil || !equalIDs(backlinkIDs(backlinks), []int{1}) {
+        t.Errorf("backlinks of plans gave %v after a rename: %v",
+            backlinkIDs(backlinks), err)
+    }
+
+    // a page that fails its integrity check is not listed
+    e.tampered[3] = true
+    backlinks, err = s.GetBacklinks(u, 1, []byte("Home"))
+    if err != nil || !equalIDs(backlinkIDs(backlinks), []int{2}) {
+        t.Errorf("backlinks of home gave %v with one tampered: %v",
+            backlinkIDs(backlinks), err)
+    }
+}
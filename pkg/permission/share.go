@@ -0,0 +1,356 @@
+package permission
+
+/**
+ * This file contains the functionality for sharing pages between users and
+ * revoking that access. Shared page keys are sealed to the recipient's public
+ * key by the encryption service, so this code never handles an unencrypted key.
+ */
+
+import (
+    "log"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+)
+
+// how many times a revoke rotates a page key that keeps being saved meanwhile
+const revokeAttempts = 3
+
+/**
+ * A Share describes a user, other than the owner, who holds a page key
+ */
+type Share struct {
+    UserID   int
+    Username string
+    CanEdit  bool
+}
+
+/**
+ * Share a page with another user --
+ * The owner's page key is re-wrapped to the recipient's public key by the
+ * encryption service and stored in a new page permission. Only the owner of a
+ * page may share it.
+ */
+func (s *Service) SharePage(pageID int, owner *user.User,
+    recipientUsername string, canEdit bool) error {
+
+    // get the page
+    p, err := s.pageService.GetByID(pageID)
+    if err != nil {
+        return err
+    }
+
+    // check user has share-permission (is the owner)
+    if p.OwnerID != owner.ID {
+        return ErrPermissionConflict
+    }
+    if p.DeletedAt != nil {
+        return ErrPageTrashed
+    }
+
+    // get recipient
+    recipient, err := s.userService.GetByUsername(recipientUsername)
+    if err != nil {
+        log.Printf("failed to get share recipient <%s>", recipientUsername)
+        return err
+    }
+    if recipient.ID == owner.ID {
+        return ErrShareWithSelf
+    }
+    if len(recipient.PublicKey) == 0 {
+        return ErrNoPublicKey
+    }
+
+    // check the page isn't already shared with the recipient
+    shared, err := s.repo.CheckPagePermissionExists(recipient.ID, pageID)
+    if err != nil {
+        return err
+    }
+    if shared {
+        return ErrAlreadyShared
+    }
+
+    // get owner-encrypted page key
+    ownerKey, err := s.GetUserEncryptedPageKey(owner, pageID)
+    if err != nil {
+        log.Printf("failed to get user-%v-encrypted page-%v key", owner.ID,
+            pageID)
+        return err
+    }
+
+    // re-wrap page key for recipient
+    log.Printf("sealing page-%v key for user-%v...", pageID, recipient.ID)
+    sealedKey, err := s.encryption.SealUserEncryptedKey(owner, ownerKey,
+        recipient)
+    if err != nil {
+        log.Printf("failed to seal page-%v key for user-%v", pageID,
+            recipient.ID)
+        return err
+    }
+
+    // create page permission for recipient
+    log.Println("creating new page permission...")
+    err = s.repo.CreatePagePermission(recipient.ID, pageID, false, canEdit,
+        sealedKey)
+    if err != nil {
+        log.Println("failed to create page permission")
+        return err
+    }
+    log.Printf("successfully shared page-%v with user-%v", pageID,
+        recipient.ID)
+
+    return nil
+}
+
+/**
+ * Get every user a page has been shared with -- only the owner of a page may
+ * see this
+ */
+func (s *Service) GetPageShares(pageID int, owner *user.User) ([]*Share,
+    error) {
+
+    // get the page
+    p, err := s.pageService.GetByID(pageID)
+    if err != nil {
+        return nil, err
+    }
+
+    // check user is the owner
+    if p.OwnerID != owner.ID {
+        return nil, ErrPermissionConflict
+    }
+
+    perms, err := s.repo.GetPagePermissions(pageID)
+    if err != nil {
+        log.Printf("failed to get permissions for page-%v", pageID)
+        return nil, err
+    }
+
+    shares := []*Share{}
+    for _, perm := range perms {
+        if perm.IsOwner {
+            continue
+        }
+        u, err := s.userService.GetByID(perm.UserID)
+        if err != nil {
+            log.Printf("failed to get user-%v for page-%v shares", perm.UserID,
+                pageID)
+            return nil, err
+        }
+        shares = append(shares, &Share{
+            UserID:   u.ID,
+            Username: u.Username,
+            CanEdit:  perm.CanEdit,
+        })
+    }
+
+    return shares, nil
+}
+
+/**
+ * Revoke a user's access to a page and rotate the page key --
+ * Deleting the permission row alone is not enough, because the revoked user may
+ * have kept the old page key. Instead, the page key is rotated (see
+ * rotatePageKey()) and the revoked user's row is deleted in the same
+ * transaction. This works for pages in the trash as well. If the page is saved
+ * while its key is being rotated, the rotation is tried again on the page as
+ * saved.
+ *
+ * The server cannot rotate the key of a browser-encrypted page, and the browser
+ * does not yet do so either, so for those pages only the permission row is
+ * deleted: the revoked user loses access through the server, but could still
+ * decrypt a copy of the page as it is now. Returns whether the key was rotated.
+ */
+func (s *Service) RevokeAccess(pageID int, owner *user.User,
+    userID int) (bool, error) {
+
+    p, err := s.pageService.GetByID(pageID)
+    if err != nil {
+        return false, err
+    }
+
+    // check user has revoke-permission (is the owner)
+    if p.OwnerID != owner.ID {
+        return false, ErrPermissionConflict
+    }
+    if userID == owner.ID {
+        return false, ErrShareWithSelf
+    }
+
+    if p.ClientEncrypted {
+        shared, err := s.repo.CheckPagePermissionExists(userID, pageID)
+        if err != nil {
+            return false, err
+        }
+        if !shared {
+            return false, ErrNotShared
+        }
+        log.Printf("revoking user-%v access to browser-encrypted page-%v "+
+            "without rotating its key...", userID, pageID)
+        err = s.repo.DeletePagePermission(userID, pageID)
+        if err != nil {
+            return false, err
+        }
+        log.Printf("successfully revoked user-%v access to page-%v; its key "+
+            "was not rotated", userID, pageID)
+        return false, nil
+    }
+
+    log.Printf("revoking user-%v access to page-%v...", userID, pageID)
+    for attempt := 1; ; attempt++ {
+        // decrypt the page with the old key
+        err = s.UserDecryptPage(owner, p)
+        if err != nil {
+            return false, err
+        }
+
+        err = s.rotatePageKey(p, owner, userID)
+        if err != page.ErrEditConflict || attempt == revokeAttempts {
+            break
+        }
+        log.Printf("page-%v was saved during key rotation, trying again",
+            pageID)
+        p, err = s.pageService.GetByID(pageID)
+        if err != nil {
+            return false, err
+        }
+    }
+    if err != nil {
+        return false, err
+    }
+    log.Printf("successfully revoked user-%v access to page-%v", userID,
+        pageID)
+
+    return true, nil
+}
+
+/**
+ * Rotate the key of a decrypted page --
+ * A fresh page key is generated, the page and all of its revisions and
+ * attachments are re-encrypted with it, and the new key is wrapped for the
+ * owner and sealed for every remaining holder. If revokedUserID is not 0, that
+ * user's permission is deleted rather than re-keyed. The repository stores all
+ * of this in a single transaction, failing with page.ErrEditConflict if the
+ * page was saved in the meantime, except for the attachments' blobs: each is
+ * written anew first, and whichever blobs end up unused are deleted after.
+ *
+ * The page is left encrypted
+ */
+func (s *Service) rotatePageKey(p *page.Page, owner *user.User,
+    revokedUserID int) error {
+
+    // get every permission for the page
+    perms, err := s.repo.GetPagePermissions(p.ID)
+    if err != nil {
+        log.Printf("failed to get permissions for page-%v", p.ID)
+        return err
+    }
+
+    // find the remaining holders
+    revoked := false
+    remaining := []*Permission{}
+    for _, perm := range perms {
+        if perm.UserID == revokedUserID {
+            revoked = true
+            continue
+        }
+        if !perm.IsOwner {
+            remaining = append(remaining, perm)
+        }
+    }
+    if revokedUserID != 0 && !revoked {
+        return ErrNotShared
+    }
+
+    // decrypt every revision with the old key
+    revisions, err := s.repo.GetPageRevisions(p.ID)
+    if err != nil {
+        log.Printf("failed to get revisions of page-%v", p.ID)
+        return err
+    }
+    for _, rev := range revisions {
+        err = s.UserDecryptPage(owner, rev.Page)
+        if err != nil {
+            log.Printf("failed to decrypt revision %v of page-%v", rev.Number,
+                p.ID)
+            return err
+        }
+    }
+
+    // create new page key for owner
+    log.Printf("creating new key for page-%v...", p.ID)
+    ownerKey, err := s.encryption.NewUserEncryptedSymmetricKey(owner)
+    if err != nil {
+        return err
+    }
+
+    // seal the new key for every remaining holder
+    newPerms := []*Permission{{
+        UserID:               owner.ID,
+        PageID:               p.ID,
+        IsOwner:              true,
+        CanEdit:              true,
+        UserEncryptedPageKey: ownerKey,
+    }}
+    for _, perm := range remaining {
+        recipient, err := s.userService.GetByID(perm.UserID)
+        if err != nil {
+            log.Printf("failed to get user-%v for key rotation", perm.UserID)
+            return err
+        }
+        sealedKey, err := s.encryption.SealUserEncryptedKey(owner, ownerKey,
+            recipient)
+        if err != nil {
+            log.Printf("failed to seal page-%v key for user-%v", p.ID,
+                recipient.ID)
+            return err
+        }
+        newPerms = append(newPerms, &Permission{
+            UserID:               perm.UserID,
+            PageID:               p.ID,
+            IsOwner:              false,
+            CanEdit:              perm.CanEdit,
+            UserEncryptedPageKey: sealedKey,
+        })
+    }
+
+    // re-encrypt the page with the new key
+    err = s.encryption.EncryptPage(p, owner, ownerKey)
+    if err != nil {
+        log.Printf("failed to encrypt page-%v with new key", p.ID)
+        return err
+    }
+
+    // re-encrypt the revisions with the new key
+    for _, rev := range revisions {
+        err = s.encryption.EncryptPage(rev.Page, owner, ownerKey)
+        if err != nil {
+            log.Printf("failed to encrypt revision %v of page-%v with new key",
+                rev.Number, p.ID)
+            return err
+        }
+    }
+
+    // re-encrypt the attachments with the new key, into new blobs
+    oldKey, err := s.GetUserEncryptedPageKey(owner, p.ID)
+    if err != nil {
+        return err
+    }
+    oldAttachments, attachments, err := s.rekeyAttachments(owner, p.ID,
+        oldKey, ownerKey)
+    if err != nil {
+        return err
+    }
+
+    // store everything at once, then delete whichever blobs are left unused
+    err = s.repo.RotatePageKey(p, revokedUserID, newPerms, revisions,
+        attachments)
+    if err != nil {
+        log.Printf("failed to rotate page-%v key", p.ID)
+        s.deleteAttachmentBlobs(attachments)
+        return err
+    }
+    s.deleteAttachmentBlobs(oldAttachments)
+
+    return nil
+}
@@ -0,0 +1,192 @@
+package permission
+
+/**
+ * This file contains tags. Like notebooks, tags belong to a single user, so
+ * the tags a user puts on a shared page are only seen by that user. Tag names
+ * are encrypted, so a user's tags are decrypted to be matched by name.
+ */
+
+import (
+    "log"
+    "sort"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/tag"
+    "github.com/setonotes/pkg/encryption" // for errors
+)
+
+/**
+ * Get a tag after checking the user owns it
+ */
+func (s *Service) getOwnedTag(u *user.User, tagID int) (*tag.Tag, error) {
+    t, err := s.tagService.GetByID(tagID)
+    if err != nil {
+        return nil, err
+    }
+    if t.OwnerID != u.ID {
+        log.Printf("user-%v does not own tag-%v", u.ID, tagID)
+        return nil, ErrPermissionConflict
+    }
+    return t, nil
+}
+
+/**
+ * Get all of a user's tags with their names decrypted, ordered by name
+ */
+func (s *Service) GetTags(u *user.User) ([]*tag.Tag, error) {
+    tags, err := s.repo.GetUserTags(u.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, t := range tags {
+        if len(t.Name) == 0 {
+            continue
+        }
+        err = s.encryption.DecryptTagName(t, u)
+        if err == encryption.ErrTagTampered {
+            t.Name = []byte("[tag failed integrity check]")
+        } else if err != nil {
+            log.Printf("failed to decrypt tag-%v", t.ID)
+            return nil, err
+        }
+    }
+
+    sort.SliceStable(tags, func(i, j int) bool {
+        return string(tags[i].Name) < string(tags[j].Name)
+    })
+
+    return tags, nil
+}
+
+/**
+ * Find one of a user's tags by its (normalized) name, or nil
+ */
+func findTag(tags []*tag.Tag, name string) *tag.Tag {
+    for _, t := range tags {
+        if string(t.Name) == name {
+            return t
+        }
+    }
+    return nil
+}
+
+/**
+ * Store a tag's name, encrypted
+ */
+func (s *Service) storeTagName(u *user.User, t *tag.Tag, name string) error {
+    t.Name = []byte(name)
+    err := s.encryption.EncryptTagName(t, u)
+    if err != nil {
+        log.Printf("failed to encrypt name of tag-%v", t.ID)
+        return err
+    }
+    return s.repo.UpdateTag(t)
+}
+
+/**
+ * Replace the tags a user has put on a page with the given tag names, creating
+ * any tags the user does not have yet -- the user only has to be able to read
+ * the page, since nobody else sees their tags
+ */
+func (s *Service) SetPageTags(u *user.User, pageID int,
+    names []string) error {
+
+    exists, err := s.repo.CheckPagePermissionExists(u.ID, pageID)
+    if err != nil {
+        return err
+    }
+    if !exists {
+        log.Printf("user-%v cannot read page-%v", u.ID, pageID)
+        return ErrPermissionConflict
+    }
+
+    tags, err := s.GetTags(u)
+    if err != nil {
+        return err
+    }
+
+    tagIDs := []int{}
+    for _, name := range names {
+        name, err = tag.Normalize(name)
+        if err != nil {
+            return err
+        }
+
+        t := findTag(tags, name)
+        if t == nil {
+            // like a page, the tag is created empty to get its ID, which its
+            // encrypted name is bound to
+            id, err := s.repo.CreateTag(u.ID)
+            if err != nil {
+                return err
+            }
+            t = &tag.Tag{ID: id, OwnerID: u.ID}
+            err = s.storeTagName(u, t, name)
+            if err != nil {
+                return err
+            }
+            t.Name = []byte(name)
+            tags = append(tags, t)
+        }
+        tagIDs = append(tagIDs, t.ID)
+    }
+
+    return s.repo.SetPageTags(u.ID, pageID, tagIDs)
+}
+
+/**
+ * Give one of a user's tags a new name -- tag.ErrTagExists is returned if the
+ * user has another tag by that name, which it can be merged into instead
+ */
+func (s *Service) RenameTag(u *user.User, tagID int, name string) error {
+    name, err := tag.Normalize(name)
+    if err != nil {
+        return err
+    }
+    t, err := s.getOwnedTag(u, tagID)
+    if err != nil {
+        return err
+    }
+
+    tags, err := s.GetTags(u)
+    if err != nil {
+        return err
+    }
+    other := findTag(tags, name)
+    if other != nil && other.ID != t.ID {
+        return tag.ErrTagExists
+    }
+
+    return s.storeTagName(u, t, name)
+}
+
+/**
+ * Merge one of a user's tags into another, which ends up on every page either
+ * was on
+ */
+func (s *Service) MergeTags(u *user.User, fromID, intoID int) error {
+    from, err := s.getOwnedTag(u, fromID)
+    if err != nil {
+        return err
+    }
+    into, err := s.getOwnedTag(u, intoID)
+    if err != nil {
+        return err
+    }
+    if from.ID == into.ID {
+        return nil
+    }
+    return s.repo.MergeTags(from.ID, into.ID)
+}
+
+/**
+ * Delete one of a user's tags, taking it off every page
+ */
+func (s *Service) DeleteTag(u *user.User, tagID int) error {
+    t, err := s.getOwnedTag(u, tagID)
+    if err != nil {
+        return err
+    }
+    return s.repo.DeleteTag(t.ID)
+}
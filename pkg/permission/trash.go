@@ -0,0 +1,167 @@
+package permission
+
+/**
+ * This file contains the trash: deleting a page moves it to its owner's trash,
+ * from where it can be restored or deleted for good. Pages left in the trash
+ * are purged after a retention period.
+ */
+
+import (
+    "log"
+    "time"
+    "errors"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/encryption" // for errors
+)
+
+var (
+    ErrPageTrashed    error = errors.New("page is in the trash")
+    ErrPageNotTrashed error = errors.New("page is not in the trash")
+)
+
+/**
+ * A TrashedPage is a decrypted page title along with when it was trashed
+ */
+type TrashedPage struct {
+    ID        int
+    Title     []byte
+    DeletedAt time.Time
+
+    // the title of a browser-encrypted page is left empty
+    ClientEncrypted bool
+}
+
+/**
+ * Move a page to the trash after checking the user is its owner
+ */
+func (s *Service) TrashPage(pageID, userID int) error {
+    p, err := s.pageService.GetByID(pageID)
+    if err != nil {
+        return err
+    }
+    if p.OwnerID != userID {
+        return ErrPermissionConflict
+    }
+    if p.DeletedAt != nil {
+        return ErrPageTrashed
+    }
+
+    return s.repo.TrashPage(p.ID)
+}
+
+/**
+ * Take a page out of its owner's trash
+ */
+func (s *Service) RestorePage(pageID, userID int) error {
+    p, err := s.pageService.GetByID(pageID)
+    if err != nil {
+        return err
+    }
+    if p.OwnerID != userID {
+        return ErrPermissionConflict
+    }
+    if p.DeletedAt == nil {
+        return ErrPageNotTrashed
+    }
+
+    return s.repo.RestorePage(p.ID)
+}
+
+/**
+ * Delete a page in its owner's trash for good
+ *
+ * The page is built from the pageID within this function so that the caller
+ * does not have to do it, as the caller is likely a handler that only has the
+ * page ID at hand
+ */
+func (s *Service) DeletePage(pageID, userID int) error {
+    p, err := s.pageService.GetByID(pageID)
+    if err != nil {
+        return err
+    }
+    if p.OwnerID != userID {
+        return ErrPermissionConflict
+    }
+    if p.DeletedAt == nil {
+        return ErrPageNotTrashed
+    }
+
+    return s.deletePage(p.ID)
+}
+
+/**
+ * Delete a page for good, along with the blobs of its attachments -- the
+ * attachment rows go with the page, and the blobs are deleted once they have
+ */
+func (s *Service) deletePage(pageID int) error {
+    attachments, err := s.repo.GetPageAttachments(pageID)
+    if err != nil {
+        log.Printf("failed to get attachments of page-%v", pageID)
+        return err
+    }
+
+    err = s.repo.DeletePage(pageID)
+    if err != nil {
+        return err
+    }
+    s.deleteAttachmentBlobs(attachments)
+    return nil
+}
+
+/**
+ * Get the pages in a user's trash with their titles decrypted
+ */
+func (s *Service) GetTrashedPages(u *user.User) ([]*TrashedPage, error) {
+    pages, err := s.repo.GetTrashedPages(u.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    trashed := []*TrashedPage{}
+    for _, p := range pages {
+        err = s.UserDecryptPage(u, p)
+        if err == ErrClientEncrypted {
+            p.Title = nil
+        } else if err == encryption.ErrPageTampered {
+            p.Title = []byte("[page failed integrity check]")
+        } else if err != nil {
+            log.Printf("failed to decrypt trashed page-%v", p.ID)
+            return nil, err
+        }
+
+        trashed = append(trashed, &TrashedPage{
+            ID:        p.ID,
+            Title:     p.Title,
+            DeletedAt: *p.DeletedAt,
+
+            ClientEncrypted: p.ClientEncrypted,
+        })
+    }
+
+    return trashed, nil
+}
+
+/**
+ * Delete every page that has been in the trash for longer than retention
+ *
+ * Returns the number of pages deleted
+ */
+func (s *Service) PurgeTrash(retention time.Duration) (int, error) {
+    pageIDs, err := s.repo.GetPagesTrashedBefore(time.Now().Add(-retention))
+    if err != nil {
+        return 0, err
+    }
+
+    purged := 0
+    for _, pageID := range pageIDs {
+        err = s.deletePage(pageID)
+        if err != nil {
+            log.Printf("failed to purge page-%v: %v", pageID, err)
+            continue
+        }
+        purged++
+    }
+
+    return purged, nil
+}
@@ -0,0 +1,186 @@
+package permission
+
+/**
+ * This file contains the re-encryption of pages written under an older
+ * algorithm or envelope format. Re-encrypting a page means rotating its key,
+ * which needs the owner's main-key, so a page can only be upgraded while its
+ * owner is signed in. It also contains the upgrade of a user's own keys, which
+ * needs their password.
+ */
+
+import (
+    "log"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+)
+
+/**
+ * A Rewrap is a value encrypted with a user's main-key -- a page key, notebook
+ * name or tag name -- as it was before and after the main-key was replaced
+ */
+type Rewrap struct {
+    ID  int
+    Old []byte
+    New []byte
+}
+
+/**
+ * Upgrade a user's own keys if they need it (see
+ * encryption.Service.UpgradeUserKeys()) --
+ * This must be called while the password is known, after the user's
+ * credentials are upgraded. The page keys the user holds as owner and the
+ * names of their notebooks and tags are re-wrapped along with the keys, and
+ * everything is stored in a single transaction that fails if any of it
+ * changed meanwhile, leaving the keys to be upgraded next time.
+ *
+ * The given user is updated in place. Returns the user's new recovery code, or
+ * an empty string if none was issued.
+ */
+func (s *Service) UpgradeUserKeys(u *user.User,
+    password string) (string, error) {
+
+    if !s.encryption.UserKeysNeedUpgrade(u) {
+        return "", nil
+    }
+    log.Printf("upgrading keys of user-%v...", u.ID)
+
+    // get everything encrypted with the main-key
+    pageIDs, err := s.repo.GetOwnedPageIDs(u.ID)
+    if err != nil {
+        log.Printf("failed to get pages owned by user-%v", u.ID)
+        return "", err
+    }
+    pageKeys := make([][]byte, len(pageIDs))
+    for i, pageID := range pageIDs {
+        perm, err := s.repo.GetPagePermission(u.ID, pageID)
+        if err != nil {
+            return "", err
+        }
+        pageKeys[i] = perm.UserEncryptedPageKey
+    }
+    notebooks, err := s.repo.GetUserNotebooks(u.ID)
+    if err != nil {
+        return "", err
+    }
+    tags, err := s.repo.GetUserTags(u.ID)
+    if err != nil {
+        return "", err
+    }
+    notebookNames := []*Rewrap{}
+    for _, nb := range notebooks {
+        notebookNames = append(notebookNames, &Rewrap{ID: nb.ID, Old: nb.Name})
+    }
+    tagNames := []*Rewrap{}
+    for _, t := range tags {
+        tagNames = append(tagNames, &Rewrap{ID: t.ID, Old: t.Name})
+    }
+
+    // re-key in memory
+    upgraded := *u
+    newPageKeys, recoveryCode, err := s.encryption.UpgradeUserKeys(&upgraded,
+        []byte(password), pageKeys, notebooks, tags)
+    if err != nil {
+        log.Printf("failed to upgrade keys of user-%v", u.ID)
+        return "", err
+    }
+    rewrapped := []*Rewrap{}
+    for i, pageID := range pageIDs {
+        rewrapped = append(rewrapped,
+            &Rewrap{ID: pageID, Old: pageKeys[i], New: newPageKeys[i]})
+    }
+    for i, nb := range notebooks {
+        notebookNames[i].New = nb.Name
+    }
+    for i, t := range tags {
+        tagNames[i].New = t.Name
+    }
+
+    // store user and everything re-wrapped at once
+    err = s.repo.StoreUserKeyUpgrade(&upgraded, u.MainKeyEncrypted, rewrapped,
+        notebookNames, tagNames)
+    if err != nil {
+        log.Printf("failed to store key upgrade of user-%v", u.ID)
+        return "", err
+    }
+    *u = upgraded
+    log.Printf("successfully upgraded keys of user-%v", u.ID)
+
+    return recoveryCode, nil
+}
+
+/**
+ * Re-encrypt every page owned by a user whose title or body was not written
+ * with the current algorithm
+ *
+ * Returns the number of pages upgraded
+ */
+func (s *Service) UpgradeUserPages(u *user.User) (int, error) {
+    pageIDs, err := s.repo.GetOwnedPageIDs(u.ID)
+    if err != nil {
+        log.Printf("failed to get pages owned by user-%v", u.ID)
+        return 0, err
+    }
+
+    upgraded := 0
+    for _, pageID := range pageIDs {
+        p, err := s.pageService.GetByID(pageID)
+        if err != nil {
+            return upgraded, err
+        }
+        if p.ClientEncrypted || (!s.encryption.NeedsUpgrade(p.Title) &&
+            !s.encryption.NeedsUpgrade(p.Body)) {
+            continue
+        }
+
+        // decrypt with the old key and rotate to a new one
+        err = s.UserDecryptPage(u, p)
+        if err != nil {
+            return upgraded, err
+        }
+        log.Printf("upgrading encryption of page-%v...", pageID)
+        err = s.rotatePageKey(p, u, 0)
+        if err == page.ErrEditConflict {
+            // saved meanwhile; it is upgraded at the next sign-in instead
+            log.Printf("page-%v was saved during its upgrade", pageID)
+            continue
+        }
+        if err != nil {
+            log.Printf("failed to upgrade encryption of page-%v", pageID)
+            return upgraded, err
+        }
+        upgraded++
+    }
+
+    return upgraded, nil
+}
+
+/**
+ * Count the pages owned by a user whose title or body was not written with the
+ * current algorithm -- this needs no keys, as the algorithm is stored in the
+ * ciphertext envelope
+ */
+func (s *Service) CountPagesToUpgrade(ownerID int) (int, error) {
+    pageIDs, err := s.repo.GetOwnedPageIDs(ownerID)
+    if err != nil {
+        log.Printf("failed to get pages owned by user-%v", ownerID)
+        return 0, err
+    }
+
+    n := 0
+    for _, pageID := range pageIDs {
+        p, err := s.pageService.GetByID(pageID)
+        if err != nil {
+            return n, err
+        }
+        if p.ClientEncrypted {
+            continue
+        }
+        if s.encryption.NeedsUpgrade(p.Title) ||
+            s.encryption.NeedsUpgrade(p.Body) {
+            n++
+        }
+    }
+
+    return n, nil
+}
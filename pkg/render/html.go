@@ -0,0 +1,278 @@
+package render
+
+/**
+ * This file extends blackfriday's HTML renderer with the features in Options:
+ * task list checkboxes, heading IDs and anchors, the table of contents and
+ * syntax highlighting -- and makes links to attachments (`attachment:12`)
+ * into links to where they are downloaded from
+ */
+
+import (
+    "io"
+    "fmt"
+    "html"
+    "bytes"
+    "strings"
+
+    "github.com/setonotes/pkg/mathml"
+    "github.com/setonotes/pkg/attachment"
+
+    "github.com/blackfriday"
+    "github.com/alecthomas/chroma/v2"
+    "github.com/alecthomas/chroma/v2/lexers"
+    "github.com/alecthomas/chroma/v2/styles"
+    chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+)
+
+// highlighted code is marked up with classes, styled by
+// `cmd/static/highlight.css` (which is made from the same style)
+var highlighter = chromahtml.New(chromahtml.WithClasses(true))
+
+const highlightStyle = "github"
+
+type htmlRenderer struct {
+    *blackfriday.HTMLRenderer
+    options  Options
+    formulas *mathml.Formulas // may be nil
+}
+
+func newHTMLRenderer(options Options,
+    formulas *mathml.Formulas) *htmlRenderer {
+    return &htmlRenderer{
+        HTMLRenderer: blackfriday.NewHTMLRenderer(
+            blackfriday.HTMLRendererParameters{Flags: htmlFlags}),
+        options:  options,
+        formulas: formulas,
+    }
+}
+
+/**
+ * Give every heading an ID, and write the table of contents if there are
+ * enough headings
+ */
+func (r *htmlRenderer) RenderHeader(w io.Writer, ast *blackfriday.Node) {
+    headings := []*blackfriday.Node{}
+    ast.Walk(func(node *blackfriday.Node,
+        entering bool) blackfriday.WalkStatus {
+        if entering && node.Type == blackfriday.Heading &&
+            !node.IsTitleblock {
+            headings = append(headings, node)
+        }
+        return blackfriday.GoToNext
+    })
+
+    r.setHeadingIDs(headings)
+    if r.options.TableOfContents && len(headings) >= minTOCHeadings {
+        r.writeTOC(w, headings)
+    }
+}
+
+func (r *htmlRenderer) RenderNode(w io.Writer, node *blackfriday.Node,
+    entering bool) blackfriday.WalkStatus {
+    switch node.Type {
+    case blackfriday.Heading:
+        if !entering && r.options.HeadingAnchors && !node.IsTitleblock {
+            fmt.Fprintf(w, ` <a class="anchor" href="#%s">#</a>`,
+                html.EscapeString(node.HeadingID))
+        }
+    case blackfriday.Text:
+        if entering && r.options.TaskLists {
+            writeTaskCheckbox(w, node)
+        }
+    case blackfriday.CodeBlock:
+        if r.options.Highlight && highlight(w, node) {
+            return blackfriday.GoToNext
+        }
+    case blackfriday.Link, blackfriday.Image:
+        if entering {
+            linkAttachment(node)
+        }
+    }
+    return r.HTMLRenderer.RenderNode(w, node, entering)
+}
+
+/**
+ * Point a link or image to an attachment at where the attachment is downloaded
+ * from -- the sanitizer would drop the `attachment:` link as it is
+ */
+func linkAttachment(node *blackfriday.Node) {
+    id, ok := attachment.ParseLink(string(node.LinkData.Destination))
+    if ok {
+        node.LinkData.Destination = []byte(attachment.Path(id))
+    }
+}
+
+/**
+ * Give each heading without an ID (from `{#id}`) one made from its text, and
+ * make them all unique
+ */
+func (r *htmlRenderer) setHeadingIDs(headings []*blackfriday.Node) {
+    seen := map[string]bool{}
+    for _, heading := range headings {
+        id := heading.HeadingID
+        if id == "" {
+            id = slugify(r.headingText(heading))
+        }
+
+        unique := id
+        for n := 1; seen[unique]; n++ {
+            unique = fmt.Sprintf("%s-%d", id, n)
+        }
+        seen[unique] = true
+        heading.HeadingID = unique
+    }
+}
+
+/**
+ * Get the plain text of a heading, with any math in it as it was written
+ */
+func (r *htmlRenderer) headingText(heading *blackfriday.Node) []byte {
+    var text []byte
+    heading.Walk(func(node *blackfriday.Node,
+        entering bool) blackfriday.WalkStatus {
+        if entering && (node.Type == blackfriday.Text ||
+            node.Type == blackfriday.Code) {
+            text = append(text, node.Literal...)
+        }
+        return blackfriday.GoToNext
+    })
+
+    if r.formulas != nil {
+        text = r.formulas.Source(text)
+    }
+    return text
+}
+
+/**
+ * Make an ID from text: its letters and digits in lower case, with a dash for
+ * each run of anything else
+ */
+func slugify(text []byte) string {
+    var b strings.Builder
+    dash := false
+    for _, c := range strings.ToLower(string(text)) {
+        if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+            dash = true
+            continue
+        }
+        if dash && b.Len() > 0 {
+            b.WriteByte('-')
+        }
+        dash = false
+        b.WriteRune(c)
+    }
+
+    if b.Len() == 0 {
+        return "section"
+    }
+    return b.String()
+}
+
+/**
+ * Write a nested list linking to each heading
+ */
+func (r *htmlRenderer) writeTOC(w io.Writer, headings []*blackfriday.Node) {
+    top := headings[0].Level
+    for _, heading := range headings {
+        if heading.Level < top {
+            top = heading.Level
+        }
+    }
+
+    var b bytes.Buffer
+    b.WriteString("<nav class=\"toc\">\n")
+    level := top - 1
+    for _, heading := range headings {
+        if heading.Level > level {
+            for ; level < heading.Level; level++ {
+                b.WriteString("<ul>\n<li>")
+            }
+        } else {
+            for ; level > heading.Level; level-- {
+                b.WriteString("</li>\n</ul>")
+            }
+            b.WriteString("</li>\n<li>")
+        }
+
+        fmt.Fprintf(&b, `<a href="#%s">`, html.EscapeString(heading.HeadingID))
+        heading.Walk(func(node *blackfriday.Node,
+            entering bool) blackfriday.WalkStatus {
+            if node == heading {
+                return blackfriday.GoToNext
+            }
+            return r.HTMLRenderer.RenderNode(&b, node, entering)
+        })
+        b.WriteString("</a>")
+    }
+    for ; level >= top; level-- {
+        b.WriteString("</li>\n</ul>")
+    }
+    b.WriteString("\n</nav>\n\n")
+
+    w.Write(b.Bytes())
+}
+
+/**
+ * Write a checkbox for a list item starting with `[ ] ` or `[x] `, and take
+ * the marker off the item's text
+ */
+func writeTaskCheckbox(w io.Writer, text *blackfriday.Node) {
+    para := text.Parent
+    if para == nil || para.Type != blackfriday.Paragraph ||
+        para.FirstChild != text {
+        return
+    }
+    item := para.Parent
+    if item == nil || item.Type != blackfriday.Item ||
+        item.FirstChild != para {
+        return
+    }
+
+    marker := text.Literal
+    if len(marker) < 4 || marker[0] != '[' || marker[2] != ']' ||
+        marker[3] != ' ' {
+        return
+    }
+    switch marker[1] {
+    case ' ':
+        io.WriteString(w, `<input type="checkbox" disabled="" /> `)
+    case 'x', 'X':
+        io.WriteString(w,
+            `<input type="checkbox" checked="" disabled="" /> `)
+    default:
+        return
+    }
+    text.Literal = marker[4:]
+}
+
+/**
+ * Write a fenced code block highlighted for the language in its info string
+ *
+ * Returns false, having written nothing, if the language is unknown
+ */
+func highlight(w io.Writer, node *blackfriday.Node) bool {
+    info := strings.Fields(string(node.Info))
+    if len(info) == 0 {
+        return false
+    }
+    lexer := lexers.Get(info[0])
+    if lexer == nil {
+        return false
+    }
+
+    tokens, err := chroma.Coalesce(lexer).Tokenise(nil, string(node.Literal))
+    if err != nil {
+        return false
+    }
+    var b bytes.Buffer
+    err = highlighter.Format(&b, styles.Get(highlightStyle), tokens)
+    if err != nil {
+        return false
+    }
+
+    w.Write(b.Bytes())
+    if node.Parent.Type != blackfriday.Item {
+        io.WriteString(w, "\n")
+    }
+    return true
+}
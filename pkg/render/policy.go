@@ -0,0 +1,37 @@
+package render
+
+/**
+ * This file holds the sanitizer policy: bluemonday's policy for user content,
+ * along with what the renderer's features produce
+ */
+
+import (
+    "regexp"
+
+    "github.com/microcosm-cc/bluemonday"
+)
+
+// classes set by the renderer: highlighting, footnotes, anchors and the table
+// of contents
+var classNames = regexp.MustCompile(`^[a-zA-Z0-9_ -]+$`)
+
+func newPolicy() *bluemonday.Policy {
+    p := bluemonday.UGCPolicy()
+
+    p.AllowAttrs("class").Matching(classNames).OnElements("pre", "code",
+        "span", "sup", "div", "a", "li", "nav")
+
+    // task lists
+    p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).
+        OnElements("input")
+    p.AllowAttrs("checked", "disabled").OnElements("input")
+
+    // the table of contents
+    p.AllowElements("nav")
+
+    // table cell alignment
+    p.AllowAttrs("align").Matching(regexp.MustCompile(`^(left|center|right)$`)).
+        OnElements("th", "td")
+
+    return p
+}
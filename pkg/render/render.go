@@ -0,0 +1,110 @@
+package render
+
+/**
+ * Package render turns page bodies written in Markdown into sanitized HTML. A
+ * Renderer is a pipeline:
+ *
+ *     normalize line endings -> take out math -> Markdown -> sanitize ->
+ *         put math back as MathML
+ *
+ * The Markdown is rendered by blackfriday with GitHub-flavoured extensions
+ * (tables, fenced code, strikethrough, autolinks and footnotes), along with
+ * the optional features in Options. The sanitizer policy allows exactly what
+ * those features produce on top of bluemonday's policy for user content.
+ *
+ * A Renderer holds no state between calls, so one can be shared by handlers,
+ * exports and tests alike.
+ */
+
+import (
+    "bytes"
+
+    "github.com/setonotes/pkg/mathml"
+
+    "github.com/blackfriday"
+    "github.com/microcosm-cc/bluemonday"
+)
+
+/**
+ * The Options of a Renderer
+ */
+type Options struct {
+    Math            bool // TeX math, rendered to MathML
+    TaskLists       bool // list items starting with [ ] or [x]
+    HeadingAnchors  bool // a link to each heading next to it
+    TableOfContents bool // for bodies with at least minTOCHeadings headings
+    Highlight       bool // syntax highlighting of fenced code with a language
+}
+
+// every option, as pages are shown
+var DefaultOptions = Options{
+    Math:            true,
+    TaskLists:       true,
+    HeadingAnchors:  true,
+    TableOfContents: true,
+    Highlight:       true,
+}
+
+// the fewest headings a body has for a table of contents to be worth it
+const minTOCHeadings = 3
+
+const extensions = blackfriday.CommonExtensions | blackfriday.Footnotes
+
+const htmlFlags = blackfriday.CommonHTMLFlags |
+    blackfriday.FootnoteReturnLinks
+
+type Renderer struct {
+    options Options
+    policy  *bluemonday.Policy
+}
+
+/**
+ * Creates a new renderer
+ */
+func New(options Options) *Renderer {
+    return &Renderer{
+        options: options,
+        policy:  newPolicy(),
+    }
+}
+
+/**
+ * Render a Markdown body to sanitized HTML
+ */
+func (r *Renderer) Render(body []byte) []byte {
+    body = NormalizeNewlines(body)
+
+    // take the math out so that neither Markdown nor the sanitizer mangles it
+    var formulas *mathml.Formulas
+    if r.options.Math {
+        body, formulas = mathml.Extract(body)
+    }
+
+    md := blackfriday.New(blackfriday.WithExtensions(extensions))
+    ast := md.Parse(body)
+
+    hr := newHTMLRenderer(r.options, formulas)
+    var unsafeHTML bytes.Buffer
+    hr.RenderHeader(&unsafeHTML, ast)
+    ast.Walk(func(node *blackfriday.Node,
+        entering bool) blackfriday.WalkStatus {
+        return hr.RenderNode(&unsafeHTML, node, entering)
+    })
+    hr.RenderFooter(&unsafeHTML, ast)
+
+    safeHTML := r.policy.SanitizeBytes(unsafeHTML.Bytes())
+
+    if formulas != nil {
+        safeHTML = formulas.Restore(safeHTML)
+    }
+    return safeHTML
+}
+
+/**
+ * Bring every line ending in a body to "\n" -- bodies from browser forms end
+ * their lines with "\r\n", and some old ones with a lone "\r"
+ */
+func NormalizeNewlines(body []byte) []byte {
+    body = bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+    return bytes.Replace(body, []byte("\r"), []byte("\n"), -1)
+}
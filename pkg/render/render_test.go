@@ -0,0 +1,201 @@
+package render
+
+import (
+    "strings"
+    "testing"
+)
+
+type renderCase struct {
+    name     string
+    body     string
+    contains []string
+    excludes []string
+}
+
+func checkRender(t *testing.T, r *Renderer, cases []renderCase) {
+    t.Helper()
+    for _, c := range cases {
+        out := string(r.Render([]byte(c.body)))
+        for _, s := range c.contains {
+            if !strings.Contains(out, s) {
+                t.Errorf("%s: output lacks %q:\n%s", c.name, s, out)
+            }
+        }
+        for _, s := range c.excludes {
+            if strings.Contains(out, s) {
+                t.Errorf("%s: output has %q:\n%s", c.name, s, out)
+            }
+        }
+    }
+}
+
+func TestHeadingsAndTableOfContents(t *testing.T) {
+    checkRender(t, New(DefaultOptions), []renderCase{
+        {
+            name: "table of contents",
+            body: "# Intro\n\n## Setup\n\n### Details\n\n## Setup\n",
+            contains: []string{
+                "<nav class=\"toc\">\n<ul>\n<li><a href=\"#intro\"",
+                "<li><a href=\"#details\" rel=\"nofollow\">Details</a></li>",
+                "</ul></li>\n<li><a href=\"#setup-1\"",
+                "</ul></li>\n</ul>\n</nav>",
+            },
+        },
+        {
+            name: "heading IDs and anchors",
+            body: "# Intro\n\n## Set up: *now*!\n\n## Set up: *now*!\n\n" +
+                "# Custom {#my-id}\n\n# ???\n",
+            contains: []string{
+                `<h1 id="intro">Intro <a class="anchor" href="#intro"`,
+                `<h2 id="set-up-now">`,
+                `<h2 id="set-up-now-1">`,
+                `<h1 id="my-id">Custom <a class="anchor" href="#my-id"`,
+                `<h1 id="section">`,
+            },
+        },
+        {
+            name: "math and code in headings",
+            body: "# `code` and $x^2$\n\n## Two\n\n## Three\n",
+            contains: []string{
+                `<h1 id="code-and-x-2"><code>code</code> and <math`,
+                `<a href="#code-and-x-2" rel="nofollow"><code>code</code>` +
+                    ` and <math`,
+            },
+        },
+        {
+            name:     "no table of contents for a few headings",
+            body:     "# One\n\n# Two\n",
+            contains: []string{`<h1 id="two">`},
+            excludes: []string{"<nav"},
+        },
+        {
+            name:     "no anchors outside headings",
+            body:     "text with # in it",
+            excludes: []string{"anchor"},
+        },
+    })
+}
+
+func TestTaskLists(t *testing.T) {
+    checkRender(t, New(DefaultOptions), []renderCase{
+        {
+            name: "task list",
+            body: "- [ ] todo\n- [x] done\n- [X] DONE\n",
+            contains: []string{
+                `<li><input type="checkbox" disabled=""/> todo</li>`,
+                `<li><input type="checkbox" checked="" disabled=""/> ` +
+                    `done</li>`,
+                `<li><input type="checkbox" checked="" disabled=""/> ` +
+                    `DONE</li>`,
+            },
+        },
+        {
+            name: "not task items",
+            body: "- [y] not\n- plain [ ] no\n- []\n\n[ ] paragraph\n",
+            contains: []string{
+                "<li>[y] not</li>",
+                "<li>plain [ ] no</li>",
+                "<p>[ ] paragraph</p>",
+            },
+            excludes: []string{"<input"},
+        },
+    })
+}
+
+func TestHighlighting(t *testing.T) {
+    checkRender(t, New(DefaultOptions), []renderCase{
+        {
+            name: "known language",
+            body: "```go\nfunc main() {}\n```\n",
+            contains: []string{
+                `<pre class="chroma"><code>`,
+                `<span class="kd">func</span>`,
+                `<span class="nf">main</span>`,
+            },
+        },
+        {
+            name: "unknown language",
+            body: "```nosuchlang\n<b>x</b>\n```\n",
+            contains: []string{
+                `<pre><code class="language-nosuchlang">` +
+                    "&lt;b&gt;x&lt;/b&gt;\n</code></pre>",
+            },
+            excludes: []string{"chroma"},
+        },
+        {
+            name: "markup in highlighted code",
+            body: "```html\n<script>alert(1)</script>\n```\n",
+            contains: []string{"&lt;", "script"},
+            excludes: []string{"<script>"},
+        },
+    })
+}
+
+func TestSanitization(t *testing.T) {
+    checkRender(t, New(DefaultOptions), []renderCase{
+        {
+            name: "scripts and handlers",
+            body: "<script>alert(1)</script>\n\n" +
+                "<a href=\"javascript:alert(1)\" onclick=\"x()\">a</a> " +
+                "<img src=\"x.png\" onerror=\"alert(1)\">\n",
+            contains: []string{`<img src="x.png">`},
+            excludes: []string{"<script", "javascript:", "onclick",
+                "onerror", "alert"},
+        },
+        {
+            name:     "only checkboxes",
+            body:     "<input type=\"text\" value=\"x\"> <input checked>\n",
+            excludes: []string{`type="text"`, "value="},
+        },
+        {
+            name: "attributes the renderer does not set",
+            body: "<nav class=\"a\" style=\"color: red\">n</nav> " +
+                "<span class=\"a&quot;b\">s</span>\n",
+            contains: []string{`<nav class="a">n</nav>`},
+            excludes: []string{"style=", "class=\"a&"},
+        },
+        {
+            name: "attachment links",
+            body: "[file](attachment:12) ![img](attachment:3) " +
+                "[bad](attachment:x)\n",
+            contains: []string{
+                `<a href="/attachment/12" rel="nofollow">file</a>`,
+                `<img src="/attachment/3" alt="img"/>`,
+            },
+            excludes: []string{"attachment:"},
+        },
+        {
+            name: "math is put back after sanitizing",
+            body: "$<script>$ and `$x$`\n",
+            contains: []string{
+                "<mo>&lt;</mo><mi>s</mi>",
+                "<code>$x$</code>",
+            },
+            excludes: []string{"<script>"},
+        },
+    })
+}
+
+func TestOptionsOff(t *testing.T) {
+    checkRender(t, New(Options{}), []renderCase{
+        {
+            name: "every feature off",
+            body: "# A\n\n# B\n\n# C\n\n- [ ] t\n\n```go\nx\n```\n\n$x$\n",
+            contains: []string{
+                `<h1 id="a">A</h1>`,
+                "<li>[ ] t</li>",
+                `<pre><code class="language-go">x`,
+                "<p>$x$</p>",
+            },
+            excludes: []string{"<nav", "anchor", "<input", "chroma",
+                "<math"},
+        },
+    })
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+    got := string(NormalizeNewlines([]byte("a\r\nb\rc\n\r\nd")))
+    if got != "a\nb\nc\n\nd" {
+        t.Errorf("normalized to %q", got)
+    }
+}
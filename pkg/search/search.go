@@ -0,0 +1,185 @@
+package search
+
+/**
+ * This package holds the parts of full-text search that do not touch
+ * encryption or storage: splitting text into words, weighing the words of a
+ * page for the index and cutting a snippet around the words searched for.
+ *
+ * The index itself never holds a word, only a blind token for it (see
+ * `pkg/encryption/search.go`), so searching is limited to whole words.
+ */
+
+import (
+    "strings"
+    "unicode"
+)
+
+// words longer than this are left out of the index
+const maxWordLength = 64
+
+// how much more a word in the title counts than a word in the body
+const titleWeight = 5
+
+// the number of words shown before and after the first match in a snippet
+const (
+    snippetBefore = 8
+    snippetAfter  = 24
+)
+
+/**
+ * A Hit is a page matching every word of a query, along with its score
+ */
+type Hit struct {
+    PageID int
+    Score  int
+}
+
+/**
+ * A Fragment is a piece of a snippet, which is highlighted if it is one of the
+ * words searched for
+ */
+type Fragment struct {
+    Text  string
+    Match bool
+}
+
+/**
+ * A Result is a page found by a search, with its decrypted title and a snippet
+ * of its body
+ */
+type Result struct {
+    ID      int
+    Title   []byte
+    Score   int
+    Snippet []Fragment
+}
+
+type span struct {
+    start, end int // rune offsets
+    word       string
+}
+
+/**
+ * Find the words in a text -- a word is a run of letters and digits, and is
+ * lower-cased
+ */
+func spans(text []rune) []span {
+    found := []span{}
+    start := -1
+    for i := 0; i <= len(text); i++ {
+        inWord := i < len(text) &&
+            (unicode.IsLetter(text[i]) || unicode.IsDigit(text[i]))
+        if inWord && start < 0 {
+            start = i
+        } else if !inWord && start >= 0 {
+            word := strings.ToLower(string(text[start:i]))
+            found = append(found, span{start, i, word})
+            start = -1
+        }
+    }
+    return found
+}
+
+/**
+ * Split a text into lower-cased words, leaving out words too long to index
+ */
+func Words(text string) []string {
+    words := []string{}
+    for _, sp := range spans([]rune(text)) {
+        if sp.end-sp.start <= maxWordLength {
+            words = append(words, sp.word)
+        }
+    }
+    return words
+}
+
+/**
+ * Split a query into the distinct words to search for
+ */
+func QueryWords(query string) []string {
+    seen := map[string]bool{}
+    words := []string{}
+    for _, word := range Words(query) {
+        if !seen[word] {
+            seen[word] = true
+            words = append(words, word)
+        }
+    }
+    return words
+}
+
+/**
+ * Weigh every distinct word of a page for the index: each time a word appears
+ * in the body counts once, and each time it appears in the title counts
+ * titleWeight times
+ */
+func Weigh(title, body string) map[string]int {
+    weights := map[string]int{}
+    for _, word := range Words(title) {
+        weights[word] += titleWeight
+    }
+    for _, word := range Words(body) {
+        weights[word]++
+    }
+    return weights
+}
+
+/**
+ * Cut a snippet of text around the first of the given words, with each of
+ * the words highlighted -- the start of the text is used if none appear
+ */
+func Snippet(text string, words []string) []Fragment {
+    runes := []rune(text)
+    found := spans(runes)
+    if len(found) == 0 {
+        return []Fragment{}
+    }
+
+    wanted := map[string]bool{}
+    for _, word := range words {
+        wanted[word] = true
+    }
+
+    first := 0
+    for i, sp := range found {
+        if wanted[sp.word] {
+            first = i
+            break
+        }
+    }
+
+    from := first - snippetBefore
+    if from < 0 {
+        from = 0
+    }
+    to := first + snippetAfter
+    if to > len(found)-1 {
+        to = len(found) - 1
+    }
+
+    // runs of text that are not highlighted are joined into one fragment
+    fragments := []Fragment{}
+    add := func(text string, match bool) {
+        last := len(fragments) - 1
+        if !match && last >= 0 && !fragments[last].Match {
+            fragments[last].Text += text
+            return
+        }
+        fragments = append(fragments, Fragment{text, match})
+    }
+
+    if from > 0 {
+        add("… ", false)
+    }
+    pos := found[from].start
+    for _, sp := range found[from : to+1] {
+        add(string(runes[pos:sp.start]), false)
+        add(string(runes[sp.start:sp.end]), wanted[sp.word])
+        pos = sp.end
+    }
+    if to < len(found)-1 {
+        add(" …", false)
+    }
+
+    return fragments
+}
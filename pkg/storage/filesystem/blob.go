@@ -0,0 +1,136 @@
+package filesystem
+
+/**
+ * This package implements a blob store (see `pkg/attachment`) in a directory
+ * on the local filesystem. Each blob is a file named by its key, kept in a
+ * subdirectory named by the key's first two characters so that no directory
+ * grows too large. Blobs are written to a temporary file first and only appear
+ * under their key once complete.
+ */
+
+import (
+    "io"
+    "os"
+    "log"
+    "errors"
+    "io/ioutil"
+    "path/filepath"
+
+    "github.com/setonotes/pkg/attachment"
+)
+
+var ErrInvalidKey = errors.New("invalid blob key")
+
+type BlobStore struct {
+    dir string
+}
+
+/**
+ * Create a blob store in a directory, which is created if it does not exist
+ */
+func New(dir string) (*BlobStore, error) {
+    log.Printf("creating new filesystem blob store in <%s>...", dir)
+    if dir == "" {
+        return nil, errors.New("no directory for blob store")
+    }
+    err := os.MkdirAll(dir, 0700)
+    if err != nil {
+        log.Printf("failed to create blob directory <%s>", dir)
+        return nil, err
+    }
+    return &BlobStore{dir: dir}, nil
+}
+
+/**
+ * The path of a blob -- keys are made of letters, digits and dashes only, so
+ * that a key can never name a file outside the store
+ */
+func (s *BlobStore) path(key string) (string, error) {
+    if len(key) < 3 {
+        return "", ErrInvalidKey
+    }
+    for _, c := range key {
+        if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+            c >= '0' && c <= '9' || c == '-') {
+
+            return "", ErrInvalidKey
+        }
+    }
+    return filepath.Join(s.dir, key[:2], key), nil
+}
+
+/**
+ * Write a blob from r
+ */
+func (s *BlobStore) Put(key string, r io.Reader) (int64, error) {
+    path, err := s.path(key)
+    if err != nil {
+        return 0, err
+    }
+    err = os.MkdirAll(filepath.Dir(path), 0700)
+    if err != nil {
+        log.Printf("failed to create directory for blob <%s>", key)
+        return 0, err
+    }
+
+    tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+    if err != nil {
+        log.Printf("failed to create temporary file for blob <%s>", key)
+        return 0, err
+    }
+    defer os.Remove(tmp.Name())
+
+    n, err := io.Copy(tmp, r)
+    if err == nil {
+        err = tmp.Sync()
+    }
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        log.Printf("failed to write blob <%s>: %v", key, err)
+        return 0, err
+    }
+
+    // a link cannot replace an existing blob, unlike a rename
+    err = os.Link(tmp.Name(), path)
+    if os.IsExist(err) {
+        return 0, attachment.ErrBlobExists
+    } else if err != nil {
+        log.Printf("failed to store blob <%s>", key)
+        return 0, err
+    }
+    return n, nil
+}
+
+/**
+ * Open a blob for reading
+ */
+func (s *BlobStore) Get(key string) (io.ReadCloser, error) {
+    path, err := s.path(key)
+    if err != nil {
+        return nil, err
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        log.Printf("failed to open blob <%s>", key)
+        return nil, err
+    }
+    return f, nil
+}
+
+/**
+ * Delete a blob
+ */
+func (s *BlobStore) Delete(key string) error {
+    path, err := s.path(key)
+    if err != nil {
+        return err
+    }
+    err = os.Remove(path)
+    if err != nil && !os.IsNotExist(err) {
+        log.Printf("failed to delete blob <%s>", key)
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,101 @@
+package filesystem
+
+import (
+    "os"
+    "strings"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+
+    "github.com/setonotes/pkg/attachment"
+)
+
+func newTestStore(t *testing.T) (*BlobStore, string) {
+    dir, err := ioutil.TempDir("", "setonotes-blobs-")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s, err := New(filepath.Join(dir, "blobs"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return s, dir
+}
+
+func TestBlobStoreRoundTrip(t *testing.T) {
+    s, dir := newTestStore(t)
+    defer os.RemoveAll(dir)
+
+    n, err := s.Put("abc-123", strings.NewReader("contents"))
+    if err != nil || n != 8 {
+        t.Fatalf("put %v bytes: %v", n, err)
+    }
+    _, err = s.Put("abc-123", strings.NewReader("other contents"))
+    if err != attachment.ErrBlobExists {
+        t.Errorf("putting an existing blob gave %v", err)
+    }
+
+    r, err := s.Get("abc-123")
+    if err != nil {
+        t.Fatal(err)
+    }
+    got, err := ioutil.ReadAll(r)
+    r.Close()
+    if err != nil || string(got) != "contents" {
+        t.Errorf("got %q: %v", got, err)
+    }
+
+    err = s.Delete("abc-123")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := s.Get("abc-123"); !os.IsNotExist(err) {
+        t.Errorf("getting a deleted blob gave %v", err)
+    }
+    if err := s.Delete("abc-123"); err != nil {
+        t.Errorf("deleting a deleted blob gave %v", err)
+    }
+}
+
+func TestBlobStoreRejectsInvalidKeys(t *testing.T) {
+    s, dir := newTestStore(t)
+    defer os.RemoveAll(dir)
+
+    // a file beside the store that no key should reach
+    outside := filepath.Join(dir, "x")
+    err := ioutil.WriteFile(outside, []byte("secret"), 0600)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, key := range []string{
+        "",
+        "ab",
+        "../x",
+        "../../x",
+        "ab/../../x",
+        "..",
+        "...",
+        "/etc/passwd",
+        "ab\\..\\x",
+        "abc.tmp",
+        ".tmp-abc",
+        "abc def",
+        "abc\x00",
+        "abé",
+    } {
+        if _, err := s.Put(key, strings.NewReader("x")); err != ErrInvalidKey {
+            t.Errorf("putting %q gave %v", key, err)
+        }
+        if _, err := s.Get(key); err != ErrInvalidKey {
+            t.Errorf("getting %q gave %v", key, err)
+        }
+        if err := s.Delete(key); err != ErrInvalidKey {
+            t.Errorf("deleting %q gave %v", key, err)
+        }
+    }
+
+    if _, err := os.Stat(outside); err != nil {
+        t.Errorf("file outside the store is gone: %v", err)
+    }
+}
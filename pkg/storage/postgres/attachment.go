@@ -0,0 +1,133 @@
+package postgres
+
+/**
+ * This file contains attachment-related repository functions. The contents of
+ * attachments are kept in a blob store (see `blob.go`); these rows only hold
+ * their encrypted names and types and the keys of their blobs.
+ */
+
+import (
+    "log"
+    "database/sql"
+
+    "github.com/setonotes/pkg/attachment"
+)
+
+/**
+ * Given an attachment ID, return the attachment
+ */
+func (r *Repository) GetAttachmentByID(id int) (*attachment.Attachment,
+    error) {
+
+    a := &attachment.Attachment{ID: id}
+    err := r.DB.QueryRow(`
+        SELECT page_id, uploader_id, name, mime_type, size, blob_key,
+            created_at
+        FROM attachments
+        WHERE id=$1`, id).Scan(&a.PageID, &a.UploaderID, &a.Name,
+        &a.MIMEType, &a.Size, &a.BlobKey, &a.CreatedAt)
+    if err != nil {
+        log.Printf("failed to get attachment-%v from DB", id)
+        return nil, err
+    }
+    return a, nil
+}
+
+/**
+ * Get every attachment of a page, in the order they were added
+ */
+func (r *Repository) GetPageAttachments(pageID int) ([]*attachment.Attachment,
+    error) {
+
+    rows, err := r.DB.Query(`
+        SELECT id, uploader_id, name, mime_type, size, blob_key, created_at
+        FROM attachments
+        WHERE page_id=$1
+        ORDER BY id`, pageID)
+    if err != nil {
+        log.Printf("failed to get attachments of page-%v from DB", pageID)
+        return nil, err
+    }
+    defer rows.Close()
+
+    attachments := []*attachment.Attachment{}
+    for rows.Next() {
+        a := &attachment.Attachment{PageID: pageID}
+        err = rows.Scan(&a.ID, &a.UploaderID, &a.Name, &a.MIMEType, &a.Size,
+            &a.BlobKey, &a.CreatedAt)
+        if err != nil {
+            log.Println("failed to get attachment from row")
+            return nil, err
+        }
+        attachments = append(attachments, a)
+    }
+
+    // get any errors encountered during iteration
+    err = rows.Err()
+    if err != nil {
+        log.Println("error iterating over rows in database")
+        return nil, err
+    }
+
+    return attachments, nil
+}
+
+/**
+ * Store a new attachment whose blob has been written, returning its ID
+ */
+func (r *Repository) CreateAttachment(a *attachment.Attachment) (int, error) {
+    log.Println("creating row in `attachments` table...")
+    id := 0
+    err := r.DB.QueryRow(`
+        INSERT INTO attachments (page_id, uploader_id, name, mime_type, size,
+            blob_key)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id`, a.PageID, a.UploaderID, a.Name, a.MIMEType, a.Size,
+        a.BlobKey).Scan(&id)
+    if err != nil {
+        log.Println("failed to store attachment")
+        return 0, err
+    }
+    return id, nil
+}
+
+/**
+ * Delete an attachment's row -- its blob is deleted by the caller
+ */
+func (r *Repository) DeleteAttachment(id int) error {
+    log.Printf("deleting attachment-%v row from attachments table...", id)
+    _, err := r.DB.Exec(`
+        DELETE FROM attachments
+        WHERE id=$1`, id)
+    if err != nil {
+        log.Printf("failed to delete attachment-%v from database", id)
+        return err
+    }
+    return nil
+}
+
+/**
+ * Lock the attachment rows of a page within a transaction, returning their IDs
+ */
+func lockPageAttachments(tx *sql.Tx, pageID int) (map[int]bool, error) {
+    rows, err := tx.Query(`
+        SELECT id FROM attachments
+        WHERE page_id=$1
+        FOR UPDATE`, pageID)
+    if err != nil {
+        log.Printf("failed to lock attachments of page-%v", pageID)
+        return nil, err
+    }
+    defer rows.Close()
+
+    ids := map[int]bool{}
+    for rows.Next() {
+        var id int
+        err = rows.Scan(&id)
+        if err != nil {
+            return nil, err
+        }
+        ids[id] = true
+    }
+    return ids, rows.Err()
+}
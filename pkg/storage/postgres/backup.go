@@ -0,0 +1,240 @@
+package postgres
+
+/**
+ * This file contains the repository functions for backups (see `pkg/backup`).
+ * Tables are dumped and loaded whole, column by column as they are in the
+ * database, so nothing here needs to know what the columns hold.
+ */
+
+import (
+    "io"
+    "log"
+    "strings"
+    "strconv"
+    "database/sql"
+
+    "github.com/lib/pq"
+
+    "github.com/setonotes/pkg/backup"
+)
+
+// columns referring to rows of their own table, which are loaded once every
+// row is in place
+var selfReferences = map[string]string{
+    "notebooks": "parent_id",
+}
+
+/**
+ * Get the version of the database schema, as set by the latest migration
+ */
+func (r *Repository) GetSchemaVersion() (int, error) {
+    version := 0
+    err := r.DB.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+    if err != nil {
+        log.Println("failed to get schema version from DB")
+        return 0, err
+    }
+    return version, nil
+}
+
+/**
+ * Dump every row of some tables, all from one snapshot of the database, to the
+ * writer dump() returns for each
+ */
+func (r *Repository) DumpTables(tables []string, dump func(name string,
+    columns []backup.Column) (backup.TableWriter, error)) error {
+
+    tx, err := r.DB.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    // read-only and done, so there is never anything to commit
+    defer tx.Rollback()
+    _, err = tx.Exec(`
+        SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY`)
+    if err != nil {
+        log.Println("failed to set transaction isolation level")
+        return err
+    }
+
+    for _, table := range tables {
+        err = dumpTable(tx, table, dump)
+        if err != nil {
+            log.Printf("failed to dump table <%s> from DB", table)
+            return err
+        }
+    }
+    return nil
+}
+
+func dumpTable(tx *sql.Tx, table string, dump func(name string,
+    columns []backup.Column) (backup.TableWriter, error)) error {
+
+    rows, err := tx.Query(`SELECT * FROM ` + pq.QuoteIdentifier(table))
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    types, err := rows.ColumnTypes()
+    if err != nil {
+        return err
+    }
+    columns := []backup.Column{}
+    for _, t := range types {
+        columns = append(columns, backup.Column{
+            Name: t.Name(),
+            Type: t.DatabaseTypeName(),
+        })
+    }
+    w, err := dump(table, columns)
+    if err != nil {
+        return err
+    }
+
+    for rows.Next() {
+        values := make([]interface{}, len(columns))
+        pointers := make([]interface{}, len(columns))
+        for i := range values {
+            pointers[i] = &values[i]
+        }
+        err = rows.Scan(pointers...)
+        if err != nil {
+            log.Println("failed to scan row")
+            return err
+        }
+        err = w.WriteRow(values)
+        if err != nil {
+            return err
+        }
+    }
+    return rows.Err()
+}
+
+/**
+ * Check that none of some tables have any rows
+ */
+func (r *Repository) CheckTablesEmpty(tables []string) (bool, error) {
+    for _, table := range tables {
+        exists := false
+        err := r.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM ` +
+            pq.QuoteIdentifier(table) + `)`).Scan(&exists)
+        if err != nil {
+            log.Printf("failed to check table <%s> in DB", table)
+            return false, err
+        }
+        if exists {
+            log.Printf("table <%s> is not empty", table)
+            return false, nil
+        }
+    }
+    return true, nil
+}
+
+/**
+ * Load the rows read from the reader load() returns for each of some tables,
+ * all in one transaction, then move each table's ID sequence past its rows
+ */
+func (r *Repository) LoadTables(tables []string, load func(name string) (
+    backup.TableReader, error)) (err error) {
+
+    tx, err := r.DB.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    for _, table := range tables {
+        var rows backup.TableReader
+        rows, err = load(table)
+        if err != nil {
+            return err
+        }
+        err = loadTable(tx, table, rows)
+        if err != nil {
+            log.Printf("failed to load table <%s> into DB", table)
+            return err
+        }
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return err
+    }
+    return nil
+}
+
+func loadTable(tx *sql.Tx, table string, rows backup.TableReader) error {
+    columns := rows.Columns()
+    names := []string{}
+    params := []string{}
+    selfReference, id := -1, -1
+    for i, column := range columns {
+        names = append(names, pq.QuoteIdentifier(column.Name))
+        params = append(params, "$"+strconv.Itoa(i+1))
+        if column.Name == selfReferences[table] {
+            selfReference = i
+        }
+        if column.Name == "id" {
+            id = i
+        }
+    }
+
+    stmt, err := tx.Prepare(`
+        INSERT INTO ` + pq.QuoteIdentifier(table) + ` (` +
+        strings.Join(names, ", ") + `)
+        VALUES (` + strings.Join(params, ", ") + `)`)
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+
+    // rows referring to their own table are inserted without the reference,
+    // which is set once the row it refers to is sure to exist
+    references := [][2]interface{}{}
+    for {
+        values, err := rows.ReadRow()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return err
+        }
+        if selfReference >= 0 && id >= 0 && values[selfReference] != nil {
+            references = append(references,
+                [2]interface{}{values[id], values[selfReference]})
+            values[selfReference] = nil
+        }
+        _, err = stmt.Exec(values...)
+        if err != nil {
+            return err
+        }
+    }
+    for _, ref := range references {
+        _, err = tx.Exec(`
+            UPDATE `+pq.QuoteIdentifier(table)+`
+            SET `+pq.QuoteIdentifier(selfReferences[table])+`=$2
+            WHERE id=$1`, ref[0], ref[1])
+        if err != nil {
+            return err
+        }
+    }
+
+    // new rows must not be given IDs the restored ones already have
+    if id >= 0 {
+        _, err = tx.Exec(`
+            SELECT setval(pg_get_serial_sequence($1, 'id'), MAX(id))
+            FROM `+pq.QuoteIdentifier(table), table)
+        if err != nil {
+            log.Printf("failed to reset ID sequence of table <%s>", table)
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,225 @@
+package postgres
+
+/**
+ * This file implements a blob store (see `pkg/attachment`) with Postgres large
+ * objects, so that attachments can be kept in the database along with
+ * everything else. The `blobs` table maps each key to its large object, which
+ * is written and read through the server-side large object functions in
+ * chunks, inside a transaction as large object descriptors require.
+ */
+
+import (
+    "io"
+    "log"
+    "database/sql"
+
+    "github.com/lib/pq"
+
+    "github.com/setonotes/pkg/attachment"
+)
+
+const (
+    loInvWrite  = 0x20000
+    loInvRead   = 0x40000
+    loChunkSize = 64 << 10
+)
+
+type BlobStore struct {
+    db *sql.DB
+}
+
+/**
+ * Create a blob store in the repository's database
+ */
+func NewBlobStore(r *Repository) *BlobStore {
+    log.Println("creating new Postgres blob store...")
+    return &BlobStore{db: r.DB}
+}
+
+/**
+ * Write a blob from r into a new large object
+ */
+func (s *BlobStore) Put(key string, r io.Reader) (n int64, err error) {
+    log.Printf("writing blob <%s> to large object...", key)
+    tx, err := s.db.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return 0, err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    var oid uint32
+    err = tx.QueryRow(`SELECT lo_create(0)`).Scan(&oid)
+    if err != nil {
+        log.Println("failed to create large object")
+        return 0, err
+    }
+    var fd int
+    err = tx.QueryRow(`SELECT lo_open($1, $2)`, oid, loInvWrite).Scan(&fd)
+    if err != nil {
+        log.Printf("failed to open large object %v", oid)
+        return 0, err
+    }
+
+    buf := make([]byte, loChunkSize)
+    for {
+        read, readErr := io.ReadFull(r, buf)
+        if read > 0 {
+            _, err = tx.Exec(`SELECT lowrite($1, $2)`, fd, buf[:read])
+            if err != nil {
+                log.Printf("failed to write to large object %v", oid)
+                return 0, err
+            }
+            n += int64(read)
+        }
+        if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+            break
+        } else if readErr != nil {
+            err = readErr
+            log.Printf("failed to read blob <%s>: %v", key, err)
+            return 0, err
+        }
+    }
+
+    _, err = tx.Exec(`SELECT lo_close($1)`, fd)
+    if err != nil {
+        log.Printf("failed to close large object %v", oid)
+        return 0, err
+    }
+    _, err = tx.Exec(`
+        INSERT INTO blobs (key, object)
+        VALUES ($1, $2)`, key, oid)
+    if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+        err = attachment.ErrBlobExists
+        return 0, err
+    } else if err != nil {
+        log.Printf("failed to store blob <%s>", key)
+        return 0, err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return 0, err
+    }
+    log.Printf("successfully wrote blob <%s> to large object %v", key, oid)
+    return n, nil
+}
+
+/**
+ * Reads a large object a chunk at a time, holding the transaction it was
+ * opened in until it is closed
+ */
+type largeObjectReader struct {
+    tx   *sql.Tx
+    fd   int
+    buf  []byte
+    done bool
+}
+
+func (lo *largeObjectReader) Read(p []byte) (int, error) {
+    if len(lo.buf) == 0 {
+        if lo.done {
+            return 0, io.EOF
+        }
+        err := lo.tx.QueryRow(`SELECT loread($1, $2)`, lo.fd,
+            loChunkSize).Scan(&lo.buf)
+        if err != nil {
+            log.Println("failed to read from large object")
+            return 0, err
+        }
+        if len(lo.buf) < loChunkSize {
+            lo.done = true
+        }
+        if len(lo.buf) == 0 {
+            return 0, io.EOF
+        }
+    }
+
+    n := copy(p, lo.buf)
+    lo.buf = lo.buf[n:]
+    return n, nil
+}
+
+/**
+ * End the transaction -- nothing was written in it, so it is rolled back
+ */
+func (lo *largeObjectReader) Close() error {
+    return lo.tx.Rollback()
+}
+
+/**
+ * Open a blob's large object for reading
+ */
+func (s *BlobStore) Get(key string) (io.ReadCloser, error) {
+    tx, err := s.db.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return nil, err
+    }
+
+    var oid uint32
+    err = tx.QueryRow(`
+        SELECT object FROM blobs
+        WHERE key=$1`, key).Scan(&oid)
+    if err != nil {
+        log.Printf("failed to get blob <%s> from DB", key)
+        tx.Rollback()
+        return nil, err
+    }
+    var fd int
+    err = tx.QueryRow(`SELECT lo_open($1, $2)`, oid, loInvRead).Scan(&fd)
+    if err != nil {
+        log.Printf("failed to open large object %v", oid)
+        tx.Rollback()
+        return nil, err
+    }
+
+    return &largeObjectReader{tx: tx, fd: fd}, nil
+}
+
+/**
+ * Delete a blob and its large object
+ */
+func (s *BlobStore) Delete(key string) (err error) {
+    log.Printf("deleting blob <%s>...", key)
+    tx, err := s.db.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    var oid uint32
+    err = tx.QueryRow(`
+        DELETE FROM blobs
+        WHERE key=$1
+        RETURNING object`, key).Scan(&oid)
+    if err == sql.ErrNoRows {
+        err = tx.Rollback()
+        return err
+    } else if err != nil {
+        log.Printf("failed to delete blob <%s> from DB", key)
+        return err
+    }
+    _, err = tx.Exec(`SELECT lo_unlink($1)`, oid)
+    if err != nil {
+        log.Printf("failed to unlink large object %v", oid)
+        return err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,230 @@
+package postgres
+
+/**
+ * This file contains notebook-related repository functions. A notebook ID of
+ * 0 stands for the top level of a user's directory and is stored as NULL.
+ */
+
+import (
+    "log"
+    "database/sql"
+
+    "github.com/setonotes/pkg/notebook"
+)
+
+/**
+ * Convert a notebook ID to a value to store, with 0 stored as NULL
+ */
+func nullNotebookID(id int) interface{} {
+    if id == 0 {
+        return nil
+    }
+    return id
+}
+
+/**
+ * Given a notebook ID, return the notebook
+ */
+func (r *Repository) GetNotebookByID(id int) (*notebook.Notebook, error) {
+    var parentID sql.NullInt64
+    nb := &notebook.Notebook{ID: id}
+    err := r.DB.QueryRow(`
+        SELECT user_id, parent_id, name
+        FROM notebooks
+        WHERE id=$1`, id).Scan(&nb.OwnerID, &parentID, &nb.Name)
+    if err != nil {
+        log.Printf("failed to get notebook-%v from DB", id)
+        return nil, err
+    }
+    nb.ParentID = int(parentID.Int64)
+    return nb, nil
+}
+
+/**
+ * Get every notebook belonging to a user, ordered by ID
+ */
+func (r *Repository) GetUserNotebooks(
+    ownerID int) ([]*notebook.Notebook, error) {
+
+    rows, err := r.DB.Query(`
+        SELECT id, parent_id, name
+        FROM notebooks
+        WHERE user_id=$1
+        ORDER BY id`, ownerID)
+    if err != nil {
+        log.Printf("failed to get notebooks of user-%v from DB", ownerID)
+        return nil, err
+    }
+    defer rows.Close()
+
+    notebooks := []*notebook.Notebook{}
+    for rows.Next() {
+        var parentID sql.NullInt64
+        nb := &notebook.Notebook{OwnerID: ownerID}
+        err = rows.Scan(&nb.ID, &parentID, &nb.Name)
+        if err != nil {
+            log.Println("failed to get notebook from row")
+            return nil, err
+        }
+        nb.ParentID = int(parentID.Int64)
+        notebooks = append(notebooks, nb)
+    }
+
+    // get any errors encountered during iteration
+    err = rows.Err()
+    if err != nil {
+        log.Println("error iterating over rows in database")
+        return nil, err
+    }
+
+    return notebooks, nil
+}
+
+/**
+ * Create a notebook with an empty name, returning its ID -- like pages, the
+ * name is encrypted once the ID is known and stored with UpdateNotebook()
+ */
+func (r *Repository) CreateNotebook(ownerID, parentID int) (int, error) {
+    log.Println("creating row in `notebooks` table...")
+    id := 0
+    err := r.DB.QueryRow(`
+        INSERT INTO notebooks (user_id, parent_id, name)
+        VALUES ($1, $2, '')
+        RETURNING id`, ownerID, nullNotebookID(parentID)).Scan(&id)
+    if err != nil {
+        log.Println("failed to store notebook")
+        return 0, err
+    }
+    return id, nil
+}
+
+/**
+ * Store a notebook's Name and ParentID
+ */
+func (r *Repository) UpdateNotebook(nb *notebook.Notebook) error {
+    log.Printf("updating notebook-%v...", nb.ID)
+    _, err := r.DB.Exec(`
+        UPDATE notebooks
+        SET name=$1, parent_id=$2
+        WHERE id=$3`, nb.Name, nullNotebookID(nb.ParentID), nb.ID)
+    if err != nil {
+        log.Printf("failed to update notebook-%v", nb.ID)
+        return err
+    }
+    return nil
+}
+
+/**
+ * Delete a notebook in a single transaction -- the notebooks and pages it
+ * holds are moved up into its parent
+ */
+func (r *Repository) DeleteNotebook(id int) (err error) {
+    log.Printf("deleting notebook-%v...", id)
+    tx, err := r.DB.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    var parentID sql.NullInt64
+    err = tx.QueryRow(`
+        SELECT parent_id FROM notebooks
+        WHERE id=$1
+        FOR UPDATE`, id).Scan(&parentID)
+    if err != nil {
+        log.Printf("failed to lock notebook-%v", id)
+        return err
+    }
+
+    _, err = tx.Exec(`
+        UPDATE notebooks
+        SET parent_id=$1
+        WHERE parent_id=$2`, parentID, id)
+    if err != nil {
+        log.Printf("failed to move notebooks out of notebook-%v", id)
+        return err
+    }
+    _, err = tx.Exec(`
+        UPDATE page_permissions
+        SET notebook_id=$1
+        WHERE notebook_id=$2`, parentID, id)
+    if err != nil {
+        log.Printf("failed to move pages out of notebook-%v", id)
+        return err
+    }
+    _, err = tx.Exec(`
+        DELETE FROM notebooks
+        WHERE id=$1`, id)
+    if err != nil {
+        log.Printf("failed to delete notebook-%v row from database", id)
+        return err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return err
+    }
+    log.Printf("successfully deleted notebook-%v", id)
+    return nil
+}
+
+/**
+ * Put a page into one of a user's notebooks (0 for the top level) -- this
+ * only affects where the page is listed for that user
+ */
+func (r *Repository) SetPageNotebook(userID, pageID, notebookID int) error {
+    log.Printf("moving page-%v to notebook-%v for user-%v...", pageID,
+        notebookID, userID)
+    _, err := r.DB.Exec(`
+        UPDATE page_permissions
+        SET notebook_id=$1
+        WHERE user_id=$2 AND page_id=$3`,
+        nullNotebookID(notebookID), userID, pageID)
+    if err != nil {
+        log.Printf("failed to move page-%v for user-%v", pageID, userID)
+        return err
+    }
+    return nil
+}
+
+/**
+ * Get the notebook each of a user's pages is kept in, by page ID -- pages at
+ * the top level are left out
+ */
+func (r *Repository) GetUserPageNotebooks(userID int) (map[int]int, error) {
+    rows, err := r.DB.Query(`
+        SELECT page_id, notebook_id
+        FROM page_permissions
+        WHERE user_id=$1 AND notebook_id IS NOT NULL`, userID)
+    if err != nil {
+        log.Printf("failed to get page notebooks of user-%v", userID)
+        return nil, err
+    }
+    defer rows.Close()
+
+    notebooks := map[int]int{}
+    for rows.Next() {
+        var pageID, notebookID int
+        err = rows.Scan(&pageID, &notebookID)
+        if err != nil {
+            log.Println("failed to get page notebook from row")
+            return nil, err
+        }
+        notebooks[pageID] = notebookID
+    }
+
+    // get any errors encountered during iteration
+    err = rows.Err()
+    if err != nil {
+        log.Println("error iterating over rows in database")
+        return nil, err
+    }
+
+    return notebooks, nil
+}
@@ -6,9 +6,12 @@ package postgres
 
 import (
     "log"
+    "time"
+    "database/sql"
+    "encoding/json"
 
-    "github.com/setonotes/pkg/page"
-    "github.com/setonotes/pkg/user" // for current version number
+    "github.com/setonotes/pkg/page" // for current version number
+    "github.com/setonotes/pkg/user"
 )
 
 /**
@@ -20,14 +23,18 @@ func (r *Repository) GetPageByID(pageID int) (*page.Page, error) {
         body      []byte
         ownerID   int
         version   int
+        revision  int
+        client    bool
+        deletedAt *time.Time
     )
     psqlStmt := `
-        SELECT title, body, author_id, version
+        SELECT title, body, author_id, version, revision, client_encrypted,
+            deleted_at
         FROM pages
         WHERE id=$1`
     log.Printf("getting page-%v from DB...", pageID)
     err := r.DB.QueryRow(psqlStmt, pageID).Scan(&title, &body, &ownerID,
-        &version)
+        &version, &revision, &client, &deletedAt)
     if err != nil {
         log.Printf("failed to get page-%v from DB", pageID)
         return nil, err
@@ -40,6 +47,10 @@ func (r *Repository) GetPageByID(pageID int) (*page.Page, error) {
         Body:    body,
         OwnerID: ownerID,
         Version: version,
+
+        Revision:        revision,
+        DeletedAt:       deletedAt,
+        ClientEncrypted: client,
     }, nil
 }
 
@@ -71,12 +82,12 @@ func (r *Repository) CheckPageExists(pageID int) (bool, error) {
 func (r *Repository) CreatePage(p *page.Page, authorID int) (int, error) {
     log.Println("creating row in `pages` table...")
     psqlStmt := `
-        INSERT INTO pages (title, body, author_id, version)
-        VALUES ($1, $2, $3, $4)
+        INSERT INTO pages (title, body, author_id, version, client_encrypted)
+        VALUES ($1, $2, $3, $4, $5)
         RETURNING id`
     pageID := 0
     err := r.DB.QueryRow(psqlStmt, p.Title, p.Body, authorID,
-        user.CurrentVersion).Scan(&pageID)
+        page.CurrentVersion, p.ClientEncrypted).Scan(&pageID)
     if err != nil {
         log.Println("failed to store page")
         return 0, err
@@ -85,36 +96,202 @@ func (r *Repository) CreatePage(p *page.Page, authorID int) (int, error) {
 }
 
 /**
- * Update Title and Body of existing page
+ * Update Title and Body of existing page and keep the new state as the page's
+ * next revision, in a single transaction
+ *
+ * The page is only updated if p.Revision is still its latest revision;
+ * otherwise page.ErrEditConflict is returned. On success p.Revision is set to
+ * the new revision.
  */
-func (r *Repository) UpdatePage(p *page.Page) error {
+func (r *Repository) UpdatePage(p *page.Page, authorID int) (err error) {
     log.Printf("updating row for page-%v", p.ID)
-    psqlStmt := `
+    tx, err := r.DB.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    var revision int
+    err = tx.QueryRow(`
         UPDATE pages
-        SET title=$1, body=$2, version=$3
-        WHERE id=$4`
-    _, err := r.DB.Exec(psqlStmt, p.Title, p.Body, p.Version, p.ID)
+        SET title=$1, body=$2, version=$3, revision=revision+1
+        WHERE id=$4 AND revision=$5
+        RETURNING revision`,
+        p.Title, p.Body, p.Version, p.ID, p.Revision).Scan(&revision)
+    if err == sql.ErrNoRows {
+        log.Printf("page-%v changed since revision %v", p.ID, p.Revision)
+        err = page.ErrEditConflict
+        return err
+    }
+    if err != nil {
+        log.Printf("failed to updated row for page-%v", p.ID)
+        return err
+    }
+    p.Revision = revision
+
+    err = insertRevision(tx, p, authorID)
     if err != nil {
-        log.Println("failed to updated row for page-%v", p.ID)
         return err
     }
-    log.Println("successfully updated row for page-%v", p.ID)
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return err
+    }
+    log.Printf("successfully updated row for page-%v", p.ID)
     return nil
 }
 
+
 /**
- * Delete a page
+ * Get every version-1 page authored by a user
  */
-func (r *Repository) DeletePage(pageID int) error {
-    log.Printf("deleting page-%v row from pages table...", pageID)
+func (r *Repository) GetLegacyPages(userID int) ([]*page.Page, error) {
     psqlStmt := `
-        DELETE FROM pages
-        WHERE id=$1`
-    _, err := r.DB.Exec(psqlStmt, pageID)
+        SELECT id, title, body
+        FROM pages
+        WHERE author_id=$1 AND version=1`
+    rows, err := r.DB.Query(psqlStmt, userID)
+    if err != nil {
+        log.Printf("failed to get legacy pages for user-%v from DB", userID)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var pages = []*page.Page{}
+    for rows.Next() {
+        p := &page.Page{OwnerID: userID, Version: 1}
+        err = rows.Scan(&p.ID, &p.Title, &p.Body)
+        if err != nil {
+            log.Println("failed to get legacy page from row")
+            return nil, err
+        }
+        pages = append(pages, p)
+    }
+
+    // get any errors encountered during iteration
+    err = rows.Err()
+    if err != nil {
+        log.Println("error iterating over rows in database")
+        return nil, err
+    }
+
+    return pages, nil
+}
+
+/**
+ * Store a migrated version-1 user along with their re-encrypted pages and new
+ * page permissions in a single transaction
+ *
+ * The user row is locked and its version checked first, so if another sign-in
+ * has already migrated the user, nothing is written
+ */
+func (r *Repository) StoreLegacyMigration(u *user.User, pages []*page.Page,
+    userEncryptedPageKeys [][]byte) (err error) {
+
+    log.Printf("storing migration for user-%v...", u.ID)
+    tx, err := r.DB.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    // lock user row and check it still needs migrating
+    var version int
+    err = tx.QueryRow(`
+        SELECT version FROM users
+        WHERE id=$1
+        FOR UPDATE`, u.ID).Scan(&version)
+    if err != nil {
+        return err
+    }
+    if version != 1 {
+        log.Printf("user-%v already migrated", u.ID)
+        err = ErrUserChanged
+        return err
+    }
+
+    // store user keys
+    kdfParams, err := json.Marshal(u.KDF)
     if err != nil {
-        log.Printf("failed to delete page-%v row from database", pageID)
+        return err
     }
-    log.Printf("successfully deleted page-%v row from database", pageID)
+    _, err = tx.Exec(`
+        UPDATE users
+        SET salt=$1, main_key_encrypted=$2, private_key_encrypted=$3,
+            public_key=$4, recovery_salt=$5, main_key_recovery_encrypted=$6,
+            private_key_recovery_encrypted=$7, kdf_params=$8, version=$9
+        WHERE id=$10`,
+        u.Salt, u.MainKeyEncrypted, u.PrivateKeyEncrypted, u.PublicKey,
+        u.RecoverySalt, u.MainKeyRecoveryEncrypted,
+        u.PrivateKeyRecoveryEncrypted, kdfParams, u.Version, u.ID)
+    if err != nil {
+        log.Printf("failed to update user-%v", u.ID)
+        return err
+    }
+
+    // store pages and page permissions
+    for i, p := range pages {
+        err = tx.QueryRow(`
+            UPDATE pages
+            SET title=$1, body=$2, version=$3, revision=revision+1
+            WHERE id=$4 AND version=1
+            RETURNING revision`,
+            p.Title, p.Body, p.Version, p.ID).Scan(&p.Revision)
+        if err != nil {
+            log.Printf("failed to update page-%v", p.ID)
+            return err
+        }
+        err = insertRevision(tx, p, u.ID)
+        if err != nil {
+            return err
+        }
+
+        _, err = tx.Exec(`
+            DELETE FROM page_permissions
+            WHERE user_id=$1 AND page_id=$2`, u.ID, p.ID)
+        if err != nil {
+            return err
+        }
+        _, err = tx.Exec(`
+            INSERT INTO page_permissions (user_id, page_id, is_owner,
+                can_edit, user_encrypted_page_key)
+            VALUES ($1, $2, true, true, $3)`,
+            u.ID, p.ID, userEncryptedPageKeys[i])
+        if err != nil {
+            log.Printf("failed to create page-%v permission", p.ID)
+            return err
+        }
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return err
+    }
+    log.Printf("successfully stored migration for user-%v", u.ID)
+
     return nil
 }
 
+/**
+ * Get the IDs of every page authored by a user
+ */
+func (r *Repository) GetOwnedPageIDs(userID int) ([]int, error) {
+    return r.queryIDs(`
+        SELECT id FROM pages
+        WHERE author_id=$1
+        ORDER BY id`, userID)
+}
+
@@ -6,6 +6,15 @@ package postgres
 
 import (
     "log"
+    "bytes"
+    "errors"
+    "database/sql"
+
+    "github.com/setonotes/pkg/user"
+    "github.com/setonotes/pkg/page"
+    "github.com/setonotes/pkg/attachment"
+
+    "github.com/setonotes/pkg/permission"
 )
 
 /**
@@ -51,6 +60,386 @@ func (r *Repository) GetUserEncryptedPageKey(userID,
     return key, nil
 }
 
+/**
+ * Get the page permission row for a given userID, pageID
+ */
+func (r *Repository) GetPagePermission(userID,
+    pageID int) (*permission.Permission, error) {
+
+    psqlStmt := `
+        SELECT is_owner, can_edit, user_encrypted_page_key
+        FROM page_permissions
+        WHERE user_id=$1 AND page_id=$2`
+    var (
+        isOwner bool
+        canEdit bool
+        key     []byte
+    )
+    err := r.DB.QueryRow(psqlStmt, userID, pageID).Scan(&isOwner, &canEdit,
+        &key)
+    if err != nil {
+        log.Printf("failed to get user-%v's page-%v permission from DB: %v",
+            userID, pageID, err)
+        return nil, err
+    }
+
+    return &permission.Permission{
+        UserID:               userID,
+        PageID:               pageID,
+        IsOwner:              isOwner,
+        CanEdit:              canEdit,
+        UserEncryptedPageKey: key,
+    }, nil
+}
+
+/**
+ * Get every page permission row for a given pageID
+ */
+func (r *Repository) GetPagePermissions(
+    pageID int) ([]*permission.Permission, error) {
+
+    psqlStmt := `
+        SELECT user_id, is_owner, can_edit, user_encrypted_page_key
+        FROM page_permissions
+        WHERE page_id=$1`
+    rows, err := r.DB.Query(psqlStmt, pageID)
+    if err != nil {
+        log.Printf("failed to get page-%v permission rows from DB", pageID)
+        return nil, err
+    }
+    defer rows.Close()
+
+    // loop over rows and create array of permissions
+    var perms = []*permission.Permission{}
+    for rows.Next() {
+        perm := &permission.Permission{PageID: pageID}
+        err = rows.Scan(&perm.UserID, &perm.IsOwner, &perm.CanEdit,
+            &perm.UserEncryptedPageKey)
+        if err != nil {
+            log.Println("failed to get page permission from row")
+            return nil, err
+        }
+        perms = append(perms, perm)
+    }
+
+    // get any errors encountered during iteration
+    err = rows.Err()
+    if err != nil {
+        log.Println("error iterating over rows in database")
+        return nil, err
+    }
+
+    return perms, nil
+}
+
+var (
+    ErrPermissionsChanged = errors.New("page permissions changed during update")
+    ErrAttachmentsChanged = errors.New("page attachments changed during update")
+)
+
+/**
+ * Store a re-encrypted page, its re-encrypted revisions and attachments and
+ * its new page keys in a single transaction, deleting the permission row
+ * (along with the tags and search index) for revokedUserID (unless it is 0)
+ *
+ * The page row is locked first and must still be at p.Revision, with exactly
+ * the given revisions, or page.ErrEditConflict is returned -- so a save made
+ * while the page was being re-encrypted is neither overwritten nor left under
+ * the old key. The permission rows for the page are then locked and compared
+ * against the given permissions, so a page shared in the meantime (with the
+ * old key) fails the whole update rather than leaving a user with an unusable
+ * key -- and likewise the attachment rows, so an attachment added with the old
+ * key fails it too
+ */
+func (r *Repository) RotatePageKey(p *page.Page, revokedUserID int,
+    perms []*permission.Permission, revisions []*page.Revision,
+    attachments []*attachment.Attachment) (err error) {
+
+    log.Printf("rotating key for page-%v...", p.ID)
+    tx, err := r.DB.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    // lock the page row, so no save can commit until the rotation has, and
+    // check nothing was saved since the page and revisions were re-encrypted
+    err = lockPageRevisions(tx, p, revisions)
+    if err != nil {
+        return err
+    }
+
+    // lock permission rows and check they are the expected set
+    rows, err := tx.Query(`
+        SELECT user_id FROM page_permissions
+        WHERE page_id=$1
+        FOR UPDATE`, p.ID)
+    if err != nil {
+        return err
+    }
+    expected := map[int]bool{}
+    if revokedUserID != 0 {
+        expected[revokedUserID] = true
+    }
+    for _, perm := range perms {
+        expected[perm.UserID] = true
+    }
+    found := 0
+    for rows.Next() {
+        var userID int
+        if err = rows.Scan(&userID); err != nil {
+            rows.Close()
+            return err
+        }
+        if !expected[userID] {
+            rows.Close()
+            return ErrPermissionsChanged
+        }
+        found++
+    }
+    rows.Close()
+    if err = rows.Err(); err != nil {
+        return err
+    }
+    if found != len(expected) {
+        return ErrPermissionsChanged
+    }
+
+    // delete revoked user's permission
+    if revokedUserID != 0 {
+        err = deletePagePermission(tx, revokedUserID, p.ID)
+        if err != nil {
+            return err
+        }
+    }
+
+    // store re-encrypted page, as long as it is still at the revision that
+    // was re-encrypted
+    result, err := tx.Exec(`
+        UPDATE pages
+        SET title=$1, body=$2, version=$3
+        WHERE id=$4 AND revision=$5`,
+        p.Title, p.Body, p.Version, p.ID, p.Revision)
+    if err != nil {
+        log.Printf("failed to update row for page-%v", p.ID)
+        return err
+    }
+    updated, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if updated == 0 {
+        err = page.ErrEditConflict
+        return err
+    }
+
+    // store re-encrypted revisions
+    for _, rev := range revisions {
+        _, err = tx.Exec(`
+            UPDATE page_revisions
+            SET title=$1, body=$2, version=$3
+            WHERE page_id=$4 AND revision=$5`,
+            rev.Page.Title, rev.Page.Body, rev.Page.Version, p.ID, rev.Number)
+        if err != nil {
+            log.Printf("failed to update revision %v of page-%v", rev.Number,
+                p.ID)
+            return err
+        }
+    }
+
+    // store re-encrypted attachments, after checking none were added or
+    // deleted in the meantime
+    attachmentIDs, err := lockPageAttachments(tx, p.ID)
+    if err != nil {
+        return err
+    }
+    if len(attachmentIDs) != len(attachments) {
+        return ErrAttachmentsChanged
+    }
+    for _, a := range attachments {
+        if !attachmentIDs[a.ID] {
+            return ErrAttachmentsChanged
+        }
+        _, err = tx.Exec(`
+            UPDATE attachments
+            SET name=$1, mime_type=$2, blob_key=$3
+            WHERE id=$4`, a.Name, a.MIMEType, a.BlobKey, a.ID)
+        if err != nil {
+            log.Printf("failed to update attachment-%v of page-%v", a.ID,
+                p.ID)
+            return err
+        }
+    }
+
+    // store new page keys
+    for _, perm := range perms {
+        _, err = tx.Exec(`
+            UPDATE page_permissions
+            SET user_encrypted_page_key=$1
+            WHERE user_id=$2 AND page_id=$3`,
+            perm.UserEncryptedPageKey, perm.UserID, p.ID)
+        if err != nil {
+            log.Printf("failed to update user-%v page-%v key", perm.UserID,
+                p.ID)
+            return err
+        }
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return err
+    }
+    log.Printf("successfully rotated key for page-%v", p.ID)
+
+    return nil
+}
+
+/**
+ * Lock a page's row and check it is still at p.Revision and has exactly the
+ * given revisions -- returns page.ErrEditConflict otherwise
+ */
+func lockPageRevisions(tx *sql.Tx, p *page.Page,
+    revisions []*page.Revision) error {
+
+    var revision int
+    err := tx.QueryRow(`
+        SELECT revision FROM pages
+        WHERE id=$1
+        FOR UPDATE`, p.ID).Scan(&revision)
+    if err != nil {
+        log.Printf("failed to lock row for page-%v", p.ID)
+        return err
+    }
+    if revision != p.Revision {
+        log.Printf("page-%v changed since revision %v", p.ID, p.Revision)
+        return page.ErrEditConflict
+    }
+
+    rows, err := tx.Query(`
+        SELECT revision FROM page_revisions
+        WHERE page_id=$1`, p.ID)
+    if err != nil {
+        log.Printf("failed to get revisions of page-%v", p.ID)
+        return err
+    }
+    defer rows.Close()
+
+    expected := map[int]bool{}
+    for _, rev := range revisions {
+        expected[rev.Number] = true
+    }
+    found := 0
+    for rows.Next() {
+        var number int
+        err = rows.Scan(&number)
+        if err != nil {
+            return err
+        }
+        if !expected[number] {
+            log.Printf("page-%v has a new revision %v", p.ID, number)
+            return page.ErrEditConflict
+        }
+        found++
+    }
+    err = rows.Err()
+    if err != nil {
+        return err
+    }
+    if found != len(expected) {
+        log.Printf("revisions of page-%v changed", p.ID)
+        return page.ErrEditConflict
+    }
+    return nil
+}
+
+/**
+ * Delete a user's permission for a page, along with their tags and search
+ * index of it
+ */
+func deletePagePermission(tx *sql.Tx, userID, pageID int) error {
+    _, err := tx.Exec(`
+        DELETE FROM page_permissions
+        WHERE user_id=$1 AND page_id=$2`, userID, pageID)
+    if err != nil {
+        log.Printf("failed to delete user-%v page-%v permission", userID,
+            pageID)
+        return err
+    }
+    _, err = tx.Exec(`
+        DELETE FROM page_tags
+        WHERE page_id=$1
+        AND tag_id IN (SELECT id FROM tags WHERE user_id=$2)`,
+        pageID, userID)
+    if err != nil {
+        log.Printf("failed to delete user-%v tags of page-%v", userID,
+            pageID)
+        return err
+    }
+    _, err = tx.Exec(`
+        DELETE FROM search_pages
+        WHERE user_id=$1 AND page_id=$2`, userID, pageID)
+    if err != nil {
+        log.Printf("failed to delete user-%v index of page-%v", userID,
+            pageID)
+        return err
+    }
+    return nil
+}
+
+/**
+ * Delete a user's permission for a page without rotating the page key, for
+ * pages whose key the server cannot rotate
+ */
+func (r *Repository) DeletePagePermission(userID, pageID int) (err error) {
+    log.Printf("deleting user-%v page-%v permission...", userID, pageID)
+    tx, err := r.DB.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    err = deletePagePermission(tx, userID, pageID)
+    if err != nil {
+        return err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return err
+    }
+    return nil
+}
+
+/**
+ * Check there exists a page permission row for a given userID, pageID
+ */
+func (r *Repository) CheckPagePermissionExists(userID,
+    pageID int) (bool, error) {
+
+    permissionExists := false
+    psqlStmt := `
+        SELECT EXISTS(
+        SELECT 1 FROM page_permissions
+        WHERE user_id=$1 AND page_id=$2)`
+    err := r.DB.QueryRow(psqlStmt, userID, pageID).Scan(&permissionExists)
+    if err != nil {
+        return false, err
+    }
+    return permissionExists, nil
+}
+
 /**
  * Check userID can edit pageID
  */
@@ -68,3 +457,134 @@ func (r *Repository) CheckUserCanEditPage(userID, pageID int) (bool, error) {
 
     return canEdit, nil
 }
+
+/**
+ * Store a user's upgraded keys along with their re-wrapped page keys and
+ * notebook and tag names in a single transaction
+ *
+ * The user row is locked and its main-key checked first, and every re-wrapped
+ * value must still be what it was re-wrapped from, with none added since, so
+ * a concurrent change leaves nothing written (ErrUserChanged). The user's
+ * search index is dropped, as its tokens come from the main-key; it is rebuilt
+ * as pages are next indexed.
+ */
+func (r *Repository) StoreUserKeyUpgrade(u *user.User,
+    oldMainKeyEncrypted []byte, pageKeys, notebookNames,
+    tagNames []*permission.Rewrap) (err error) {
+
+    log.Printf("storing key upgrade for user-%v...", u.ID)
+    tx, err := r.DB.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    // lock user row and check the keys were upgraded from the current ones
+    var mainKeyEncrypted []byte
+    err = tx.QueryRow(`
+        SELECT main_key_encrypted FROM users
+        WHERE id=$1
+        FOR UPDATE`, u.ID).Scan(&mainKeyEncrypted)
+    if err != nil {
+        return err
+    }
+    if !bytes.Equal(mainKeyEncrypted, oldMainKeyEncrypted) {
+        log.Printf("keys of user-%v changed during upgrade", u.ID)
+        err = ErrUserChanged
+        return err
+    }
+
+    // check nothing was added since the values were read
+    for _, c := range []struct {
+        query   string
+        rewraps []*permission.Rewrap
+    }{
+        {`SELECT COUNT(*) FROM page_permissions
+            JOIN pages ON (pages.id=page_permissions.page_id)
+            WHERE pages.author_id=$1 AND page_permissions.user_id=$1`,
+            pageKeys},
+        {`SELECT COUNT(*) FROM notebooks WHERE user_id=$1`, notebookNames},
+        {`SELECT COUNT(*) FROM tags WHERE user_id=$1`, tagNames},
+    } {
+        n := 0
+        err = tx.QueryRow(c.query, u.ID).Scan(&n)
+        if err != nil {
+            return err
+        }
+        if n != len(c.rewraps) {
+            log.Printf("user-%v added keys or names during upgrade", u.ID)
+            err = ErrUserChanged
+            return err
+        }
+    }
+
+    // store re-wrapped values
+    for _, c := range []struct {
+        query   string
+        rewraps []*permission.Rewrap
+    }{
+        {`UPDATE page_permissions SET user_encrypted_page_key=$1
+            WHERE user_id=$2 AND page_id=$3 AND user_encrypted_page_key=$4`,
+            pageKeys},
+        {`UPDATE notebooks SET name=$1
+            WHERE user_id=$2 AND id=$3 AND name=$4`, notebookNames},
+        {`UPDATE tags SET name=$1
+            WHERE user_id=$2 AND id=$3 AND name=$4`, tagNames},
+    } {
+        for _, rewrap := range c.rewraps {
+            var result sql.Result
+            result, err = tx.Exec(c.query, rewrap.New, u.ID, rewrap.ID,
+                rewrap.Old)
+            if err != nil {
+                return err
+            }
+            var n int64
+            n, err = result.RowsAffected()
+            if err != nil {
+                return err
+            }
+            if n != 1 {
+                log.Printf("value-%v of user-%v changed during upgrade",
+                    rewrap.ID, u.ID)
+                err = ErrUserChanged
+                return err
+            }
+        }
+    }
+
+    // store user keys
+    _, err = tx.Exec(`
+        UPDATE users
+        SET main_key_encrypted=$1, private_key_encrypted=$2,
+            recovery_salt=$3, main_key_recovery_encrypted=$4,
+            private_key_recovery_encrypted=$5
+        WHERE id=$6`,
+        u.MainKeyEncrypted, u.PrivateKeyEncrypted, u.RecoverySalt,
+        u.MainKeyRecoveryEncrypted, u.PrivateKeyRecoveryEncrypted, u.ID)
+    if err != nil {
+        log.Printf("failed to update user-%v", u.ID)
+        return err
+    }
+
+    // deleting the index's rows deletes their tokens too
+    _, err = tx.Exec(`
+        DELETE FROM search_pages
+        WHERE user_id=$1`, u.ID)
+    if err != nil {
+        return err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return err
+    }
+    log.Printf("successfully stored key upgrade for user-%v", u.ID)
+
+    return nil
+}
@@ -38,3 +38,37 @@ func New(c *config.Config) (*Repository, error) {
 
     return r, nil
 }
+
+/**
+ * Run a query returning a single integer column and collect the results
+ */
+func (r *Repository) queryIDs(psqlStmt string, args ...interface{}) ([]int,
+    error) {
+
+    rows, err := r.DB.Query(psqlStmt, args...)
+    if err != nil {
+        log.Printf("failed to query IDs from DB: %v", err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    ids := []int{}
+    for rows.Next() {
+        var id int
+        err = rows.Scan(&id)
+        if err != nil {
+            log.Println("failed to scan ID from row")
+            return nil, err
+        }
+        ids = append(ids, id)
+    }
+
+    // get any errors encountered during iteration
+    err = rows.Err()
+    if err != nil {
+        log.Println("error iterating over rows in database")
+        return nil, err
+    }
+
+    return ids, nil
+}
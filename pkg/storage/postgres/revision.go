@@ -0,0 +1,179 @@
+package postgres
+
+/**
+ * This file contains page-revision-related repository functions
+ */
+
+import (
+    "log"
+    "time"
+    "database/sql"
+
+    "github.com/setonotes/pkg/page"
+)
+
+/**
+ * Insert revision p.Revision of a page within a transaction -- the page row
+ * must already have been updated (and its revision counter incremented) in the
+ * same transaction, which locks it, so concurrent saves are numbered one after
+ * the other
+ */
+func insertRevision(tx *sql.Tx, p *page.Page, authorID int) error {
+    _, err := tx.Exec(`
+        INSERT INTO page_revisions (page_id, revision, author_id, title, body,
+            version)
+        VALUES ($1, $2, $3, $4, $5, $6)`,
+        p.ID, p.Revision, authorID, p.Title, p.Body, p.Version)
+    if err != nil {
+        log.Printf("failed to insert revision for page-%v", p.ID)
+        return err
+    }
+    return nil
+}
+
+/**
+ * Scan revision rows (page_id, revision, author_id, created_at, title, body,
+ * version, author of the page, client_encrypted)
+ */
+func scanRevisions(rows *sql.Rows) ([]*page.Revision, error) {
+    defer rows.Close()
+
+    revisions := []*page.Revision{}
+    for rows.Next() {
+        var (
+            number    int
+            authorID  int
+            createdAt time.Time
+        )
+        p := &page.Page{}
+        err := rows.Scan(&p.ID, &number, &authorID, &createdAt, &p.Title,
+            &p.Body, &p.Version, &p.OwnerID, &p.ClientEncrypted)
+        if err != nil {
+            log.Println("failed to scan revision from row")
+            return nil, err
+        }
+        revisions = append(revisions, &page.Revision{
+            Number:    number,
+            AuthorID:  authorID,
+            CreatedAt: createdAt,
+            Page:      p,
+        })
+    }
+
+    // get any errors encountered during iteration
+    err := rows.Err()
+    if err != nil {
+        log.Println("error iterating over rows in database")
+        return nil, err
+    }
+
+    return revisions, nil
+}
+
+/**
+ * Get every revision of a page, newest first
+ */
+func (r *Repository) GetPageRevisions(pageID int) ([]*page.Revision, error) {
+    log.Printf("getting revisions of page-%v from DB...", pageID)
+    rows, err := r.DB.Query(`
+        SELECT page_id, revision, page_revisions.author_id, created_at,
+            page_revisions.title, page_revisions.body,
+            page_revisions.version, pages.author_id, client_encrypted
+        FROM page_revisions JOIN pages
+        ON (pages.id=page_revisions.page_id)
+        WHERE page_id=$1
+        ORDER BY revision DESC`, pageID)
+    if err != nil {
+        log.Printf("failed to get revisions of page-%v from DB", pageID)
+        return nil, err
+    }
+    return scanRevisions(rows)
+}
+
+/**
+ * Get a single revision of a page
+ */
+func (r *Repository) GetPageRevision(pageID,
+    number int) (*page.Revision, error) {
+
+    rows, err := r.DB.Query(`
+        SELECT page_id, revision, page_revisions.author_id, created_at,
+            page_revisions.title, page_revisions.body,
+            page_revisions.version, pages.author_id, client_encrypted
+        FROM page_revisions JOIN pages
+        ON (pages.id=page_revisions.page_id)
+        WHERE page_id=$1 AND revision=$2`, pageID, number)
+    if err != nil {
+        log.Printf("failed to get revision %v of page-%v from DB", number,
+            pageID)
+        return nil, err
+    }
+    revisions, err := scanRevisions(rows)
+    if err != nil {
+        return nil, err
+    }
+    if len(revisions) == 0 {
+        return nil, sql.ErrNoRows
+    }
+    return revisions[0], nil
+}
+
+/**
+ * Get when each page a user can read was first and last saved, by page ID --
+ * pages without revisions are left out
+ */
+func (r *Repository) GetUserPageTimes(userID int) (map[int]*page.Times,
+    error) {
+
+    rows, err := r.DB.Query(`
+        SELECT page_revisions.page_id, MIN(created_at), MAX(created_at)
+        FROM page_revisions JOIN page_permissions
+        ON (page_permissions.page_id=page_revisions.page_id)
+        WHERE user_id=$1
+        GROUP BY page_revisions.page_id`, userID)
+    if err != nil {
+        log.Printf("failed to get page times of user-%v", userID)
+        return nil, err
+    }
+    defer rows.Close()
+
+    times := map[int]*page.Times{}
+    for rows.Next() {
+        var pageID int
+        t := &page.Times{}
+        err = rows.Scan(&pageID, &t.Created, &t.Updated)
+        if err != nil {
+            log.Println("failed to get page times from row")
+            return nil, err
+        }
+        times[pageID] = t
+    }
+
+    // get any errors encountered during iteration
+    err = rows.Err()
+    if err != nil {
+        log.Println("error iterating over rows in database")
+        return nil, err
+    }
+
+    return times, nil
+}
+
+/**
+ * Date the revisions of a page -- its first revision is dated t.Created and
+ * every later one t.Updated
+ */
+func (r *Repository) SetPageTimes(pageID int, t *page.Times) error {
+    _, err := r.DB.Exec(`
+        UPDATE page_revisions
+        SET created_at = CASE
+            WHEN revision = (SELECT MIN(revision) FROM page_revisions
+                WHERE page_id=$1) THEN $2
+            ELSE $3 END
+        WHERE page_id=$1`, pageID, t.Created, t.Updated)
+    if err != nil {
+        log.Printf("failed to set times of page-%v", pageID)
+        return err
+    }
+    return nil
+}
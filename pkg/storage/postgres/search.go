@@ -0,0 +1,141 @@
+package postgres
+
+/**
+ * This file contains the repository functions for the search index. Tokens are
+ * opaque here; see `pkg/encryption/search.go`.
+ */
+
+import (
+    "log"
+
+    "github.com/setonotes/pkg/search"
+
+    "github.com/lib/pq"
+)
+
+/**
+ * Replace a user's index of a page with the given tokens and weights, recording
+ * the page revision they were made from, in a single transaction
+ */
+func (r *Repository) StoreSearchTokens(userID, pageID, revision int,
+    tokens [][]byte, weights []int) (err error) {
+
+    log.Printf("indexing page-%v for user-%v...", pageID, userID)
+    tx, err := r.DB.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    // deleting the page's row deletes its tokens too
+    _, err = tx.Exec(`
+        DELETE FROM search_pages
+        WHERE user_id=$1 AND page_id=$2`, userID, pageID)
+    if err != nil {
+        log.Printf("failed to clear index of page-%v", pageID)
+        return err
+    }
+    _, err = tx.Exec(`
+        INSERT INTO search_pages (user_id, page_id, revision)
+        VALUES ($1, $2, $3)`, userID, pageID, revision)
+    if err != nil {
+        log.Printf("failed to record index of page-%v", pageID)
+        return err
+    }
+
+    stmt, err := tx.Prepare(`
+        INSERT INTO search_tokens (user_id, page_id, token, weight)
+        VALUES ($1, $2, $3, $4)`)
+    if err != nil {
+        return err
+    }
+    defer stmt.Close()
+    for i, token := range tokens {
+        _, err = stmt.Exec(userID, pageID, token, weights[i])
+        if err != nil {
+            log.Printf("failed to store token for page-%v", pageID)
+            return err
+        }
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return err
+    }
+    return nil
+}
+
+/**
+ * Get the IDs of the pages a user can read that are missing from their index
+ * or were indexed at an older revision -- pages in the trash, version-1 pages
+ * and browser-encrypted pages (which the server cannot read) are left out
+ */
+func (r *Repository) GetUnindexedPageIDs(userID int) ([]int, error) {
+    return r.queryIDs(`
+        SELECT pages.id
+        FROM pages
+        JOIN page_permissions ON (page_permissions.page_id=pages.id)
+        LEFT JOIN search_pages ON (search_pages.page_id=pages.id
+            AND search_pages.user_id=page_permissions.user_id)
+        WHERE page_permissions.user_id=$1
+        AND pages.deleted_at IS NULL
+        AND NOT pages.client_encrypted
+        AND pages.version >= 2
+        AND (search_pages.revision IS NULL
+            OR search_pages.revision<>pages.revision)
+        ORDER BY pages.id`, userID)
+}
+
+/**
+ * Find the pages in a user's index holding every one of the given (distinct)
+ * tokens, best first -- pages the user can no longer read or that are in the
+ * trash are left out
+ */
+func (r *Repository) SearchPages(userID int, tokens [][]byte,
+    limit int) ([]*search.Hit, error) {
+
+    rows, err := r.DB.Query(`
+        SELECT search_tokens.page_id, SUM(search_tokens.weight) AS score
+        FROM search_tokens
+        JOIN pages ON (pages.id=search_tokens.page_id)
+        JOIN page_permissions ON (page_permissions.page_id=pages.id
+            AND page_permissions.user_id=search_tokens.user_id)
+        WHERE search_tokens.user_id=$1
+        AND search_tokens.token=ANY($2)
+        AND pages.deleted_at IS NULL
+        GROUP BY search_tokens.page_id
+        HAVING COUNT(*)=$3
+        ORDER BY score DESC, search_tokens.page_id
+        LIMIT $4`, userID, pq.ByteaArray(tokens), len(tokens), limit)
+    if err != nil {
+        log.Printf("failed to search pages of user-%v", userID)
+        return nil, err
+    }
+    defer rows.Close()
+
+    hits := []*search.Hit{}
+    for rows.Next() {
+        hit := &search.Hit{}
+        err = rows.Scan(&hit.PageID, &hit.Score)
+        if err != nil {
+            log.Println("failed to get search hit from row")
+            return nil, err
+        }
+        hits = append(hits, hit)
+    }
+
+    // get any errors encountered during iteration
+    err = rows.Err()
+    if err != nil {
+        log.Println("error iterating over rows in database")
+        return nil, err
+    }
+
+    return hits, nil
+}
@@ -0,0 +1,241 @@
+package postgres
+
+/**
+ * This file contains tag-related repository functions
+ */
+
+import (
+    "log"
+
+    "github.com/setonotes/pkg/tag"
+)
+
+/**
+ * Given a tag ID, return the tag
+ */
+func (r *Repository) GetTagByID(id int) (*tag.Tag, error) {
+    t := &tag.Tag{ID: id}
+    err := r.DB.QueryRow(`
+        SELECT user_id, name
+        FROM tags
+        WHERE id=$1`, id).Scan(&t.OwnerID, &t.Name)
+    if err != nil {
+        log.Printf("failed to get tag-%v from DB", id)
+        return nil, err
+    }
+    return t, nil
+}
+
+/**
+ * Get every tag belonging to a user, ordered by ID
+ */
+func (r *Repository) GetUserTags(ownerID int) ([]*tag.Tag, error) {
+    rows, err := r.DB.Query(`
+        SELECT id, name
+        FROM tags
+        WHERE user_id=$1
+        ORDER BY id`, ownerID)
+    if err != nil {
+        log.Printf("failed to get tags of user-%v from DB", ownerID)
+        return nil, err
+    }
+    defer rows.Close()
+
+    tags := []*tag.Tag{}
+    for rows.Next() {
+        t := &tag.Tag{OwnerID: ownerID}
+        err = rows.Scan(&t.ID, &t.Name)
+        if err != nil {
+            log.Println("failed to get tag from row")
+            return nil, err
+        }
+        tags = append(tags, t)
+    }
+
+    // get any errors encountered during iteration
+    err = rows.Err()
+    if err != nil {
+        log.Println("error iterating over rows in database")
+        return nil, err
+    }
+
+    return tags, nil
+}
+
+/**
+ * Create a tag with an empty name, returning its ID -- the name is encrypted
+ * once the ID is known and stored with UpdateTag()
+ */
+func (r *Repository) CreateTag(ownerID int) (int, error) {
+    log.Println("creating row in `tags` table...")
+    id := 0
+    err := r.DB.QueryRow(`
+        INSERT INTO tags (user_id, name)
+        VALUES ($1, '')
+        RETURNING id`, ownerID).Scan(&id)
+    if err != nil {
+        log.Println("failed to store tag")
+        return 0, err
+    }
+    return id, nil
+}
+
+/**
+ * Store a tag's Name
+ */
+func (r *Repository) UpdateTag(t *tag.Tag) error {
+    log.Printf("updating tag-%v...", t.ID)
+    _, err := r.DB.Exec(`
+        UPDATE tags
+        SET name=$1
+        WHERE id=$2`, t.Name, t.ID)
+    if err != nil {
+        log.Printf("failed to update tag-%v", t.ID)
+        return err
+    }
+    return nil
+}
+
+/**
+ * Delete a tag, taking it off every page (by cascade)
+ */
+func (r *Repository) DeleteTag(id int) error {
+    log.Printf("deleting tag-%v...", id)
+    _, err := r.DB.Exec(`
+        DELETE FROM tags
+        WHERE id=$1`, id)
+    if err != nil {
+        log.Printf("failed to delete tag-%v", id)
+        return err
+    }
+    return nil
+}
+
+/**
+ * Merge one tag into another in a single transaction -- every page with the
+ * first tag gets the second, and the first is deleted
+ */
+func (r *Repository) MergeTags(fromID, intoID int) (err error) {
+    log.Printf("merging tag-%v into tag-%v...", fromID, intoID)
+    tx, err := r.DB.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    _, err = tx.Exec(`
+        INSERT INTO page_tags (tag_id, page_id)
+        SELECT $1, page_id FROM page_tags
+        WHERE tag_id=$2
+        ON CONFLICT DO NOTHING`, intoID, fromID)
+    if err != nil {
+        log.Printf("failed to copy pages of tag-%v", fromID)
+        return err
+    }
+    _, err = tx.Exec(`
+        DELETE FROM tags
+        WHERE id=$1`, fromID)
+    if err != nil {
+        log.Printf("failed to delete tag-%v", fromID)
+        return err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return err
+    }
+    log.Printf("successfully merged tag-%v into tag-%v", fromID, intoID)
+    return nil
+}
+
+/**
+ * Replace the tags a user has put on a page, in a single transaction -- tags
+ * other users have put on the page are left alone
+ */
+func (r *Repository) SetPageTags(userID, pageID int,
+    tagIDs []int) (err error) {
+
+    log.Printf("setting tags of page-%v for user-%v...", pageID, userID)
+    tx, err := r.DB.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    _, err = tx.Exec(`
+        DELETE FROM page_tags
+        WHERE page_id=$1
+        AND tag_id IN (SELECT id FROM tags WHERE user_id=$2)`,
+        pageID, userID)
+    if err != nil {
+        log.Printf("failed to clear tags of page-%v", pageID)
+        return err
+    }
+    for _, tagID := range tagIDs {
+        _, err = tx.Exec(`
+            INSERT INTO page_tags (tag_id, page_id)
+            VALUES ($1, $2)`, tagID, pageID)
+        if err != nil {
+            log.Printf("failed to put tag-%v on page-%v", tagID, pageID)
+            return err
+        }
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return err
+    }
+    return nil
+}
+
+/**
+ * Get the IDs of the tags a user has put on each page, by page ID -- only
+ * pages the user can still read are included
+ */
+func (r *Repository) GetUserPageTags(userID int) (map[int][]int, error) {
+    rows, err := r.DB.Query(`
+        SELECT page_tags.page_id, page_tags.tag_id
+        FROM page_tags
+        JOIN tags ON (tags.id=page_tags.tag_id)
+        JOIN page_permissions ON (page_permissions.page_id=page_tags.page_id
+            AND page_permissions.user_id=tags.user_id)
+        WHERE tags.user_id=$1
+        ORDER BY page_tags.page_id, page_tags.tag_id`, userID)
+    if err != nil {
+        log.Printf("failed to get page tags of user-%v", userID)
+        return nil, err
+    }
+    defer rows.Close()
+
+    tags := map[int][]int{}
+    for rows.Next() {
+        var pageID, tagID int
+        err = rows.Scan(&pageID, &tagID)
+        if err != nil {
+            log.Println("failed to get page tag from row")
+            return nil, err
+        }
+        tags[pageID] = append(tags[pageID], tagID)
+    }
+
+    // get any errors encountered during iteration
+    err = rows.Err()
+    if err != nil {
+        log.Println("error iterating over rows in database")
+        return nil, err
+    }
+
+    return tags, nil
+}
@@ -0,0 +1,146 @@
+package postgres
+
+/**
+ * This file contains the repository functions for the trash. A page in the
+ * trash keeps its row, with `deleted_at` set, until it is deleted for good.
+ */
+
+import (
+    "log"
+    "time"
+
+    "github.com/setonotes/pkg/page"
+)
+
+/**
+ * Move a page to the trash
+ */
+func (r *Repository) TrashPage(pageID int) error {
+    log.Printf("moving page-%v to the trash...", pageID)
+    _, err := r.DB.Exec(`
+        UPDATE pages
+        SET deleted_at=now()
+        WHERE id=$1 AND deleted_at IS NULL`, pageID)
+    if err != nil {
+        log.Printf("failed to move page-%v to the trash", pageID)
+        return err
+    }
+    return nil
+}
+
+/**
+ * Take a page back out of the trash
+ */
+func (r *Repository) RestorePage(pageID int) error {
+    log.Printf("restoring page-%v from the trash...", pageID)
+    _, err := r.DB.Exec(`
+        UPDATE pages
+        SET deleted_at=NULL
+        WHERE id=$1`, pageID)
+    if err != nil {
+        log.Printf("failed to restore page-%v from the trash", pageID)
+        return err
+    }
+    return nil
+}
+
+/**
+ * Delete a page in the trash for good, along with its permissions (and, by
+ * cascade, its revisions), in a single transaction
+ *
+ * The page row is locked and checked to still be in the trash first, so a
+ * page restored in the meantime is left alone (and sql.ErrNoRows returned)
+ */
+func (r *Repository) DeletePage(pageID int) (err error) {
+    log.Printf("deleting page-%v row from pages table...", pageID)
+    tx, err := r.DB.Begin()
+    if err != nil {
+        log.Println("failed to begin transaction")
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tx.Rollback()
+        }
+    }()
+
+    var id int
+    err = tx.QueryRow(`
+        SELECT id FROM pages
+        WHERE id=$1 AND deleted_at IS NOT NULL
+        FOR UPDATE`, pageID).Scan(&id)
+    if err != nil {
+        log.Printf("page-%v is not in the trash", pageID)
+        return err
+    }
+
+    _, err = tx.Exec(`
+        DELETE FROM page_permissions
+        WHERE page_id=$1`, pageID)
+    if err != nil {
+        log.Printf("failed to delete permissions of page-%v", pageID)
+        return err
+    }
+    _, err = tx.Exec(`
+        DELETE FROM pages
+        WHERE id=$1`, pageID)
+    if err != nil {
+        log.Printf("failed to delete page-%v row from database", pageID)
+        return err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        log.Println("failed to commit transaction")
+        return err
+    }
+    log.Printf("successfully deleted page-%v row from database", pageID)
+    return nil
+}
+
+/**
+ * Get every (disembodied) page in a user's trash, most recently trashed first
+ */
+func (r *Repository) GetTrashedPages(ownerID int) ([]*page.Page, error) {
+    rows, err := r.DB.Query(`
+        SELECT id, title, version, client_encrypted, deleted_at
+        FROM pages
+        WHERE author_id=$1 AND deleted_at IS NOT NULL
+        ORDER BY deleted_at DESC`, ownerID)
+    if err != nil {
+        log.Printf("failed to get trashed pages of user-%v from DB", ownerID)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var pages = []*page.Page{}
+    for rows.Next() {
+        p := &page.Page{OwnerID: ownerID, Body: []byte("")}
+        err = rows.Scan(&p.ID, &p.Title, &p.Version, &p.ClientEncrypted,
+            &p.DeletedAt)
+        if err != nil {
+            log.Println("failed to get trashed page from row")
+            return nil, err
+        }
+        pages = append(pages, p)
+    }
+
+    // get any errors encountered during iteration
+    err = rows.Err()
+    if err != nil {
+        log.Println("error iterating over rows in database")
+        return nil, err
+    }
+
+    return pages, nil
+}
+
+/**
+ * Get the IDs of every page moved to the trash before a given time
+ */
+func (r *Repository) GetPagesTrashedBefore(before time.Time) ([]int, error) {
+    return r.queryIDs(`
+        SELECT id FROM pages
+        WHERE deleted_at < $1
+        ORDER BY id`, before)
+}
@@ -7,6 +7,8 @@ package postgres
 import (
     "log"
     "time"
+    "errors"
+    "encoding/json"
 
     "github.com/setonotes/pkg/user"
     "github.com/setonotes/pkg/page"
@@ -25,6 +27,12 @@ func (r *Repository) GetUserByID(userID int) (*user.User, error) {
         publicKey           []byte
         salt                []byte
         version             int
+
+        recoverySalt                []byte
+        mainKeyRecoveryEncrypted    []byte
+        privateKeyRecoveryEncrypted []byte
+        kdfParams                   []byte
+        clientEncryption            bool
     )
 
     // query database for user-fields
@@ -37,7 +45,12 @@ func (r *Repository) GetUserByID(userID int) (*user.User, error) {
             private_key_encrypted,
             public_key,
             salt,
-            version
+            version,
+            recovery_salt,
+            main_key_recovery_encrypted,
+            private_key_recovery_encrypted,
+            kdf_params,
+            client_encryption
         FROM users
         WHERE id=$1`
     err := r.DB.QueryRow(psqlStmt, userID).Scan(
@@ -49,12 +62,27 @@ func (r *Repository) GetUserByID(userID int) (*user.User, error) {
         &publicKey,
         &salt,
         &version,
+        &recoverySalt,
+        &mainKeyRecoveryEncrypted,
+        &privateKeyRecoveryEncrypted,
+        &kdfParams,
+        &clientEncryption,
     )
     if err != nil {
         log.Printf("failed to get user-%v from storage: %v", userID, err)
         return nil, err
     }
 
+    // a NULL column means the legacy (zero-value) parameters
+    var kdf user.KDFParams
+    if len(kdfParams) > 0 {
+        err = json.Unmarshal(kdfParams, &kdf)
+        if err != nil {
+            log.Printf("failed to parse KDF parameters for user-%v", userID)
+            return nil, err
+        }
+    }
+
     return &user.User{
         ID:                  userID,
         Username:            username,
@@ -65,6 +93,12 @@ func (r *Repository) GetUserByID(userID int) (*user.User, error) {
         PublicKey:           publicKey,
         Salt:                salt,
         Version:             version,
+
+        RecoverySalt:                recoverySalt,
+        MainKeyRecoveryEncrypted:    mainKeyRecoveryEncrypted,
+        PrivateKeyRecoveryEncrypted: privateKeyRecoveryEncrypted,
+        KDF:                         kdf,
+        ClientEncryption:            clientEncryption,
     }, nil
 }
 
@@ -84,6 +118,15 @@ func (r *Repository) GetUserIDFromUsername(username string) (int, error) {
     return userID, err
 }
 
+/**
+ * Returns the IDs of every user
+ */
+func (r *Repository) GetUserIDs() ([]int, error) {
+    return r.queryIDs(`
+        SELECT id FROM users
+        ORDER BY id`)
+}
+
 /**
  * Returns userID corresponding to given email address
  */
@@ -115,11 +158,19 @@ func (r *Repository) CreateUser(user *user.User) (int, error) {
             private_key_encrypted,
             public_key,
             salt,
-            version)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+            version,
+            recovery_salt,
+            main_key_recovery_encrypted,
+            private_key_recovery_encrypted,
+            kdf_params)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
         RETURNING id`
+    kdfParams, err := json.Marshal(user.KDF)
+    if err != nil {
+        return -1, err
+    }
     var userID int
-    err := r.DB.QueryRow(psqlStmt,
+    err = r.DB.QueryRow(psqlStmt,
         user.Username,
         user.Email,
         user.PasswordHash,
@@ -128,6 +179,10 @@ func (r *Repository) CreateUser(user *user.User) (int, error) {
         user.PublicKey,
         user.Salt,
         user.Version,
+        user.RecoverySalt,
+        user.MainKeyRecoveryEncrypted,
+        user.PrivateKeyRecoveryEncrypted,
+        kdfParams,
     ).Scan(&userID)
     if err != nil {
         log.Printf("failed to create row in `users`: %v", err)
@@ -137,6 +192,86 @@ func (r *Repository) CreateUser(user *user.User) (int, error) {
     return userID, nil
 }
 
+/**
+ * Store a user's encrypted private key and public key
+ */
+func (r *Repository) UpdateUserKeyPair(u *user.User) error {
+    psqlStmt := `
+        UPDATE users
+        SET private_key_encrypted=$1, public_key=$2
+        WHERE id=$3`
+    _, err := r.DB.Exec(psqlStmt, u.PrivateKeyEncrypted, u.PublicKey, u.ID)
+    if err != nil {
+        log.Printf("failed to update key-pair for user-%v: %v", u.ID, err)
+        return err
+    }
+    return nil
+}
+
+var ErrUserChanged = errors.New("user changed during update")
+
+/**
+ * Store a user's recovery salt and recovery-wrapped keys
+ */
+func (r *Repository) UpdateUserRecovery(u *user.User) error {
+    psqlStmt := `
+        UPDATE users
+        SET recovery_salt=$1, main_key_recovery_encrypted=$2,
+            private_key_recovery_encrypted=$3
+        WHERE id=$4`
+    _, err := r.DB.Exec(psqlStmt, u.RecoverySalt, u.MainKeyRecoveryEncrypted,
+        u.PrivateKeyRecoveryEncrypted, u.ID)
+    if err != nil {
+        log.Printf("failed to update recovery for user-%v: %v", u.ID, err)
+        return err
+    }
+    return nil
+}
+
+/**
+ * Store a user's new password hash, salt, KDF parameters, re-wrapped keys,
+ * recovery keys and browser-encryption flag
+ *
+ * All of these columns are written by a single statement, which only matches
+ * if the password hash is still the one the new keys were derived against, so
+ * a concurrent password change cannot leave the keys wrapped under the wrong
+ * password
+ */
+func (r *Repository) UpdateUserPassword(u *user.User,
+    oldPasswordHash []byte) error {
+
+    psqlStmt := `
+        UPDATE users
+        SET password_hash=$1, salt=$2, main_key_encrypted=$3,
+            private_key_encrypted=$4, recovery_salt=$5,
+            main_key_recovery_encrypted=$6, private_key_recovery_encrypted=$7,
+            kdf_params=$8, client_encryption=$9
+        WHERE id=$10 AND password_hash=$11`
+    kdfParams, err := json.Marshal(u.KDF)
+    if err != nil {
+        return err
+    }
+    result, err := r.DB.Exec(psqlStmt, u.PasswordHash, u.Salt,
+        u.MainKeyEncrypted, u.PrivateKeyEncrypted, u.RecoverySalt,
+        u.MainKeyRecoveryEncrypted, u.PrivateKeyRecoveryEncrypted, kdfParams,
+        u.ClientEncryption, u.ID, oldPasswordHash)
+    if err != nil {
+        log.Printf("failed to update password for user-%v: %v", u.ID, err)
+        return err
+    }
+
+    n, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n != 1 {
+        log.Printf("password for user-%v changed concurrently", u.ID)
+        return ErrUserChanged
+    }
+
+    return nil
+}
+
 /**
  * Tracks user ID, URL path and timestamp for each authorized HTTP request
  */
@@ -153,17 +288,18 @@ func (r *Repository) TrackUserActivity(userID int, url string) error {
 }
 
 /**
- * Get all (disembodied) pages for which userID has read-permission
+ * Get all (disembodied) pages for which userID has read-permission, leaving out
+ * pages in the trash
  *
  * See https://www.calhoun.io/querying-for-multiple-records-with-gos-sql-
  * package/ for querying multiple records
  */
 func (r *Repository) GetUserDisembodiedPages(userID int) ([]*page.Page, error) {
     psqlStmt := `
-        SELECT id, title, version, author_id
+        SELECT id, title, version, author_id, client_encrypted
         FROM pages JOIN page_permissions
         ON (pages.id=page_permissions.page_id)
-        WHERE user_id=$1`
+        WHERE user_id=$1 AND deleted_at IS NULL`
     log.Printf("getting page rows for user-%v from DB...", userID)
     rows, err := r.DB.Query(psqlStmt, userID)
     if err != nil {
@@ -181,9 +317,10 @@ func (r *Repository) GetUserDisembodiedPages(userID int) ([]*page.Page, error) {
             titleEncrypted []byte
             ownerID        int
             version        int
+            client         bool
         )
         log.Println("scanning row for page ID, title, owner ID, version...")
-        err = rows.Scan(&pageID, &titleEncrypted, &version, &ownerID)
+        err = rows.Scan(&pageID, &titleEncrypted, &version, &ownerID, &client)
         if err != nil {
             log.Println("failed to get disembodied page from row")
             return nil, err
@@ -197,6 +334,8 @@ func (r *Repository) GetUserDisembodiedPages(userID int) ([]*page.Page, error) {
             Body:    []byte(""),
             OwnerID: ownerID,
             Version: version,
+
+            ClientEncrypted: client,
         })
     }
 
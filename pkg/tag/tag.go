@@ -0,0 +1,92 @@
+package tag
+
+/**
+ * Like the page and notebook packages, this is a light package that just
+ * defines the tag struct and allows us to get it from a repository. Tags
+ * belong to a single user and their names are encrypted with that user's
+ * main-key, so tagging pages lives in the permission package.
+ */
+
+import (
+    "log"
+    "errors"
+    "strings"
+    "unicode"
+)
+
+type Tag struct {
+    ID      int
+    OwnerID int
+    Name    []byte
+}
+
+var (
+    ErrInvalidName = errors.New("tag names cannot be empty or hold spaces")
+    ErrTagExists   = errors.New("a tag with that name already exists")
+)
+
+type Repository interface {
+    GetTagByID(id int) (*Tag, error)
+}
+
+type Service struct {
+    repo Repository
+}
+
+/**
+ * Creates a new Tag Service
+ */
+func NewService(r Repository) *Service {
+    return &Service{
+        repo: r,
+    }
+}
+
+/**
+ * Returns a pointer to a tag given the tag's ID
+ */
+func (s *Service) GetByID(id int) (*Tag, error) {
+    t, err := s.repo.GetTagByID(id)
+    if err != nil {
+        log.Println("failed to get tag by ID from repository")
+        return nil, err
+    }
+    return t, nil
+}
+
+/**
+ * Bring a tag name into the form it is stored in: without a leading '#' and in
+ * lower case, so that `#Meeting` and `meeting` are the same tag
+ */
+func Normalize(name string) (string, error) {
+    name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#"))
+    if name == "" || strings.IndexFunc(name, unicode.IsSpace) >= 0 ||
+        strings.Contains(name, ",") {
+        return "", ErrInvalidName
+    }
+    return name, nil
+}
+
+/**
+ * Split a list of tags as typed by a user, such as "#meeting, #runbook", into
+ * normalized names, leaving out duplicates
+ */
+func ParseList(list string) ([]string, error) {
+    fields := strings.FieldsFunc(list, func(r rune) bool {
+        return r == ',' || unicode.IsSpace(r)
+    })
+
+    seen := map[string]bool{}
+    names := []string{}
+    for _, field := range fields {
+        name, err := Normalize(field)
+        if err != nil {
+            return nil, err
+        }
+        if !seen[name] {
+            seen[name] = true
+            names = append(names, name)
+        }
+    }
+    return names, nil
+}
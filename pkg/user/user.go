@@ -6,13 +6,14 @@ package user
  * mostly pertains to code in the `Create()` function. Ultimately, the following
  * functions should no longer be exported by `encryption`:
  *     NewSymmetricKey()
- *     GenerateKeyFromPassword()
+ *     DeriveKey()
  *     EncryptData()
  *     DecryptData()
  */
 
 import (
     "log"
+    "errors"
 )
 
 type User struct {
@@ -25,8 +26,42 @@ type User struct {
     PublicKey           []byte // same for public key
     Salt                []byte
     Version             int
+
+    // second wrapping of the main-key and private key under a recovery code
+    RecoverySalt                []byte
+    MainKeyRecoveryEncrypted    []byte
+    PrivateKeyRecoveryEncrypted []byte
+
+    // how the password-generated key is derived from the password and salt
+    KDF                         KDFParams
+
+    // whether the user's new pages are encrypted in the browser -- such users
+    // keep a KDF and cipher that WebCrypto supports
+    ClientEncryption            bool
+
+    // the password-generated key of the current session -- this is unwrapped
+    // from the session by the auth service for each request and never stored
+    SessionKey                  []byte
 }
 
+/**
+ * KDFParams describe how a user's password-generated key is derived. The zero
+ * value stands for the PBKDF2 derivation every account used before these
+ * parameters were stored.
+ */
+type KDFParams struct {
+    Algorithm  string `json:"alg"`
+    Iterations uint32 `json:"t"` // PBKDF2 iterations or Argon2 passes
+    MemoryKiB  uint32 `json:"m,omitempty"`
+    Threads    uint8  `json:"p,omitempty"`
+    KeyLength  uint32 `json:"len"`
+}
+
+const (
+    KDFPBKDF2SHA256 = "pbkdf2-sha256"
+    KDFArgon2id     = "argon2id"
+)
+
 /**
  * The version number is used for updating accounts.
  * Version 1 was the old encryption scheme, encrypting all pages with the MD5
@@ -43,6 +78,9 @@ type Repository interface {
     GetUserIDFromEmail(email string) (int, error) // returns userID
     GetUserIDFromUsername(username string) (int, error) // return userID
     CreateUser(u *User) (int, error) // returns userID
+    UpdateUserKeyPair(u *User) error
+    UpdateUserPassword(u *User, oldPasswordHash []byte) error
+    UpdateUserRecovery(u *User) error
     TrackUserActivity(userID int, url string) error
     CheckBetaTesterWhitelist(username string) (bool, error)
 }
@@ -55,11 +93,20 @@ type EncryptService interface {
     NewSymmetricKey() ([]byte, error)
     NewAssymetricKeyPair() ([]byte, []byte, error)
     NewSalt() ([]byte, error)
-    GenerateKeyFromPassword(password, salt []byte) ([]byte, error)
+    DeriveKey(password, salt []byte, params KDFParams) ([]byte, error)
+    CurrentKDFParams() KDFParams
+    ClientKDFParams() KDFParams
+    ClientEncryptionSupported() bool
     EncryptData(data, key []byte) ([]byte, error)
     DecryptData(data, key []byte) ([]byte, error)
     UserEncryptData(u *User, data []byte) ([]byte, error)
     UserDecryptData(u *User, data []byte) ([]byte, error)
+    NewUserEncryptedKeyPair(u *User) ([]byte, []byte, error)
+    RewrapUserKeys(u *User, oldPassword, newPassword, newSalt []byte,
+        newParams KDFParams) ([]byte, []byte, error)
+    SetRecoveryCode(u *User, password []byte) (string, error)
+    RecoverUserKeys(u *User, code string, newPassword, newSalt []byte,
+        newParams KDFParams) ([]byte, []byte, error)
 }
 
 /**
@@ -67,8 +114,19 @@ type EncryptService interface {
  */
 type AuthService interface {
     HashAndSalt(password []byte) ([]byte, error)
+    CheckPassHash(hash, password []byte) (bool, error)
+    CheckHashNeedsUpgrade(hash []byte) bool
+    EndAllUserSessions(userID int) error
 }
 
+var (
+    ErrWrongPassword      = errors.New("wrong password")
+    ErrUnsupportedVersion = errors.New("account version not supported")
+    ErrRecoveryFailed     = errors.New("wrong username or recovery code")
+    ErrClientEncryption   = errors.New(
+        "browser encryption is not supported by this server's cipher")
+)
+
 type Service struct {
     repo       Repository
     encryption EncryptService
@@ -133,6 +191,9 @@ func (s *Service) GetByEmail(email string) (*User, error) {
 /**
  * Creates a new user in storage
  *
+ * Returns the new user and their recovery code, which must be shown to the
+ * user exactly once
+ *
  * TODO: SECURITY-SENSITIVE -- adjust this so that unencrypted main-keys and
  * password-generated keys do not leave the encryption service
  *
@@ -141,13 +202,14 @@ func (s *Service) GetByEmail(email string) (*User, error) {
  * Also, check username, email, and password are all valid (actually, maybe this
  * should be done in the auth package with unexported functions)
  */
-func (s *Service) Create(username, email, passwordStr string) (*User, error) {
+func (s *Service) Create(username, email, passwordStr string) (*User, string,
+    error) {
     // hash password
     password := []byte(passwordStr)
     passwordHash, err := s.auth.HashAndSalt(password)
     if err != nil {
         log.Printf("failed to hash and salt password: %v", err)
-        return nil, err
+        return nil, "", err
     }
 
     // TODO: This needs to be changed such that the unencrypted main key is not
@@ -156,7 +218,7 @@ func (s *Service) Create(username, email, passwordStr string) (*User, error) {
     mainKey, err := s.encryption.NewSymmetricKey()
     if err != nil {
         log.Printf("failed to create symmetric key: %v", err)
-        return nil, err
+        return nil, "", err
     }
 
     // TODO: This needs to be changed such that the unencrypted key-pair is not
@@ -164,25 +226,25 @@ func (s *Service) Create(username, email, passwordStr string) (*User, error) {
     // create new assymetric key pair
     privateKey, publicKey, err := s.encryption.NewAssymetricKeyPair()
     if err != nil {
-        log.Printf("failed to create assymetric key pair :v", err)
-        return nil, err
+        log.Printf("failed to create assymetric key pair: %v", err)
+        return nil, "", err
     }
 
     //  create salt
     salt, err := s.encryption.NewSalt()
     if err != nil {
         log.Printf("failed to create salt: %v", err)
-        return nil, err
+        return nil, "", err
     }
 
     // TODO: THIS FUNCTIONALITY NEEDS TO BE MOVED INTO THE ENCRYPTION PACKAGE
     // FOR SECURITY PURPOSES
     // create password-generated key
-    passwordGeneratedKey, err := s.encryption.GenerateKeyFromPassword(password,
-        salt)
+    kdf := s.encryption.CurrentKDFParams()
+    passwordGeneratedKey, err := s.encryption.DeriveKey(password, salt, kdf)
     if err != nil {
         log.Printf("failed to generate key from password: %v", err)
-        return nil, err
+        return nil, "", err
     }
 
     // TODO: This will also be moved to the encryption package
@@ -191,7 +253,7 @@ func (s *Service) Create(username, email, passwordStr string) (*User, error) {
         passwordGeneratedKey)
     if err != nil {
         log.Printf("failed to encrypt main key: %v", err)
-        return nil, err
+        return nil, "", err
     }
 
     // TODO: This will also be moved to the encryption package
@@ -200,7 +262,7 @@ func (s *Service) Create(username, email, passwordStr string) (*User, error) {
         passwordGeneratedKey)
     if err != nil {
         log.Printf("failed to encrypt private key: %v", err)
-        return nil, err
+        return nil, "", err
     }
 
     u := &User{
@@ -212,10 +274,397 @@ func (s *Service) Create(username, email, passwordStr string) (*User, error) {
         PublicKey:           publicKey,
         Salt:                salt,
         Version:             CurrentVersion,
+        KDF:                 kdf,
     }
+
+    // create recovery code
+    recoveryCode, err := s.encryption.SetRecoveryCode(u, password)
+    if err != nil {
+        log.Printf("failed to create recovery code: %v", err)
+        return nil, "", err
+    }
+
     userID, err := s.repo.CreateUser(u) // returns -1 userID if err
     u.ID = userID
-    return u, err
+    return u, recoveryCode, err
+}
+
+/**
+ * Give a user a public key-pair if they do not have one yet
+ *
+ * Accounts created before public keys were implemented have empty key fields,
+ * and nobody can share a page with them until this has run. The private key is
+ * encrypted with the password-generated key, so this must be called after the
+ * user's session has been initialized.
+ */
+func (s *Service) EnsureKeyPair(u *User) error {
+    if len(u.PublicKey) > 0 {
+        return nil
+    }
+
+    log.Printf("creating key-pair for user-%v...", u.ID)
+    privateKeyEncrypted, publicKey, err :=
+        s.encryption.NewUserEncryptedKeyPair(u)
+    if err != nil {
+        log.Printf("failed to create key-pair for user-%v: %v", u.ID, err)
+        return err
+    }
+
+    u.PrivateKeyEncrypted = privateKeyEncrypted
+    u.PublicKey = publicKey
+    err = s.repo.UpdateUserKeyPair(u)
+    if err != nil {
+        log.Printf("failed to store key-pair for user-%v: %v", u.ID, err)
+        return err
+    }
+    log.Printf("successfully created key-pair for user-%v", u.ID)
+
+    return nil
+}
+
+/**
+ * Change a user's password --
+ * The old password is checked, the main-key and private key are re-wrapped
+ * under a key derived from the new password and a new salt, and the new
+ * password hash is stored along with them in a single update. Every session for
+ * the user is then ended, because the password-generated keys held by those
+ * sessions can no longer decrypt the main-key. The caller is expected to start a new session
+ * with the new password.
+ *
+ * The given user is updated in place
+ */
+func (s *Service) ChangePassword(u *User, oldPasswordStr,
+    newPasswordStr string) error {
+
+    if u.Version < CurrentVersion {
+        return ErrUnsupportedVersion
+    }
+
+    // check old password
+    oldPassword := []byte(oldPasswordStr)
+    newPassword := []byte(newPasswordStr)
+    ok, err := s.auth.CheckPassHash(u.PasswordHash, oldPassword)
+    if err != nil || !ok {
+        log.Printf("wrong password for user-%v password change", u.ID)
+        return ErrWrongPassword
+    }
+
+    // create new salt
+    salt, err := s.encryption.NewSalt()
+    if err != nil {
+        log.Printf("failed to create salt: %v", err)
+        return err
+    }
+
+    // re-wrap keys under new password
+    kdf := s.kdfParams(u)
+    mainKeyEncrypted, privateKeyEncrypted, err := s.encryption.RewrapUserKeys(
+        u, oldPassword, newPassword, salt, kdf)
+    if err != nil {
+        log.Printf("failed to re-wrap keys for user-%v: %v", u.ID, err)
+        return err
+    }
+
+    // hash new password
+    passwordHash, err := s.auth.HashAndSalt(newPassword)
+    if err != nil {
+        log.Printf("failed to hash and salt password: %v", err)
+        return err
+    }
+
+    // store everything at once
+    oldPasswordHash := u.PasswordHash
+    updated := *u
+    updated.PasswordHash = passwordHash
+    updated.MainKeyEncrypted = mainKeyEncrypted
+    updated.PrivateKeyEncrypted = privateKeyEncrypted
+    updated.Salt = salt
+    updated.KDF = kdf
+    err = s.repo.UpdateUserPassword(&updated, oldPasswordHash)
+    if err != nil {
+        log.Printf("failed to store new password for user-%v: %v", u.ID, err)
+        return err
+    }
+    *u = updated
+    log.Printf("successfully changed password for user-%v", u.ID)
+
+    // end every session, as the session keys are now stale
+    err = s.auth.EndAllUserSessions(u.ID)
+    if err != nil {
+        log.Printf("failed to end sessions for user-%v: %v", u.ID, err)
+        return err
+    }
+
+    return nil
+}
+
+/**
+ * Upgrade a user's password hash and key derivation after a successful sign-in
+ * --
+ * If the bcrypt cost or the KDF parameters are older than the current ones,
+ * the password is hashed again and/or the keys are re-wrapped under a key
+ * derived with the current parameters. Like ChangePassword(), but with the
+ * same password. Re-wrapping changes the password-generated key, so every other
+ * session is ended in that case, just as it is after a password change.
+ *
+ * This must be called before the session is initialized. The given user is
+ * updated in place.
+ */
+func (s *Service) UpgradeCredentials(u *User, passwordStr string) error {
+    if u.Version < CurrentVersion {
+        return nil
+    }
+    kdf := s.kdfParams(u)
+    rehash := s.auth.CheckHashNeedsUpgrade(u.PasswordHash)
+    rewrap := u.KDF != kdf
+    if !rehash && !rewrap {
+        return nil
+    }
+    log.Printf("upgrading credentials for user-%v...", u.ID)
+
+    password := []byte(passwordStr)
+    updated := *u
+
+    if rehash {
+        passwordHash, err := s.auth.HashAndSalt(password)
+        if err != nil {
+            log.Printf("failed to hash and salt password: %v", err)
+            return err
+        }
+        updated.PasswordHash = passwordHash
+    }
+
+    if rewrap {
+        salt, err := s.encryption.NewSalt()
+        if err != nil {
+            log.Printf("failed to create salt: %v", err)
+            return err
+        }
+        mainKeyEncrypted, privateKeyEncrypted, err :=
+            s.encryption.RewrapUserKeys(u, password, password, salt, kdf)
+        if err != nil {
+            log.Printf("failed to re-wrap keys for user-%v: %v", u.ID, err)
+            return err
+        }
+        updated.MainKeyEncrypted = mainKeyEncrypted
+        updated.PrivateKeyEncrypted = privateKeyEncrypted
+        updated.Salt = salt
+        updated.KDF = kdf
+    }
+
+    err := s.repo.UpdateUserPassword(&updated, u.PasswordHash)
+    if err != nil {
+        log.Printf("failed to store credentials for user-%v: %v", u.ID, err)
+        return err
+    }
+    *u = updated
+    log.Printf("successfully upgraded credentials for user-%v", u.ID)
+
+    // other sessions hold the old password-generated key
+    if rewrap {
+        err = s.auth.EndAllUserSessions(u.ID)
+        if err != nil {
+            log.Printf("failed to end sessions for user-%v: %v", u.ID, err)
+            return err
+        }
+    }
+
+    return nil
+}
+
+/**
+ * Recover an account with a recovery code --
+ * The recovery code unwraps the user's keys, which are wrapped again under the
+ * new password and a new salt. A new recovery code is issued at the same time,
+ * since the old one has now been typed into a browser, and every session for
+ * the user is ended.
+ *
+ * Returns the recovered user and their new recovery code
+ */
+func (s *Service) Recover(username, code,
+    newPasswordStr string) (*User, string, error) {
+
+    u, err := s.GetByUsername(username)
+    if err != nil {
+        log.Printf("failed to get user <%s> for recovery", username)
+        return nil, "", ErrRecoveryFailed
+    }
+    if u.Version < CurrentVersion {
+        return nil, "", ErrUnsupportedVersion
+    }
+
+    // create new salt
+    newPassword := []byte(newPasswordStr)
+    salt, err := s.encryption.NewSalt()
+    if err != nil {
+        log.Printf("failed to create salt: %v", err)
+        return nil, "", err
+    }
+
+    // re-wrap keys under new password
+    kdf := s.kdfParams(u)
+    mainKeyEncrypted, privateKeyEncrypted, err := s.encryption.RecoverUserKeys(
+        u, code, newPassword, salt, kdf)
+    if err != nil {
+        log.Printf("failed to recover keys for user-%v: %v", u.ID, err)
+        return nil, "", ErrRecoveryFailed
+    }
+
+    // hash new password
+    passwordHash, err := s.auth.HashAndSalt(newPassword)
+    if err != nil {
+        log.Printf("failed to hash and salt password: %v", err)
+        return nil, "", err
+    }
+
+    oldPasswordHash := u.PasswordHash
+    updated := *u
+    updated.PasswordHash = passwordHash
+    updated.MainKeyEncrypted = mainKeyEncrypted
+    updated.PrivateKeyEncrypted = privateKeyEncrypted
+    updated.Salt = salt
+    updated.KDF = kdf
+
+    // issue new recovery code
+    recoveryCode, err := s.encryption.SetRecoveryCode(&updated, newPassword)
+    if err != nil {
+        log.Printf("failed to create recovery code: %v", err)
+        return nil, "", err
+    }
+
+    // store everything at once
+    err = s.repo.UpdateUserPassword(&updated, oldPasswordHash)
+    if err != nil {
+        log.Printf("failed to store recovered user-%v: %v", u.ID, err)
+        return nil, "", err
+    }
+    log.Printf("successfully recovered user-%v", u.ID)
+
+    // end every session, as the session keys are now stale
+    err = s.auth.EndAllUserSessions(u.ID)
+    if err != nil {
+        log.Printf("failed to end sessions for user-%v: %v", u.ID, err)
+        return nil, "", err
+    }
+
+    return &updated, recoveryCode, nil
+}
+
+/**
+ * Get the KDF parameters a user's password-generated key should be derived
+ * with -- browser-encryption users need a derivation WebCrypto can repeat
+ */
+func (s *Service) kdfParams(u *User) KDFParams {
+    if u.ClientEncryption {
+        return s.encryption.ClientKDFParams()
+    }
+    return s.encryption.CurrentKDFParams()
+}
+
+/**
+ * Turn on browser encryption for a user --
+ * The user's keys are re-wrapped under a key derived with the browser KDF
+ * parameters, so the browser can derive it from the password and unwrap the
+ * main-key itself. From then on, new pages are encrypted in the browser and the
+ * server only ever stores their ciphertext. This cannot be turned off again, as
+ * those pages can only be read in the browser.
+ *
+ * Every session is ended, because the password-generated key changes. The
+ * given user is updated in place.
+ */
+func (s *Service) EnableClientEncryption(u *User, passwordStr string) error {
+    if u.Version < CurrentVersion {
+        return ErrUnsupportedVersion
+    }
+    if u.ClientEncryption {
+        return nil
+    }
+    if !s.encryption.ClientEncryptionSupported() {
+        return ErrClientEncryption
+    }
+
+    // check password
+    password := []byte(passwordStr)
+    ok, err := s.auth.CheckPassHash(u.PasswordHash, password)
+    if err != nil || !ok {
+        log.Printf("wrong password for user-%v browser encryption", u.ID)
+        return ErrWrongPassword
+    }
+
+    // create new salt
+    salt, err := s.encryption.NewSalt()
+    if err != nil {
+        log.Printf("failed to create salt: %v", err)
+        return err
+    }
+
+    // re-wrap keys under the browser derivation
+    log.Printf("enabling browser encryption for user-%v...", u.ID)
+    kdf := s.encryption.ClientKDFParams()
+    mainKeyEncrypted, privateKeyEncrypted, err := s.encryption.RewrapUserKeys(
+        u, password, password, salt, kdf)
+    if err != nil {
+        log.Printf("failed to re-wrap keys for user-%v: %v", u.ID, err)
+        return err
+    }
+
+    updated := *u
+    updated.MainKeyEncrypted = mainKeyEncrypted
+    updated.PrivateKeyEncrypted = privateKeyEncrypted
+    updated.Salt = salt
+    updated.KDF = kdf
+    updated.ClientEncryption = true
+    err = s.repo.UpdateUserPassword(&updated, u.PasswordHash)
+    if err != nil {
+        log.Printf("failed to store keys for user-%v: %v", u.ID, err)
+        return err
+    }
+    *u = updated
+    log.Printf("successfully enabled browser encryption for user-%v", u.ID)
+
+    // end every session, as the session keys are now stale
+    err = s.auth.EndAllUserSessions(u.ID)
+    if err != nil {
+        log.Printf("failed to end sessions for user-%v: %v", u.ID, err)
+        return err
+    }
+
+    return nil
+}
+
+/**
+ * Replace a user's recovery code after checking their password -- this is how
+ * accounts created before recovery codes existed get one, and how a user can
+ * invalidate a code they think has leaked
+ */
+func (s *Service) ResetRecoveryCode(u *User,
+    passwordStr string) (string, error) {
+
+    if u.Version < CurrentVersion {
+        return "", ErrUnsupportedVersion
+    }
+
+    // check password
+    password := []byte(passwordStr)
+    ok, err := s.auth.CheckPassHash(u.PasswordHash, password)
+    if err != nil || !ok {
+        log.Printf("wrong password for user-%v recovery code reset", u.ID)
+        return "", ErrWrongPassword
+    }
+
+    recoveryCode, err := s.encryption.SetRecoveryCode(u, password)
+    if err != nil {
+        log.Printf("failed to create recovery code: %v", err)
+        return "", err
+    }
+
+    err = s.repo.UpdateUserRecovery(u)
+    if err != nil {
+        log.Printf("failed to store recovery code for user-%v: %v", u.ID, err)
+        return "", err
+    }
+
+    return recoveryCode, nil
 }
 
 /**
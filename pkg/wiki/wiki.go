@@ -0,0 +1,155 @@
+package wiki
+
+/**
+ * This package handles wiki-style links between pages: `[[Page Title]]` in a
+ * page body links to the page with that title. Links are found and rewritten
+ * as Markdown before the body is rendered; links inside code are left alone.
+ */
+
+import (
+    "bytes"
+    "regexp"
+    "strconv"
+    "strings"
+    "net/url"
+)
+
+var linkPattern = regexp.MustCompile(`\[\[([^\[\]\n]+)\]\]`)
+
+// characters escaped in link text so that a title renders as it is typed
+var markdownEscaper = strings.NewReplacer(
+    `\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`,
+    `<`, `\<`, `>`, `\>`)
+
+/**
+ * Bring a title into the form links are matched in: lower case, with runs of
+ * spaces made single and trimmed, so that `[[Meeting  notes]]` links to a
+ * page titled "meeting notes"
+ */
+func Normalize(title string) string {
+    return strings.ToLower(strings.Join(strings.Fields(title), " "))
+}
+
+/**
+ * Call fn on each piece of a body that is not code -- fenced code blocks and
+ * inline code spans are passed over, and everything is kept in order in the
+ * returned body, with the pieces replaced by what fn returns
+ */
+func mapText(body []byte, fn func(text []byte) []byte) []byte {
+    var out bytes.Buffer
+    fenced := false
+    lines := bytes.SplitAfter(body, []byte("\n"))
+    for _, line := range lines {
+        trimmed := bytes.TrimSpace(line)
+        if bytes.HasPrefix(trimmed, []byte("```")) ||
+            bytes.HasPrefix(trimmed, []byte("~~~")) {
+            fenced = !fenced
+            out.Write(line)
+            continue
+        }
+        if fenced {
+            out.Write(line)
+            continue
+        }
+
+        // an inline code span runs from a run of backticks to the next run
+        // as long -- a run with none is only text
+        start := 0
+        for i := 0; i < len(line); {
+            if line[i] != '`' {
+                i++
+                continue
+            }
+            run := 1
+            for i+run < len(line) && line[i+run] == '`' {
+                run++
+            }
+            end := closingRun(line[i+run:], run)
+            if end < 0 {
+                i += run
+                continue
+            }
+            out.Write(fn(line[start:i]))
+            end += i + 2*run
+            out.Write(line[i:end])
+            i, start = end, end
+        }
+        out.Write(fn(line[start:]))
+    }
+    return out.Bytes()
+}
+
+/**
+ * The index of the first run of exactly n backticks in text, or -1 if there
+ * is none
+ */
+func closingRun(text []byte, n int) int {
+    for i := 0; i < len(text); {
+        if text[i] != '`' {
+            i++
+            continue
+        }
+        j := i
+        for j < len(text) && text[j] == '`' {
+            j++
+        }
+        if j-i == n {
+            return i
+        }
+        i = j
+    }
+    return -1
+}
+
+/**
+ * Get the (normalized) title of every page a body links to, once each
+ */
+func Links(body []byte) []string {
+    seen := map[string]bool{}
+    titles := []string{}
+    mapText(body, func(text []byte) []byte {
+        for _, m := range linkPattern.FindAllSubmatch(text, -1) {
+            title := Normalize(string(m[1]))
+            if title != "" && !seen[title] {
+                seen[title] = true
+                titles = append(titles, title)
+            }
+        }
+        return text
+    })
+    return titles
+}
+
+/**
+ * Rewrite every link in a body as a Markdown link -- resolve gives the ID of
+ * the page with a (normalized) title, or false if there is none, in which
+ * case the link is to create a page with that title instead
+ */
+func Rewrite(body []byte, resolve func(title string) (int, bool)) []byte {
+    return mapText(body, func(text []byte) []byte {
+        return linkPattern.ReplaceAllFunc(text, func(link []byte) []byte {
+            title := strings.TrimSpace(string(link[2 : len(link)-2]))
+            if title == "" {
+                return link
+            }
+
+            var target string
+            pageID, ok := resolve(Normalize(title))
+            if ok {
+                target = "/view/" + strconv.Itoa(pageID)
+            } else {
+                target = NewPagePath(title)
+            }
+            return []byte("[" + markdownEscaper.Replace(title) + "](" +
+                target + ")")
+        })
+    })
+}
+
+/**
+ * The path that creates a page with a given title -- links to pages that do
+ * not exist yet point here
+ */
+func NewPagePath(title string) string {
+    return "/edit/0?title=" + url.QueryEscape(title)
+}
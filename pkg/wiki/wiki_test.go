@@ -0,0 +1,83 @@
+package wiki
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestNormalize(t *testing.T) {
+    for _, c := range []struct {
+        title, want string
+    }{
+        {"Meeting notes", "meeting notes"},
+        {"  Meeting \t NOTES\n", "meeting notes"},
+        {"", ""},
+        {" \t ", ""},
+        {"Ünïcödé Straße", "ünïcödé straße"},
+    } {
+        if got := Normalize(c.title); got != c.want {
+            t.Errorf("%q gave %q, want %q", c.title, got, c.want)
+        }
+    }
+}
+
+func TestLinks(t *testing.T) {
+    for _, c := range []struct {
+        body string
+        want []string
+    }{
+        {"no links", nil},
+        {"see [[Plans]] and [[Meeting  Notes]]",
+            []string{"plans", "meeting notes"}},
+        {"[[Plans]] [[plans]] [[ PLANS ]]", []string{"plans"}},
+        {"[[]] [[ ]] [[a\nb]] [[a[b]] [Plans] [[Plans]", nil},
+        {"[[[Plans]]]", []string{"plans"}},
+        {"[[a]][[b]]", []string{"a", "b"}},
+
+        // links in code are left alone
+        {"`[[code]]` [[text]] ``[[more]]``", []string{"text"}},
+        {"``a ` [[code]]`` ```[[b]]`` [[text]]", []string{"b", "text"}},
+        {"unmatched ` [[text]]", []string{"text"}},
+        {"```\n[[fenced]]\n```\n[[after]]\n~~~\n[[tilde]]\n~~~",
+            []string{"after"}},
+        {"  ```go\n[[indented fence]]\n  ```\n", nil},
+        {"```\n[[never closed]]", nil},
+    } {
+        got := Links([]byte(c.body))
+        if strings.Join(got, "|") != strings.Join(c.want, "|") {
+            t.Errorf("%q gave %q, want %q", c.body, got, c.want)
+        }
+    }
+}
+
+func TestRewrite(t *testing.T) {
+    pages := map[string]int{"plans": 2, "meeting notes": 7}
+    resolve := func(title string) (int, bool) {
+        id, ok := pages[title]
+        return id, ok
+    }
+
+    for _, c := range []struct {
+        body, want string
+    }{
+        {"see [[Plans]].", "see [Plans](/view/2)."},
+        {"[[ meeting   NOTES ]]", "[meeting   NOTES](/view/7)"},
+        {"[[New page]]", "[New page](/edit/0?title=New+page)"},
+        {"[[a & b?]]", "[a & b?](/edit/0?title=a+%26+b%3F)"},
+        // a title renders as it is typed
+        {"[[*not* <b>bold</b> _x_ \\]]",
+            `[\*not\* \<b\>bold\</b\> \_x\_ \\](/edit/0?title=` +
+                "%2Anot%2A+%3Cb%3Ebold%3C%2Fb%3E+_x_+%5C)"},
+        {"[[a]b]]", "[[a]b]]"},
+        {"[[ ]]", "[[ ]]"},
+        {"`[[Plans]]` [[Plans]]", "`[[Plans]]` [Plans](/view/2)"},
+        {"``a ` [[Plans]]`` `[[Plans]]", "``a ` [[Plans]]`` `[Plans](/view/2)"},
+        {"```\n[[Plans]]\n```\n", "```\n[[Plans]]\n```\n"},
+        {"line one\n[[Plans]]\n", "line one\n[Plans](/view/2)\n"},
+    } {
+        got := string(Rewrite([]byte(c.body), resolve))
+        if got != c.want {
+            t.Errorf("%q gave %q, want %q", c.body, got, c.want)
+        }
+    }
+}